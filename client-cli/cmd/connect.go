@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/varun0310t/VPN/src/protocol"
 )
 
 var (
@@ -85,6 +86,10 @@ var connectCmd = &cobra.Command{
 		// Create a Channel to listen for the specific success signal
 		// We make it buffered (size 1) so the goroutine doesn't block if we exit early
 		successChan := make(chan bool, 1)
+		// exitChan receives the exit code if the client stops before connecting
+		exitChan := make(chan int, 1)
+		stdoutDone := make(chan struct{})
+		stderrDone := make(chan struct{})
 
 		// Scanner for STDOUT
 		go func() {
@@ -102,6 +107,16 @@ var connectCmd = &cobra.Command{
 					return
 				}
 			}
+			close(stdoutDone)
+		}()
+
+		// Stdout only closes early if the client exited, so collect its exit code.
+		// Wait closes the pipes, so stderr must be read to the end first.
+		go func() {
+			<-stdoutDone
+			<-stderrDone
+			proc.Wait()
+			exitChan <- proc.ProcessState.ExitCode()
 		}()
 
 		// Scanner for STDERR (Just for logging)
@@ -111,6 +126,7 @@ var connectCmd = &cobra.Command{
 				// logs in the file in the future
 				fmt.Printf("error: %s\n", scanner.Text())
 			}
+			close(stderrDone)
 		}()
 
 		// Wait for Success OR Timeout
@@ -120,6 +136,14 @@ var connectCmd = &cobra.Command{
 			// Success! We received the signal.
 			fmt.Println("VPN connection established successfully!")
 
+		case code := <-exitChan:
+			if reason, ok := protocol.ReasonFromExitCode(code); ok {
+				fmt.Printf("VPN client exited: %s\n", reason)
+			} else {
+				fmt.Printf("VPN client exited with code %d\n", code)
+			}
+			os.Exit(code)
+
 		case <-time.After(10 * time.Second):
 			// Timeout! It took too long.
 			// Note: The process might still be trying to connect, or it might have failed silently.
@@ -4,6 +4,10 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/varun0310t/VPN/src/server"
 )
 
@@ -12,6 +16,16 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+
+	// Tell connected clients the server is going away before exiting
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		server.StopServer()
+		os.Exit(0)
+	}()
+
 	err = server.Run()
 	if err != nil {
 		panic(err)
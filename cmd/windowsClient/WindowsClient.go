@@ -5,10 +5,12 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 
+	"github.com/varun0310t/VPN/src/protocol"
 	windowsclient "github.com/varun0310t/VPN/src/windows-client"
 )
 
@@ -34,9 +36,20 @@ func main() {
 	if err != nil {
 		fmt.Printf("Failed to connect: %v\n", err)
 		windowsclient.Disconnect()
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 
 	// Keep running
 	select {}
 }
+
+// exitCode reports server refusals with a per-reason exit code so the CLI can tell them apart
+func exitCode(err error) int {
+	var reasonErr *protocol.ReasonError
+	if errors.As(err, &reasonErr) {
+		if code, ok := reasonErr.Reason.ExitCode(); ok {
+			return code
+		}
+	}
+	return 1
+}
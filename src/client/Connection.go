@@ -8,81 +8,62 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync/atomic"
 	"time"
 
-	"github.com/pion/dtls/v2"
-)
-
-// PacketType identifies the type of VPN packet
-type PacketType byte
-
-const (
-	PacketTypeAuthReq      PacketType = 0x01 // Authentication request
-	PacketTypeAuthRespPass PacketType = 0x02 // Authentication response - success
-	PacketTypeData         PacketType = 0x03 // VPN data packet
-	PacketTypePing         PacketType = 0x04 // Keep-alive ping
-	PacketTypePong         PacketType = 0x05 // Keep-alive pong
-	PacketTypeDisc         PacketType = 0x06 // Disconnect
-	PacketTypeAuthRespFail PacketType = 0x07 // Authentication response - failure
-	PacketTypeAskForIP     PacketType = 0x08 // Request for IP address
-	PacketTypeIPRes        PacketType = 0x09 // IP address response
+	"github.com/varun0310t/VPN/src/offload"
+	"github.com/varun0310t/VPN/src/protocol"
 )
 
 type VPNClient struct {
-	serverAddr    *net.UDPAddr
-	conn          net.Conn
+	serverAddr    net.Addr // Peer of the tunnel connection (the proxy, if one is used), kept off the VPN routes
+	conn          *switchConn
 	tunManager    *TunManager
 	assignedIP    string
 	authenticated bool
 	netConfig     *NetworkConfig
 	running       bool
+	session       *protocol.SessionConfig // Session parameters pushed by the server
+	batch         []byte                  // Reused storage for outgoing batches
+	batchCount    int                     // Packets in batch not yet sent
+	scratch       []byte                  // Read buffer for packets added to a batch
+	compressor    protocol.Compressor     // Compresses packets sent to the server
+	decompressor  protocol.Decompressor   // Expands packets received from the server
+	compressed    []byte                  // Reused compressed record storage
+	rendezvous    string                  // Server's rendezvous port, for peer-to-peer links
+	peers         *peerManager            // Direct links to other clients, nil unless negotiated
+	token         []byte                  // Session token to resume with on another server
+	servers       []string                // Servers to resume on, "host:port", nil = no failover
+	serverIndex   int                     // Server in servers currently connected to
+	certPool      *x509.CertPool          // For connecting to other servers on failover
+	lastRecv      atomic.Int64            // Unix nanoseconds of the last message from the server
 }
 
-func NewVPNClient(serverIP string, serverPort int) (*VPNClient, error) {
-	// Resolve server address
-	serverAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", serverIP, serverPort))
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve server address: %w", err)
-	}
-
-	// Load server certificate for verification
+// loadServerCertPool loads the server certificate to verify against, or
+// returns nil to skip verification when it is missing
+func loadServerCertPool() *x509.CertPool {
 	certPool := x509.NewCertPool()
 	serverCert, err := os.ReadFile("/etc/vpn/server-cert.pem")
 	if err != nil {
 		fmt.Printf(" Warning: Could not load server cert, using insecure mode: %v\n", err)
-		certPool = nil
-	} else {
-		certPool.AppendCertsFromPEM(serverCert)
-	}
-
-	// Configure DTLS
-	config := &dtls.Config{
-		InsecureSkipVerify:   certPool == nil,
-		RootCAs:              certPool,
-		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
-	}
-
-	// Create UDP connection
-	udpConn, err := net.DialUDP("udp", nil, serverAddr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
+		return nil
 	}
+	certPool.AppendCertsFromPEM(serverCert)
+	return certPool
+}
 
-	udpConn.SetReadBuffer(4 * 1024 * 1024)
-	udpConn.SetWriteBuffer(4 * 1024 * 1024)
-	// Wrap with DTLS
-	fmt.Println(" Establishing encrypted DTLS connection...")
-	dtlsConn, err := dtls.Client(udpConn, config)
+// NewVPNClient connects to the server over transport
+func NewVPNClient(transport Transport) (*VPNClient, error) {
+	conn, err := transport.Dial()
 	if err != nil {
-		udpConn.Close()
-		return nil, fmt.Errorf("failed to establish DTLS connection: %w", err)
+		return nil, err
 	}
 
 	fmt.Println(" Encrypted connection established!")
 
 	return &VPNClient{
-		serverAddr: serverAddr,
-		conn:       dtlsConn,
+		serverAddr: conn.RemoteAddr(),
+		conn:       newSwitchConn(conn),
 		netConfig:  NewNetworkConfig(),
 	}, nil
 }
@@ -109,7 +90,12 @@ func (vc *VPNClient) Connect() error {
 	fmt.Printf(" Authenticated! Assigned IP: %s\n", vc.assignedIP)
 
 	// Create TUN interface
-	vc.tunManager, err = NewTunManager("tun1", vc.assignedIP)
+	dnsServers := make([]string, 0, len(vc.session.DNSServers))
+	for _, ip := range vc.session.DNSServers {
+		dnsServers = append(dnsServers, ip.String())
+	}
+	vc.tunManager, err = NewTunManager("tun1", vc.assignedIP, vc.session.PrefixLen, vc.session.MTU,
+		dnsServers, vc.session.SearchDomains, ClientCfg.TUNOFFLOAD)
 	if err != nil {
 		return fmt.Errorf("failed to create TUN interface: %w", err)
 	}
@@ -122,10 +108,22 @@ func (vc *VPNClient) Connect() error {
 		return fmt.Errorf("failed to setup routes: %w", err)
 	}
 
+	if vc.session.Capabilities&protocol.CapPeerToPeer != 0 {
+		vc.peers, err = newPeerManager(vc, vc.rendezvous)
+		if err != nil {
+			fmt.Printf(" Warning: peer-to-peer disabled, all traffic goes through the server: %v\n", err)
+		}
+	}
+
 	vc.running = true
+	vc.lastRecv.Store(time.Now().UnixNano())
 
 	// Start packet forwarding
-	go vc.forwardFromTUN()
+	if vc.tunManager.offload {
+		go vc.forwardFromOffloadTUN()
+	} else {
+		go vc.forwardFromTUN()
+	}
 	go vc.receiveFromServer()
 
 	// Start keep-alive
@@ -136,58 +134,76 @@ func (vc *VPNClient) Connect() error {
 }
 
 func (vc *VPNClient) sendAuthRequest() error {
-	payload := []byte(ClientCfg.PASSWORD)
+	password := ClientCfg.PASSWORD
 	if Password == "" {
 		fmt.Printf("no password provided for authentication using ClientCfg")
 	} else {
 		fmt.Println(" Using provided password for authentication")
-		payload = []byte(Password)
+		password = Password
 	}
-	packet := make([]byte, len(payload)+1)
-	packet[0] = byte(PacketTypeAuthReq)
-	copy(packet[1:], payload)
-	_, err := vc.conn.Write(packet)
+	_, err := vc.conn.Write(buildClientHello(password, nil))
 	return err
 }
 
 func (vc *VPNClient) waitForAuthResponse() error {
+	session, err := readServerConfig(vc.conn)
+	if err != nil {
+		return err
+	}
+	vc.session = session
+	vc.assignedIP = session.AssignedIP.String()
+	vc.token = session.SessionToken
+	vc.authenticated = true
+	fmt.Printf(" Negotiated protocol v%d (capabilities 0x%08x)\n", session.Version, session.Capabilities)
+	return nil
+}
+
+// readServerConfig waits for the server's answer to a hello on conn
+func readServerConfig(conn net.Conn) (*protocol.SessionConfig, error) {
 	buffer := make([]byte, 1024)
-	vc.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 
-	n, err := vc.conn.Read(buffer)
+	n, err := conn.Read(buffer)
 	if err != nil {
-		return fmt.Errorf("timeout waiting for auth response: %w", err)
+		return nil, fmt.Errorf("timeout waiting for auth response: %w", err)
 	}
 
-	vc.conn.SetReadDeadline(time.Time{}) // Clear deadline
+	conn.SetReadDeadline(time.Time{}) // Clear deadline
 
 	if n < 1 {
-		return fmt.Errorf("invalid auth response")
+		return nil, fmt.Errorf("invalid auth response")
 	}
 
-	packetType := PacketType(buffer[0])
-	if packetType == PacketTypeAuthRespPass {
-		// Extract assigned IP from response (last octet)
-		if n >= 5 {
-			lastOctet := int(buffer[4])
-			vc.assignedIP = fmt.Sprintf("10.8.0.%d", lastOctet)
-			vc.authenticated = true
-			return nil
+	packetType, payload, _ := protocol.Decode(buffer[:n])
+	switch packetType {
+	case protocol.PacketTypeServerConfig:
+		session, err := parseServerConfig(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server config: %w", err)
 		}
-		return fmt.Errorf("invalid auth response format")
-	} else if packetType == PacketTypeAuthRespFail {
-		return fmt.Errorf("authentication rejected by server")
+		return session, nil
+	case protocol.PacketTypeVersionReject:
+		minVersion, maxVersion, err := protocol.DecodeVersionReject(payload)
+		if err != nil {
+			return nil, fmt.Errorf("protocol version %d rejected by server", protocol.ProtocolVersion)
+		}
+		return nil, fmt.Errorf("server supports protocol versions %d-%d, client supports %d-%d",
+			minVersion, maxVersion, protocol.MinProtocolVersion, protocol.ProtocolVersion)
+	case protocol.PacketTypeAuthRespFail:
+		reason, message := protocol.DecodeAuthFail(payload)
+		return nil, &protocol.ReasonError{Reason: reason, Message: message}
 	}
 
-	return fmt.Errorf("unexpected response type: 0x%02x", packetType)
+	return nil, fmt.Errorf("unexpected response type: %s", packetType)
 }
 
 func (vc *VPNClient) forwardFromTUN() {
-	buffer := make([]byte, 65535)
+	// Packets are read after HeaderSize bytes of headroom and framed in place
+	buffer := make([]byte, protocol.HeaderSize+65535)
 	PacketSendCounter := 0
 	PrevTime := time.Now().UnixMilli()
 	for vc.running {
-		n, err := vc.tunManager.ReadPacket(buffer)
+		n, err := vc.tunManager.ReadPacket(buffer[protocol.HeaderSize:])
 		if err != nil {
 			if vc.running {
 				fmt.Printf(" Error reading from TUN: %v\n", err)
@@ -195,16 +211,21 @@ func (vc *VPNClient) forwardFromTUN() {
 			continue
 		}
 
-		packet := buffer[:n]
+		packet := buffer[protocol.HeaderSize : protocol.HeaderSize+n]
 
 		if len(packet) >= 20 {
 			//	destIP := net.IPv4(packet[16], packet[17], packet[18], packet[19])
 			//fmt.Printf("Sending to VPN: dest=%s (%d bytes)\n", destIP.String(), n)
 		}
 
-		// Wrap in VPN data packet and send to server
-		vc.sendDataPacket(packet)
-		PacketSendCounter++
+		// Wrap in VPN data packet and send to server, batching it with
+		// whatever the TUN already has ready when the server accepts batches
+		if vc.session.Capabilities&protocol.CapBatching != 0 && vc.tunManager.PacketReady() {
+			PacketSendCounter += vc.sendBatch(buffer, n)
+		} else {
+			vc.sendDataPacket(buffer, n)
+			PacketSendCounter++
+		}
 		CurrentTime := time.Now().UnixMilli()
 		if CurrentTime-PrevTime >= 1000 {
 			fmt.Printf(" Sent %d packets in the last second\n", PacketSendCounter)
@@ -215,6 +236,62 @@ func (vc *VPNClient) forwardFromTUN() {
 	}
 }
 
+// forwardFromOffloadTUN reads packets behind a virtio-net header, splits large
+// TCP packets into MTU-sized segments and sends them, batched when negotiated
+func (vc *VPNClient) forwardFromOffloadTUN() {
+	raw := make([]byte, offload.HdrLen+offload.MaxPacketSize)
+	frame := make([]byte, protocol.HeaderSize+offload.MaxPacketSize)
+	batching := vc.session.Capabilities&protocol.CapBatching != 0
+	PacketSendCounter := 0
+	PrevTime := time.Now().UnixMilli()
+
+	emit := func(packet []byte) {
+		if len(packet) < 20 {
+			return
+		}
+		// Segments are built after the headroom of frame; anything else is copied there
+		if &packet[0] != &frame[protocol.HeaderSize] {
+			copy(frame[protocol.HeaderSize:], packet)
+		}
+		if batching {
+			PacketSendCounter += vc.batchAdd(frame, len(packet))
+		} else {
+			vc.sendDataPacket(frame, len(packet))
+			PacketSendCounter++
+		}
+	}
+
+	for vc.running {
+		n, err := vc.tunManager.ReadPacket(raw)
+		if err != nil {
+			if vc.running {
+				fmt.Printf(" Error reading from TUN: %v\n", err)
+			}
+			continue
+		}
+
+		hdr, err := offload.DecodeHdr(raw[:n])
+		if err != nil {
+			continue
+		}
+		if err := offload.Segment(raw[offload.HdrLen:n], hdr, frame[protocol.HeaderSize:], emit); err != nil {
+			fmt.Printf(" Dropped offloaded TUN packet: %v\n", err)
+		}
+
+		// Keep batching while the TUN has more; send what we have once it runs dry
+		if batching && !vc.tunManager.PacketReady() {
+			PacketSendCounter += vc.batchFlush()
+		}
+
+		CurrentTime := time.Now().UnixMilli()
+		if CurrentTime-PrevTime >= 1000 {
+			fmt.Printf(" Sent %d packets in the last second\n", PacketSendCounter)
+			PacketSendCounter = 0
+			PrevTime = CurrentTime
+		}
+	}
+}
+
 func (vc *VPNClient) receiveFromServer() {
 	buffer := make([]byte, 65535)
 	PacketRecvCounter := 0
@@ -224,24 +301,59 @@ func (vc *VPNClient) receiveFromServer() {
 		if err != nil {
 			if vc.running {
 				fmt.Printf(" Error receiving from server: %v\n", err)
+				if vc.canResume() {
+					if !vc.resume() {
+						serverDisconnected(&protocol.ReasonError{Reason: protocol.ReasonUnspecified, Message: "no server resumed the session"})
+						return
+					}
+				}
 			}
 			continue
 		}
 
-		if n < 1 {
+		packetType, payload, err := protocol.Decode(buffer[:n])
+		if err != nil {
 			continue
 		}
-
-		packetType := PacketType(buffer[0])
-		payload := buffer[1:n]
+		vc.lastRecv.Store(time.Now().UnixNano())
 
 		switch packetType {
-		case PacketTypeData:
+		case protocol.PacketTypeData:
 			vc.handleDataPacket(payload)
-		case PacketTypePong:
+		case protocol.PacketTypeDataCompressed:
+			if !vc.compressing() {
+				continue
+			}
+			packet, err := vc.decompressor.Decompress(payload)
+			if err != nil {
+				fmt.Printf(" Bad compressed packet from server: %v\n", err)
+				continue
+			}
+			vc.handleDataPacket(packet)
+		case protocol.PacketTypeDataBatch:
+			var d *protocol.Decompressor
+			if vc.compressing() {
+				d = &vc.decompressor
+			}
+			if err := vc.tunManager.WriteBatch(payload, d); err != nil {
+				fmt.Printf(" Malformed data batch from server: %v\n", err)
+			}
+		case protocol.PacketTypePong:
 			// Keep-alive response received
+		case protocol.PacketTypePeerInvite:
+			vc.peers.handleInvite(payload)
+		case protocol.PacketTypePeerInfo:
+			vc.peers.handlePeerInfo(payload)
+		case protocol.PacketTypeDisc:
+			reason, message := protocol.DecodeDisconnect(payload)
+			fmt.Printf(" Server closed the session: %s\n", reason)
+			if reason == protocol.ReasonServerShutdown && vc.canResume() && vc.resume() {
+				continue
+			}
+			serverDisconnected(&protocol.ReasonError{Reason: reason, Message: message})
+			return
 		default:
-			fmt.Printf("Unknown packet type: 0x%02x\n", packetType)
+			fmt.Printf("Unknown packet type: %s\n", packetType)
 		}
 
 		PacketRecvCounter++
@@ -268,24 +380,122 @@ func (vc *VPNClient) handleDataPacket(payload []byte) {
 	}
 }
 
-func (vc *VPNClient) sendDataPacket(data []byte) error {
-	// Prepend packet type
-	packet := make([]byte, len(data)+1)
-	packet[0] = byte(PacketTypeData)
-	copy(packet[1:], data)
+// sendBatch packs the n byte packet in buffer and every packet the TUN has
+// ready into batch records no larger than a single full-size data record.
+// It returns the number of packets sent.
+func (vc *VPNClient) sendBatch(buffer []byte, n int) int {
+	if vc.scratch == nil {
+		vc.scratch = make([]byte, protocol.HeaderSize+65535)
+	}
+
+	sent := vc.batchAdd(buffer, n)
+	for vc.tunManager.PacketReady() {
+		m, err := vc.tunManager.ReadPacket(vc.scratch[protocol.HeaderSize:])
+		if err != nil {
+			break
+		}
+		sent += vc.batchAdd(vc.scratch, m)
+	}
+	return sent + vc.batchFlush()
+}
+
+// batchAdd appends the n byte packet stored after the headroom of buf to the
+// pending batch, sending the batch first if the packet would not fit, unless
+// it goes over a direct peer link. It returns the number of packets sent.
+func (vc *VPNClient) batchAdd(buf []byte, n int) int {
+	if vc.peers.send(buf, n) {
+		return 1
+	}
+	limit := vc.session.MTU + protocol.HeaderSize
+	if vc.compressing() {
+		limit = min(limit, protocol.CompressedBatchLimit)
+	}
+	if vc.batchCount == 0 {
+		vc.batch = protocol.StartBatch(vc.batch)
+	}
+
+	record, compressed := vc.compress(buf[protocol.HeaderSize : protocol.HeaderSize+n])
+	if !compressed {
+		record = protocol.FrameData(buf, n)
+	}
+	entry := record[protocol.HeaderSize:]
+
+	sent := 0
+	if !protocol.BatchFits(vc.batch, len(entry), limit) {
+		sent = vc.batchFlush()
+		vc.batch = protocol.StartBatch(vc.batch)
+		if !protocol.BatchFits(vc.batch, len(entry), limit) {
+			// Too big to batch at all
+			vc.conn.Write(record)
+			return sent + 1
+		}
+	}
+	if compressed {
+		vc.batch = protocol.AppendBatchCompressed(vc.batch, entry)
+	} else {
+		vc.batch = protocol.AppendBatchPacket(vc.batch, entry)
+	}
+	vc.batchCount++
+	return sent
+}
+
+// batchFlush sends the pending batch, if any, and returns the number of packets in it
+func (vc *VPNClient) batchFlush() int {
+	if vc.batchCount == 0 {
+		return 0
+	}
+	vc.conn.Write(vc.batch)
+	sent := vc.batchCount
+	vc.batchCount = 0
+	return sent
+}
 
-	_, err := vc.conn.Write(packet)
+// sendDataPacket frames the n byte packet stored after the headroom of buffer
+// and sends it over a direct peer link, or to the server compressed when
+// negotiated and worthwhile
+func (vc *VPNClient) sendDataPacket(buffer []byte, n int) error {
+	if vc.peers.send(buffer, n) {
+		return nil
+	}
+	if record, ok := vc.compress(buffer[protocol.HeaderSize : protocol.HeaderSize+n]); ok {
+		_, err := vc.conn.Write(record)
+		return err
+	}
+	_, err := vc.conn.Write(protocol.FrameData(buffer, n))
 	return err
 }
 
+// compressing reports whether the session negotiated compression
+func (vc *VPNClient) compressing() bool {
+	return vc.session.Capabilities&protocol.CapCompressZstd != 0
+}
+
+// compress returns packet as a compressed data record, or ok=false if it
+// should be sent as is
+func (vc *VPNClient) compress(packet []byte) ([]byte, bool) {
+	if !vc.compressing() {
+		return nil, false
+	}
+	record, ok := vc.compressor.Compress(protocol.StartCompressedData(vc.compressed), packet)
+	if ok {
+		vc.compressed = record
+	}
+	return record, ok
+}
+
 func (vc *VPNClient) keepAlive() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(vc.session.Keepalive)
 	defer ticker.Stop()
 
 	for vc.running {
 		<-ticker.C
-		packet := []byte{byte(PacketTypePing)}
-		_, err := vc.conn.Write(packet)
+		// A dead server's connection often just goes quiet; closing it starts failover
+		if silent := time.Since(time.Unix(0, vc.lastRecv.Load())); vc.canResume() && silent > 3*vc.session.Keepalive {
+			fmt.Printf(" No answer from server for %s\n", silent.Round(time.Second))
+			vc.conn.get().Close()
+			continue
+		}
+		_, err := vc.conn.Write(protocol.EncodePing())
 		if err != nil {
 			fmt.Printf(" Warning: Keep-alive failed: %v\n", err)
 		}
@@ -301,8 +511,33 @@ func (vc *VPNClient) setupRoutes() error {
 		return fmt.Errorf("failed to save default gateway: %w", err)
 	}
 
+	if subnets := ClientCfg.subnets(); len(subnets) > 0 {
+		cidrs := make([]string, 0, len(subnets))
+		for _, subnet := range subnets {
+			cidrs = append(cidrs, subnet.String())
+		}
+		err = vc.netConfig.EnableForwarding("tun1", cidrs)
+		if err != nil {
+			return fmt.Errorf("failed to enable site-to-site forwarding: %w", err)
+		}
+	}
+
+	if vc.session.SplitTunnel {
+		// Only the pushed networks go through the VPN, default route stays untouched
+		routes := make([]string, 0, len(vc.session.Routes))
+		for _, route := range vc.session.Routes {
+			routes = append(routes, route.String())
+		}
+		err = vc.netConfig.AddSplitRoutes(hostOf(vc.serverAddr), "tun1", routes)
+		if err != nil {
+			return fmt.Errorf("failed to add split tunnel routes: %w", err)
+		}
+		fmt.Println(" Routes configured")
+		return nil
+	}
+
 	// Route all traffic through VPN (except server connection)
-	err = vc.netConfig.AddVPNRoutes(vc.serverAddr.IP.String(), "tun1")
+	err = vc.netConfig.AddVPNRoutes(hostOf(vc.serverAddr), "tun1")
 	if err != nil {
 		return fmt.Errorf("failed to add VPN routes: %w", err)
 	}
@@ -314,6 +549,8 @@ func (vc *VPNClient) setupRoutes() error {
 func (vc *VPNClient) Disconnect() error {
 	vc.running = false
 
+	vc.peers.Close()
+
 	fmt.Println(" Restoring original network configuration...")
 
 	// Restore original network config
@@ -326,10 +563,13 @@ func (vc *VPNClient) Disconnect() error {
 		}
 	}
 
+	if vc.session != nil && vc.compressing() {
+		fmt.Printf(" Compression ratio: %.2f sent, %.2f received\n", vc.compressor.Ratio(), vc.decompressor.Ratio())
+	}
+
 	// Send disconnect packet
 	if vc.conn != nil {
-		packet := []byte{byte(PacketTypeDisc)}
-		vc.conn.Write(packet)
+		vc.conn.Write(protocol.EncodeDisconnect(protocol.ReasonClientShutdown, ""))
 	}
 	// Restore DNS settings
 	vc.tunManager.RestoreDNS()
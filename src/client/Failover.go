@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+const (
+	resumeRounds  = 3               // Times every server is tried before giving up
+	resumeBackoff = 2 * time.Second // After a server that could not be reached
+)
+
+// switchConn is the connection to the server. Failover swaps in a connection
+// to another cluster node while the goroutines using it carry on; a Read or
+// Write on the old one just fails.
+type switchConn struct {
+	current atomic.Pointer[connRef]
+}
+
+type connRef struct {
+	net.Conn
+}
+
+func newSwitchConn(conn net.Conn) *switchConn {
+	c := &switchConn{}
+	c.current.Store(&connRef{conn})
+	return c
+}
+
+// get returns the current connection
+func (c *switchConn) get() net.Conn {
+	return c.current.Load().Conn
+}
+
+// swap makes conn the current connection and closes the old one
+func (c *switchConn) swap(conn net.Conn) {
+	c.current.Swap(&connRef{conn}).Close()
+}
+
+func (c *switchConn) Read(b []byte) (int, error)         { return c.get().Read(b) }
+func (c *switchConn) Write(b []byte) (int, error)        { return c.get().Write(b) }
+func (c *switchConn) Close() error                       { return c.get().Close() }
+func (c *switchConn) LocalAddr() net.Addr                { return c.get().LocalAddr() }
+func (c *switchConn) RemoteAddr() net.Addr               { return c.get().RemoteAddr() }
+func (c *switchConn) SetDeadline(t time.Time) error      { return c.get().SetDeadline(t) }
+func (c *switchConn) SetReadDeadline(t time.Time) error  { return c.get().SetReadDeadline(t) }
+func (c *switchConn) SetWriteDeadline(t time.Time) error { return c.get().SetWriteDeadline(t) }
+
+// failoverServers returns the servers to resume on, the one connected to
+// first, or nil when SERVERS is not set
+func failoverServers(serverAddr string, serverPort int) ([]string, error) {
+	if len(ClientCfg.SERVERS) == 0 {
+		return nil, nil
+	}
+	if ClientCfg.TRANSPORT == TransportWebSocket && ClientCfg.WEBSOCKETURL != "" {
+		// every node would be dialled at the one URL, i.e. the dead node again
+		return nil, fmt.Errorf("WEBSOCKETURL names a single server, so it cannot be used with SERVERS; leave it unset to dial wss://<server>/vpn on each")
+	}
+	servers := []string{net.JoinHostPort(serverAddr, strconv.Itoa(serverPort))}
+	for _, server := range ClientCfg.SERVERS {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, strconv.Itoa(serverPort))
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// canResume reports whether the client fails over instead of giving up
+func (vc *VPNClient) canResume() bool {
+	return len(vc.servers) > 0
+}
+
+// resume resumes the session on the next server that takes it, trying each
+// a few times, and reports whether one did. The address, TUN and negotiated
+// parameters stay as they are; only the connection and token change.
+func (vc *VPNClient) resume() bool {
+	if len(vc.token) == 0 {
+		return false
+	}
+	for attempt := 0; attempt < resumeRounds*len(vc.servers) && vc.running; attempt++ {
+		vc.serverIndex = (vc.serverIndex + 1) % len(vc.servers)
+		server := vc.servers[vc.serverIndex]
+		fmt.Printf(" Resuming session on %s...\n", server)
+
+		conn, err := vc.dialServer(server)
+		if err != nil {
+			fmt.Printf(" Could not reach %s: %v\n", server, err)
+			time.Sleep(resumeBackoff)
+			continue
+		}
+		session, err := vc.resumeOn(conn)
+		if err != nil {
+			fmt.Printf(" %s did not resume the session: %v\n", server, err)
+			conn.Write(protocol.EncodeDisconnect(protocol.ReasonClientShutdown, ""))
+			conn.Close()
+			continue
+		}
+
+		vc.conn.swap(conn)
+		vc.token = session.SessionToken
+		vc.lastRecv.Store(time.Now().UnixNano())
+		fmt.Printf(" Session resumed on %s at %s\n", server, vc.assignedIP)
+		return true
+	}
+	return false
+}
+
+// dialServer connects to server ("host:port") with the configured transport,
+// keeping it off the VPN routes first
+func (vc *VPNClient) dialServer(server string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q", server)
+	}
+	ip, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	if err := vc.netConfig.addServerRoute(ip.String()); err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(host, port, vc.certPool)
+	if err != nil {
+		return nil, err
+	}
+	return transport.Dial()
+}
+
+// resumeOn sends the hello with the session token over conn and checks that
+// the server gave the session its address back
+func (vc *VPNClient) resumeOn(conn net.Conn) (*protocol.SessionConfig, error) {
+	if _, err := conn.Write(buildClientHello(Password, vc.token)); err != nil {
+		return nil, err
+	}
+	session, err := readServerConfig(conn)
+	if err != nil {
+		return nil, err
+	}
+	if session.AssignedIP.String() != vc.assignedIP {
+		return nil, fmt.Errorf("assigned %s instead of %s", session.AssignedIP, vc.assignedIP)
+	}
+	if err := sameSession(vc.session, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// sameSession reports how a resumed session differs from the one the tunnel
+// was set up for. The TUN, routes, batching and compression stay as they
+// are, so a node that negotiates other ones cannot take the session over.
+func sameSession(old, resumed *protocol.SessionConfig) error {
+	sameNet := func(a, b net.IPNet) bool { return a.String() == b.String() }
+	switch {
+	case resumed.Version != old.Version || resumed.Capabilities != old.Capabilities:
+		return fmt.Errorf("negotiated v%d with capabilities 0x%08x instead of v%d with 0x%08x",
+			resumed.Version, resumed.Capabilities, old.Version, old.Capabilities)
+	case resumed.MTU != old.MTU || resumed.PrefixLen != old.PrefixLen:
+		return fmt.Errorf("MTU %d and prefix /%d instead of %d and /%d", resumed.MTU, resumed.PrefixLen, old.MTU, old.PrefixLen)
+	case resumed.SplitTunnel != old.SplitTunnel || !slices.EqualFunc(resumed.Routes, old.Routes, sameNet):
+		return fmt.Errorf("pushed other routes")
+	case resumed.Keepalive != old.Keepalive:
+		return fmt.Errorf("keepalive %v instead of %v", resumed.Keepalive, old.Keepalive)
+	}
+	return nil
+}
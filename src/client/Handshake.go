@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// supportedCapabilities lists the capability bits this client implements
+// with the current config
+func supportedCapabilities() uint32 {
+	capabilities := protocol.CapBatching
+	if ClientCfg != nil && ClientCfg.COMPRESSION == "zstd" {
+		capabilities |= protocol.CapCompressZstd
+	}
+	if ClientCfg != nil && ClientCfg.PEERTOPEER {
+		capabilities |= protocol.CapPeerToPeer
+	}
+	return capabilities
+}
+
+// buildClientHello encodes the versioned auth request, resuming the session
+// resumeToken was issued for when it is set
+func buildClientHello(password string, resumeToken []byte) []byte {
+	var username string
+	var subnets []net.IPNet
+	if ClientCfg != nil {
+		username = ClientCfg.USERNAME
+		subnets = ClientCfg.subnets()
+	}
+	return protocol.EncodeClientHello(&protocol.ClientHello{
+		Version:      protocol.ProtocolVersion,
+		Capabilities: supportedCapabilities(),
+		Username:     username,
+		Password:     password,
+		Subnets:      subnets,
+		ResumeToken:  resumeToken,
+	})
+}
+
+// parseServerConfig decodes the server config and checks it against what this client supports
+func parseServerConfig(payload []byte) (*protocol.SessionConfig, error) {
+	cfg, err := protocol.DecodeServerConfig(payload)
+	if err != nil {
+		return nil, err
+	}
+	if !protocol.SupportsVersion(cfg.Version) {
+		return nil, fmt.Errorf("server selected unsupported protocol version %d", cfg.Version)
+	}
+
+	// Never act on capabilities we did not offer
+	cfg.Capabilities &= supportedCapabilities()
+	return cfg, nil
+}
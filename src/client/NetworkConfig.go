@@ -12,10 +12,13 @@ import (
 
 // NetworkConfig stores original network configuration to restore on disconnect
 type NetworkConfig struct {
-	DefaultGateway string
-	DefaultIface   string
-	OriginalRoutes []string
-	VPNRoutes      []string
+	DefaultGateway  string
+	DefaultIface    string
+	OriginalRoutes  []string
+	VPNRoutes       []string
+	ReplacedDefault bool       // Whether the default route was moved to the TUN
+	ForwardRules    [][]string // iptables FORWARD rules added for site-to-site subnets
+	IPForward       string     // net.ipv4.ip_forward before it was enabled, "" if unchanged
 }
 
 func NewNetworkConfig() *NetworkConfig {
@@ -77,10 +80,9 @@ func (nc *NetworkConfig) SaveDefaultGateway() error {
 	return nil
 }
 
-// AddVPNRoutes sets up routing to send traffic through VPN
-func (nc *NetworkConfig) AddVPNRoutes(serverIP string, tunIface string) error {
-	//  specific route for VPN server through original gateway
-	//    (so VPN traffic itself doesn't go through VPN)
+// addServerRoute pins the VPN server to the original gateway
+// (so VPN traffic itself doesn't go through VPN)
+func (nc *NetworkConfig) addServerRoute(serverIP string) error {
 	if nc.DefaultGateway != "" && nc.DefaultIface != "" {
 		cmd := exec.Command("ip", "route", "add", serverIP, "via", nc.DefaultGateway, "dev", nc.DefaultIface)
 		output, err := cmd.CombinedOutput()
@@ -90,6 +92,41 @@ func (nc *NetworkConfig) AddVPNRoutes(serverIP string, tunIface string) error {
 		nc.VPNRoutes = append(nc.VPNRoutes, fmt.Sprintf("%s via %s dev %s", serverIP, nc.DefaultGateway, nc.DefaultIface))
 		fmt.Printf(" Route to VPN server via original gateway\n")
 	}
+	return nil
+}
+
+// AddSplitRoutes routes only the given CIDRs through the VPN and leaves the default route alone
+func (nc *NetworkConfig) AddSplitRoutes(serverIP string, tunIface string, routes []string) error {
+	// A pushed route may cover the server itself
+	if err := nc.addServerRoute(serverIP); err != nil {
+		return err
+	}
+
+	added := 0
+	for _, route := range routes {
+		cmd := exec.Command("ip", "route", "add", route, "dev", tunIface)
+		output, err := cmd.CombinedOutput()
+		if err != nil && strings.Contains(string(output), "File exists") {
+			// Not ours to remove on disconnect, and its traffic keeps bypassing the VPN
+			fmt.Printf("Warning: a route for %s already exists; its traffic does not go through %s\n", route, tunIface)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add route %s: %w (output: %s)", route, err, string(output))
+		}
+		nc.VPNRoutes = append(nc.VPNRoutes, fmt.Sprintf("%s dev %s", route, tunIface))
+		added++
+	}
+
+	fmt.Printf("Split tunnel: %d of %d routes go through %s\n", added, len(routes), tunIface)
+	return nil
+}
+
+// AddVPNRoutes sets up routing to send traffic through VPN
+func (nc *NetworkConfig) AddVPNRoutes(serverIP string, tunIface string) error {
+	if err := nc.addServerRoute(serverIP); err != nil {
+		return err
+	}
 
 	// Change default route to go through VPN
 	// First, delete old default route
@@ -103,15 +140,76 @@ func (nc *NetworkConfig) AddVPNRoutes(serverIP string, tunIface string) error {
 		return fmt.Errorf("failed to add default VPN route: %w (output: %s)", err, string(output))
 	}
 	nc.VPNRoutes = append(nc.VPNRoutes, fmt.Sprintf("default dev %s", tunIface))
+	nc.ReplacedDefault = true
 	fmt.Printf("Default route now goes through %s\n", tunIface)
 
 	return nil
 }
 
+// AddPeerRoute pins a peer's public address to the original gateway when it
+// would otherwise be routed through the tunnel, so the direct link is direct
+func (nc *NetworkConfig) AddPeerRoute(peerIP string, tunIface string) error {
+	output, err := exec.Command("ip", "route", "get", peerIP).Output()
+	if err != nil || !strings.Contains(string(output), "dev "+tunIface) {
+		return nil
+	}
+	if nc.DefaultGateway == "" || nc.DefaultIface == "" {
+		return fmt.Errorf("no original gateway to route peer %s through", peerIP)
+	}
+
+	cmd := exec.Command("ip", "route", "replace", peerIP, "via", nc.DefaultGateway, "dev", nc.DefaultIface)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add peer route: %w (output: %s)", err, string(output))
+	}
+	nc.VPNRoutes = append(nc.VPNRoutes, fmt.Sprintf("%s via %s dev %s", peerIP, nc.DefaultGateway, nc.DefaultIface))
+	return nil
+}
+
+// EnableForwarding lets traffic between the TUN and the LAN subnets behind
+// this client through, so it can act as a site-to-site gateway
+func (nc *NetworkConfig) EnableForwarding(tunIface string, subnets []string) error {
+	output, err := exec.Command("sysctl", "-n", "net.ipv4.ip_forward").Output()
+	if err != nil {
+		return fmt.Errorf("failed to read IP forwarding setting: %w", err)
+	}
+	if previous := strings.TrimSpace(string(output)); previous != "1" {
+		if err := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1").Run(); err != nil {
+			return fmt.Errorf("failed to enable IP forwarding: %w", err)
+		}
+		nc.IPForward = previous
+	}
+
+	for _, subnet := range subnets {
+		for _, rule := range [][]string{
+			{"FORWARD", "-i", tunIface, "-d", subnet, "-j", "ACCEPT"},
+			{"FORWARD", "-o", tunIface, "-s", subnet, "-j", "ACCEPT"},
+		} {
+			args := append([]string{"-I"}, rule...)
+			if output, err := exec.Command("iptables", args...).CombinedOutput(); err != nil {
+				return fmt.Errorf("failed to allow forwarding for %s: %w (output: %s)", subnet, err, string(output))
+			}
+			nc.ForwardRules = append(nc.ForwardRules, rule)
+		}
+	}
+
+	fmt.Printf("Forwarding between %s and %d subnets\n", tunIface, len(subnets))
+	return nil
+}
+
 // Restore returns network configuration to original state
 func (nc *NetworkConfig) Restore() error {
 	fmt.Println("🔄 Restoring original network configuration...")
 
+	for _, rule := range nc.ForwardRules {
+		args := append([]string{"-D"}, rule...)
+		_ = exec.Command("iptables", args...).Run()
+	}
+	nc.ForwardRules = nil
+	if nc.IPForward != "" {
+		_ = exec.Command("sysctl", "-w", "net.ipv4.ip_forward="+nc.IPForward).Run()
+		nc.IPForward = ""
+	}
+
 	// Delete VPN routes
 	for _, route := range nc.VPNRoutes {
 		parts := strings.Fields(route)
@@ -121,8 +219,8 @@ func (nc *NetworkConfig) Restore() error {
 		}
 	}
 
-	// Restore default gateway if we have it
-	if nc.DefaultGateway != "" && nc.DefaultIface != "" {
+	// Restore default gateway if we replaced it
+	if nc.ReplacedDefault && nc.DefaultGateway != "" && nc.DefaultIface != "" {
 		// Delete any existing default route
 		cmd := exec.Command("ip", "route", "del", "default")
 		_ = cmd.Run()
@@ -0,0 +1,324 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+	"github.com/varun0310t/VPN/src/transport"
+)
+
+const (
+	peerRetryInterval  = 30 * time.Second // Between requests for the same peer
+	peerConnectTimeout = 10 * time.Second // For hole punching and the DTLS handshake
+	peerPingInterval   = 5 * time.Second
+	peerLinkTimeout    = 15 * time.Second // Without anything from the peer before the link is closed
+	peerProbeCount     = 5
+	peerProbeInterval  = 200 * time.Millisecond
+)
+
+// peerManager keeps direct links to other clients. Packets to a linked peer
+// go over its link while it is healthy; everything else, and traffic to
+// peers without a link, goes through the server as before.
+type peerManager struct {
+	vc         *VPNClient
+	socket     *transport.PeerSocket
+	rendezvous netip.AddrPort
+	self       [4]byte
+	tunnel     netip.Prefix
+
+	mu         sync.Mutex
+	links      map[[4]byte]*peerLink
+	connecting map[[4]byte]bool
+	attempts   map[[4]byte]time.Time // Last request per peer
+}
+
+type peerLink struct {
+	ip       [4]byte
+	conn     net.Conn
+	lastRecv atomic.Int64 // Unix nanoseconds
+	done     chan struct{}
+	once     sync.Once
+}
+
+// healthy reports whether the peer was heard from recently enough to send to it
+func (l *peerLink) healthy() bool {
+	return time.Since(time.Unix(0, l.lastRecv.Load())) < peerLinkTimeout
+}
+
+// newPeerManager opens the peer socket; rendezvous is the server's rendezvous port
+func newPeerManager(vc *VPNClient, rendezvous string) (*peerManager, error) {
+	rendezvousAddr, err := net.ResolveUDPAddr("udp4", rendezvous)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve rendezvous address: %w", err)
+	}
+	self, err := netip.ParseAddr(vc.assignedIP)
+	if err != nil || !self.Is4() {
+		return nil, fmt.Errorf("invalid assigned IP %q", vc.assignedIP)
+	}
+	socket, err := transport.ListenPeer("0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+
+	return &peerManager{
+		vc:         vc,
+		socket:     socket,
+		rendezvous: rendezvousAddr.AddrPort(),
+		self:       self.As4(),
+		tunnel:     netip.PrefixFrom(self, vc.session.PrefixLen).Masked(),
+		links:      make(map[[4]byte]*peerLink),
+		connecting: make(map[[4]byte]bool),
+		attempts:   make(map[[4]byte]time.Time),
+	}, nil
+}
+
+// send writes the n byte packet stored after the headroom of buffer over a
+// direct link and reports whether it did. Without a link to the destination
+// it asks the server for one, and the packet goes through the relay.
+func (pm *peerManager) send(buffer []byte, n int) bool {
+	if pm == nil || n < 20 {
+		return false
+	}
+	packet := buffer[protocol.HeaderSize : protocol.HeaderSize+n]
+	dst := [4]byte(packet[16:20])
+	// Only our own traffic: the peer drops anything else it gets on the link
+	if [4]byte(packet[12:16]) != pm.self || dst == pm.self || !pm.tunnel.Contains(netip.AddrFrom4(dst)) {
+		return false
+	}
+
+	pm.mu.Lock()
+	link := pm.links[dst]
+	pm.mu.Unlock()
+	if link == nil {
+		pm.request(dst, false)
+		return false
+	}
+	if !link.healthy() {
+		return false
+	}
+	_, err := link.conn.Write(protocol.FrameData(buffer, n))
+	return err == nil
+}
+
+// request asks the server for a direct path to ip, unless there is one or
+// it was asked for recently; invited requests skip the retry interval
+func (pm *peerManager) request(ip [4]byte, invited bool) {
+	pm.mu.Lock()
+	if pm.links[ip] != nil || pm.connecting[ip] || (!invited && time.Since(pm.attempts[ip]) < peerRetryInterval) {
+		pm.mu.Unlock()
+		return
+	}
+	pm.attempts[ip] = time.Now()
+	pm.mu.Unlock()
+
+	go pm.sendRequest(ip)
+}
+
+// sendRequest sends a peer request over the tunnel and its nonce from the
+// peer socket to the rendezvous port, a few times in case some are lost
+func (pm *peerManager) sendRequest(ip [4]byte) {
+	nonce := make([]byte, protocol.PeerNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return
+	}
+	packet, err := protocol.EncodePeerRequest(&protocol.PeerRequest{
+		PeerIP:    net.IP(ip[:]),
+		Nonce:     nonce,
+		Endpoints: pm.localEndpoints(),
+	})
+	if err != nil {
+		return
+	}
+	if _, err := pm.vc.conn.Write(packet); err != nil {
+		fmt.Printf(" Failed to request a direct path to %s: %v\n", net.IP(ip[:]), err)
+		return
+	}
+
+	probe := protocol.EncodePeerProbe(nonce)
+	for i := 0; i < peerProbeCount; i++ {
+		if err := pm.socket.WriteTo(probe, pm.rendezvous); err != nil {
+			return
+		}
+		time.Sleep(peerProbeInterval)
+	}
+}
+
+// localEndpoints returns the peer socket's addresses on the local networks,
+// which peers behind the same NAT can reach directly
+func (pm *peerManager) localEndpoints() []netip.AddrPort {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	port := pm.socket.LocalAddr().AddrPort().Port()
+	var endpoints []netip.AddrPort
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.Name == "tun1" {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ip, _ := netip.AddrFromSlice(ipNet.IP.To4())
+			endpoints = append(endpoints, netip.AddrPortFrom(ip, port))
+		}
+	}
+	return endpoints
+}
+
+// handleInvite answers a peer that asked the server for a path to us
+func (pm *peerManager) handleInvite(payload []byte) {
+	if pm == nil {
+		return
+	}
+	ip, err := protocol.DecodePeerInvite(payload)
+	if err != nil {
+		fmt.Printf(" Bad peer invite from server: %v\n", err)
+		return
+	}
+	pm.request([4]byte(ip), true)
+}
+
+// handlePeerInfo starts connecting to the peer the server introduced
+func (pm *peerManager) handlePeerInfo(payload []byte) {
+	if pm == nil {
+		return
+	}
+	info, err := protocol.DecodePeerInfo(payload)
+	if err != nil {
+		fmt.Printf(" Bad peer info from server: %v\n", err)
+		return
+	}
+	ip := [4]byte(info.PeerIP)
+	if !pm.tunnel.Contains(netip.AddrFrom4(ip)) || ip == pm.self || len(info.Endpoints) == 0 {
+		return
+	}
+
+	pm.mu.Lock()
+	if pm.links[ip] != nil || pm.connecting[ip] {
+		pm.mu.Unlock()
+		return
+	}
+	pm.connecting[ip] = true
+	pm.mu.Unlock()
+
+	go pm.connect(ip, info)
+}
+
+func (pm *peerManager) connect(ip [4]byte, info *protocol.PeerInfo) {
+	defer func() {
+		pm.mu.Lock()
+		delete(pm.connecting, ip)
+		pm.mu.Unlock()
+	}()
+
+	// The peer's public endpoint must not be routed into the tunnel
+	if err := pm.vc.netConfig.AddPeerRoute(info.Endpoints[0].Addr().String(), "tun1"); err != nil {
+		fmt.Printf(" Warning: %v\n", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), peerConnectTimeout)
+	defer cancel()
+	// The end with the lower tunnel address runs the DTLS server side
+	conn, err := pm.socket.Connect(ctx, info.Endpoints, info.Key, bytes.Compare(pm.self[:], ip[:]) < 0)
+	if err != nil {
+		fmt.Printf(" No direct path to %s, using the relay: %v\n", info.PeerIP, err)
+		return
+	}
+
+	link := &peerLink{ip: ip, conn: conn, done: make(chan struct{})}
+	link.lastRecv.Store(time.Now().UnixNano())
+	pm.mu.Lock()
+	pm.links[ip] = link
+	pm.mu.Unlock()
+	fmt.Printf(" Direct link to %s via %s\n", info.PeerIP, conn.RemoteAddr())
+
+	go pm.pingLink(link)
+	pm.readLink(link)
+}
+
+// readLink writes the peer's packets to the TUN until the link fails
+func (pm *peerManager) readLink(link *peerLink) {
+	defer pm.drop(link)
+	buffer := make([]byte, 65535)
+	for {
+		n, err := link.conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		link.lastRecv.Store(time.Now().UnixNano())
+
+		packetType, payload, err := protocol.Decode(buffer[:n])
+		if err != nil {
+			continue
+		}
+		switch packetType {
+		case protocol.PacketTypeData:
+			// The link only carries the peer's own traffic
+			if len(payload) < 20 || [4]byte(payload[12:16]) != link.ip {
+				continue
+			}
+			pm.vc.handleDataPacket(payload)
+		case protocol.PacketTypePing:
+			link.conn.Write(protocol.EncodePong())
+		}
+	}
+}
+
+// pingLink keeps the link's NAT mappings open and closes it once the peer
+// has been silent for peerLinkTimeout, after which the relay takes over
+func (pm *peerManager) pingLink(link *peerLink) {
+	ticker := time.NewTicker(peerPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-link.done:
+			return
+		}
+		if !link.healthy() {
+			link.conn.Close()
+			return
+		}
+		link.conn.Write(protocol.EncodePing())
+	}
+}
+
+// drop forgets a failed link
+func (pm *peerManager) drop(link *peerLink) {
+	link.once.Do(func() {
+		close(link.done)
+		link.conn.Close()
+		pm.mu.Lock()
+		if pm.links[link.ip] == link {
+			delete(pm.links, link.ip)
+		}
+		pm.mu.Unlock()
+		fmt.Printf(" Direct link to %s closed, using the relay\n", net.IP(link.ip[:]))
+	})
+}
+
+// Close closes the peer socket and every link on it
+func (pm *peerManager) Close() {
+	if pm == nil {
+		return
+	}
+	pm.socket.Close()
+}
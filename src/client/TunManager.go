@@ -8,9 +8,15 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
+
+	"github.com/varun0310t/VPN/src/offload"
+	"github.com/varun0310t/VPN/src/protocol"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -25,17 +31,27 @@ type ifreq struct {
 	_     [22]byte
 }
 
+// defaultDNSServers are used when the server does not push any DNS servers
+var defaultDNSServers = []string{"8.8.8.8", "1.1.1.1"}
+
 type TunManager struct {
 	fd               int
 	name             string
 	ip               string
+	prefixLen        int
+	mtu              int
 	closed           bool
+	offload          bool               // Opened with IFF_VNET_HDR; every packet has a virtio-net header
+	coalescer        *offload.Coalescer // Merges TCP segments of a batch before they are written
+	dnsServers       []string
+	searchDomains    []string
+	usedResolvectl   bool
 	resolvBackup     string
 	resolvWasSymlink bool
 	resolvLinkTarget string
 }
 
-func NewTunManager(tunName string, assignedIP string) (*TunManager, error) {
+func NewTunManager(tunName string, assignedIP string, prefixLen int, mtu int, dnsServers []string, searchDomains []string, withOffload bool) (*TunManager, error) {
 	// Create TUN interface
 	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
@@ -45,20 +61,39 @@ func NewTunManager(tunName string, assignedIP string) (*TunManager, error) {
 	var ifr ifreq
 	copy(ifr.name[:], tunName)
 	ifr.flags = IFF_TUN | IFF_NO_PI
+	if withOffload {
+		ifr.flags |= offload.IFF_VNET_HDR
+	}
 
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
 	if errno != 0 {
 		syscall.Close(fd)
 		return nil, fmt.Errorf("ioctl TUNSETIFF failed: %v", errno)
 	}
+	if withOffload {
+		if err := offload.EnableTUN(fd); err != nil {
+			syscall.Close(fd)
+			return nil, err
+		}
+		fmt.Println(" TUN offloads enabled")
+	}
 	//
 	fmt.Printf(" TUN interface %s created (fd: %d)\n", tunName, fd)
 
 	tm := &TunManager{
-		fd:     fd,
-		name:   tunName,
-		ip:     assignedIP,
-		closed: false,
+		fd:            fd,
+		name:          tunName,
+		ip:            assignedIP,
+		prefixLen:     prefixLen,
+		mtu:           mtu,
+		closed:        false,
+		offload:       withOffload,
+		dnsServers:    dnsServers,
+		searchDomains: searchDomains,
+	}
+
+	if withOffload {
+		tm.coalescer = offload.NewCoalescer(tm.writeVnet)
 	}
 
 	// Configure the interface
@@ -81,7 +116,7 @@ func (tm *TunManager) Configure() error {
 	fmt.Printf("Configuring TUN interface %s with IP %s...\n", tm.name, tm.ip)
 
 	// Set MTU first
-	cmd := exec.Command("ip", "link", "set", "dev", tm.name, "mtu", "1400")
+	cmd := exec.Command("ip", "link", "set", "dev", tm.name, "mtu", strconv.Itoa(tm.mtu))
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to set MTU: %w, output: %s", err, string(output))
@@ -92,7 +127,7 @@ func (tm *TunManager) Configure() error {
 	_ = cmd.Run()
 
 	// Set IP address
-	cmd = exec.Command("ip", "addr", "add", tm.ip+"/24", "dev", tm.name)
+	cmd = exec.Command("ip", "addr", "add", fmt.Sprintf("%s/%d", tm.ip, tm.prefixLen), "dev", tm.name)
 	output, err = cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to set IP: %w (output: %s)", err, string(output))
@@ -105,7 +140,7 @@ func (tm *TunManager) Configure() error {
 		return fmt.Errorf("failed to bring interface up: %w (output: %s)", err, string(output))
 	}
 
-	fmt.Printf(" TUN interface configured: %s (%s/24)\n", tm.name, tm.ip)
+	fmt.Printf(" TUN interface configured: %s (%s/%d)\n", tm.name, tm.ip, tm.prefixLen)
 	return nil
 }
 
@@ -122,6 +157,16 @@ func (tm *TunManager) ReadPacket(buffer []byte) (int, error) {
 	return n, nil
 }
 
+// PacketReady reports whether a packet can be read from the TUN without blocking
+func (tm *TunManager) PacketReady() bool {
+	if tm.closed {
+		return false
+	}
+	fds := []unix.PollFd{{Fd: int32(tm.fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 0)
+	return err == nil && n > 0 && fds[0].Revents&unix.POLLIN != 0
+}
+
 func (tm *TunManager) WritePacket(packet []byte) error {
 	if tm.closed {
 		return fmt.Errorf("TUN interface is closed")
@@ -131,6 +176,10 @@ func (tm *TunManager) WritePacket(packet []byte) error {
 		return fmt.Errorf("packet too small: %d bytes", len(packet))
 	}
 
+	if tm.offload {
+		return offload.WriteTUN(tm.fd, offload.VirtioNetHdr{}, packet)
+	}
+
 	n, err := syscall.Write(tm.fd, packet)
 	if err != nil {
 		return fmt.Errorf("failed to write to TUN: %w", err)
@@ -143,9 +192,44 @@ func (tm *TunManager) WritePacket(packet []byte) error {
 	return nil
 }
 
+// WriteBatch writes every packet of a batch payload to the TUN, expanding
+// compressed packets with d. With offloads, consecutive TCP segments are
+// coalesced into fewer, larger writes.
+func (tm *TunManager) WriteBatch(payload []byte, d *protocol.Decompressor) error {
+	if !tm.offload {
+		return protocol.ForEachBatchPacket(payload, d, func(packet []byte) {
+			if err := tm.WritePacket(packet); err != nil {
+				fmt.Printf(" Error writing to TUN: %v\n", err)
+			}
+		})
+	}
+
+	err := protocol.ForEachBatchPacket(payload, d, func(packet []byte) {
+		if err := tm.coalescer.Add(packet); err != nil {
+			fmt.Printf(" Error writing to TUN: %v\n", err)
+		}
+	})
+	if err := tm.coalescer.Flush(); err != nil {
+		fmt.Printf(" Error writing to TUN: %v\n", err)
+	}
+	return err
+}
+
+// writeVnet writes a packet behind the given virtio-net header
+func (tm *TunManager) writeVnet(hdr offload.VirtioNetHdr, packet []byte) error {
+	if tm.closed {
+		return fmt.Errorf("TUN interface is closed")
+	}
+	return offload.WriteTUN(tm.fd, hdr, packet)
+}
+
 func (tm *TunManager) ConfigureDNS() error {
 
-	dnsServers := []string{"8.8.8.8", "1.1.1.1"}
+	dnsServers := tm.dnsServers
+	if len(dnsServers) == 0 {
+		fmt.Println(" No DNS servers pushed by server, using defaults")
+		dnsServers = defaultDNSServers
+	}
 
 	// If systemd-resolved's resolvectl is available, use it to set DNS for the interface
 	if _, err := exec.LookPath("resolvectl"); err == nil {
@@ -173,6 +257,18 @@ func (tm *TunManager) ConfigureDNS() error {
 		if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
 			return fmt.Errorf("resolvectl dns failed: %w - %s", err, string(out))
 		}
+		tm.usedResolvectl = true
+
+		// "~." makes this link the routing domain for all queries, so lookups
+		// don't leak through the other interfaces' resolvers
+		args = append([]string{"domain", tm.name, "~."}, tm.searchDomains...)
+		if out, err := exec.Command("resolvectl", args...).CombinedOutput(); err != nil {
+			return fmt.Errorf("resolvectl domain failed: %w - %s", err, string(out))
+		}
+
+		if out, err := exec.Command("resolvectl", "default-route", tm.name, "true").CombinedOutput(); err != nil {
+			fmt.Printf(" Warning: resolvectl default-route failed: %v - %s\n", err, string(out))
+		}
 		fmt.Printf(" DNS configured via resolvectl for %s\n", tm.name)
 		return nil
 	}
@@ -215,6 +311,9 @@ func (tm *TunManager) ConfigureDNS() error {
 	for _, s := range dnsServers {
 		content += "nameserver " + s + "\n"
 	}
+	if len(tm.searchDomains) > 0 {
+		content += "search " + strings.Join(tm.searchDomains, " ") + "\n"
+	}
 	if err := os.WriteFile(dst, []byte(content), 0644); err != nil {
 		return fmt.Errorf("failed to write %s: %w", dst, err)
 	}
@@ -225,6 +324,14 @@ func (tm *TunManager) ConfigureDNS() error {
 func (tm *TunManager) RestoreDNS() error {
 	dst := "/etc/resolv.conf"
 
+	// Drop the per-link settings; the link itself goes away on Close
+	if tm.usedResolvectl {
+		if out, err := exec.Command("resolvectl", "revert", tm.name).CombinedOutput(); err != nil {
+			fmt.Printf(" Warning: resolvectl revert failed: %v - %s\n", err, string(out))
+		}
+		tm.usedResolvectl = false
+	}
+
 	// If we recorded a backup path, try to restore it
 	if tm.resolvBackup != "" {
 		// If original was a symlink, restore symlink target
@@ -3,13 +3,79 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"time"
 )
 
 type ClientConfig struct {
-	PASSWORD   string `json:"PASSWORD"`
-	SERVERIP   string `json:"SERVERIP,omitempty"`
-	SERVERPORT int    `json:"SERVERPORT,omitempty"`
+	PASSWORD     string   `json:"PASSWORD"`
+	USERNAME     string   `json:"USERNAME,omitempty"` // Optional; the client's DNS name on servers that run a resolver
+	SERVERIP     string   `json:"SERVERIP,omitempty"`
+	SERVERPORT   int      `json:"SERVERPORT,omitempty"`
+	TUNOFFLOAD   bool     `json:"TUNOFFLOAD,omitempty"`   // Open TUN with IFF_VNET_HDR for GSO/GRO
+	COMPRESSION  string   `json:"COMPRESSION,omitempty"`  // "zstd" to offer compression to the server
+	TRANSPORT    string   `json:"TRANSPORT,omitempty"`    // "dtls" (default), "tls", "websocket" or "quic"
+	TCPFALLBACK  bool     `json:"TCPFALLBACK,omitempty"`  // Use TLS over TCP when DTLS over UDP fails
+	TCPPORT      int      `json:"TCPPORT,omitempty"`      // Server TCP port, 0 = the UDP port
+	UDPTIMEOUT   int      `json:"UDPTIMEOUT,omitempty"`   // Seconds to wait for the DTLS handshake, 0 = 5
+	WEBSOCKETURL string   `json:"WEBSOCKETURL,omitempty"` // wss:// URL of the server, "" = wss://<server>/vpn
+	HTTPPROXY    string   `json:"HTTPPROXY,omitempty"`    // HTTP proxy for WebSocket, "" = HTTPS_PROXY from the environment
+	QUICPORT     int      `json:"QUICPORT,omitempty"`     // Server QUIC port, 0 = the UDP port + 1
+	KNOCKKEY     string   `json:"KNOCKKEY,omitempty"`     // Pre-shared knock key, when the server sets knock_key
+	SUBNETS      []string `json:"SUBNETS,omitempty"`      // LAN subnets behind this client, as a site-to-site gateway
+	PEERTOPEER   bool     `json:"PEERTOPEER,omitempty"`   // Reach other clients directly when the server supports it
+	PEERPORT     int      `json:"PEERPORT,omitempty"`     // Server rendezvous port, 0 = the UDP port + 2
+	SERVERS      []string `json:"SERVERS,omitempty"`      // Other cluster nodes to resume on, "host" or "host:port"
+}
+
+// tcpPort returns the server's TLS over TCP port
+func (cfg *ClientConfig) tcpPort(serverPort int) int {
+	if cfg.TCPPORT != 0 {
+		return cfg.TCPPORT
+	}
+	return serverPort
+}
+
+// quicPort returns the server's QUIC port
+func (cfg *ClientConfig) quicPort(serverPort int) int {
+	if cfg.QUICPORT != 0 {
+		return cfg.QUICPORT
+	}
+	return serverPort + 1
+}
+
+// peerPort returns the server's rendezvous port
+func (cfg *ClientConfig) peerPort(serverPort int) int {
+	if cfg.PEERPORT != 0 {
+		return cfg.PEERPORT
+	}
+	return serverPort + 2
+}
+
+// subnets returns the site-to-site subnets to advertise, skipping invalid entries
+func (cfg *ClientConfig) subnets() []net.IPNet {
+	nets := make([]net.IPNet, 0, len(cfg.SUBNETS))
+	for _, subnet := range cfg.SUBNETS {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			fmt.Printf("Skipping invalid subnet in config: %q\n", subnet)
+			continue
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets
+}
+
+// defaultUDPTimeout is how long the DTLS handshake may take before giving up on UDP
+const defaultUDPTimeout = 5 * time.Second
+
+// udpTimeout returns the DTLS handshake timeout
+func (cfg *ClientConfig) udpTimeout() time.Duration {
+	if cfg.UDPTIMEOUT > 0 {
+		return time.Duration(cfg.UDPTIMEOUT) * time.Second
+	}
+	return defaultUDPTimeout
 }
 
 func loadClientConfig() (*ClientConfig, error) {
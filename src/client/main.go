@@ -5,9 +5,13 @@ package client
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+
+	"github.com/varun0310t/VPN/src/protocol"
 )
 
 var (
@@ -19,6 +23,11 @@ var (
 func InitClient(serverAddr string, serverPort int, password string) error {
 	var err error
 
+	ClientCfg, err = loadClientConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load client config: %w", err)
+	}
+
 	if serverAddr == "" {
 		serverAddr = ClientCfg.SERVERIP
 	}
@@ -33,15 +42,24 @@ func InitClient(serverAddr string, serverPort int, password string) error {
 
 	Password = password
 
-	vpnClient, err = NewVPNClient(serverAddr, serverPort)
+	servers, err := failoverServers(serverAddr, serverPort)
 	if err != nil {
-		return fmt.Errorf("failed to create VPN client: %w", err)
+		return err
 	}
 
-	ClientCfg, err = loadClientConfig()
+	certPool := loadServerCertPool()
+	transport, err := newTransport(serverAddr, serverPort, certPool)
 	if err != nil {
-		return fmt.Errorf("failed to load client config: %w", err)
+		return err
+	}
+
+	vpnClient, err = NewVPNClient(transport)
+	if err != nil {
+		return fmt.Errorf("failed to create VPN client: %w", err)
 	}
+	vpnClient.rendezvous = net.JoinHostPort(serverAddr, strconv.Itoa(ClientCfg.peerPort(serverPort)))
+	vpnClient.certPool = certPool
+	vpnClient.servers = servers
 
 	// Save original network configuration
 	err = vpnClient.SaveNetworkConfig()
@@ -78,6 +96,17 @@ func Connect() error {
 	return nil
 }
 
+// serverDisconnected tears the tunnel down after the server ended the session
+// and exits with the reason's exit code so callers can tell why
+func serverDisconnected(reason *protocol.ReasonError) {
+	fmt.Printf("Disconnected by server: %v\n", reason)
+	Disconnect()
+	if code, ok := reason.Reason.ExitCode(); ok {
+		os.Exit(code)
+	}
+	os.Exit(1)
+}
+
 func Disconnect() error {
 	if vpnClient == nil {
 		return nil
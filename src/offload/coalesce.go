@@ -0,0 +1,155 @@
+package offload
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Coalescer merges consecutive in-order TCP segments of the same flow into one
+// large packet for a TUN with IFF_VNET_HDR, the receive-side counterpart of
+// Segment. Packets that cannot be merged are written unchanged.
+type Coalescer struct {
+	write func(hdr VirtioNetHdr, packet []byte) error
+
+	buf     []byte // Packet being built
+	layout  tcpPacket
+	count   int    // Segments merged into buf
+	gsoSize int    // Payload size of the first segment
+	nextSeq uint32 // Sequence number the next segment must carry
+	closed  bool   // PSH or a short segment ends the packet
+}
+
+// NewCoalescer creates a coalescer that hands finished packets to write
+func NewCoalescer(write func(hdr VirtioNetHdr, packet []byte) error) *Coalescer {
+	return &Coalescer{
+		write: write,
+		buf:   make([]byte, 0, MaxPacketSize),
+	}
+}
+
+// Add merges pkt into the pending packet or, if it cannot be merged, flushes
+// the pending packet first. Call Flush once the batch is done.
+func (c *Coalescer) Add(pkt []byte) error {
+	if c.count > 0 && c.canAppend(pkt) {
+		c.append(pkt)
+		return nil
+	}
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	if c.start(pkt) {
+		return nil
+	}
+	return c.write(VirtioNetHdr{}, pkt)
+}
+
+// Flush writes the pending packet, if any
+func (c *Coalescer) Flush() error {
+	if c.count == 0 {
+		return nil
+	}
+	pkt, count := c.buf, c.count
+	c.count = 0
+
+	if count == 1 {
+		// Nothing merged; the original checksums are still valid
+		return c.write(VirtioNetHdr{}, pkt)
+	}
+
+	p := c.layout
+	p.setLength(pkt)
+
+	// Leave only the pseudo-header sum in the checksum field for the kernel to complete
+	src, dst := p.addrs(pkt)
+	binary.BigEndian.PutUint16(pkt[p.ipLen+16:], checksumFold(pseudoHeaderSum(src, dst, protoTCP, len(pkt)-p.ipLen)))
+
+	hdr := VirtioNetHdr{
+		Flags:      FlagNeedsCsum,
+		GSOType:    GSOTCPv4,
+		HdrLen:     uint16(p.ipLen + p.tcpLen),
+		GSOSize:    uint16(c.gsoSize),
+		CsumStart:  uint16(p.ipLen),
+		CsumOffset: 16,
+	}
+	if p.version == 6 {
+		hdr.GSOType = GSOTCPv6
+	}
+	return c.write(hdr, pkt)
+}
+
+// start begins a new packet from pkt if it can be the head of a merge
+func (c *Coalescer) start(pkt []byte) bool {
+	p, ok := parseTCP(pkt)
+	if !ok {
+		return false
+	}
+	flags := pkt[p.ipLen+13]
+	payload := len(pkt) - p.ipLen - p.tcpLen
+	if flags&^tcpACK != 0 || payload == 0 {
+		// Only plain ACK segments with data are worth merging
+		return false
+	}
+
+	c.buf = append(c.buf[:0], pkt...)
+	c.layout = p
+	c.count = 1
+	c.gsoSize = payload
+	c.nextSeq = binary.BigEndian.Uint32(pkt[p.ipLen+4:]) + uint32(payload)
+	c.closed = false
+	return true
+}
+
+// canAppend reports whether pkt is the next segment of the pending packet
+func (c *Coalescer) canAppend(pkt []byte) bool {
+	if c.closed {
+		return false
+	}
+	p, ok := parseTCP(pkt)
+	if !ok || p != c.layout {
+		return false
+	}
+
+	payload := len(pkt) - p.ipLen - p.tcpLen
+	if payload == 0 || payload > c.gsoSize || len(c.buf)+payload > MaxPacketSize {
+		return false
+	}
+
+	head := c.buf
+	if p.version == 4 {
+		// Version, TOS, flags, TTL, protocol, addresses and options must match
+		if !bytes.Equal(pkt[0:2], head[0:2]) || !bytes.Equal(pkt[6:10], head[6:10]) || !bytes.Equal(pkt[12:p.ipLen], head[12:p.ipLen]) {
+			return false
+		}
+	} else {
+		// Traffic class, flow label, next header, hop limit and addresses must match
+		if !bytes.Equal(pkt[0:4], head[0:4]) || !bytes.Equal(pkt[6:40], head[6:40]) {
+			return false
+		}
+	}
+
+	tcp, headTCP := pkt[p.ipLen:], head[p.ipLen:]
+	flags := tcp[13]
+	return bytes.Equal(tcp[0:4], headTCP[0:4]) && // Ports
+		binary.BigEndian.Uint32(tcp[4:]) == c.nextSeq &&
+		bytes.Equal(tcp[8:13], headTCP[8:13]) && // Ack and data offset
+		flags&^(tcpACK|tcpPSH) == 0 &&
+		bytes.Equal(tcp[14:16], headTCP[14:16]) && // Window
+		bytes.Equal(tcp[20:p.tcpLen], headTCP[20:p.tcpLen]) // Options
+}
+
+// append adds the payload of pkt to the pending packet
+func (c *Coalescer) append(pkt []byte) {
+	p := c.layout
+	payload := pkt[p.ipLen+p.tcpLen:]
+	c.buf = append(c.buf, payload...)
+	c.count++
+	c.nextSeq += uint32(len(payload))
+
+	if pkt[p.ipLen+13]&tcpPSH != 0 {
+		c.buf[p.ipLen+13] |= tcpPSH
+		c.closed = true
+	}
+	if len(payload) < c.gsoSize {
+		c.closed = true
+	}
+}
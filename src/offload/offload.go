@@ -0,0 +1,170 @@
+// Package offload implements the userspace half of TUN offloads: the
+// virtio-net header that precedes every packet on a TUN opened with
+// IFF_VNET_HDR, segmentation of the large TCP packets the kernel hands us
+// (GSO) and coalescing of inbound TCP segments before they are written (GRO).
+package offload
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// HdrLen is the size of the virtio-net header in front of every packet
+const HdrLen = 10
+
+// MaxPacketSize is the largest packet a TUN with offloads reads or accepts
+const MaxPacketSize = 65535
+
+// Virtio-net header flags and GSO types
+const (
+	FlagNeedsCsum = 0x01 // Checksum at CsumStart+CsumOffset must be completed
+
+	GSONone  = 0x00
+	GSOTCPv4 = 0x01
+	GSOUDP   = 0x03
+	GSOTCPv6 = 0x04
+	GSOECN   = 0x80 // Combined with a TCP type when ECN is in use
+)
+
+// VirtioNetHdr is struct virtio_net_hdr. The fields are in host byte order,
+// which is little endian on every platform the server and client run on.
+type VirtioNetHdr struct {
+	Flags      uint8
+	GSOType    uint8
+	HdrLen     uint16 // Length of the IP and transport headers
+	GSOSize    uint16 // Payload bytes per segment
+	CsumStart  uint16 // Offset where checksumming starts
+	CsumOffset uint16 // Offset of the checksum field from CsumStart
+}
+
+// DecodeHdr parses the virtio-net header at the front of b
+func DecodeHdr(b []byte) (VirtioNetHdr, error) {
+	if len(b) < HdrLen {
+		return VirtioNetHdr{}, fmt.Errorf("virtio-net header too short: %d bytes", len(b))
+	}
+	return VirtioNetHdr{
+		Flags:      b[0],
+		GSOType:    b[1],
+		HdrLen:     binary.LittleEndian.Uint16(b[2:]),
+		GSOSize:    binary.LittleEndian.Uint16(b[4:]),
+		CsumStart:  binary.LittleEndian.Uint16(b[6:]),
+		CsumOffset: binary.LittleEndian.Uint16(b[8:]),
+	}, nil
+}
+
+// Encode writes the header into the first HdrLen bytes of b
+func (h VirtioNetHdr) Encode(b []byte) {
+	b[0] = h.Flags
+	b[1] = h.GSOType
+	binary.LittleEndian.PutUint16(b[2:], h.HdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.GSOSize)
+	binary.LittleEndian.PutUint16(b[6:], h.CsumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.CsumOffset)
+}
+
+// checksumAdd adds b to a ones' complement sum of big-endian 16-bit words
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// checksumFold folds a sum down to 16 bits
+func checksumFold(sum uint32) uint16 {
+	for sum>>16 != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+// pseudoHeaderSum sums the TCP/UDP pseudo-header for IPv4 or IPv6 addresses
+func pseudoHeaderSum(src, dst []byte, proto byte, length int) uint32 {
+	sum := checksumAdd(0, src)
+	sum = checksumAdd(sum, dst)
+	sum += uint32(proto)
+	sum += uint32(length & 0xFFFF)
+	sum += uint32(length >> 16)
+	return sum
+}
+
+// tcpPacket describes the headers of an IPv4 or IPv6 TCP packet
+type tcpPacket struct {
+	version int
+	ipLen   int // IP header length
+	tcpLen  int // TCP header length
+}
+
+// parseTCP returns the header layout of a TCP packet, or ok=false for anything
+// else (other protocols, fragments, IPv6 extension headers, truncated packets
+// and packets with bytes past the IP length, such as link-layer padding)
+func parseTCP(pkt []byte) (tcpPacket, bool) {
+	var p tcpPacket
+	if len(pkt) < 20 {
+		return p, false
+	}
+
+	switch pkt[0] >> 4 {
+	case 4:
+		p.version = 4
+		p.ipLen = int(pkt[0]&0x0F) * 4
+		fragmented := binary.BigEndian.Uint16(pkt[6:8])&0x3FFF != 0
+		if p.ipLen < 20 || pkt[9] != protoTCP || fragmented || int(binary.BigEndian.Uint16(pkt[2:4])) != len(pkt) {
+			return p, false
+		}
+	case 6:
+		p.version = 6
+		p.ipLen = 40
+		if len(pkt) < p.ipLen || pkt[6] != protoTCP || int(binary.BigEndian.Uint16(pkt[4:6]))+40 != len(pkt) {
+			return p, false
+		}
+	default:
+		return p, false
+	}
+
+	if len(pkt) < p.ipLen+20 {
+		return p, false
+	}
+	p.tcpLen = int(pkt[p.ipLen+12]>>4) * 4
+	if p.tcpLen < 20 || len(pkt) < p.ipLen+p.tcpLen {
+		return p, false
+	}
+	return p, true
+}
+
+// addrs returns the source and destination address of the packet
+func (p tcpPacket) addrs(pkt []byte) (src, dst []byte) {
+	if p.version == 4 {
+		return pkt[12:16], pkt[16:20]
+	}
+	return pkt[8:24], pkt[24:40]
+}
+
+// setLength updates the IP length field and, for IPv4, the header checksum
+func (p tcpPacket) setLength(pkt []byte) {
+	if p.version == 6 {
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-40))
+		return
+	}
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:], ^checksumFold(checksumAdd(0, pkt[:p.ipLen])))
+}
+
+const protoTCP = 6
+
+// TCP flags
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+	tcpURG = 0x20
+	tcpECE = 0x40
+	tcpCWR = 0x80
+)
@@ -0,0 +1,98 @@
+package offload
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Segment turns a packet read from a TUN with IFF_VNET_HDR into the packets it
+// stands for and calls emit with each: a large TCP packet is split into
+// GSOSize segments, and a partial checksum is completed. Segments are built in
+// scratch, which must hold the largest segment; emit must copy what it keeps.
+func Segment(pkt []byte, hdr VirtioNetHdr, scratch []byte, emit func(packet []byte)) error {
+	switch hdr.GSOType &^ GSOECN {
+	case GSONone:
+		if hdr.Flags&FlagNeedsCsum != 0 {
+			if err := completeChecksum(pkt, int(hdr.CsumStart), int(hdr.CsumOffset)); err != nil {
+				return err
+			}
+		}
+		emit(pkt)
+		return nil
+	case GSOTCPv4, GSOTCPv6:
+		return segmentTCP(pkt, int(hdr.GSOSize), scratch, emit)
+	default:
+		return fmt.Errorf("unsupported GSO type 0x%02x", hdr.GSOType)
+	}
+}
+
+// completeChecksum finishes a checksum the kernel left as a pseudo-header sum
+func completeChecksum(pkt []byte, start, offset int) error {
+	if start+offset+2 > len(pkt) {
+		return fmt.Errorf("checksum offset %d+%d outside %d byte packet", start, offset, len(pkt))
+	}
+
+	csum := ^checksumFold(checksumAdd(0, pkt[start:]))
+	if csum == 0 && offset == 6 {
+		// A computed UDP checksum of zero is sent as all ones
+		csum = 0xFFFF
+	}
+	binary.BigEndian.PutUint16(pkt[start+offset:], csum)
+	return nil
+}
+
+// segmentTCP splits a TCP packet into mss sized segments with full checksums
+func segmentTCP(pkt []byte, mss int, scratch []byte, emit func(packet []byte)) error {
+	p, ok := parseTCP(pkt)
+	if !ok {
+		return fmt.Errorf("GSO packet is not a valid TCP packet")
+	}
+	if mss == 0 {
+		return fmt.Errorf("GSO packet without a segment size")
+	}
+
+	hdrLen := p.ipLen + p.tcpLen
+	if len(scratch) < hdrLen+mss {
+		return fmt.Errorf("scratch buffer of %d bytes cannot hold a %d byte segment", len(scratch), hdrLen+mss)
+	}
+
+	payload := pkt[hdrLen:]
+	seq := binary.BigEndian.Uint32(pkt[p.ipLen+4:])
+	flags := pkt[p.ipLen+13]
+	id := binary.BigEndian.Uint16(pkt[4:])
+
+	for i, off := 0, 0; ; i, off = i+1, off+mss {
+		end := min(off+mss, len(payload))
+		first, last := off == 0, end == len(payload)
+
+		seg := scratch[:hdrLen+end-off]
+		copy(seg, pkt[:hdrLen])
+		copy(seg[hdrLen:], payload[off:end])
+
+		// FIN and PSH belong to the last segment, CWR to the first
+		segFlags := flags
+		if !last {
+			segFlags &^= tcpFIN | tcpPSH
+		}
+		if !first {
+			segFlags &^= tcpCWR
+		}
+		seg[p.ipLen+13] = segFlags
+		binary.BigEndian.PutUint32(seg[p.ipLen+4:], seq+uint32(off))
+
+		if p.version == 4 {
+			binary.BigEndian.PutUint16(seg[4:], id+uint16(i))
+		}
+		p.setLength(seg)
+
+		src, dst := p.addrs(seg)
+		seg[p.ipLen+16], seg[p.ipLen+17] = 0, 0
+		sum := checksumAdd(pseudoHeaderSum(src, dst, protoTCP, len(seg)-p.ipLen), seg[p.ipLen:])
+		binary.BigEndian.PutUint16(seg[p.ipLen+16:], ^checksumFold(sum))
+
+		emit(seg)
+		if last {
+			return nil
+		}
+	}
+}
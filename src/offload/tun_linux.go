@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package offload
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	IFF_VNET_HDR  = 0x4000
+	TUNSETOFFLOAD = 0x400454d0
+
+	TUN_F_CSUM = 0x01
+	TUN_F_TSO4 = 0x02
+	TUN_F_TSO6 = 0x04
+)
+
+// EnableTUN turns on checksum and TCP segmentation offload for a TUN fd that
+// was opened with IFF_VNET_HDR
+func EnableTUN(fd int) error {
+	if err := unix.IoctlSetInt(fd, TUNSETOFFLOAD, TUN_F_CSUM|TUN_F_TSO4|TUN_F_TSO6); err != nil {
+		return fmt.Errorf("ioctl TUNSETOFFLOAD failed: %w", err)
+	}
+	return nil
+}
+
+// WriteTUN writes a packet behind its virtio-net header in one syscall
+func WriteTUN(fd int, hdr VirtioNetHdr, packet []byte) error {
+	var h [HdrLen]byte
+	hdr.Encode(h[:])
+
+	if _, err := unix.Writev(fd, [][]byte{h[:], packet}); err != nil {
+		return fmt.Errorf("failed to write to TUN: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BatchOverhead is the length prefix in front of every packet in a batch
+const BatchOverhead = 2
+
+// A batch is [PacketTypeDataBatch]([2 byte length][IP packet])... and is only
+// sent to peers that negotiated CapBatching. With CapCompressZstd the top bit
+// of a length marks a compressed packet, so such batches stay below
+// CompressedBatchLimit.
+
+// batchCompressed flags a compressed packet in a batch length
+const batchCompressed = 0x8000
+
+// CompressedBatchLimit is the largest batch record when compression is negotiated
+const CompressedBatchLimit = batchCompressed
+
+// StartBatch resets dst to an empty batch message, reusing its storage
+func StartBatch(dst []byte) []byte {
+	return append(dst[:0], byte(PacketTypeDataBatch))
+}
+
+// AppendBatchPacket adds a length-prefixed IP packet to a batch
+func AppendBatchPacket(batch []byte, packet []byte) []byte {
+	batch = binary.BigEndian.AppendUint16(batch, uint16(len(packet)))
+	return append(batch, packet...)
+}
+
+// AppendBatchCompressed adds a length-prefixed compressed IP packet to a batch
+func AppendBatchCompressed(batch []byte, compressed []byte) []byte {
+	batch = binary.BigEndian.AppendUint16(batch, uint16(len(compressed))|batchCompressed)
+	return append(batch, compressed...)
+}
+
+// BatchFits reports whether a packet of size n can be added without the batch exceeding limit
+func BatchFits(batch []byte, n int, limit int) bool {
+	return len(batch)+BatchOverhead+n <= limit
+}
+
+// ForEachBatchPacket calls fn with every packet in the payload of a
+// PacketTypeDataBatch message. Compressed packets are expanded with d, which
+// is nil unless the session negotiated compression. Other packets alias payload.
+func ForEachBatchPacket(payload []byte, d *Decompressor, fn func(packet []byte)) error {
+	for len(payload) > 0 {
+		if len(payload) < BatchOverhead {
+			return fmt.Errorf("truncated batch length")
+		}
+		n := int(binary.BigEndian.Uint16(payload))
+		payload = payload[BatchOverhead:]
+
+		compressed := d != nil && n&batchCompressed != 0
+		if compressed {
+			n &^= batchCompressed
+		}
+		if n > len(payload) {
+			return fmt.Errorf("batch packet of %d bytes exceeds remaining %d", n, len(payload))
+		}
+
+		packet := payload[:n]
+		if compressed {
+			var err error
+			if packet, err = d.Decompress(packet); err != nil {
+				return err
+			}
+		}
+		fn(packet)
+		payload = payload[n:]
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import "sync"
+
+// FrameData writes the data header into the headroom in front of an IP packet
+// that was read into buf[HeaderSize:HeaderSize+n] and returns the framed
+// message. Nothing is copied.
+func FrameData(buf []byte, n int) []byte {
+	buf[0] = byte(PacketTypeData)
+	return buf[:HeaderSize+n]
+}
+
+// Buffer is a pooled packet buffer with headroom for the protocol header, so
+// a packet can be read once and framed in place.
+type Buffer struct {
+	data   []byte // HeaderSize bytes of headroom followed by the payload area
+	framed []byte // Framed message, set by FrameData
+	pool   *BufferPool
+}
+
+// Payload returns the area after the headroom to read a packet into
+func (b *Buffer) Payload() []byte {
+	return b.data[HeaderSize:]
+}
+
+// FrameData frames the first n payload bytes as a data message and returns it
+func (b *Buffer) FrameData(n int) []byte {
+	b.framed = FrameData(b.data, n)
+	return b.framed
+}
+
+// Packet returns the IP packet inside the framed message
+func (b *Buffer) Packet() []byte {
+	return b.framed[HeaderSize:]
+}
+
+// Bytes returns the framed message
+func (b *Buffer) Bytes() []byte {
+	return b.framed
+}
+
+// Release returns the buffer to its pool; it must not be used afterwards
+func (b *Buffer) Release() {
+	b.framed = nil
+	b.pool.pool.Put(b)
+}
+
+// BufferPool hands out Buffers with room for payloads of a fixed size
+type BufferPool struct {
+	pool sync.Pool
+}
+
+// NewBufferPool creates a pool of buffers that hold payloadSize bytes after the header
+func NewBufferPool(payloadSize int) *BufferPool {
+	p := &BufferPool{}
+	p.pool.New = func() any {
+		return &Buffer{data: make([]byte, HeaderSize+payloadSize), pool: p}
+	}
+	return p
+}
+
+// Get returns a buffer from the pool
+func (p *BufferPool) Get() *Buffer {
+	return p.pool.Get().(*Buffer)
+}
@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ClusterLease is a session a cluster node holds: the tunnel address, the
+// token a client resumes it with on another node and what the session needs
+// to be set up again there
+type ClusterLease struct {
+	IP      net.IP
+	Token   []byte
+	Group   string
+	Name    string // DNS name of the client, "" if it has none
+	Subnets []net.IPNet
+	Since   time.Time // When the node claimed the address; the newest claim wins
+}
+
+// ClusterState is everything one node holds. Nodes send theirs to each other
+// every second; Seq only grows, so a state older than one already seen is
+// ignored. A state too large for one message is sent in Parts messages with
+// the same Seq, each holding some of the leases.
+type ClusterState struct {
+	NodeID string
+	Seq    uint64
+	Leases []ClusterLease
+	Part   int // Index of a decoded part; 0 for a state sent whole
+	Parts  int // Messages a decoded state was split over; 1 for a state sent whole
+}
+
+// ClusterStateLimit is the size state messages are kept to, so each fits in
+// one unfragmented datagram and well within a DTLS peer's receive buffer
+const ClusterStateLimit = 1200
+
+// EncodeClusterState returns state as [PacketTypeClusterState][TLV options...]
+// messages, one OptLease per lease holding the lease's own options. A state
+// over limit bytes is split into parts, each marked with OptStatePart.
+func EncodeClusterState(state *ClusterState, limit int) [][]byte {
+	header := []byte{byte(PacketTypeClusterState)}
+	header = AppendOption(header, OptNodeID, []byte(state.NodeID))
+	header = binary.BigEndian.AppendUint64(append(header, OptStateSeq, 0, 8), state.Seq)
+	partSize := tlvHeaderSize + 4
+
+	// Leases are grouped so each part's header and leases stay within limit
+	var parts [][][]byte
+	var part [][]byte
+	size := len(header) + partSize
+	for _, lease := range encodeClusterLeases(state.Leases) {
+		if len(part) > 0 && size+len(lease) > limit {
+			parts = append(parts, part)
+			part, size = nil, len(header)+partSize
+		}
+		part = append(part, lease)
+		size += len(lease)
+	}
+	parts = append(parts, part)
+
+	messages := make([][]byte, 0, len(parts))
+	for i, leases := range parts {
+		packet := append([]byte(nil), header...)
+		if len(parts) > 1 {
+			packet = append(packet, OptStatePart, 0, 4)
+			packet = binary.BigEndian.AppendUint16(packet, uint16(i))
+			packet = binary.BigEndian.AppendUint16(packet, uint16(len(parts)))
+		}
+		for _, lease := range leases {
+			packet = append(packet, lease...)
+		}
+		messages = append(messages, packet)
+	}
+	return messages
+}
+
+// encodeClusterLeases returns each lease as a whole OptLease option
+func encodeClusterLeases(leases []ClusterLease) [][]byte {
+	encoded := make([][]byte, 0, len(leases))
+	var lease []byte
+	for _, l := range leases {
+		ip4 := l.IP.To4()
+		if ip4 == nil {
+			continue
+		}
+		lease = AppendOption(lease[:0], OptAssignedIP, ip4)
+		lease = AppendOption(lease, OptSessionToken, l.Token)
+		if l.Group != "" {
+			lease = AppendOption(lease, OptGroup, []byte(l.Group))
+		}
+		if l.Name != "" {
+			lease = AppendOption(lease, OptUsername, []byte(l.Name))
+		}
+		for _, subnet := range l.Subnets {
+			if value, err := encodeRoute(subnet); err == nil {
+				lease = AppendOption(lease, OptSubnet, value)
+			}
+		}
+		if !l.Since.IsZero() {
+			lease = binary.BigEndian.AppendUint64(append(lease, OptLeaseSince, 0, 8), uint64(l.Since.UnixNano()))
+		}
+		encoded = append(encoded, AppendOption(nil, OptLease, lease))
+	}
+	return encoded
+}
+
+// DecodeClusterState parses the payload of a PacketTypeClusterState message
+func DecodeClusterState(payload []byte) (*ClusterState, error) {
+	options, err := ParseOptions(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &ClusterState{Parts: 1}
+	for _, opt := range options {
+		switch opt.Type {
+		case OptNodeID:
+			state.NodeID = string(opt.Value)
+		case OptStateSeq:
+			if len(opt.Value) != 8 {
+				return nil, fmt.Errorf("invalid state sequence length %d", len(opt.Value))
+			}
+			state.Seq = binary.BigEndian.Uint64(opt.Value)
+		case OptStatePart:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid state part length %d", len(opt.Value))
+			}
+			state.Part = int(binary.BigEndian.Uint16(opt.Value[:2]))
+			state.Parts = int(binary.BigEndian.Uint16(opt.Value[2:]))
+			if state.Part >= state.Parts {
+				return nil, fmt.Errorf("state part %d of %d", state.Part, state.Parts)
+			}
+		case OptLease:
+			lease, err := decodeClusterLease(opt.Value)
+			if err != nil {
+				return nil, err
+			}
+			state.Leases = append(state.Leases, *lease)
+		}
+	}
+	if state.NodeID == "" {
+		return nil, fmt.Errorf("cluster state without node ID")
+	}
+	return state, nil
+}
+
+func decodeClusterLease(value []byte) (*ClusterLease, error) {
+	options, err := ParseOptions(value)
+	if err != nil {
+		return nil, err
+	}
+
+	lease := &ClusterLease{}
+	for _, opt := range options {
+		switch opt.Type {
+		case OptAssignedIP:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid lease IP length %d", len(opt.Value))
+			}
+			lease.IP = net.IPv4(opt.Value[0], opt.Value[1], opt.Value[2], opt.Value[3]).To4()
+		case OptSessionToken:
+			lease.Token = append([]byte(nil), opt.Value...)
+		case OptGroup:
+			lease.Group = string(opt.Value)
+		case OptUsername:
+			lease.Name = string(opt.Value)
+		case OptSubnet:
+			subnet, err := decodeRoute(opt.Value)
+			if err != nil {
+				return nil, err
+			}
+			lease.Subnets = append(lease.Subnets, subnet)
+		case OptLeaseSince:
+			if len(opt.Value) != 8 {
+				return nil, fmt.Errorf("invalid lease time length %d", len(opt.Value))
+			}
+			lease.Since = time.Unix(0, int64(binary.BigEndian.Uint64(opt.Value)))
+		}
+	}
+	if lease.IP == nil || len(lease.Token) == 0 {
+		return nil, fmt.Errorf("lease without IP or token")
+	}
+	return lease, nil
+}
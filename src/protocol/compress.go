@@ -0,0 +1,126 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Data packets are compressed one at a time with zstd, and only sent
+// compressed when that makes them smaller. After an incompressible packet
+// (TLS, video, archives) the sender skips a growing number of packets before
+// trying again, so already-compressed traffic costs almost nothing.
+const (
+	minCompressSize     = 128   // Smaller packets are never worth compressing
+	maxCompressSkip     = 64    // Longest run of packets sent as is after failures
+	maxDecompressedSize = 65535 // No IP packet is larger
+)
+
+// Shared codecs; EncodeAll and DecodeAll are safe for concurrent use
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, err := zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithEncoderCRC(false), // Records are already authenticated by DTLS
+			zstd.WithLowerEncoderMem(true))
+		if err != nil {
+			panic(err)
+		}
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, err := zstd.NewReader(nil,
+			zstd.WithDecoderMaxMemory(maxDecompressedSize),
+			zstd.WithDecodeAllCapLimit(true))
+		if err != nil {
+			panic(err)
+		}
+		return dec
+	})
+)
+
+// Compressor compresses the data packets sent on one session. It is not safe
+// for concurrent use, but the counters may be read from any goroutine.
+type Compressor struct {
+	skip    int // Packets to send as is before trying again
+	backoff int // Skip applied after the next incompressible packet
+
+	RawBytes  atomic.Uint64 // Size of every packet offered
+	WireBytes atomic.Uint64 // Size they were sent as
+}
+
+// Compress appends the compressed form of packet to dst. It returns ok=false,
+// and dst unchanged, when the packet should be sent uncompressed.
+func (c *Compressor) Compress(dst, packet []byte) ([]byte, bool) {
+	c.RawBytes.Add(uint64(len(packet)))
+
+	if len(packet) < minCompressSize || c.skip > 0 {
+		if c.skip > 0 {
+			c.skip--
+		}
+		c.WireBytes.Add(uint64(len(packet)))
+		return dst, false
+	}
+
+	out := zstdEncoder().EncodeAll(packet, dst)
+	if len(out)-len(dst) >= len(packet) {
+		c.backoff = min(max(2*c.backoff, 1), maxCompressSkip)
+		c.skip = c.backoff
+		c.WireBytes.Add(uint64(len(packet)))
+		return dst, false
+	}
+
+	c.backoff = 0
+	c.WireBytes.Add(uint64(len(out) - len(dst)))
+	return out, true
+}
+
+// Ratio returns bytes offered per byte sent, 1 when nothing was sent yet
+func (c *Compressor) Ratio() float64 {
+	return ratio(c.RawBytes.Load(), c.WireBytes.Load())
+}
+
+// Decompressor expands compressed data packets received on one session. It
+// is not safe for concurrent use, but the counters may be read from any goroutine.
+type Decompressor struct {
+	buf []byte
+
+	RawBytes  atomic.Uint64 // Decompressed size of compressed packets received
+	WireBytes atomic.Uint64 // Their size on the wire
+}
+
+// Decompress returns the packet compressed in payload. The result is only
+// valid until the next call.
+func (d *Decompressor) Decompress(payload []byte) ([]byte, error) {
+	if d.buf == nil {
+		d.buf = make([]byte, 0, maxDecompressedSize)
+	}
+
+	packet, err := zstdDecoder().DecodeAll(payload, d.buf[:0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress packet: %w", err)
+	}
+
+	d.RawBytes.Add(uint64(len(packet)))
+	d.WireBytes.Add(uint64(len(payload)))
+	return packet, nil
+}
+
+// Ratio returns decompressed bytes per compressed byte, 1 when nothing was received yet
+func (d *Decompressor) Ratio() float64 {
+	return ratio(d.RawBytes.Load(), d.WireBytes.Load())
+}
+
+func ratio(raw, wire uint64) float64 {
+	if wire == 0 {
+		return 1
+	}
+	return float64(raw) / float64(wire)
+}
+
+// StartCompressedData resets dst to an empty PacketTypeDataCompressed message
+func StartCompressedData(dst []byte) []byte {
+	return append(dst[:0], byte(PacketTypeDataCompressed))
+}
@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func FuzzDecode(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(EncodePing())
+	f.Add(EncodeData([]byte{0x45, 0x00, 0x00, 0x14}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packetType, payload, err := Decode(data)
+		if err != nil {
+			return
+		}
+		if byte(packetType) != data[0] || len(payload) != len(data)-HeaderSize {
+			t.Fatalf("Decode split %v into %s and %d bytes", data, packetType, len(payload))
+		}
+	})
+}
+
+func FuzzParseOptions(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(AppendOption(nil, OptPassword, []byte("pw")))
+	f.Add([]byte{OptMTU, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		options, err := ParseOptions(data)
+		if err != nil {
+			return
+		}
+
+		// Re-encoding what we parsed must reproduce the input exactly
+		var encoded []byte
+		for _, opt := range options {
+			encoded = AppendOption(encoded, opt.Type, opt.Value)
+		}
+		if !bytes.Equal(encoded, data) {
+			t.Fatalf("re-encoded options differ:\n got  %x\n want %x", encoded, data)
+		}
+	})
+}
+
+func FuzzDecodeClientHello(f *testing.F) {
+	f.Add(EncodeClientHello(&ClientHello{Version: ProtocolVersion, Password: "VPN1234"})[HeaderSize:])
+	f.Add([]byte{ProtocolVersion, OptCapabilities, 0, 3, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		hello, err := DecodeClientHello(payload)
+		if err != nil {
+			return
+		}
+
+		again, err := DecodeClientHello(EncodeClientHello(hello)[HeaderSize:])
+		if err != nil {
+			t.Fatalf("decoding re-encoded hello: %v", err)
+		}
+		if !reflect.DeepEqual(hello, again) {
+			t.Fatalf("hello round trip mismatch:\n got  %+v\n want %+v", again, hello)
+		}
+	})
+}
+
+func FuzzDecodePeerInfo(f *testing.F) {
+	seed, _ := EncodePeerInfo(&PeerInfo{
+		PeerIP:    net.IPv4(10, 8, 0, 3),
+		Endpoints: []netip.AddrPort{netip.MustParseAddrPort("203.0.113.5:40000")},
+		Key:       []byte("key"),
+	})
+	f.Add(seed[HeaderSize:])
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		info, err := DecodePeerInfo(payload)
+		if err != nil {
+			return
+		}
+
+		encoded, err := EncodePeerInfo(info)
+		if err != nil {
+			t.Fatalf("re-encoding decoded peer info: %v", err)
+		}
+		again, err := DecodePeerInfo(encoded[HeaderSize:])
+		if err != nil {
+			t.Fatalf("decoding re-encoded peer info: %v", err)
+		}
+		if !reflect.DeepEqual(info, again) {
+			t.Fatalf("peer info round trip mismatch:\n got  %+v\n want %+v", again, info)
+		}
+	})
+}
+
+func FuzzDecodeClusterState(f *testing.F) {
+	seed := EncodeClusterState(&ClusterState{
+		NodeID: "node-a",
+		Seq:    42,
+		Leases: []ClusterLease{{IP: net.IPv4(10, 8, 0, 3), Token: []byte("token"), Group: "office", Since: time.Unix(0, 1)}},
+	}, ClusterStateLimit)
+	f.Add(seed[0][HeaderSize:])
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		state, err := DecodeClusterState(payload)
+		if err != nil {
+			return
+		}
+
+		// Re-encoded whole, so it comes back as a state of one part
+		again, err := DecodeClusterState(EncodeClusterState(state, 1<<20)[0][HeaderSize:])
+		if err != nil {
+			t.Fatalf("decoding re-encoded cluster state: %v", err)
+		}
+		state.Part, state.Parts = 0, 1
+		if !reflect.DeepEqual(state, again) {
+			t.Fatalf("cluster state round trip mismatch:\n got  %+v\n want %+v", again, state)
+		}
+	})
+}
+
+func FuzzDecodeServerConfig(f *testing.F) {
+	seed, _ := EncodeServerConfig(&SessionConfig{
+		Version:       ProtocolVersion,
+		AssignedIP:    net.IPv4(10, 8, 0, 10),
+		PrefixLen:     24,
+		MTU:           1400,
+		DNSServers:    []net.IP{net.IPv4(1, 1, 1, 1)},
+		SearchDomains: []string{"vpn.example"},
+		SplitTunnel:   true,
+		Routes:        []net.IPNet{{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}},
+		Keepalive:     30 * time.Second,
+		SessionToken:  []byte("0123456789abcdef"),
+	})
+	f.Add(seed[HeaderSize:])
+	f.Add([]byte{ProtocolVersion})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		cfg, err := DecodeServerConfig(payload)
+		if err != nil {
+			return
+		}
+
+		// Anything the decoder accepts must survive a round trip
+		encoded, err := EncodeServerConfig(cfg)
+		if err != nil {
+			t.Fatalf("re-encoding decoded config: %v", err)
+		}
+		again, err := DecodeServerConfig(encoded[HeaderSize:])
+		if err != nil {
+			t.Fatalf("decoding re-encoded config: %v", err)
+		}
+		if !again.AssignedIP.Equal(cfg.AssignedIP) || again.MTU != cfg.MTU || again.PrefixLen != cfg.PrefixLen ||
+			len(again.DNSServers) != len(cfg.DNSServers) || len(again.SearchDomains) != len(cfg.SearchDomains) {
+			t.Fatalf("config round trip mismatch:\n got  %+v\n want %+v", again, cfg)
+		}
+	})
+}
+
+func FuzzDecodeAuthSuccess(f *testing.F) {
+	seed, _ := EncodeAuthSuccess(&AuthSuccess{
+		AssignedIP:    net.IPv4(10, 8, 0, 10),
+		DNSServers:    []net.IP{net.IPv4(8, 8, 8, 8)},
+		SearchDomains: []string{"corp.example"},
+		SplitTunnel:   true,
+		Routes:        []net.IPNet{{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}},
+	})
+	f.Add(seed[HeaderSize:])
+	f.Add([]byte{10, 8, 0, 1})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		resp, err := DecodeAuthSuccess(payload)
+		if err != nil {
+			return
+		}
+		if _, err := EncodeAuthSuccess(resp); err != nil {
+			t.Fatalf("re-encoding decoded auth response: %v", err)
+		}
+	})
+}
+
+func FuzzForEachBatchPacket(f *testing.F) {
+	f.Add(AppendBatchPacket(AppendBatchPacket(nil, []byte{1, 2, 3}), []byte{4}))
+	f.Add([]byte{0x00})
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		// Re-encoding what we parsed must reproduce the input exactly
+		encoded := StartBatch(nil)
+		if err := ForEachBatchPacket(payload, nil, func(p []byte) { encoded = AppendBatchPacket(encoded, p) }); err != nil {
+			return
+		}
+		if !bytes.Equal(encoded[HeaderSize:], payload) {
+			t.Fatalf("re-encoded batch differs:\n got  %x\n want %x", encoded[HeaderSize:], payload)
+		}
+	})
+}
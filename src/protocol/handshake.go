@@ -0,0 +1,313 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Protocol versions understood by this package. Version 0 is the legacy
+// [PacketTypeAuthReq][password] exchange.
+const (
+	MinProtocolVersion byte = 1
+	ProtocolVersion    byte = 1
+)
+
+// Capability bits exchanged in the hello; the session uses the intersection
+const (
+	CapNone         uint32 = 0
+	CapBatching     uint32 = 1 << 0 // Peer accepts PacketTypeDataBatch
+	CapCompressZstd uint32 = 1 << 1 // Peer accepts zstd-compressed data packets
+	CapPeerToPeer   uint32 = 1 << 2 // Client can set up direct links to other clients
+)
+
+// Tunnel mode values carried in the server config and legacy auth response
+const (
+	RouteModeFull  byte = 0x00 // Client replaces its default route
+	RouteModeSplit byte = 0x01 // Client only routes the pushed CIDRs through the TUN
+)
+
+// Defaults applied when the server config omits an option
+const (
+	DefaultPrefixLen = 24
+	DefaultMTU       = 1400
+	DefaultKeepalive = 30 * time.Second
+)
+
+// NegotiateVersion picks the highest version both sides speak
+func NegotiateVersion(peerVersion byte) (byte, bool) {
+	if peerVersion < MinProtocolVersion {
+		return 0, false
+	}
+	if peerVersion > ProtocolVersion {
+		return ProtocolVersion, true
+	}
+	return peerVersion, true
+}
+
+// SupportsVersion reports whether version is within the supported range
+func SupportsVersion(version byte) bool {
+	return version >= MinProtocolVersion && version <= ProtocolVersion
+}
+
+// ClientHello is the versioned auth request sent by clients
+type ClientHello struct {
+	Version      byte
+	Capabilities uint32
+	Username     string // Optional; the client's DNS name on servers that run a resolver
+	Password     string
+	Subnets      []net.IPNet // Subnets the client routes to, when it is a site-to-site gateway
+	ResumeToken  []byte      // Token of an earlier session to resume, e.g. on another cluster node
+}
+
+// EncodeClientHello returns [PacketTypeClientHello][version][TLV options...]
+func EncodeClientHello(hello *ClientHello) []byte {
+	packet := []byte{byte(PacketTypeClientHello), hello.Version}
+	packet = appendUint32Option(packet, OptCapabilities, hello.Capabilities)
+	if hello.Username != "" {
+		packet = AppendOption(packet, OptUsername, []byte(hello.Username))
+	}
+	packet = AppendOption(packet, OptPassword, []byte(hello.Password))
+	for _, subnet := range hello.Subnets {
+		// Subnets are validated when the client loads its config
+		if value, err := encodeRoute(subnet); err == nil {
+			packet = AppendOption(packet, OptSubnet, value)
+		}
+	}
+	if len(hello.ResumeToken) > 0 {
+		packet = AppendOption(packet, OptSessionToken, hello.ResumeToken)
+	}
+	return packet
+}
+
+// DecodeClientHello parses the payload of a PacketTypeClientHello message
+func DecodeClientHello(payload []byte) (*ClientHello, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("missing protocol version")
+	}
+
+	hello := &ClientHello{Version: payload[0]}
+	options, err := ParseOptions(payload[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range options {
+		switch opt.Type {
+		case OptCapabilities:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid capabilities length %d", len(opt.Value))
+			}
+			hello.Capabilities = binary.BigEndian.Uint32(opt.Value)
+		case OptUsername:
+			hello.Username = string(opt.Value)
+		case OptPassword:
+			hello.Password = string(opt.Value)
+		case OptSubnet:
+			subnet, err := decodeRoute(opt.Value)
+			if err != nil {
+				return nil, err
+			}
+			hello.Subnets = append(hello.Subnets, subnet)
+		case OptSessionToken:
+			hello.ResumeToken = append([]byte(nil), opt.Value...)
+		}
+	}
+	return hello, nil
+}
+
+// SessionConfig holds the session parameters the server pushes on a successful hello
+type SessionConfig struct {
+	Version       byte
+	Capabilities  uint32
+	AssignedIP    net.IP
+	PrefixLen     int
+	MTU           int
+	DNSServers    []net.IP
+	SearchDomains []string
+	SplitTunnel   bool
+	Routes        []net.IPNet
+	Keepalive     time.Duration
+	SessionToken  []byte
+}
+
+// EncodeServerConfig returns [PacketTypeServerConfig][version][TLV options...]
+func EncodeServerConfig(cfg *SessionConfig) ([]byte, error) {
+	ip4 := cfg.AssignedIP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("invalid assigned IP %v", cfg.AssignedIP)
+	}
+	if cfg.PrefixLen < 0 || cfg.PrefixLen > 32 {
+		return nil, fmt.Errorf("invalid prefix length %d", cfg.PrefixLen)
+	}
+	if cfg.MTU < 0 || cfg.MTU > 0xFFFF {
+		return nil, fmt.Errorf("invalid MTU %d", cfg.MTU)
+	}
+	keepalive := cfg.Keepalive / time.Second
+	if keepalive < 0 || keepalive > 0xFFFF {
+		return nil, fmt.Errorf("invalid keep-alive interval %v", cfg.Keepalive)
+	}
+
+	packet := []byte{byte(PacketTypeServerConfig), cfg.Version}
+	packet = appendUint32Option(packet, OptCapabilities, cfg.Capabilities)
+	packet = AppendOption(packet, OptAssignedIP, ip4)
+	packet = AppendOption(packet, OptPrefixLen, []byte{byte(cfg.PrefixLen)})
+	packet = appendUint16Option(packet, OptMTU, uint16(cfg.MTU))
+
+	for _, ip := range cfg.DNSServers {
+		dns4 := ip.To4()
+		if dns4 == nil {
+			return nil, fmt.Errorf("invalid DNS server %v", ip)
+		}
+		packet = AppendOption(packet, OptDNSServer, dns4)
+	}
+
+	for _, d := range cfg.SearchDomains {
+		if d == "" || len(d) > 255 {
+			return nil, fmt.Errorf("invalid search domain %q", d)
+		}
+		packet = AppendOption(packet, OptSearchDomain, []byte(d))
+	}
+
+	if cfg.SplitTunnel {
+		packet = AppendOption(packet, OptTunnelMode, []byte{RouteModeSplit})
+		for _, route := range cfg.Routes {
+			value, err := encodeRoute(route)
+			if err != nil {
+				return nil, err
+			}
+			packet = AppendOption(packet, OptRoute, value)
+		}
+	} else {
+		packet = AppendOption(packet, OptTunnelMode, []byte{RouteModeFull})
+	}
+
+	packet = appendUint16Option(packet, OptKeepalive, uint16(keepalive))
+
+	if len(cfg.SessionToken) > 0 {
+		packet = AppendOption(packet, OptSessionToken, cfg.SessionToken)
+	}
+
+	return packet, nil
+}
+
+// DecodeServerConfig parses the payload of a PacketTypeServerConfig message.
+// Options missing from the message keep their defaults; unknown options are skipped.
+func DecodeServerConfig(payload []byte) (*SessionConfig, error) {
+	if len(payload) < 1 {
+		return nil, fmt.Errorf("missing protocol version")
+	}
+
+	cfg := &SessionConfig{
+		Version:   payload[0],
+		PrefixLen: DefaultPrefixLen,
+		MTU:       DefaultMTU,
+		Keepalive: DefaultKeepalive,
+	}
+
+	options, err := ParseOptions(payload[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range options {
+		switch opt.Type {
+		case OptCapabilities:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid capabilities length %d", len(opt.Value))
+			}
+			cfg.Capabilities = binary.BigEndian.Uint32(opt.Value)
+		case OptAssignedIP:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid assigned IP length %d", len(opt.Value))
+			}
+			cfg.AssignedIP = net.IPv4(opt.Value[0], opt.Value[1], opt.Value[2], opt.Value[3])
+		case OptPrefixLen:
+			if len(opt.Value) != 1 || opt.Value[0] > 32 {
+				return nil, fmt.Errorf("invalid prefix length")
+			}
+			cfg.PrefixLen = int(opt.Value[0])
+		case OptMTU:
+			if len(opt.Value) != 2 {
+				return nil, fmt.Errorf("invalid MTU length %d", len(opt.Value))
+			}
+			cfg.MTU = int(binary.BigEndian.Uint16(opt.Value))
+		case OptDNSServer:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid DNS server length %d", len(opt.Value))
+			}
+			cfg.DNSServers = append(cfg.DNSServers, net.IPv4(opt.Value[0], opt.Value[1], opt.Value[2], opt.Value[3]))
+		case OptSearchDomain:
+			if len(opt.Value) == 0 || len(opt.Value) > 255 {
+				return nil, fmt.Errorf("invalid search domain length %d", len(opt.Value))
+			}
+			cfg.SearchDomains = append(cfg.SearchDomains, string(opt.Value))
+		case OptTunnelMode:
+			if len(opt.Value) != 1 {
+				return nil, fmt.Errorf("invalid tunnel mode length %d", len(opt.Value))
+			}
+			cfg.SplitTunnel = opt.Value[0] == RouteModeSplit
+		case OptRoute:
+			route, err := decodeRoute(opt.Value)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Routes = append(cfg.Routes, route)
+		case OptKeepalive:
+			if len(opt.Value) != 2 {
+				return nil, fmt.Errorf("invalid keep-alive length %d", len(opt.Value))
+			}
+			if seconds := binary.BigEndian.Uint16(opt.Value); seconds > 0 {
+				cfg.Keepalive = time.Duration(seconds) * time.Second
+			}
+		case OptSessionToken:
+			cfg.SessionToken = append([]byte(nil), opt.Value...)
+		}
+	}
+
+	if cfg.AssignedIP == nil {
+		return nil, fmt.Errorf("server config is missing the assigned IP")
+	}
+
+	return cfg, nil
+}
+
+// EncodeVersionReject returns [PacketTypeVersionReject][min version][max version]
+func EncodeVersionReject(minVersion, maxVersion byte) []byte {
+	return []byte{byte(PacketTypeVersionReject), minVersion, maxVersion}
+}
+
+// DecodeVersionReject parses the payload of a PacketTypeVersionReject message
+func DecodeVersionReject(payload []byte) (byte, byte, error) {
+	if len(payload) < 2 {
+		return 0, 0, fmt.Errorf("version reject too short: %d bytes", len(payload))
+	}
+	return payload[0], payload[1], nil
+}
+
+// encodeRoute returns [4 byte network][prefix length]
+func encodeRoute(route net.IPNet) ([]byte, error) {
+	ip4 := route.IP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("invalid IPv4 route %v", route.String())
+	}
+	ones, bits := route.Mask.Size()
+	if bits != 32 {
+		return nil, fmt.Errorf("invalid IPv4 route mask %v", route.String())
+	}
+	value := make([]byte, 5)
+	copy(value, ip4.Mask(route.Mask))
+	value[4] = byte(ones)
+	return value, nil
+}
+
+// decodeRoute parses [4 byte network][prefix length]
+func decodeRoute(value []byte) (net.IPNet, error) {
+	if len(value) != 5 || value[4] > 32 {
+		return net.IPNet{}, fmt.Errorf("invalid route")
+	}
+	mask := net.CIDRMask(int(value[4]), 32)
+	ip := net.IPv4(value[0], value[1], value[2], value[3]).To4().Mask(mask)
+	return net.IPNet{IP: ip, Mask: mask}, nil
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+// KnockSize is the length of a knock datagram
+const KnockSize = 32
+
+// knockMACSize is the length of the truncated HMAC at the end of a knock
+const knockMACSize = 16
+
+// NewKnock returns the datagram a client sends before its first DTLS
+// handshake message when the server requires a knock:
+// [8 byte unix time][8 byte random nonce][16 byte HMAC-SHA256 of both].
+// Without the key it is indistinguishable from random bytes.
+func NewKnock(key []byte, now time.Time) ([]byte, error) {
+	knock := make([]byte, KnockSize)
+	binary.BigEndian.PutUint64(knock, uint64(now.Unix()))
+	if _, err := rand.Read(knock[8:16]); err != nil {
+		return nil, err
+	}
+	copy(knock[16:], knockMAC(key, knock[:16]))
+	return knock, nil
+}
+
+// VerifyKnock checks a knock's MAC and that its time is within window of now.
+// It returns the nonce so the caller can reject replays.
+func VerifyKnock(key []byte, knock []byte, now time.Time, window time.Duration) (uint64, bool) {
+	if len(knock) != KnockSize || !hmac.Equal(knock[16:], knockMAC(key, knock[:16])) {
+		return 0, false
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint64(knock)), 0)
+	if sent.Before(now.Add(-window)) || sent.After(now.Add(window)) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(knock[8:16]), true
+}
+
+func knockMAC(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:knockMACSize]
+}
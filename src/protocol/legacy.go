@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+)
+
+// AuthSuccess is the legacy (version 0) auth success response:
+// [PacketTypeAuthRespPass][4 byte IPv4 address][DNS section][routing section].
+// Old clients only read the address; the trailing sections are optional.
+type AuthSuccess struct {
+	AssignedIP    net.IP
+	DNSServers    []net.IP
+	SearchDomains []string
+	SplitTunnel   bool
+	Routes        []net.IPNet
+}
+
+// EncodeAuthSuccess encodes the legacy auth success response
+func EncodeAuthSuccess(resp *AuthSuccess) ([]byte, error) {
+	ip4 := resp.AssignedIP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("invalid assigned IP %v", resp.AssignedIP)
+	}
+	if len(resp.DNSServers) > 255 || len(resp.SearchDomains) > 255 || len(resp.Routes) > 255 {
+		return nil, fmt.Errorf("too many DNS servers, search domains or routes")
+	}
+
+	packet := append([]byte{byte(PacketTypeAuthRespPass)}, ip4...)
+
+	// DNS section: [server count][4 bytes per server][domain count]([length][domain])...
+	packet = append(packet, byte(len(resp.DNSServers)))
+	for _, ip := range resp.DNSServers {
+		dns4 := ip.To4()
+		if dns4 == nil {
+			return nil, fmt.Errorf("invalid DNS server %v", ip)
+		}
+		packet = append(packet, dns4...)
+	}
+	packet = append(packet, byte(len(resp.SearchDomains)))
+	for _, d := range resp.SearchDomains {
+		if d == "" || len(d) > 255 {
+			return nil, fmt.Errorf("invalid search domain %q", d)
+		}
+		packet = append(packet, byte(len(d)))
+		packet = append(packet, d...)
+	}
+
+	// Routing section: [tunnel mode][route count]([4 byte network][prefix length])...
+	// Full tunnel replaces the default route, so no route list is sent
+	if !resp.SplitTunnel {
+		return append(packet, RouteModeFull, 0), nil
+	}
+	packet = append(packet, RouteModeSplit, byte(len(resp.Routes)))
+	for _, route := range resp.Routes {
+		value, err := encodeRoute(route)
+		if err != nil {
+			return nil, err
+		}
+		packet = append(packet, value...)
+	}
+
+	return packet, nil
+}
+
+// DecodeAuthSuccess parses the payload of a legacy PacketTypeAuthRespPass message
+func DecodeAuthSuccess(payload []byte) (*AuthSuccess, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("auth response too short: %d bytes", len(payload))
+	}
+
+	resp := &AuthSuccess{AssignedIP: net.IPv4(payload[0], payload[1], payload[2], payload[3])}
+	data := payload[4:]
+	if len(data) == 0 {
+		// Server predates DNS and route push
+		return resp, nil
+	}
+
+	serverCount := int(data[0])
+	offset := 1
+	if len(data) < offset+serverCount*4 {
+		return nil, fmt.Errorf("truncated DNS server list")
+	}
+	for i := 0; i < serverCount; i++ {
+		resp.DNSServers = append(resp.DNSServers, net.IPv4(data[offset], data[offset+1], data[offset+2], data[offset+3]))
+		offset += 4
+	}
+
+	if len(data) < offset+1 {
+		return nil, fmt.Errorf("missing search domain count")
+	}
+	domainCount := int(data[offset])
+	offset++
+	for i := 0; i < domainCount; i++ {
+		if len(data) < offset+1 {
+			return nil, fmt.Errorf("truncated search domain list")
+		}
+		length := int(data[offset])
+		offset++
+		if length == 0 || len(data) < offset+length {
+			return nil, fmt.Errorf("truncated search domain")
+		}
+		resp.SearchDomains = append(resp.SearchDomains, string(data[offset:offset+length]))
+		offset += length
+	}
+
+	if len(data) == offset {
+		// Server predates route push
+		return resp, nil
+	}
+	if len(data) < offset+2 {
+		return nil, fmt.Errorf("truncated routing policy")
+	}
+	resp.SplitTunnel = data[offset] == RouteModeSplit
+	routeCount := int(data[offset+1])
+	offset += 2
+	if len(data) < offset+routeCount*5 {
+		return nil, fmt.Errorf("truncated route list")
+	}
+	for i := 0; i < routeCount; i++ {
+		route, err := decodeRoute(data[offset : offset+5])
+		if err != nil {
+			return nil, err
+		}
+		resp.Routes = append(resp.Routes, route)
+		offset += 5
+	}
+
+	return resp, nil
+}
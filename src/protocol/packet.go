@@ -0,0 +1,127 @@
+// Package protocol defines the Mycelium VPN wire format shared by the server
+// and the clients: packet types, framing and the encode/decode functions for
+// every message.
+//
+// Every message is a single DTLS record of the form [PacketType][payload].
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// PacketType identifies the type of VPN packet
+type PacketType byte
+
+const (
+	PacketTypeAuthReq        PacketType = 0x01 // Authentication request (legacy)
+	PacketTypeAuthRespPass   PacketType = 0x02 // Authentication response - success (legacy)
+	PacketTypeData           PacketType = 0x03 // VPN data packet
+	PacketTypePing           PacketType = 0x04 // Keep-alive ping
+	PacketTypePong           PacketType = 0x05 // Keep-alive pong
+	PacketTypeDisc           PacketType = 0x06 // Disconnect
+	PacketTypeAuthRespFail   PacketType = 0x07 // Authentication response - failure
+	PacketTypeAskForIP       PacketType = 0x08 // Request for IP address
+	PacketTypeIPRes          PacketType = 0x09 // IP address response
+	PacketTypeClientHello    PacketType = 0x0A // Versioned authentication request
+	PacketTypeServerConfig   PacketType = 0x0B // Versioned authentication response - success
+	PacketTypeVersionReject  PacketType = 0x0C // Versioned authentication response - unsupported version
+	PacketTypeDataBatch      PacketType = 0x0D // Several length-prefixed VPN data packets (CapBatching)
+	PacketTypeDataCompressed PacketType = 0x0E // zstd-compressed VPN data packet (CapCompressZstd)
+	PacketTypePeerRequest    PacketType = 0x0F // Client asks for a direct path to another client (CapPeerToPeer)
+	PacketTypePeerInvite     PacketType = 0x10 // Server asks a client to request a path back to a peer
+	PacketTypePeerInfo       PacketType = 0x11 // Server hands both peers each other's endpoints and a link key
+	PacketTypeClusterState   PacketType = 0x12 // Leases a cluster node holds, sent to the other nodes
+)
+
+// HeaderSize is the number of bytes in front of every payload
+const HeaderSize = 1
+
+var packetTypeNames = map[PacketType]string{
+	PacketTypeAuthReq:        "AuthReq",
+	PacketTypeAuthRespPass:   "AuthRespPass",
+	PacketTypeData:           "Data",
+	PacketTypePing:           "Ping",
+	PacketTypePong:           "Pong",
+	PacketTypeDisc:           "Disc",
+	PacketTypeAuthRespFail:   "AuthRespFail",
+	PacketTypeAskForIP:       "AskForIP",
+	PacketTypeIPRes:          "IPRes",
+	PacketTypeClientHello:    "ClientHello",
+	PacketTypeServerConfig:   "ServerConfig",
+	PacketTypeVersionReject:  "VersionReject",
+	PacketTypeDataBatch:      "DataBatch",
+	PacketTypeDataCompressed: "DataCompressed",
+	PacketTypePeerRequest:    "PeerRequest",
+	PacketTypePeerInvite:     "PeerInvite",
+	PacketTypePeerInfo:       "PeerInfo",
+	PacketTypeClusterState:   "ClusterState",
+}
+
+func (t PacketType) String() string {
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
+
+// ErrEmptyPacket is returned when a packet has no type byte
+var ErrEmptyPacket = errors.New("empty packet")
+
+// Decode splits a packet into its type and payload. The payload aliases packet.
+func Decode(packet []byte) (PacketType, []byte, error) {
+	if len(packet) < HeaderSize {
+		return 0, nil, ErrEmptyPacket
+	}
+	return PacketType(packet[0]), packet[HeaderSize:], nil
+}
+
+// encodeEmpty returns a message that carries no payload
+func encodeEmpty(t PacketType) []byte {
+	return []byte{byte(t)}
+}
+
+// EncodeData wraps an IP packet in a data message
+func EncodeData(ipPacket []byte) []byte {
+	packet := make([]byte, HeaderSize+len(ipPacket))
+	packet[0] = byte(PacketTypeData)
+	copy(packet[HeaderSize:], ipPacket)
+	return packet
+}
+
+// EncodePing returns a keep-alive ping
+func EncodePing() []byte { return encodeEmpty(PacketTypePing) }
+
+// EncodePong returns a keep-alive pong
+func EncodePong() []byte { return encodeEmpty(PacketTypePong) }
+
+// EncodeAskForIP returns a request for the client's assigned address
+func EncodeAskForIP() []byte { return encodeEmpty(PacketTypeAskForIP) }
+
+// EncodeIPResponse returns [PacketTypeIPRes][4 byte IPv4 address]
+func EncodeIPResponse(ip net.IP) ([]byte, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %v", ip)
+	}
+	return append([]byte{byte(PacketTypeIPRes)}, ip4...), nil
+}
+
+// DecodeIPResponse parses the payload of a PacketTypeIPRes message
+func DecodeIPResponse(payload []byte) (net.IP, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("IP response too short: %d bytes", len(payload))
+	}
+	return net.IPv4(payload[0], payload[1], payload[2], payload[3]), nil
+}
+
+// EncodeAuthRequest returns the legacy [PacketTypeAuthReq][password] request
+func EncodeAuthRequest(password string) []byte {
+	return append([]byte{byte(PacketTypeAuthReq)}, password...)
+}
+
+// DecodeAuthRequest parses the payload of a legacy PacketTypeAuthReq message
+func DecodeAuthRequest(payload []byte) string {
+	return string(payload)
+}
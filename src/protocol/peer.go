@@ -0,0 +1,175 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// PeerNonceSize is the length of the nonce tying a peer request to its probe
+const PeerNonceSize = 16
+
+// peerProbeMagic starts every rendezvous probe
+var peerProbeMagic = []byte("MYCP")
+
+// PeerProbeSize is the length of a rendezvous probe datagram
+const PeerProbeSize = 4 + PeerNonceSize
+
+// PeerRequest asks the server for a direct path to the client at PeerIP. The
+// client sends Nonce from its peer socket to the server's rendezvous port, so
+// the server learns the socket's public endpoint; Endpoints are the socket's
+// local addresses, for peers behind the same NAT.
+type PeerRequest struct {
+	PeerIP    net.IP
+	Nonce     []byte
+	Endpoints []netip.AddrPort
+}
+
+// PeerInfo tells a client how to reach PeerIP directly: the endpoints to
+// punch, the peer's public one first, and the key both ends use for the link
+type PeerInfo struct {
+	PeerIP    net.IP
+	Endpoints []netip.AddrPort
+	Key       []byte
+}
+
+// EncodePeerRequest returns [PacketTypePeerRequest][TLV options...]
+func EncodePeerRequest(req *PeerRequest) ([]byte, error) {
+	ip4 := req.PeerIP.To4()
+	if ip4 == nil || len(req.Nonce) != PeerNonceSize {
+		return nil, fmt.Errorf("invalid peer request for %v", req.PeerIP)
+	}
+	packet := []byte{byte(PacketTypePeerRequest)}
+	packet = AppendOption(packet, OptPeerIP, ip4)
+	packet = AppendOption(packet, OptPeerNonce, req.Nonce)
+	return appendEndpoints(packet, req.Endpoints), nil
+}
+
+// DecodePeerRequest parses the payload of a PacketTypePeerRequest message
+func DecodePeerRequest(payload []byte) (*PeerRequest, error) {
+	options, err := ParseOptions(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &PeerRequest{}
+	for _, opt := range options {
+		switch opt.Type {
+		case OptPeerIP:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid peer IP length %d", len(opt.Value))
+			}
+			req.PeerIP = net.IPv4(opt.Value[0], opt.Value[1], opt.Value[2], opt.Value[3]).To4()
+		case OptPeerNonce:
+			if len(opt.Value) != PeerNonceSize {
+				return nil, fmt.Errorf("invalid peer nonce length %d", len(opt.Value))
+			}
+			req.Nonce = append([]byte(nil), opt.Value...)
+		case OptPeerEndpoint:
+			endpoint, err := decodeEndpoint(opt.Value)
+			if err != nil {
+				return nil, err
+			}
+			req.Endpoints = append(req.Endpoints, endpoint)
+		}
+	}
+	if req.PeerIP == nil || req.Nonce == nil {
+		return nil, fmt.Errorf("peer request without peer IP or nonce")
+	}
+	return req, nil
+}
+
+// EncodePeerInvite returns [PacketTypePeerInvite][4 byte peer IP]
+func EncodePeerInvite(peerIP net.IP) ([]byte, error) {
+	ip4 := peerIP.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %v", peerIP)
+	}
+	return append([]byte{byte(PacketTypePeerInvite)}, ip4...), nil
+}
+
+// DecodePeerInvite parses the payload of a PacketTypePeerInvite message
+func DecodePeerInvite(payload []byte) (net.IP, error) {
+	if len(payload) < 4 {
+		return nil, fmt.Errorf("peer invite too short: %d bytes", len(payload))
+	}
+	return net.IPv4(payload[0], payload[1], payload[2], payload[3]).To4(), nil
+}
+
+// EncodePeerInfo returns [PacketTypePeerInfo][TLV options...]
+func EncodePeerInfo(info *PeerInfo) ([]byte, error) {
+	ip4 := info.PeerIP.To4()
+	if ip4 == nil || len(info.Key) == 0 {
+		return nil, fmt.Errorf("invalid peer info for %v", info.PeerIP)
+	}
+	packet := []byte{byte(PacketTypePeerInfo)}
+	packet = AppendOption(packet, OptPeerIP, ip4)
+	packet = AppendOption(packet, OptPeerKey, info.Key)
+	return appendEndpoints(packet, info.Endpoints), nil
+}
+
+// DecodePeerInfo parses the payload of a PacketTypePeerInfo message
+func DecodePeerInfo(payload []byte) (*PeerInfo, error) {
+	options, err := ParseOptions(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &PeerInfo{}
+	for _, opt := range options {
+		switch opt.Type {
+		case OptPeerIP:
+			if len(opt.Value) != 4 {
+				return nil, fmt.Errorf("invalid peer IP length %d", len(opt.Value))
+			}
+			info.PeerIP = net.IPv4(opt.Value[0], opt.Value[1], opt.Value[2], opt.Value[3]).To4()
+		case OptPeerKey:
+			info.Key = append([]byte(nil), opt.Value...)
+		case OptPeerEndpoint:
+			endpoint, err := decodeEndpoint(opt.Value)
+			if err != nil {
+				return nil, err
+			}
+			info.Endpoints = append(info.Endpoints, endpoint)
+		}
+	}
+	if info.PeerIP == nil || len(info.Key) == 0 {
+		return nil, fmt.Errorf("peer info without peer IP or key")
+	}
+	return info, nil
+}
+
+// appendEndpoints appends the IPv4 endpoints as OptPeerEndpoint options
+func appendEndpoints(packet []byte, endpoints []netip.AddrPort) []byte {
+	for _, endpoint := range endpoints {
+		if !endpoint.Addr().Unmap().Is4() {
+			continue
+		}
+		value := endpoint.Addr().Unmap().As4()
+		packet = AppendOption(packet, OptPeerEndpoint, binary.BigEndian.AppendUint16(value[:], endpoint.Port()))
+	}
+	return packet
+}
+
+// decodeEndpoint parses [4 byte IPv4 address][uint16 port]
+func decodeEndpoint(value []byte) (netip.AddrPort, error) {
+	if len(value) != 6 {
+		return netip.AddrPort{}, fmt.Errorf("invalid peer endpoint length %d", len(value))
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(value[:4])), binary.BigEndian.Uint16(value[4:])), nil
+}
+
+// EncodePeerProbe returns the rendezvous probe datagram carrying nonce
+func EncodePeerProbe(nonce []byte) []byte {
+	return append(append(make([]byte, 0, PeerProbeSize), peerProbeMagic...), nonce...)
+}
+
+// DecodePeerProbe returns the nonce of a rendezvous probe datagram
+func DecodePeerProbe(datagram []byte) ([]byte, bool) {
+	if len(datagram) != PeerProbeSize || !bytes.HasPrefix(datagram, peerProbeMagic) {
+		return nil, false
+	}
+	return datagram[len(peerProbeMagic):], true
+}
@@ -0,0 +1,766 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+)
+
+func mustCIDR(t *testing.T, s string) net.IPNet {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(%q): %v", s, err)
+	}
+	return *ipNet
+}
+
+func TestDecodeEmpty(t *testing.T) {
+	if _, _, err := Decode(nil); err != ErrEmptyPacket {
+		t.Fatalf("Decode(nil) error = %v, want ErrEmptyPacket", err)
+	}
+}
+
+func TestControlMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   PacketType
+	}{
+		{"ping", EncodePing(), PacketTypePing},
+		{"pong", EncodePong(), PacketTypePong},
+		{"ask for ip", EncodeAskForIP(), PacketTypeAskForIP},
+	}
+
+	for _, tt := range tests {
+		packetType, payload, err := Decode(tt.packet)
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", tt.name, err)
+		}
+		if packetType != tt.want || len(payload) != 0 {
+			t.Errorf("%s: got type %s with %d byte payload, want %s with none", tt.name, packetType, len(payload), tt.want)
+		}
+	}
+}
+
+func TestReasonRoundTrip(t *testing.T) {
+	packetType, payload, _ := Decode(EncodeAuthFail(ReasonPoolExhausted, "no free address"))
+	if packetType != PacketTypeAuthRespFail {
+		t.Fatalf("type = %s, want AuthRespFail", packetType)
+	}
+	if reason, msg := DecodeAuthFail(payload); reason != ReasonPoolExhausted || msg != "no free address" {
+		t.Fatalf("got %s %q", reason, msg)
+	}
+
+	packetType, payload, _ = Decode(EncodeDisconnect(ReasonServerShutdown, ""))
+	if packetType != PacketTypeDisc {
+		t.Fatalf("type = %s, want Disc", packetType)
+	}
+	if reason, msg := DecodeDisconnect(payload); reason != ReasonServerShutdown || msg != "" {
+		t.Fatalf("got %s %q", reason, msg)
+	}
+
+	// Older peers send no payload
+	if reason, _ := DecodeDisconnect(nil); reason != ReasonUnspecified {
+		t.Fatalf("empty disconnect decoded as %s", reason)
+	}
+}
+
+func TestReasonExitCode(t *testing.T) {
+	for r := range reasonNames {
+		code, ok := r.ExitCode()
+		got, back := ReasonFromExitCode(code)
+		if !ok || !back || got != r {
+			t.Errorf("exit code %d for %s maps back to %s, %v", code, r, got, back)
+		}
+	}
+	if _, ok := ReasonFromExitCode(1); ok {
+		t.Errorf("generic exit code 1 mapped to a reason")
+	}
+
+	// Exit statuses stop at 255, so reasons past it have no code
+	if code, ok := Reason(0xF5).ExitCode(); !ok || code != 255 {
+		t.Errorf("reason 0xf5 exit code = %d, %v; want 255", code, ok)
+	}
+	if code, ok := Reason(0xF6).ExitCode(); ok {
+		t.Errorf("reason 0xf6 has exit code %d, which wraps", code)
+	}
+	if r, ok := ReasonFromExitCode(256); ok {
+		t.Errorf("exit code 256 mapped to %s", r)
+	}
+}
+
+func TestDataRoundTrip(t *testing.T) {
+	ipPacket := bytes.Repeat([]byte{0x45, 0x00, 0xab}, 100)
+
+	packetType, payload, err := Decode(EncodeData(ipPacket))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if packetType != PacketTypeData {
+		t.Fatalf("type = %s, want Data", packetType)
+	}
+	if !bytes.Equal(payload, ipPacket) {
+		t.Fatalf("payload mismatch")
+	}
+}
+
+func TestIPResponseRoundTrip(t *testing.T) {
+	ip := net.IPv4(10, 8, 0, 42)
+
+	packet, err := EncodeIPResponse(ip)
+	if err != nil {
+		t.Fatalf("EncodeIPResponse: %v", err)
+	}
+	packetType, payload, _ := Decode(packet)
+	if packetType != PacketTypeIPRes {
+		t.Fatalf("type = %s, want IPRes", packetType)
+	}
+	got, err := DecodeIPResponse(payload)
+	if err != nil {
+		t.Fatalf("DecodeIPResponse: %v", err)
+	}
+	if !got.Equal(ip) {
+		t.Fatalf("got %v, want %v", got, ip)
+	}
+
+	if _, err := EncodeIPResponse(net.ParseIP("fd00::1")); err == nil {
+		t.Fatalf("EncodeIPResponse accepted an IPv6 address")
+	}
+}
+
+func TestAuthRequestRoundTrip(t *testing.T) {
+	packetType, payload, _ := Decode(EncodeAuthRequest("VPN1234"))
+	if packetType != PacketTypeAuthReq {
+		t.Fatalf("type = %s, want AuthReq", packetType)
+	}
+	if got := DecodeAuthRequest(payload); got != "VPN1234" {
+		t.Fatalf("password = %q, want VPN1234", got)
+	}
+}
+
+func TestAuthSuccessRoundTrip(t *testing.T) {
+	tests := []*AuthSuccess{
+		{AssignedIP: net.IPv4(10, 8, 0, 10).To4()},
+		{
+			AssignedIP:    net.IPv4(10, 8, 0, 11).To4(),
+			DNSServers:    []net.IP{net.IPv4(1, 1, 1, 1).To4(), net.IPv4(8, 8, 8, 8).To4()},
+			SearchDomains: []string{"corp.example", "lab.example"},
+			SplitTunnel:   true,
+			Routes:        []net.IPNet{mustCIDR(t, "192.168.10.0/24"), mustCIDR(t, "10.0.0.0/8")},
+		},
+	}
+
+	for _, want := range tests {
+		packet, err := EncodeAuthSuccess(want)
+		if err != nil {
+			t.Fatalf("EncodeAuthSuccess: %v", err)
+		}
+		packetType, payload, _ := Decode(packet)
+		if packetType != PacketTypeAuthRespPass {
+			t.Fatalf("type = %s, want AuthRespPass", packetType)
+		}
+		got, err := DecodeAuthSuccess(payload)
+		if err != nil {
+			t.Fatalf("DecodeAuthSuccess: %v", err)
+		}
+		got.AssignedIP = got.AssignedIP.To4()
+		for i := range got.DNSServers {
+			got.DNSServers[i] = got.DNSServers[i].To4()
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round trip mismatch:\n got  %+v\n want %+v", got, want)
+		}
+	}
+}
+
+func TestAuthSuccessLegacyIPOnly(t *testing.T) {
+	// Servers that predate DNS push only send the address
+	got, err := DecodeAuthSuccess([]byte{10, 8, 0, 7})
+	if err != nil {
+		t.Fatalf("DecodeAuthSuccess: %v", err)
+	}
+	if !got.AssignedIP.Equal(net.IPv4(10, 8, 0, 7)) || len(got.DNSServers) != 0 || got.SplitTunnel {
+		t.Fatalf("unexpected result %+v", got)
+	}
+}
+
+func TestClientHelloRoundTrip(t *testing.T) {
+	want := &ClientHello{
+		Version:      ProtocolVersion,
+		Capabilities: 0xdeadbeef,
+		Username:     "alice",
+		Password:     "s3cret",
+		Subnets:      []net.IPNet{{IP: net.IPv4(192, 168, 10, 0).To4(), Mask: net.CIDRMask(24, 32)}},
+		ResumeToken:  []byte("0123456789abcdef"),
+	}
+
+	packetType, payload, _ := Decode(EncodeClientHello(want))
+	if packetType != PacketTypeClientHello {
+		t.Fatalf("type = %s, want ClientHello", packetType)
+	}
+	got, err := DecodeClientHello(payload)
+	if err != nil {
+		t.Fatalf("DecodeClientHello: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestServerConfigRoundTrip(t *testing.T) {
+	want := &SessionConfig{
+		Version:       ProtocolVersion,
+		Capabilities:  0x3,
+		AssignedIP:    net.IPv4(10, 8, 0, 12).To4(),
+		PrefixLen:     24,
+		MTU:           1380,
+		DNSServers:    []net.IP{net.IPv4(10, 8, 0, 1).To4()},
+		SearchDomains: []string{"vpn.example"},
+		SplitTunnel:   true,
+		Routes:        []net.IPNet{mustCIDR(t, "172.16.0.0/12")},
+		Keepalive:     15 * time.Second,
+		SessionToken:  []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+	}
+
+	packet, err := EncodeServerConfig(want)
+	if err != nil {
+		t.Fatalf("EncodeServerConfig: %v", err)
+	}
+	packetType, payload, _ := Decode(packet)
+	if packetType != PacketTypeServerConfig {
+		t.Fatalf("type = %s, want ServerConfig", packetType)
+	}
+	got, err := DecodeServerConfig(payload)
+	if err != nil {
+		t.Fatalf("DecodeServerConfig: %v", err)
+	}
+	got.AssignedIP = got.AssignedIP.To4()
+	for i := range got.DNSServers {
+		got.DNSServers[i] = got.DNSServers[i].To4()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round trip mismatch:\n got  %+v\n want %+v", got, want)
+	}
+}
+
+func TestServerConfigSkipsUnknownOptions(t *testing.T) {
+	packet, err := EncodeServerConfig(&SessionConfig{Version: ProtocolVersion, AssignedIP: net.IPv4(10, 8, 0, 5)})
+	if err != nil {
+		t.Fatalf("EncodeServerConfig: %v", err)
+	}
+	packet = AppendOption(packet, 0xEE, []byte("from the future"))
+
+	got, err := DecodeServerConfig(packet[HeaderSize:])
+	if err != nil {
+		t.Fatalf("DecodeServerConfig: %v", err)
+	}
+	if !got.AssignedIP.Equal(net.IPv4(10, 8, 0, 5)) {
+		t.Fatalf("assigned IP = %v", got.AssignedIP)
+	}
+}
+
+func TestServerConfigDefaults(t *testing.T) {
+	payload := AppendOption([]byte{ProtocolVersion}, OptAssignedIP, []byte{10, 8, 0, 9})
+
+	got, err := DecodeServerConfig(payload)
+	if err != nil {
+		t.Fatalf("DecodeServerConfig: %v", err)
+	}
+	if got.PrefixLen != DefaultPrefixLen || got.MTU != DefaultMTU || got.Keepalive != DefaultKeepalive {
+		t.Fatalf("defaults not applied: %+v", got)
+	}
+}
+
+func TestServerConfigRequiresAssignedIP(t *testing.T) {
+	if _, err := DecodeServerConfig([]byte{ProtocolVersion}); err == nil {
+		t.Fatalf("DecodeServerConfig accepted a config without an assigned IP")
+	}
+}
+
+func TestParseOptionsTruncated(t *testing.T) {
+	tests := [][]byte{
+		{OptPassword},
+		{OptPassword, 0x00},
+		{OptPassword, 0x00, 0x05, 'a', 'b'},
+	}
+	for _, data := range tests {
+		if _, err := ParseOptions(data); err == nil {
+			t.Errorf("ParseOptions(%v) accepted truncated input", data)
+		}
+	}
+}
+
+func TestVersionRejectRoundTrip(t *testing.T) {
+	packetType, payload, _ := Decode(EncodeVersionReject(1, 3))
+	if packetType != PacketTypeVersionReject {
+		t.Fatalf("type = %s, want VersionReject", packetType)
+	}
+	minVersion, maxVersion, err := DecodeVersionReject(payload)
+	if err != nil {
+		t.Fatalf("DecodeVersionReject: %v", err)
+	}
+	if minVersion != 1 || maxVersion != 3 {
+		t.Fatalf("got %d-%d, want 1-3", minVersion, maxVersion)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if _, ok := NegotiateVersion(0); ok {
+		t.Errorf("version 0 should be rejected")
+	}
+	if v, ok := NegotiateVersion(ProtocolVersion); !ok || v != ProtocolVersion {
+		t.Errorf("NegotiateVersion(%d) = %d, %v", ProtocolVersion, v, ok)
+	}
+	if v, ok := NegotiateVersion(ProtocolVersion + 1); !ok || v != ProtocolVersion {
+		t.Errorf("newer client should be downgraded to %d, got %d, %v", ProtocolVersion, v, ok)
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	packets := [][]byte{
+		bytes.Repeat([]byte{0x45}, 40),
+		bytes.Repeat([]byte{0x46}, 1),
+		bytes.Repeat([]byte{0x47}, 300),
+	}
+
+	batch := StartBatch(nil)
+	for _, p := range packets {
+		if !BatchFits(batch, len(p), 1400) {
+			t.Fatalf("packet of %d bytes should fit", len(p))
+		}
+		batch = AppendBatchPacket(batch, p)
+	}
+	if BatchFits(batch, 1400, 1400) {
+		t.Fatalf("BatchFits allowed exceeding the limit")
+	}
+
+	packetType, payload, _ := Decode(batch)
+	if packetType != PacketTypeDataBatch {
+		t.Fatalf("type = %s, want DataBatch", packetType)
+	}
+	var got [][]byte
+	if err := ForEachBatchPacket(payload, nil, func(p []byte) { got = append(got, p) }); err != nil {
+		t.Fatalf("ForEachBatchPacket: %v", err)
+	}
+	if !reflect.DeepEqual(got, packets) {
+		t.Fatalf("batch round trip mismatch")
+	}
+
+	if err := ForEachBatchPacket(payload[:len(payload)-1], nil, func([]byte) {}); err == nil {
+		t.Fatalf("truncated batch accepted")
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /api/v1/logs?level=info HTTP/1.1\r\n"), 30)
+	var c Compressor
+	var d Decompressor
+
+	record, ok := c.Compress(StartCompressedData(nil), text)
+	if !ok {
+		t.Fatalf("text packet was not compressed")
+	}
+	packetType, payload, _ := Decode(record)
+	if packetType != PacketTypeDataCompressed || len(payload) >= len(text) {
+		t.Fatalf("type %s, %d compressed bytes for %d", packetType, len(payload), len(text))
+	}
+	got, err := d.Decompress(payload)
+	if err != nil || !bytes.Equal(got, text) {
+		t.Fatalf("decompress: %v", err)
+	}
+	if c.Ratio() <= 1 || d.Ratio() <= 1 {
+		t.Fatalf("ratios %.2f/%.2f, want > 1", c.Ratio(), d.Ratio())
+	}
+
+	// Compressed and plain packets share a batch
+	batch := StartBatch(nil)
+	compressed, _ := c.Compress(nil, text)
+	batch = AppendBatchCompressed(batch, compressed)
+	batch = AppendBatchPacket(batch, []byte{0x45, 1, 2})
+	var packets [][]byte
+	err = ForEachBatchPacket(batch[HeaderSize:], &d, func(p []byte) { packets = append(packets, append([]byte(nil), p...)) })
+	if err != nil || len(packets) != 2 || !bytes.Equal(packets[0], text) || len(packets[1]) != 3 {
+		t.Fatalf("compressed batch round trip failed: %v", err)
+	}
+}
+
+func TestCompressSkipsIncompressible(t *testing.T) {
+	random := make([]byte, 1200)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	var c Compressor
+	tried := 0
+	for i := 0; i < 100; i++ {
+		skipping := c.skip > 0
+		if _, ok := c.Compress(nil, random); ok {
+			t.Fatalf("random data compressed")
+		}
+		if !skipping {
+			tried++
+		}
+	}
+	if tried > 10 {
+		t.Fatalf("tried compressing %d of 100 incompressible packets", tried)
+	}
+	if c.Ratio() != 1 {
+		t.Fatalf("ratio %.2f, want 1", c.Ratio())
+	}
+}
+
+func TestDecompressRejectsOversized(t *testing.T) {
+	huge := zstdEncoder().EncodeAll(make([]byte, 2*maxDecompressedSize), nil)
+	var d Decompressor
+	if _, err := d.Decompress(huge); err == nil {
+		t.Fatalf("oversized packet accepted")
+	}
+}
+
+func TestStreamConnFraming(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := NewStreamConn(a), NewStreamConn(b)
+	defer client.Close()
+	defer server.Close()
+
+	messages := [][]byte{EncodePing(), bytes.Repeat([]byte{0x03}, 1401), {}, EncodeDisconnect(ReasonClientShutdown, "bye")}
+	go func() {
+		for _, m := range messages {
+			client.Write(m)
+		}
+		client.Write(make([]byte, 100)) // Too big for the reader below
+		client.Write(EncodePong())
+	}()
+
+	buf := make([]byte, 2048)
+	for i, want := range messages {
+		n, err := server.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], want) {
+			t.Fatalf("message %d: got %x, %v; want %x", i, buf[:n], err, want)
+		}
+	}
+	if _, err := server.Read(buf[:10]); err != io.ErrShortBuffer {
+		t.Fatalf("oversized message: err = %v, want io.ErrShortBuffer", err)
+	}
+	if n, err := server.Read(buf); err != nil || !bytes.Equal(buf[:n], EncodePong()) {
+		t.Fatalf("stream out of sync after an oversized message: %x, %v", buf[:n], err)
+	}
+
+	if _, err := client.Write(make([]byte, MaxStreamMessage+1)); err == nil {
+		t.Fatalf("oversized write accepted")
+	}
+}
+
+func TestWebSocketConnFraming(t *testing.T) {
+	received := make(chan []byte, 4)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conn := NewWebSocketConn(ws)
+		defer conn.Close()
+
+		buf := make([]byte, 1500)
+		for {
+			n, err := conn.Read(buf)
+			if err == io.ErrShortBuffer {
+				received <- nil
+				continue
+			}
+			if err != nil {
+				return
+			}
+			received <- append([]byte(nil), buf[:n]...)
+			conn.Write(buf[:n]) // Echo
+		}
+	}))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client := NewWebSocketConn(ws)
+	defer client.Close()
+
+	// Text messages are ignored, oversized ones reported, the rest arrive intact
+	ws.WriteMessage(websocket.TextMessage, []byte("hello"))
+	client.Write(make([]byte, 2000))
+	data := bytes.Repeat([]byte{0x45}, 1500)
+	client.Write(data)
+
+	if got := <-received; got != nil {
+		t.Fatalf("oversized message delivered as %d bytes", len(got))
+	}
+	if got := <-received; !bytes.Equal(got, data) {
+		t.Fatalf("server got %d bytes, want %d", len(got), len(data))
+	}
+
+	buf := make([]byte, 2048)
+	n, err := client.Read(buf)
+	if err != nil || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("echo: %d bytes, %v", n, err)
+	}
+}
+
+// selfSignedTLS returns a server certificate for localhost
+func selfSignedTLS(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestQUICConnMessages(t *testing.T) {
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{selfSignedTLS(t)}, NextProtos: []string{QUICALPN}}
+	ln, err := quic.ListenAddr("127.0.0.1:0", serverTLS, QUICConfig())
+	if err != nil {
+		t.Fatalf("ListenAddr: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		qc, err := ln.Accept(ctx)
+		if err != nil {
+			return
+		}
+		stream, err := qc.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		conn := NewQUICConn(qc, stream)
+		defer conn.Close()
+
+		buf := make([]byte, MaxStreamMessage)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n]) // Echo
+		}
+	}()
+
+	clientTLS := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{QUICALPN}}
+	qc, err := quic.DialAddr(ctx, ln.Addr().String(), clientTLS, QUICConfig())
+	if err != nil {
+		t.Fatalf("DialAddr: %v", err)
+	}
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("OpenStreamSync: %v", err)
+	}
+	client := NewQUICConn(qc, stream)
+	defer client.Close()
+
+	// Control messages go on the stream, small data as a datagram and data
+	// too large for a datagram falls back to the stream
+	small := append([]byte{byte(PacketTypeData)}, bytes.Repeat([]byte{0x45}, 100)...)
+	large := append([]byte{byte(PacketTypeData)}, bytes.Repeat([]byte{0x45}, 4000)...)
+	buf := make([]byte, MaxStreamMessage)
+	for _, m := range [][]byte{EncodePing(), small, large} {
+		if _, err := client.Write(m); err != nil {
+			t.Fatalf("Write %d bytes: %v", len(m), err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], m) {
+			t.Fatalf("echo of %d bytes: got %d bytes, %v", len(m), n, err)
+		}
+	}
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := client.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read past deadline: err = %v", err)
+	}
+}
+
+func TestKnock(t *testing.T) {
+	key := []byte("knock-key")
+	now := time.Now()
+	knock, err := NewKnock(key, now)
+	if err != nil {
+		t.Fatalf("NewKnock: %v", err)
+	}
+
+	nonce, ok := VerifyKnock(key, knock, now.Add(10*time.Second), 30*time.Second)
+	if !ok {
+		t.Fatalf("valid knock rejected")
+	}
+	if other, _ := NewKnock(key, now); bytes.Equal(other[8:16], knock[8:16]) {
+		t.Fatalf("nonce %x repeated", nonce)
+	}
+
+	if _, ok := VerifyKnock([]byte("other-key"), knock, now, 30*time.Second); ok {
+		t.Fatalf("knock accepted with the wrong key")
+	}
+	if _, ok := VerifyKnock(key, knock, now.Add(time.Minute), 30*time.Second); ok {
+		t.Fatalf("stale knock accepted")
+	}
+	tampered := append([]byte(nil), knock...)
+	tampered[3] ^= 1
+	if _, ok := VerifyKnock(key, tampered, now, 30*time.Second); ok {
+		t.Fatalf("tampered knock accepted")
+	}
+	if _, ok := VerifyKnock(key, knock[:KnockSize-1], now, 30*time.Second); ok {
+		t.Fatalf("short knock accepted")
+	}
+}
+
+func TestPeerMessagesRoundTrip(t *testing.T) {
+	endpoints := []netip.AddrPort{netip.MustParseAddrPort("203.0.113.5:40000"), netip.MustParseAddrPort("192.168.1.20:40000")}
+
+	req := &PeerRequest{PeerIP: net.IPv4(10, 8, 0, 7).To4(), Nonce: bytes.Repeat([]byte{0xab}, PeerNonceSize), Endpoints: endpoints}
+	packet, err := EncodePeerRequest(req)
+	if err != nil {
+		t.Fatalf("EncodePeerRequest: %v", err)
+	}
+	packetType, payload, _ := Decode(packet)
+	if packetType != PacketTypePeerRequest {
+		t.Fatalf("type = %s, want PeerRequest", packetType)
+	}
+	if got, err := DecodePeerRequest(payload); err != nil || !reflect.DeepEqual(got, req) {
+		t.Fatalf("got %+v (%v), want %+v", got, err, req)
+	}
+
+	info := &PeerInfo{PeerIP: net.IPv4(10, 8, 0, 9).To4(), Endpoints: endpoints, Key: []byte("0123456789abcdef0123456789abcdef")}
+	packet, err = EncodePeerInfo(info)
+	if err != nil {
+		t.Fatalf("EncodePeerInfo: %v", err)
+	}
+	_, payload, _ = Decode(packet)
+	if got, err := DecodePeerInfo(payload); err != nil || !reflect.DeepEqual(got, info) {
+		t.Fatalf("got %+v (%v), want %+v", got, err, info)
+	}
+
+	packet, _ = EncodePeerInvite(info.PeerIP)
+	_, payload, _ = Decode(packet)
+	if got, err := DecodePeerInvite(payload); err != nil || !got.Equal(info.PeerIP) {
+		t.Fatalf("invite for %v (%v), want %v", got, err, info.PeerIP)
+	}
+
+	nonce, ok := DecodePeerProbe(EncodePeerProbe(req.Nonce))
+	if !ok || !bytes.Equal(nonce, req.Nonce) {
+		t.Fatalf("probe nonce %x, want %x", nonce, req.Nonce)
+	}
+	if _, ok := DecodePeerProbe([]byte("MYCP")); ok {
+		t.Fatalf("short probe accepted")
+	}
+}
+
+func TestClusterStateRoundTrip(t *testing.T) {
+	want := &ClusterState{
+		NodeID: "node-b",
+		Seq:    1<<40 + 7,
+		Leases: []ClusterLease{
+			{IP: net.IPv4(10, 8, 0, 12).To4(), Token: []byte("0123456789abcdef"), Since: time.Unix(0, 1700000000123456789)},
+			{
+				IP:      net.IPv4(10, 8, 0, 13).To4(),
+				Token:   []byte("fedcba9876543210"),
+				Group:   "office",
+				Name:    "alice",
+				Subnets: []net.IPNet{{IP: net.IPv4(192, 168, 10, 0).To4(), Mask: net.CIDRMask(24, 32)}},
+				Since:   time.Unix(0, 1700000000987654321),
+			},
+		},
+		Parts: 1,
+	}
+
+	messages := EncodeClusterState(want, ClusterStateLimit)
+	if len(messages) != 1 {
+		t.Fatalf("state sent in %d messages, want 1", len(messages))
+	}
+	packetType, payload, _ := Decode(messages[0])
+	if packetType != PacketTypeClusterState {
+		t.Fatalf("type = %s, want ClusterState", packetType)
+	}
+	got, err := DecodeClusterState(payload)
+	if err != nil {
+		t.Fatalf("DecodeClusterState: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := DecodeClusterState(EncodeClusterState(&ClusterState{NodeID: "a", Leases: []ClusterLease{{IP: net.IPv4(10, 8, 0, 2)}}}, ClusterStateLimit)[0][HeaderSize:]); err == nil {
+		t.Fatalf("lease without token accepted")
+	}
+}
+
+func TestClusterStateParts(t *testing.T) {
+	want := &ClusterState{NodeID: "node-a", Seq: 9}
+	for host := 2; host < 252; host++ {
+		want.Leases = append(want.Leases, ClusterLease{
+			IP:    net.IPv4(10, 8, 0, byte(host)).To4(),
+			Token: bytes.Repeat([]byte{byte(host)}, 32),
+			Group: "office",
+			Name:  fmt.Sprintf("client-%d", host),
+			Since: time.Unix(0, int64(host)),
+		})
+	}
+
+	messages := EncodeClusterState(want, ClusterStateLimit)
+	if len(messages) < 2 {
+		t.Fatalf("250 leases sent in %d message", len(messages))
+	}
+	got := &ClusterState{}
+	for i, message := range messages {
+		if len(message) > ClusterStateLimit {
+			t.Fatalf("part %d is %d bytes, over %d", i, len(message), ClusterStateLimit)
+		}
+		part, err := DecodeClusterState(message[HeaderSize:])
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if part.NodeID != want.NodeID || part.Seq != want.Seq || part.Part != i || part.Parts != len(messages) {
+			t.Fatalf("part %d = node %q seq %d part %d/%d", i, part.NodeID, part.Seq, part.Part, part.Parts)
+		}
+		got.Leases = append(got.Leases, part.Leases...)
+	}
+	if !reflect.DeepEqual(got.Leases, want.Leases) {
+		t.Fatalf("leases across parts differ from those sent")
+	}
+
+	// An empty state is still sent, whole
+	if messages := EncodeClusterState(&ClusterState{NodeID: "node-a"}, ClusterStateLimit); len(messages) != 1 {
+		t.Fatalf("empty state sent in %d messages", len(messages))
+	}
+}
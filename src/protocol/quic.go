@@ -0,0 +1,204 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICALPN is the ALPN protocol both ends of a QUIC connection negotiate
+const QUICALPN = "mycelium"
+
+// quicKeepAlive keeps NAT bindings and the QUIC idle timer alive between the
+// protocol's own pings
+const quicKeepAlive = 10 * time.Second
+
+// QUICConfig returns the QUIC settings shared by server and client
+func QUICConfig() *quic.Config {
+	return &quic.Config{
+		EnableDatagrams: true,
+		KeepAlivePeriod: quicKeepAlive,
+	}
+}
+
+// QUICConn carries data messages as unreliable QUIC datagrams (RFC 9221) and
+// every other message on one reliable control stream framed like StreamConn,
+// so a QUIC connection can stand in for a DTLS connection. The client opens
+// the control stream and the server accepts it.
+type QUICConn struct {
+	conn    *quic.Conn
+	control *StreamConn
+
+	incoming chan []byte // Messages from the datagram and stream readers
+	done     chan struct{}
+	doneOnce sync.Once
+	err      error // Why done was closed
+
+	readDeadline atomic.Int64 // Unix nanoseconds, 0 for none
+}
+
+// NewQUICConn frames messages over conn and its control stream
+func NewQUICConn(conn *quic.Conn, stream *quic.Stream) *QUICConn {
+	c := &QUICConn{
+		conn:     conn,
+		control:  NewStreamConn(quicStream{Stream: stream, conn: conn}),
+		incoming: make(chan []byte, 256),
+		done:     make(chan struct{}),
+	}
+	go c.receiveDatagrams()
+	go c.receiveControl()
+	return c
+}
+
+// isDataMessage reports whether a message may be lost without harm
+func isDataMessage(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	switch PacketType(b[0]) {
+	case PacketTypeData, PacketTypeDataBatch, PacketTypeDataCompressed:
+		return true
+	}
+	return false
+}
+
+func (c *QUICConn) receiveDatagrams() {
+	for {
+		msg, err := c.conn.ReceiveDatagram(c.conn.Context())
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if !c.deliver(msg) {
+			return
+		}
+	}
+}
+
+func (c *QUICConn) receiveControl() {
+	buf := make([]byte, MaxStreamMessage)
+	for {
+		n, err := c.control.Read(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if !c.deliver(append([]byte(nil), buf[:n]...)) {
+			return
+		}
+	}
+}
+
+// deliver queues a message for Read, or returns false once the connection is done
+func (c *QUICConn) deliver(msg []byte) bool {
+	select {
+	case c.incoming <- msg:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// fail marks the connection done, keeping the first error
+func (c *QUICConn) fail(err error) {
+	c.doneOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Read reads the next message into b. A message larger than b is discarded
+// and io.ErrShortBuffer returned.
+func (c *QUICConn) Read(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	if deadline := c.readDeadline.Load(); deadline != 0 {
+		timer := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case msg := <-c.incoming:
+		if len(msg) > len(b) {
+			return 0, io.ErrShortBuffer
+		}
+		return copy(b, msg), nil
+	case <-c.done:
+		return 0, c.err
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends a data message as a datagram and anything else on the control
+// stream. A data message too large for a datagram on the current path goes on
+// the control stream instead.
+func (c *QUICConn) Write(b []byte) (int, error) {
+	if isDataMessage(b) {
+		err := c.conn.SendDatagram(b)
+		if err == nil {
+			return len(b), nil
+		}
+		var tooLarge *quic.DatagramTooLargeError
+		if !errors.As(err, &tooLarge) {
+			return 0, err
+		}
+	}
+	return c.control.Write(b)
+}
+
+// Close closes the QUIC connection
+func (c *QUICConn) Close() error {
+	c.fail(net.ErrClosed)
+	return c.conn.CloseWithError(0, "")
+}
+
+// LocalAddr returns the local network address
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the current address of the peer
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *QUICConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *QUICConn) SetReadDeadline(t time.Time) error {
+	var deadline int64
+	if !t.IsZero() {
+		deadline = t.UnixNano()
+	}
+	c.readDeadline.Store(deadline)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the control stream; datagrams
+// are never blocked on
+func (c *QUICConn) SetWriteDeadline(t time.Time) error {
+	return c.control.SetWriteDeadline(t)
+}
+
+// quicStream gives a QUIC stream the addresses of its connection so it can be
+// framed as a net.Conn
+type quicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (s quicStream) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s quicStream) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
@@ -0,0 +1,121 @@
+package protocol
+
+import "fmt"
+
+// Reason explains why the server refused authentication or ended a session.
+// It is the first payload byte of PacketTypeAuthRespFail and PacketTypeDisc,
+// optionally followed by a human readable message.
+type Reason byte
+
+const (
+	ReasonUnspecified    Reason = 0x00 // Peer sent no reason (older peers)
+	ReasonBadCredentials Reason = 0x01 // Wrong password
+	ReasonPoolExhausted  Reason = 0x02 // No free address in the IP pool
+	ReasonServerFull     Reason = 0x03 // max_clients reached
+	ReasonKicked         Reason = 0x04 // Session removed by the server operator
+	ReasonServerShutdown Reason = 0x05 // Server is stopping
+	ReasonIdleTimeout    Reason = 0x06 // No traffic within the keep-alive window
+	ReasonClientShutdown Reason = 0x07 // Client is disconnecting
+	ReasonProtocolError  Reason = 0x08 // Malformed or unexpected message
+	ReasonBacklogged     Reason = 0x09 // Client fell too far behind the server's send queue
+	ReasonLockedOut      Reason = 0x0A // Too many failed attempts from this address
+	ReasonRateLimited    Reason = 0x0B // Server is refusing authentication attempts for now
+	ReasonSessionMoved   Reason = 0x0C // Client resumed the session on another cluster node
+	ReasonNameInUse      Reason = 0x0D // Another connected client has the username
+)
+
+var reasonNames = map[Reason]string{
+	ReasonUnspecified:    "unspecified",
+	ReasonBadCredentials: "bad credentials",
+	ReasonPoolExhausted:  "address pool exhausted",
+	ReasonServerFull:     "server full",
+	ReasonKicked:         "kicked by server",
+	ReasonServerShutdown: "server shutting down",
+	ReasonIdleTimeout:    "idle timeout",
+	ReasonClientShutdown: "client shutting down",
+	ReasonProtocolError:  "protocol error",
+	ReasonBacklogged:     "send queue backlogged",
+	ReasonLockedOut:      "locked out after failed attempts",
+	ReasonRateLimited:    "authentication rate limited",
+	ReasonSessionMoved:   "session resumed on another server",
+	ReasonNameInUse:      "username in use",
+}
+
+func (r Reason) String() string {
+	if name, ok := reasonNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("reason 0x%02x", byte(r))
+}
+
+// exitCodeBase keeps reason exit codes clear of the generic 0/1 codes
+const exitCodeBase = 10
+
+// maxExitReason is the highest reason with an exit code; exit statuses are
+// truncated to 0-255, so higher ones would wrap onto unrelated codes
+const maxExitReason = 255 - exitCodeBase
+
+// ExitCode is the process exit code a client uses when it stops because of r,
+// or ok=false for a reason too high to have one
+func (r Reason) ExitCode() (int, bool) {
+	if r > maxExitReason {
+		return 0, false
+	}
+	return exitCodeBase + int(r), true
+}
+
+// ReasonFromExitCode maps a client exit code back to the reason, if it is one
+func ReasonFromExitCode(code int) (Reason, bool) {
+	if code < exitCodeBase || code > exitCodeBase+maxExitReason {
+		return 0, false
+	}
+	return Reason(code - exitCodeBase), true
+}
+
+// ReasonError is returned by clients when the server refuses or ends the session
+type ReasonError struct {
+	Reason  Reason
+	Message string
+}
+
+func (e *ReasonError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %s", e.Reason, e.Message)
+	}
+	return e.Reason.String()
+}
+
+// encodeReason returns [type][reason][message]
+func encodeReason(t PacketType, reason Reason, message string) []byte {
+	packet := make([]byte, 0, 2+len(message))
+	packet = append(packet, byte(t), byte(reason))
+	return append(packet, message...)
+}
+
+// decodeReason parses [reason][message]; an empty payload is ReasonUnspecified
+func decodeReason(payload []byte) (Reason, string) {
+	if len(payload) == 0 {
+		return ReasonUnspecified, ""
+	}
+	return Reason(payload[0]), string(payload[1:])
+}
+
+// EncodeAuthFail returns an authentication failure response
+func EncodeAuthFail(reason Reason, message string) []byte {
+	return encodeReason(PacketTypeAuthRespFail, reason, message)
+}
+
+// DecodeAuthFail parses the payload of a PacketTypeAuthRespFail message
+func DecodeAuthFail(payload []byte) (Reason, string) {
+	return decodeReason(payload)
+}
+
+// EncodeDisconnect returns a disconnect message
+func EncodeDisconnect(reason Reason, message string) []byte {
+	return encodeReason(PacketTypeDisc, reason, message)
+}
+
+// DecodeDisconnect parses the payload of a PacketTypeDisc message
+func DecodeDisconnect(payload []byte) (Reason, string) {
+	return decodeReason(payload)
+}
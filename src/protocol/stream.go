@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// StreamOverhead is the length prefix in front of every message on a stream
+const StreamOverhead = 2
+
+// MaxStreamMessage is the largest message a stream can carry
+const MaxStreamMessage = 0xFFFF
+
+// StreamConn carries messages over a byte stream such as TLS over TCP. Every
+// message is sent as [2 byte length][message], so each Read and Write moves
+// exactly one message, just like a DTLS connection.
+type StreamConn struct {
+	net.Conn
+	r    *bufio.Reader
+	wmu  sync.Mutex // Writes come from the session writer and the control path
+	wbuf []byte
+}
+
+// NewStreamConn frames messages over conn
+func NewStreamConn(conn net.Conn) *StreamConn {
+	return &StreamConn{
+		Conn: conn,
+		r:    bufio.NewReaderSize(conn, 64*1024),
+	}
+}
+
+// Read reads the next message into b. A message larger than b is discarded
+// and io.ErrShortBuffer returned.
+func (c *StreamConn) Read(b []byte) (int, error) {
+	var hdr [StreamOverhead]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, err
+	}
+
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(b) {
+		if _, err := c.r.Discard(n); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrShortBuffer
+	}
+	if _, err := io.ReadFull(c.r, b[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// Write sends b as one message with a single write on the stream
+func (c *StreamConn) Write(b []byte) (int, error) {
+	if len(b) > MaxStreamMessage {
+		return 0, fmt.Errorf("message of %d bytes exceeds the stream limit of %d", len(b), MaxStreamMessage)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.wbuf = binary.BigEndian.AppendUint16(c.wbuf[:0], uint16(len(b)))
+	c.wbuf = append(c.wbuf, b...)
+	if _, err := c.Conn.Write(c.wbuf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Option types used in the client hello and server config TLVs.
+// Each option is encoded as [type][2 byte big-endian length][value].
+const (
+	OptCapabilities byte = 0x01 // uint32 capability bits
+	OptPassword     byte = 0x02 // Password (client hello)
+	OptUsername     byte = 0x03 // Username (client hello, optional)
+	OptSubnet       byte = 0x04 // Subnet behind the client, encoded like OptRoute (client hello, repeated)
+	OptAssignedIP   byte = 0x10 // 4 byte IPv4 address
+	OptPrefixLen    byte = 0x11 // 1 byte prefix length of the tunnel subnet
+	OptMTU          byte = 0x12 // uint16 tunnel MTU
+	OptDNSServer    byte = 0x13 // 4 byte IPv4 DNS server (repeated)
+	OptSearchDomain byte = 0x14 // Search domain (repeated)
+	OptTunnelMode   byte = 0x15 // RouteModeFull or RouteModeSplit
+	OptRoute        byte = 0x16 // 4 byte network + 1 byte prefix length (repeated)
+	OptKeepalive    byte = 0x17 // uint16 keep-alive interval in seconds
+	OptSessionToken byte = 0x18 // Opaque session token (server config; client hello when resuming)
+	OptPeerIP       byte = 0x20 // 4 byte tunnel address of the peer (peer messages)
+	OptPeerNonce    byte = 0x21 // Nonce the client also sends in its rendezvous probe
+	OptPeerEndpoint byte = 0x22 // 4 byte IPv4 address + uint16 port (repeated)
+	OptPeerKey      byte = 0x23 // Pre-shared key for the direct link
+	OptNodeID       byte = 0x30 // Cluster node ID (cluster state)
+	OptStateSeq     byte = 0x31 // uint64 sequence number of a cluster state
+	OptLease        byte = 0x32 // One lease, itself a list of options (cluster state, repeated)
+	OptGroup        byte = 0x33 // Group of the leased session
+	OptLeaseSince   byte = 0x34 // uint64 Unix nanoseconds the lease was claimed
+	OptStatePart    byte = 0x35 // uint16 index + uint16 count of a cluster state split over messages
+)
+
+// tlvHeaderSize is the size of the [type][length] prefix of each option
+const tlvHeaderSize = 3
+
+// Option is a single decoded TLV option. Value aliases the decoded buffer.
+type Option struct {
+	Type  byte
+	Value []byte
+}
+
+// AppendOption appends one option to buf
+func AppendOption(buf []byte, optType byte, value []byte) []byte {
+	buf = append(buf, optType, 0, 0)
+	binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(value)))
+	return append(buf, value...)
+}
+
+// ParseOptions splits data into options; unknown option types are kept so callers can skip them
+func ParseOptions(data []byte) ([]Option, error) {
+	options := make([]Option, 0, 16)
+	for len(data) > 0 {
+		if len(data) < tlvHeaderSize {
+			return nil, fmt.Errorf("truncated option header")
+		}
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < tlvHeaderSize+length {
+			return nil, fmt.Errorf("option 0x%02x truncated: want %d bytes, have %d", data[0], length, len(data)-tlvHeaderSize)
+		}
+		options = append(options, Option{Type: data[0], Value: data[tlvHeaderSize : tlvHeaderSize+length]})
+		data = data[tlvHeaderSize+length:]
+	}
+	return options, nil
+}
+
+func appendUint16Option(buf []byte, optType byte, v uint16) []byte {
+	var value [2]byte
+	binary.BigEndian.PutUint16(value[:], v)
+	return AppendOption(buf, optType, value[:])
+}
+
+func appendUint32Option(buf []byte, optType byte, v uint32) []byte {
+	var value [4]byte
+	binary.BigEndian.PutUint32(value[:], v)
+	return AppendOption(buf, optType, value[:])
+}
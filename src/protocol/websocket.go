@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketConn carries one message per binary WebSocket message, so a
+// WebSocket can stand in for a DTLS connection.
+type WebSocketConn struct {
+	ws  *websocket.Conn
+	wmu sync.Mutex // Writes come from the session writer and the control path
+}
+
+// NewWebSocketConn frames messages over ws
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	ws.SetReadLimit(MaxStreamMessage)
+	return &WebSocketConn{ws: ws}
+}
+
+// Read reads the next binary message into b, skipping any other message
+// types. A message larger than b is discarded and io.ErrShortBuffer returned.
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	for {
+		messageType, r, err := c.ws.NextReader()
+		if err != nil {
+			return 0, err
+		}
+		if messageType != websocket.BinaryMessage {
+			continue
+		}
+
+		n, err := io.ReadFull(r, b)
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			return n, nil // Message shorter than b
+		case nil:
+			// b is full; the message must end here
+			var extra [1]byte
+			if _, err := r.Read(extra[:]); err != io.EOF {
+				return 0, io.ErrShortBuffer
+			}
+			return n, nil
+		default:
+			return 0, err
+		}
+	}
+}
+
+// Write sends b as one binary message
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the underlying connection without a closing handshake
+func (c *WebSocketConn) Close() error {
+	return c.ws.Close()
+}
+
+// LocalAddr returns the local network address
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer, or of the proxy when the
+// connection goes through one
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,248 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// authGuard is the brute-force protection in front of password checks
+var authGuard *AuthGuard
+
+const (
+	// authMaxTracked bounds the sources and the usernames with a failure
+	// history; beyond it the one that failed longest ago is forgotten first
+	authMaxTracked = 65536
+
+	authNameDelay    = 250 * time.Millisecond // First delay for a username that failed too often
+	authNameDelayMax = 4 * time.Second        // Longest delay, well within the handshake timeout
+)
+
+// AuthGuard tracks failed authentication attempts per source IP and per
+// username. After max failures a source is locked out, for a period that
+// doubles with every further lockout up to maxLockout. A username is never
+// locked out, as anyone can send it: attempts with it are delayed instead,
+// doubling with every further failure up to authNameDelayMax, and the right
+// password still gets through. A token bucket limits authentication attempts
+// across all clients.
+type AuthGuard struct {
+	cfg         *ServerConfig // allow_sources and deny_sources
+	maxFailures int
+	lockout     time.Duration
+	maxLockout  time.Duration
+
+	mu      sync.Mutex
+	sources map[netip.Addr]*failureRecord
+	names   map[string]*failureRecord // By lowercase username
+	bucket  tokenBucket               // Attempts across all clients
+
+	failures    atomic.Uint64
+	lockouts    atomic.Uint64
+	lockedOut   atomic.Uint64 // Attempts refused during a lockout
+	delayed     atomic.Uint64 // Attempts delayed for their username
+	rateLimited atomic.Uint64
+	denied      atomic.Uint64 // Connections refused by allow_sources/deny_sources
+}
+
+// failureRecord is the failure history of one source IP or username
+type failureRecord struct {
+	failures    int // Failures since the last lockout; for a username, since the last success
+	lockouts    int // Lockouts so far, which sets the next lockout's length
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+// NewAuthGuard creates a guard with the limits from cfg
+func NewAuthGuard(cfg *ServerConfig) *AuthGuard {
+	return &AuthGuard{
+		cfg:         cfg,
+		maxFailures: cfg.AuthMaxFailures,
+		lockout:     time.Duration(cfg.AuthLockout) * time.Second,
+		maxLockout:  time.Duration(cfg.AuthLockoutMax) * time.Second,
+		sources:     make(map[netip.Addr]*failureRecord),
+		names:       make(map[string]*failureRecord),
+		bucket:      newTokenBucket(cfg.AuthRate, time.Now()),
+	}
+}
+
+// sourceIP returns the IP address a client connects from
+func sourceIP(addr net.Addr) netip.Addr {
+	return addrKey(addr).Addr()
+}
+
+// Check decides whether an authentication attempt may go ahead. When it may
+// not, it returns the reason to send the client and a message saying when to
+// retry. Every allowed attempt takes a token from the global bucket.
+func (g *AuthGuard) Check(ip netip.Addr, now time.Time) (protocol.Reason, string, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if r, ok := g.sources[ip]; ok && r.lockedUntil.After(now) {
+		g.lockedOut.Add(1)
+		return protocol.ReasonLockedOut, fmt.Sprintf("retry in %v", r.lockedUntil.Sub(now).Round(time.Second)), false
+	}
+
+	if !g.bucket.take(now) {
+		g.rateLimited.Add(1)
+		fmt.Printf("Auth rate limit reached, refusing %s\n", ip)
+		return protocol.ReasonRateLimited, "retry in 1s", false
+	}
+	return protocol.ReasonUnspecified, "", true
+}
+
+// Delay returns how long to hold an attempt with username before checking
+// its password: zero until the username has failed max times
+func (g *AuthGuard) Delay(username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := g.names[strings.ToLower(username)]
+	if !ok || r.failures < g.maxFailures {
+		return 0
+	}
+	g.delayed.Add(1)
+	if extra := r.failures - g.maxFailures; extra < 5 {
+		return min(authNameDelay<<extra, authNameDelayMax)
+	}
+	return authNameDelayMax
+}
+
+// Failed records a wrong password from ip, with username if the client sent
+// one, and locks ip out once it has too many
+func (g *AuthGuard) Failed(ip netip.Addr, username string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.failures.Add(1)
+	if username != "" {
+		name := strings.ToLower(username)
+		r, ok := g.names[name]
+		if !ok {
+			if len(g.names) >= authMaxTracked {
+				g.pruneLocked(now)
+				evictOldest(g.names)
+			}
+			r = &failureRecord{}
+			g.names[name] = r
+		}
+		r.failures++
+		r.lastFailure = now
+	}
+
+	r, ok := g.sources[ip]
+	if !ok {
+		if len(g.sources) >= authMaxTracked {
+			g.pruneLocked(now)
+			evictOldest(g.sources)
+		}
+		r = &failureRecord{}
+		g.sources[ip] = r
+	}
+	r.failures++
+	r.lastFailure = now
+	if r.failures < g.maxFailures {
+		return
+	}
+
+	r.failures = 0
+	r.lockouts++
+	d := g.maxLockout
+	if r.lockouts <= 32 {
+		d = min(g.lockout<<(r.lockouts-1), g.maxLockout)
+	}
+	r.lockedUntil = now.Add(d)
+	g.lockouts.Add(1)
+	fmt.Printf("Locking out %s for %v after %d failed attempts\n", ip, d, g.maxFailures)
+}
+
+// evictOldest makes room in records, if pruning left it full, by forgetting
+// the record whose last failure is oldest. Caller holds g.mu.
+func evictOldest[K comparable](records map[K]*failureRecord) {
+	if len(records) < authMaxTracked {
+		return
+	}
+	var oldest K
+	var oldestFailure time.Time
+	first := true
+	for key, r := range records {
+		if first || r.lastFailure.Before(oldestFailure) {
+			oldest, oldestFailure, first = key, r.lastFailure, false
+		}
+	}
+	delete(records, oldest)
+}
+
+// Succeeded clears the failure history of ip and username
+func (g *AuthGuard) Succeeded(ip netip.Addr, username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.sources, ip)
+	delete(g.names, strings.ToLower(username))
+}
+
+// Prune forgets sources and usernames that are not locked out and have not
+// failed for maxLockout, so lockouts and delays stop growing after a quiet
+// period
+func (g *AuthGuard) Prune(now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pruneLocked(now)
+}
+
+func (g *AuthGuard) pruneLocked(now time.Time) {
+	pruneRecords(g.sources, now, g.maxLockout)
+	pruneRecords(g.names, now, g.maxLockout)
+}
+
+func pruneRecords[K comparable](records map[K]*failureRecord, now time.Time, quiet time.Duration) {
+	for key, r := range records {
+		if now.After(r.lockedUntil) && now.Sub(r.lastFailure) > quiet {
+			delete(records, key)
+		}
+	}
+}
+
+// Admit reports whether a client at addr may connect according to
+// allow_sources and deny_sources
+func (g *AuthGuard) Admit(addr net.Addr) bool {
+	if g.cfg.SourceAllowed(sourceIP(addr)) {
+		return true
+	}
+	g.denied.Add(1)
+	fmt.Printf("Refusing connection from %s: source not allowed\n", addr)
+	return false
+}
+
+// AuthStats returns the brute-force protection counters
+func AuthStats() map[string]uint64 {
+	return authGuard.Stats()
+}
+
+// Stats returns the guard's counters for monitoring
+func (g *AuthGuard) Stats() map[string]uint64 {
+	g.mu.Lock()
+	tracked, trackedNames := uint64(len(g.sources)), uint64(len(g.names))
+	g.mu.Unlock()
+
+	return map[string]uint64{
+		"auth_failures":     g.failures.Load(),
+		"auth_lockouts":     g.lockouts.Load(),
+		"auth_locked_out":   g.lockedOut.Load(),
+		"auth_delayed":      g.delayed.Load(),
+		"auth_rate_limited": g.rateLimited.Load(),
+		"sources_denied":    g.denied.Load(),
+		"tracked":           tracked,
+		"tracked_usernames": trackedNames,
+	}
+}
@@ -0,0 +1,170 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+func newTestGuard(rate int) *AuthGuard {
+	return NewAuthGuard(&ServerConfig{AuthMaxFailures: 3, AuthLockout: 60, AuthLockoutMax: 150, AuthRate: rate})
+}
+
+func TestAuthGuardExponentialLockout(t *testing.T) {
+	g := newTestGuard(1000)
+	ip := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	// Each lockout doubles, up to auth_lockout_max
+	for _, want := range []time.Duration{60 * time.Second, 120 * time.Second, 150 * time.Second} {
+		for i := 0; i < 3; i++ {
+			if _, _, ok := g.Check(ip, now); !ok {
+				t.Fatalf("attempt refused before the lockout")
+			}
+			g.Failed(ip, "", now)
+		}
+		if reason, _, ok := g.Check(ip, now.Add(want-time.Second)); ok || reason != protocol.ReasonLockedOut {
+			t.Fatalf("not locked out %v into a %v lockout", want-time.Second, want)
+		}
+		now = now.Add(want)
+	}
+
+	// Success clears the history
+	g.Succeeded(ip, "")
+	g.Failed(ip, "", now)
+	if _, _, ok := g.Check(ip, now); !ok {
+		t.Fatalf("locked out after one failure following a success")
+	}
+}
+
+func TestAuthGuardUsernameDelay(t *testing.T) {
+	g := newTestGuard(1000)
+	ip := netip.MustParseAddr("2001:db8::1")
+	now := time.Now()
+
+	// Failures spread over many sources slow the username down but never lock it out
+	want := []time.Duration{0, 0, 0, 250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second, 4 * time.Second}
+	for i, delay := range want {
+		if got := g.Delay("Alice"); got != delay {
+			t.Fatalf("delay after %d failures = %v, want %v", i, got, delay)
+		}
+		if _, _, ok := g.Check(ip, now); !ok {
+			t.Fatalf("attempt %d from a fresh source refused", i)
+		}
+		g.Failed(ip, "alice", now)
+		ip = ip.Next()
+	}
+	if g.Delay("bob") != 0 {
+		t.Fatalf("another username delayed")
+	}
+	if stats := g.Stats(); stats["auth_delayed"] != 7 || stats["tracked_usernames"] != 1 || stats["auth_lockouts"] != 0 {
+		t.Fatalf("stats = %v", stats)
+	}
+
+	// The right password clears the username's history
+	g.Succeeded(ip, "ALICE")
+	if g.Delay("alice") != 0 {
+		t.Fatalf("username still delayed after a success")
+	}
+}
+
+func TestAuthGuardBounded(t *testing.T) {
+	g := newTestGuard(1000)
+	now := time.Now()
+
+	// A flood of sources keeps at most authMaxTracked, the oldest going first
+	first := netip.MustParseAddr("2001:db8::")
+	ip := first
+	for i := 0; i < authMaxTracked+10; i++ {
+		g.Failed(ip, "", now.Add(time.Duration(i)))
+		ip = ip.Next()
+	}
+	if tracked := g.Stats()["tracked"]; tracked != authMaxTracked {
+		t.Fatalf("tracking %d sources, want %d", tracked, authMaxTracked)
+	}
+	g.mu.Lock()
+	_, kept := g.sources[first]
+	g.mu.Unlock()
+	if kept {
+		t.Fatalf("oldest source kept")
+	}
+}
+
+func TestAuthGuardRateLimit(t *testing.T) {
+	g := newTestGuard(2)
+	ip := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if _, _, ok := g.Check(ip, now); !ok {
+			t.Fatalf("attempt %d refused within the rate", i)
+		}
+	}
+	if reason, _, ok := g.Check(ip, now); ok || reason != protocol.ReasonRateLimited {
+		t.Fatalf("third attempt in the same instant allowed")
+	}
+	if _, _, ok := g.Check(ip, now.Add(time.Second)); !ok {
+		t.Fatalf("bucket did not refill")
+	}
+}
+
+func TestAuthGuardPrune(t *testing.T) {
+	g := newTestGuard(1000)
+	ip := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	g.Failed(ip, "alice", now)
+	g.Prune(now.Add(time.Minute))
+	if g.Stats()["tracked"] != 1 || g.Stats()["tracked_usernames"] != 1 {
+		t.Fatalf("recent failures pruned")
+	}
+	g.Prune(now.Add(151 * time.Second))
+	if g.Stats()["tracked"] != 0 || g.Stats()["tracked_usernames"] != 0 {
+		t.Fatalf("idle records kept")
+	}
+}
+
+func TestSecurityStats(t *testing.T) {
+	authGuard = newTestGuard(1000)
+	authGuard.Failed(netip.MustParseAddr("192.0.2.1"), "", time.Now())
+	handshakeFailures[HandshakeFailTimeout].Add(1)
+
+	stats := securityStats()
+	if !strings.Contains(stats, "auth_failures=1 ") || !strings.Contains(stats, "handshake_timeout=") || strings.Contains(stats, "auth_lockouts") {
+		t.Fatalf("security stats %q", stats)
+	}
+}
+
+func TestSourceAllowed(t *testing.T) {
+	cfg := &ServerConfig{
+		AllowSources: []string{"10.0.0.0/8", "192.0.2.1"},
+		DenySources:  []string{"10.1.0.0/16"},
+	}
+	if err := cfg.validateAuth(); err != nil {
+		t.Fatalf("validateAuth: %v", err)
+	}
+
+	for addr, want := range map[string]bool{
+		"10.2.3.4":         true,
+		"10.1.2.3":         false, // Denied inside an allowed range
+		"192.0.2.1":        true,
+		"::ffff:192.0.2.1": true,
+		"192.0.2.2":        false,
+		"2001:db8::1":      false,
+	} {
+		if got := cfg.SourceAllowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("SourceAllowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	bad := &ServerConfig{DenySources: []string{"not-a-cidr"}}
+	if err := bad.validateAuth(); err == nil {
+		t.Fatalf("invalid deny_sources accepted")
+	}
+}
@@ -0,0 +1,480 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+	"github.com/varun0310t/VPN/src/transport"
+)
+
+// cluster links this server to the other nodes; nil unless cluster_node_id is set
+var cluster *Cluster
+
+const (
+	clusterStateInterval  = time.Second      // Between states sent to each node, which double as pings
+	clusterNodeTimeout    = 5 * time.Second  // Without a state from a node before its link is closed
+	clusterConnectTimeout = 5 * time.Second  // Per attempt to link to a node
+	clusterLeaseTTL       = 10 * time.Minute // A silent node's leases can be resumed for this long
+)
+
+// Cluster shares sessions between servers. Every node links to every other
+// over DTLS with a key derived from cluster_key and sends them the leases it
+// holds each second. With those, a node does not hand out an address leased
+// elsewhere, forwards packets for addresses and subnets leased elsewhere over
+// the link to that node, and lets a client resume its session with the
+// session token after its node died. The newest claim on an address wins, so
+// the node a client left drops its old session.
+type Cluster struct {
+	id      string
+	key     []byte
+	share   int // This node hands out addresses with (ip - ip_pool_min) % shares == share
+	shares  int
+	poolMin int
+	manager *Manager
+	pool    *protocol.BufferPool // Buffers for packets forwarded by other nodes
+	socket  *transport.PeerSocket
+	done    chan struct{}
+
+	mu      sync.RWMutex
+	nodes   []*clusterNode
+	byIP    map[[4]byte]*remoteLease      // Newest remote claim on each address
+	subnets map[netip.Prefix]*remoteLease // Subnets behind gateway clients of other nodes
+}
+
+// clusterNode is another server and what it last told us; guarded by Cluster.mu
+type clusterNode struct {
+	cfg   ClusterNodeConfig
+	link  net.Conn // nil while there is no link
+	state *protocol.ClusterState
+	heard time.Time // When state arrived
+
+	// A state arriving in parts, only touched by the link's reader
+	pending  *protocol.ClusterState
+	received []bool
+}
+
+type remoteLease struct {
+	node  *clusterNode
+	lease protocol.ClusterLease
+}
+
+// NewCluster creates the cluster for cfg's node, sharing manager's sessions;
+// Listen links it to the other nodes
+func NewCluster(cfg *ServerConfig, manager *Manager) *Cluster {
+	c := &Cluster{
+		id:      cfg.ClusterNodeID,
+		key:     []byte(cfg.ClusterKey),
+		poolMin: cfg.IPPoolMin,
+		manager: manager,
+		pool:    protocol.NewBufferPool(cfg.MTU),
+		done:    make(chan struct{}),
+		byIP:    make(map[[4]byte]*remoteLease),
+		subnets: make(map[netip.Prefix]*remoteLease),
+	}
+	ids := cfg.ClusterNodeIDs()
+	c.share, c.shares = slices.Index(ids, cfg.ClusterNodeID), len(ids)
+	for _, node := range cfg.ClusterNodes {
+		c.nodes = append(c.nodes, &clusterNode{cfg: node})
+	}
+	return c
+}
+
+// Listen opens the cluster port and keeps a link to every other node until Close
+func (c *Cluster) Listen(addr string) error {
+	socket, err := transport.ListenPeer(addr)
+	if err != nil {
+		return fmt.Errorf("failed to start cluster listener: %w", err)
+	}
+	c.socket = socket
+	for _, node := range c.nodes {
+		go c.maintain(node)
+	}
+	return nil
+}
+
+// Close drops every link
+func (c *Cluster) Close() error {
+	close(c.done)
+	if c.socket == nil {
+		return nil
+	}
+	return c.socket.Close()
+}
+
+// pairKey derives the key of the link between this node and other, the same on both ends
+func (c *Cluster) pairKey(other string) []byte {
+	ids := []string{c.id, other}
+	slices.Sort(ids)
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte("mycelium cluster link\x00" + ids[0] + "\x00" + ids[1]))
+	return mac.Sum(nil)
+}
+
+// maintain links to node, and links again whenever the link fails
+func (c *Cluster) maintain(node *clusterNode) {
+	for {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		conn, err := c.connect(node)
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		fmt.Printf("Cluster link to node %s (%s) up\n", node.cfg.ID, conn.RemoteAddr())
+		c.serveLink(node, conn)
+		fmt.Printf("Cluster link to node %s down\n", node.cfg.ID)
+	}
+}
+
+func (c *Cluster) connect(node *clusterNode) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", node.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), clusterConnectTimeout)
+	defer cancel()
+	// The node with the lower ID runs the DTLS server side
+	return c.socket.Connect(ctx, []netip.AddrPort{addr.AddrPort()}, c.pairKey(node.cfg.ID), c.id < node.cfg.ID)
+}
+
+// serveLink sends our state over the link every clusterStateInterval and
+// handles what the node sends until the link fails or goes silent
+func (c *Cluster) serveLink(node *clusterNode, conn net.Conn) {
+	c.mu.Lock()
+	node.link = conn
+	node.heard = time.Now()
+	c.mu.Unlock()
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(clusterStateInterval)
+		defer ticker.Stop()
+		for {
+			c.mu.RLock()
+			silent := time.Since(node.heard) > clusterNodeTimeout
+			c.mu.RUnlock()
+			if silent {
+				conn.Close()
+				return
+			}
+			for _, message := range protocol.EncodeClusterState(c.localState(), protocol.ClusterStateLimit) {
+				if _, err := conn.Write(message); err != nil {
+					conn.Close()
+					return
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	buffer := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			break
+		}
+		packetType, payload, err := protocol.Decode(buffer[:n])
+		if err != nil {
+			continue
+		}
+		switch packetType {
+		case protocol.PacketTypeClusterState:
+			state, err := protocol.DecodeClusterState(payload)
+			if err != nil {
+				fmt.Printf("Invalid cluster state from node %s: %v\n", node.cfg.ID, err)
+				continue
+			}
+			if state, ok := node.assemble(state); ok {
+				c.apply(node, state, time.Now())
+			}
+		case protocol.PacketTypeData:
+			c.deliver(payload)
+		}
+	}
+
+	close(stop)
+	conn.Close()
+	c.mu.Lock()
+	node.link = nil
+	c.mu.Unlock()
+}
+
+// assemble collects the parts of a state and returns the whole state once all
+// have arrived. A part of a newer state drops one still missing parts, which
+// the node sends again a second later anyway.
+func (node *clusterNode) assemble(part *protocol.ClusterState) (*protocol.ClusterState, bool) {
+	if part.Parts == 1 {
+		return part, true
+	}
+	if node.pending == nil || part.Seq > node.pending.Seq {
+		node.pending = &protocol.ClusterState{NodeID: part.NodeID, Seq: part.Seq, Parts: 1}
+		node.received = make([]bool, part.Parts)
+	}
+	if part.Seq != node.pending.Seq || part.Parts != len(node.received) || node.received[part.Part] {
+		return nil, false
+	}
+	node.received[part.Part] = true
+	node.pending.Leases = append(node.pending.Leases, part.Leases...)
+	if slices.Contains(node.received, false) {
+		return nil, false
+	}
+	state := node.pending
+	node.pending, node.received = nil, nil
+	return state, true
+}
+
+// localState returns the leases of this node's authenticated sessions
+func (c *Cluster) localState() *protocol.ClusterState {
+	sessions := c.manager.GetAllSessions()
+	state := &protocol.ClusterState{
+		NodeID: c.id,
+		Seq:    uint64(time.Now().UnixNano()), // Keeps growing across restarts
+		Leases: make([]protocol.ClusterLease, 0, len(sessions)),
+	}
+
+	c.manager.mu.Lock()
+	defer c.manager.mu.Unlock()
+	for _, s := range sessions {
+		if !s.Authenticated.Load() || len(s.SessionToken) == 0 {
+			continue
+		}
+		subnets := make([]net.IPNet, 0, len(s.Subnets))
+		for _, prefix := range s.Subnets {
+			subnets = append(subnets, net.IPNet{IP: prefix.Addr().AsSlice(), Mask: net.CIDRMask(prefix.Bits(), 32)})
+		}
+		state.Leases = append(state.Leases, protocol.ClusterLease{
+			IP:      s.AssignedIP,
+			Token:   s.SessionToken,
+			Group:   s.Group,
+			Name:    s.Name,
+			Subnets: subnets,
+			Since:   s.ConnectedAt,
+		})
+	}
+	return state
+}
+
+// apply records a state from node, rebuilds the remote lease index and drops
+// local sessions the client has since resumed on node
+func (c *Cluster) apply(node *clusterNode, state *protocol.ClusterState, now time.Time) {
+	if state.NodeID != node.cfg.ID {
+		fmt.Printf("Cluster node %s sent the state of %q - ignored\n", node.cfg.ID, state.NodeID)
+		return
+	}
+
+	c.mu.Lock()
+	if node.state != nil && state.Seq <= node.state.Seq {
+		c.mu.Unlock()
+		return
+	}
+	node.state = state
+	node.heard = now
+	added, removed := c.reindex(now)
+	c.mu.Unlock()
+
+	for _, prefix := range removed {
+		if _, local := c.manager.sessions().subnets[prefix]; !local && tunManager != nil {
+			tunManager.RemoveRoute(prefix)
+		}
+	}
+	for _, prefix := range added {
+		if tunManager != nil {
+			if err := tunManager.AddRoute(prefix); err != nil {
+				fmt.Printf("Failed to route subnet %s to cluster node %s: %v\n", prefix, node.cfg.ID, err)
+			}
+		}
+	}
+
+	for _, lease := range state.Leases {
+		local, ok := c.manager.GetClientByIP(lease.IP)
+		if ok && local.ConnectedAt.Before(lease.Since) {
+			c.manager.DisconnectClient(local.Addr, protocol.ReasonSessionMoved, "resumed on node "+node.cfg.ID)
+		}
+	}
+}
+
+// reindex rebuilds byIP and subnets from the nodes' states, skipping nodes
+// silent for longer than clusterLeaseTTL, and returns the subnets that
+// appeared and disappeared. Caller holds c.mu.
+func (c *Cluster) reindex(now time.Time) (added, removed []netip.Prefix) {
+	byIP := make(map[[4]byte]*remoteLease)
+	subnets := make(map[netip.Prefix]*remoteLease)
+	for _, node := range c.nodes {
+		if node.state == nil || now.Sub(node.heard) > clusterLeaseTTL {
+			continue
+		}
+		for _, lease := range node.state.Leases {
+			rl := &remoteLease{node: node, lease: lease}
+			key := ipKey(lease.IP)
+			if old, ok := byIP[key]; ok && !old.lease.Since.Before(lease.Since) {
+				continue
+			}
+			byIP[key] = rl
+			for _, subnet := range lease.Subnets {
+				ones, _ := subnet.Mask.Size()
+				prefix := netip.PrefixFrom(netip.AddrFrom4([4]byte(subnet.IP.To4())), ones).Masked()
+				subnets[prefix] = rl
+			}
+		}
+	}
+
+	for prefix := range subnets {
+		if _, ok := c.subnets[prefix]; !ok {
+			added = append(added, prefix)
+		}
+	}
+	for prefix := range c.subnets {
+		if _, ok := subnets[prefix]; !ok {
+			removed = append(removed, prefix)
+		}
+	}
+	c.byIP, c.subnets = byIP, subnets
+	return added, removed
+}
+
+// Prune forgets the leases of nodes silent for longer than clusterLeaseTTL
+func (c *Cluster) Prune(now time.Time) {
+	c.mu.Lock()
+	_, removed := c.reindex(now)
+	c.mu.Unlock()
+	for _, prefix := range removed {
+		if _, local := c.manager.sessions().subnets[prefix]; !local && tunManager != nil {
+			tunManager.RemoveRoute(prefix)
+		}
+	}
+}
+
+// Forward sends a framed TUN packet to the node holding its destination and
+// takes ownership of buf. It returns false, leaving buf to the caller, when
+// no linked node holds the destination.
+func (c *Cluster) Forward(buf *protocol.Buffer) bool {
+	dst := [4]byte(buf.Packet()[16:20])
+
+	c.mu.RLock()
+	owner, ok := c.byIP[dst]
+	if !ok {
+		owner, ok = c.lookupSubnet(dst)
+	}
+	var link net.Conn
+	if ok {
+		link = owner.node.link
+	}
+	c.mu.RUnlock()
+	if link == nil {
+		return false
+	}
+
+	link.Write(buf.Bytes())
+	buf.Release()
+	return true
+}
+
+// lookupSubnet returns the remote lease with the longest subnet containing ip. Caller holds c.mu.
+func (c *Cluster) lookupSubnet(ip [4]byte) (*remoteLease, bool) {
+	var best *remoteLease
+	bits := -1
+	addr := netip.AddrFrom4(ip)
+	for prefix, rl := range c.subnets {
+		if prefix.Bits() > bits && prefix.Contains(addr) {
+			best, bits = rl, prefix.Bits()
+		}
+	}
+	return best, best != nil
+}
+
+// deliver queues a packet another node forwarded for one of our clients.
+// It is never forwarded again, so a stale lease cannot make packets loop.
+func (c *Cluster) deliver(packet []byte) {
+	if len(packet) < 20 {
+		return
+	}
+	session, ok := c.manager.GetClientForDestination(net.IP(packet[16:20]))
+	if !ok || !session.Authenticated.Load() {
+		return
+	}
+	buf := c.pool.Get()
+	if len(packet) > len(buf.Payload()) {
+		buf.Release()
+		return
+	}
+	buf.FrameData(copy(buf.Payload(), packet))
+	session.Send(buf)
+}
+
+// Lookup returns the lease another node holds, or held before it went
+// silent, for a session token
+func (c *Cluster) Lookup(token []byte) (protocol.ClusterLease, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, rl := range c.byIP {
+		if subtle.ConstantTimeCompare(rl.lease.Token, token) == 1 {
+			return rl.lease, true
+		}
+	}
+	return protocol.ClusterLease{}, false
+}
+
+// LookupName returns the address of the client with the DNS name on another
+// node, the one connected longest if there are several
+func (c *Cluster) LookupName(name string) (net.IP, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var found *remoteLease
+	for _, rl := range c.byIP {
+		if rl.lease.Name == name && (found == nil || rl.lease.Since.Before(found.lease.Since)) {
+			found = rl
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+	return found.lease.IP, true
+}
+
+// Reserved reports whether this node must not hand out the address with the
+// given last octet: it belongs to another node's share of the pool, or
+// another node holds it
+func (c *Cluster) Reserved(lastOctet int) bool {
+	if (lastOctet-c.poolMin)%c.shares != c.share {
+		return true
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, leased := c.byIP[[4]byte{10, 8, 0, byte(lastOctet)}]
+	return leased
+}
+
+// Nodes reports, for each other node, whether it is linked
+func (c *Cluster) Nodes() map[string]bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	nodes := make(map[string]bool, len(c.nodes))
+	for _, node := range c.nodes {
+		nodes[node.cfg.ID] = node.link != nil
+	}
+	return nodes
+}
@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// freeUDPPort returns a loopback address with a port that was free a moment ago
+func freeUDPPort(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// newClusterNode creates a node with its own session manager, linked to other at otherAddr
+func newClusterNode(t *testing.T, id, addr, other, otherAddr string) (*Cluster, *Manager) {
+	t.Helper()
+	cfg := *ServerCfg
+	cfg.ClusterNodeID = id
+	cfg.ClusterKey = "0123456789abcdef"
+	cfg.ClusterNodes = []ClusterNodeConfig{{ID: other, Address: otherAddr}}
+	manager, _ := NewManager()
+	c := NewCluster(&cfg, manager)
+	if err := c.Listen(addr); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, manager
+}
+
+// addTestSession adds an authenticated session with a token to m
+func addTestSession(t *testing.T, m *Manager, host byte, token string) (*ClientSession, *captureConn) {
+	t.Helper()
+	conn := &captureConn{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, host), Port: 4000}}
+	session, err := m.GetOrAddClient(conn.addr, conn)
+	if err != nil {
+		t.Fatalf("GetOrAddClient: %v", err)
+	}
+	m.SetHandshake(conn.addr, protocol.ProtocolVersion, 0, []byte(token))
+	session.Authenticated.Store(true)
+	session, _ = m.GetClient(conn.addr)
+	return session, conn
+}
+
+// eventually polls cond for up to 10 seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestClusterSharesSessions links two nodes over loopback and checks that
+// leases are shared, packets are forwarded to the node holding the
+// destination and a session resumed on one node is dropped on the other
+func TestClusterSharesSessions(t *testing.T) {
+	newTestManager(t)
+	addrA, addrB := freeUDPPort(t), freeUDPPort(t)
+	a, managerA := newClusterNode(t, "a", addrA, "b", addrB)
+	b, managerB := newClusterNode(t, "b", addrB, "a", addrA)
+
+	session, conn := addTestSession(t, managerB, 1, "token-of-b-client")
+	managerB.ClaimName(session.Addr, "carol")
+	ip := session.AssignedIP
+	eventually(t, "the lease to reach node a", func() bool {
+		lease, ok := a.Lookup([]byte("token-of-b-client"))
+		named, _ := a.LookupName("carol")
+		return ok && lease.IP.Equal(ip) && named.Equal(ip)
+	})
+	if !a.Reserved(int(ip.To4()[3])) {
+		t.Errorf("node a may hand out %s, leased on node b", ip)
+	}
+	if nodes := b.Nodes(); !nodes["a"] {
+		t.Errorf("node b reports links %v", nodes)
+	}
+
+	buf := a.pool.Get()
+	n := copy(buf.Payload(), ipv4Packet(net.IPv4(8, 8, 8, 8), ip, 32))
+	buf.FrameData(n)
+	if !a.Forward(buf) {
+		t.Fatalf("node a did not forward a packet for %s", ip)
+	}
+	eventually(t, "the forwarded packet", func() bool {
+		packet := conn.last(protocol.PacketTypeData)
+		return len(packet) == n && bytes.Equal(packet[16:20], ip.To4())
+	})
+
+	// The client resumes on node a; node b must let go of it
+	resumed, _ := addTestSession(t, managerA, 2, "new-token")
+	if err := managerA.Resume(resumed.Addr, ip); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	eventually(t, "node b to drop the moved session", func() bool {
+		_, ok := managerB.GetClientByIP(ip)
+		return !ok
+	})
+	if reason, _ := protocol.DecodeDisconnect(conn.last(protocol.PacketTypeDisc)); reason != protocol.ReasonSessionMoved {
+		t.Errorf("moved client got reason %s", reason)
+	}
+}
+
+// TestClusterFullPool checks that a node holding 250 leases, a state far
+// larger than one DTLS record, still gets it across
+func TestClusterFullPool(t *testing.T) {
+	newTestManager(t)
+	addrA, addrB := freeUDPPort(t), freeUDPPort(t)
+	a, _ := newClusterNode(t, "a", addrA, "b", addrB)
+	_, managerB := newClusterNode(t, "b", addrB, "a", addrA)
+
+	var last *ClientSession
+	for host := 1; host <= 250; host++ {
+		last, _ = addTestSession(t, managerB, byte(host), fmt.Sprintf("token-%028d", host))
+		managerB.ClaimName(last.Addr, fmt.Sprintf("client-%d", host))
+	}
+	eventually(t, "all 250 leases to reach node a", func() bool {
+		a.mu.RLock()
+		defer a.mu.RUnlock()
+		return len(a.byIP) == 250
+	})
+	if lease, ok := a.Lookup([]byte(fmt.Sprintf("token-%028d", 250))); !ok || !lease.IP.Equal(last.AssignedIP) {
+		t.Errorf("last lease = %v, %v; want %s", lease.IP, ok, last.AssignedIP)
+	}
+}
+
+// TestClusterReservedShares checks that nodes hand out disjoint shares of the pool
+func TestClusterReservedShares(t *testing.T) {
+	cfg := &ServerConfig{
+		IPPoolMin:     10,
+		MTU:           1400,
+		ClusterNodeID: "b",
+		ClusterNodes:  []ClusterNodeConfig{{ID: "a"}, {ID: "c"}},
+	}
+	c := NewCluster(cfg, nil)
+	for octet := 10; octet < 20; octet++ {
+		if got, want := c.Reserved(octet), (octet-10)%3 != 1; got != want {
+			t.Errorf("Reserved(%d) = %v, want %v", octet, got, want)
+		}
+	}
+}
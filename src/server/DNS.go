@@ -0,0 +1,352 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsServer answers client names on the tunnel address; nil unless
+// dns_enabled is set
+var dnsServer *DNSServer
+
+const (
+	dnsTTL             = 60               // Seconds clients may cache a name; sessions come and go
+	dnsUpstreamTimeout = 2 * time.Second  // Per upstream, before the next one is tried
+	dnsTCPIdleTimeout  = 10 * time.Second // Between queries on a TCP connection
+	dnsMaxInFlight     = 256              // Queries being answered at once; more are dropped
+)
+
+// DNSServer answers A queries for <name>.<domain> with the address of the
+// connected client that sent that username, here or on another cluster node,
+// and relays every other query to the upstream resolvers, over DNS over TLS
+// or HTTPS if they are configured so, caching their answers. It only
+// answers sources inside the tunnel subnet, behind gateway clients or on the
+// server itself, so it is not an open resolver.
+type DNSServer struct {
+	domain    string // Lowercase, with a trailing dot
+	upstreams []*dnsUpstream
+	cache     *dnsCache
+	subnet    netip.Prefix
+	manager   *Manager
+	inFlight  chan struct{}
+	udp       *net.UDPConn
+	tcp       *net.TCPListener
+}
+
+// NewDNSServer creates a resolver for cfg's domain and upstreams that looks
+// names up in manager; Listen starts it
+func NewDNSServer(cfg *ServerConfig, manager *Manager) *DNSServer {
+	subnet, _ := netip.ParsePrefix(cfg.TunSubnet)
+	upstreams := make([]*dnsUpstream, 0, len(cfg.dnsUpstreams))
+	for _, spec := range cfg.dnsUpstreams {
+		upstreams = append(upstreams, newDNSUpstream(spec, nil))
+	}
+	return &DNSServer{
+		domain:    cfg.DNSDomain + ".",
+		upstreams: upstreams,
+		cache:     newDNSCache(dnsCacheSize),
+		subnet:    subnet.Masked(),
+		manager:   manager,
+		inFlight:  make(chan struct{}, dnsMaxInFlight),
+	}
+}
+
+// dnsName returns the DNS name for a username, or "" if it is not a valid label
+func dnsName(username string) string {
+	name := strings.ToLower(username)
+	if !validDNSLabel(name) {
+		return ""
+	}
+	return name
+}
+
+// Listen serves DNS over UDP and TCP on addr until Close
+func (d *DNSServer) Listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve DNS address: %w", err)
+	}
+	d.udp, err = net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start DNS listener: %w", err)
+	}
+	d.tcp, err = net.ListenTCP("tcp4", &net.TCPAddr{IP: udpAddr.IP, Port: d.udp.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		d.udp.Close()
+		return fmt.Errorf("failed to start DNS listener: %w", err)
+	}
+
+	go d.serveUDP()
+	go d.serveTCP()
+	return nil
+}
+
+// Close stops the resolver
+func (d *DNSServer) Close() error {
+	for _, upstream := range d.upstreams {
+		upstream.close()
+	}
+	if d.udp == nil {
+		return nil
+	}
+	d.tcp.Close()
+	return d.udp.Close()
+}
+
+// allowed reports whether queries from ip are answered
+func (d *DNSServer) allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || d.subnet.Contains(ip) {
+		return true
+	}
+	_, ok := d.manager.GetClientForDestination(ip.AsSlice())
+	return ok
+}
+
+// acquire takes an in-flight slot, or reports false when all are taken
+func (d *DNSServer) acquire() bool {
+	select {
+	case d.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *DNSServer) release() {
+	<-d.inFlight
+}
+
+func (d *DNSServer) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := d.udp.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !d.allowed(from.Addr()) || !d.acquire() {
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer d.release()
+			if response := d.resolve(query, "udp"); response != nil {
+				d.udp.WriteToUDPAddrPort(response, from)
+			}
+		}()
+	}
+}
+
+func (d *DNSServer) serveTCP() {
+	for {
+		conn, err := d.tcp.AcceptTCP()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		if !d.allowed(conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr()) || !d.acquire() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer d.release()
+			d.serveTCPConn(conn)
+		}()
+	}
+}
+
+// serveTCPConn answers length-prefixed queries on conn until it goes idle
+func (d *DNSServer) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPIdleTimeout))
+		query, err := readDNSStream(conn)
+		if err != nil {
+			return
+		}
+		response := d.resolve(query, "tcp")
+		if response == nil {
+			return
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(response)))); err != nil {
+			return
+		}
+		if _, err := conn.Write(response); err != nil {
+			return
+		}
+	}
+}
+
+// readDNSStream reads one [2 byte length][message] DNS message from conn
+func readDNSStream(conn net.Conn) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// resolve returns the response to query, received over network ("udp" or
+// "tcp"), or nil if it gets none
+func (d *DNSServer) resolve(query []byte, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response || header.OpCode != 0 {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+
+	if name, ok := d.localName(question.Name); ok {
+		return d.answer(header, question, name)
+	}
+
+	now := time.Now()
+	response := d.cache.get(question, header.ID, now)
+	if response == nil {
+		if response, err = d.forward(query, network); err != nil {
+			return dnsReply(header, question, dnsmessage.RCodeServerFailure, false, nil)
+		}
+		d.cache.put(question, response, now)
+	}
+	// DoT, DoH and cached answers may be longer than the client takes over UDP
+	if network == "udp" && len(response) > udpLimit(&parser) {
+		return dnsTruncated(header, question)
+	}
+	return response
+}
+
+// udpLimit returns the largest UDP response the querying client takes: the
+// size in its EDNS OPT record, or 512. parser has read the question.
+func udpLimit(parser *dnsmessage.Parser) int {
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return 512
+	}
+	for {
+		h, err := parser.AdditionalHeader()
+		if err != nil {
+			return 512
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			return max(512, int(h.Class))
+		}
+		if parser.SkipAdditional() != nil {
+			return 512
+		}
+	}
+}
+
+// localName returns the label of name in d.domain ("" for the domain
+// itself), reporting false for names outside it
+func (d *DNSServer) localName(name dnsmessage.Name) (string, bool) {
+	fqdn := strings.ToLower(name.String())
+	if fqdn == d.domain {
+		return "", true
+	}
+	label, ok := strings.CutSuffix(fqdn, "."+d.domain)
+	return label, ok
+}
+
+// answer answers a question for a name in the VPN domain
+func (d *DNSServer) answer(header dnsmessage.Header, question dnsmessage.Question, name string) []byte {
+	if name == "" {
+		return dnsReply(header, question, dnsmessage.RCodeSuccess, true, nil)
+	}
+	ip, ok := d.lookup(name)
+	if !ok {
+		return dnsReply(header, question, dnsmessage.RCodeNameError, true, nil)
+	}
+	if question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeALL {
+		return dnsReply(header, question, dnsmessage.RCodeSuccess, true, nil)
+	}
+	return dnsReply(header, question, dnsmessage.RCodeSuccess, true, &dnsmessage.AResource{A: [4]byte(ip.To4())})
+}
+
+// lookup returns the address of the client named name
+func (d *DNSServer) lookup(name string) (net.IP, bool) {
+	if session, ok := d.manager.ClientByName(name); ok {
+		return session.AssignedIP, true
+	}
+	if cluster != nil {
+		return cluster.LookupName(name)
+	}
+	return nil, false
+}
+
+// dnsReply builds a response to question with rcode and, if a is set, one A record
+func dnsReply(query dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode, authoritative bool, a *dnsmessage.AResource) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		Authoritative:      authoritative,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+	builder.StartQuestions()
+	builder.Question(question)
+	if a != nil {
+		builder.StartAnswers()
+		builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}, *a)
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// dnsTruncated builds an empty response with the TC bit set, which sends the
+// client to ask again over TCP
+func dnsTruncated(query dnsmessage.Header, question dnsmessage.Question) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		Truncated:          true,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	builder.StartQuestions()
+	builder.Question(question)
+	response, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// forward relays query to the upstreams in turn and returns the first
+// response; network is how the client asked
+func (d *DNSServer) forward(query []byte, network string) ([]byte, error) {
+	err := errors.New("no DNS upstreams")
+	for _, upstream := range d.upstreams {
+		var response []byte
+		if response, err = upstream.exchange(query, network); err == nil {
+			return response, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsCacheSize   = 4096             // Answers kept at most
+	dnsNegativeTTL = 30 * time.Second // For negative answers without an SOA to take a TTL from
+	dnsMaxCacheTTL = time.Hour        // However long an upstream says
+)
+
+// dnsCache keeps upstream answers for their TTL, so repeated lookups do not
+// leave the server again. Answers are served with the TTLs that remain.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+	size    int
+}
+
+type dnsCacheKey struct {
+	name  string // Lowercase
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{entries: make(map[dnsCacheKey]*dnsCacheEntry), size: size}
+}
+
+func cacheKey(question dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{name: strings.ToLower(question.Name.String()), qtype: question.Type, class: question.Class}
+}
+
+// get returns the cached answer to question as a response with id, or nil
+func (c *dnsCache) get(question dnsmessage.Question, id uint16, now time.Time) []byte {
+	key := cacheKey(question)
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	msg := entry.msg
+	msg.ID = id
+	msg.Questions = []dnsmessage.Question{question} // In the client's spelling
+	msg.Answers = agedResources(msg.Answers, elapsed)
+	msg.Authorities = agedResources(msg.Authorities, elapsed)
+	msg.Additionals = agedResources(msg.Additionals, elapsed)
+	response, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// agedResources returns a copy of resources with elapsed seconds taken off
+// their TTLs. OPT records keep theirs, as the field holds EDNS flags there.
+func agedResources(resources []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(resources))
+	for i, r := range resources {
+		if r.Header.Type != dnsmessage.TypeOPT {
+			r.Header.TTL -= min(r.Header.TTL, elapsed)
+		}
+		aged[i] = r
+	}
+	return aged
+}
+
+// put caches an upstream response to question for its shortest TTL, or a
+// negative one for the TTL its SOA gives. Only complete answers and NXDOMAIN
+// are cached; failures are asked again.
+func (c *dnsCache) put(question dnsmessage.Question, response []byte, now time.Time) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil || msg.Truncated {
+		return
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+
+	ttl := dnsMaxCacheTTL
+	if len(msg.Answers) == 0 {
+		ttl = min(ttl, negativeTTL(msg.Authorities))
+	} else {
+		for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+			for _, r := range section {
+				ttl = min(ttl, time.Duration(r.Header.TTL)*time.Second)
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) >= c.size {
+		// Still full of live answers: make room with any one of them
+		for key := range c.entries {
+			delete(c.entries, key)
+			break
+		}
+	}
+	c.entries[cacheKey(question)] = &dnsCacheEntry{msg: msg, stored: now, expires: now.Add(ttl)}
+}
+
+// negativeTTL returns how long an NXDOMAIN or empty answer may be cached:
+// the lower of its SOA record's TTL and the SOA's MINIMUM field (RFC 2308),
+// or dnsNegativeTTL without an SOA
+func negativeTTL(authorities []dnsmessage.Resource) time.Duration {
+	for _, r := range authorities {
+		if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(r.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+	return dnsNegativeTTL
+}
+
+// Len returns the number of cached answers, expired ones included
+func (c *dnsCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
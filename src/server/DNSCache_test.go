@@ -0,0 +1,126 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testQuery returns a question for name and a query carrying it
+func testQuery(t *testing.T, name string) (dnsmessage.Question, []byte) {
+	t.Helper()
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(question)
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("building query: %v", err)
+	}
+	return question, query
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	cache := newDNSCache(16)
+	now := time.Now()
+	question, query := testQuery(t, "www.example.com.")
+	cache.put(question, testAnswer(query, 1), now)
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(cache.get(question, 0x1234, now.Add(20*time.Second))); err != nil {
+		t.Fatalf("cached answer: %v", err)
+	}
+	if msg.ID != 0x1234 || len(msg.Answers) != 1 || msg.Answers[0].Header.TTL != dnsTTL-20 {
+		t.Fatalf("cached answer = ID %#x, %d records, TTL %d", msg.ID, len(msg.Answers), msg.Answers[0].Header.TTL)
+	}
+	if cache.get(question, 1, now.Add(dnsTTL*time.Second)) != nil {
+		t.Fatalf("answer served after its TTL")
+	}
+
+	// Failures are not kept; NXDOMAIN without records is, for dnsNegativeTTL
+	for rcode, kept := range map[dnsmessage.RCode]bool{dnsmessage.RCodeServerFailure: false, dnsmessage.RCodeNameError: true} {
+		var parser dnsmessage.Parser
+		header, _ := parser.Start(query)
+		cache.put(question, dnsReply(header, question, rcode, false, nil), now)
+		if got := cache.get(question, 1, now.Add(dnsNegativeTTL-time.Second)) != nil; got != kept {
+			t.Errorf("%v cached = %v, want %v", rcode, got, kept)
+		}
+		if cache.get(question, 1, now.Add(dnsNegativeTTL)) != nil {
+			t.Errorf("%v served after %s", rcode, dnsNegativeTTL)
+		}
+	}
+}
+
+// negativeAnswer returns a response to query with rcode, no answers and an
+// SOA with the given TTL and MINIMUM
+func negativeAnswer(t *testing.T, query []byte, rcode dnsmessage.RCode, ttl, minTTL uint32) []byte {
+	t.Helper()
+	var parser dnsmessage.Parser
+	header, _ := parser.Start(query)
+	question, _ := parser.Question()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RCode: rcode})
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAuthorities()
+	builder.SOAResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: ttl}, dnsmessage.SOAResource{
+		NS:      dnsmessage.MustNewName("ns.example.com."),
+		MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		MinTTL:  minTTL,
+	})
+	response, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("building answer: %v", err)
+	}
+	return response
+}
+
+func TestDNSCacheNegativeTTL(t *testing.T) {
+	now := time.Now()
+	question, query := testQuery(t, "missing.example.com.")
+	for _, tc := range []struct {
+		rcode       dnsmessage.RCode
+		ttl, minTTL uint32
+		want        time.Duration
+	}{
+		{dnsmessage.RCodeNameError, 300, 5, 5 * time.Second},
+		{dnsmessage.RCodeNameError, 3, 900, 3 * time.Second},
+		{dnsmessage.RCodeSuccess, 300, 7, 7 * time.Second}, // No records of the type
+		{dnsmessage.RCodeNameError, 86400, 86400, dnsMaxCacheTTL},
+	} {
+		cache := newDNSCache(16)
+		cache.put(question, negativeAnswer(t, query, tc.rcode, tc.ttl, tc.minTTL), now)
+		response := cache.get(question, 1, now.Add(tc.want-time.Second))
+		var msg dnsmessage.Message
+		if err := msg.Unpack(response); err != nil || msg.RCode != tc.rcode || len(msg.Authorities) != 1 {
+			t.Errorf("%v with SOA TTL %d, MINIMUM %d not cached for %s", tc.rcode, tc.ttl, tc.minTTL, tc.want)
+			continue
+		}
+		if cache.get(question, 1, now.Add(tc.want)) != nil {
+			t.Errorf("%v with SOA TTL %d, MINIMUM %d served after %s", tc.rcode, tc.ttl, tc.minTTL, tc.want)
+		}
+	}
+}
+
+func TestDNSCacheSize(t *testing.T) {
+	cache := newDNSCache(2)
+	now := time.Now()
+	for _, name := range []string{"a.example.com.", "b.example.com.", "c.example.com."} {
+		question, query := testQuery(t, name)
+		cache.put(question, testAnswer(query, 1), now)
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("cache holds %d answers, want 2", cache.Len())
+	}
+	question, _ := testQuery(t, "c.example.com.")
+	if cache.get(question, 1, now) == nil {
+		t.Fatalf("newest answer was evicted")
+	}
+}
@@ -0,0 +1,226 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsMessageType    = "application/dns-message" // Of DNS-over-HTTPS requests and responses (RFC 8484)
+	dnsTLSIdleConns   = 4                         // DoT connections kept open per upstream
+	dnsTLSIdleTimeout = 10 * time.Second          // Before a kept DoT connection is closed instead of reused
+)
+
+// dnsUpstream is a resolver the built-in DNS server relays queries to: plain
+// DNS over the client's own UDP or TCP, DNS over TLS or DNS over HTTPS
+type dnsUpstream struct {
+	name   string       // As in dns_upstreams, for logs
+	addr   string       // host:port, for plain DNS and DNS over TLS
+	tls    *tls.Config  // DNS over TLS, nil otherwise
+	url    string       // DNS over HTTPS, "" otherwise
+	client *http.Client // DNS over HTTPS; keeps connections open between queries
+
+	mu   sync.Mutex
+	idle []idleConn // DNS over TLS connections kept open between queries (RFC 7858)
+}
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// newDNSUpstream creates the upstream for a normalized dns_upstreams entry.
+// tlsConfig carries the roots to verify DoT and DoH servers with, nil = the
+// system's.
+func newDNSUpstream(spec string, tlsConfig *tls.Config) *dnsUpstream {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	u := &dnsUpstream{name: spec}
+	switch {
+	case strings.HasPrefix(spec, "https://"):
+		u.url = spec
+		u.client = &http.Client{
+			Timeout: dnsUpstreamTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig.Clone(),
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+	case strings.HasPrefix(spec, "tls://"):
+		u.addr = strings.TrimPrefix(spec, "tls://")
+		host, _, _ := net.SplitHostPort(u.addr)
+		u.tls = tlsConfig.Clone()
+		u.tls.ServerName = host
+	default:
+		u.addr = spec
+	}
+	return u
+}
+
+// exchange sends query to the upstream and returns the response with the
+// same ID. network ("udp" or "tcp") is how the client asked and only matters
+// for plain DNS, so a truncated UDP answer reaches the client to retry over TCP.
+func (u *dnsUpstream) exchange(query []byte, network string) ([]byte, error) {
+	var response []byte
+	var err error
+	switch {
+	case u.client != nil:
+		response, err = u.exchangeHTTPS(query)
+	case u.tls != nil:
+		response, err = u.exchangeTLS(query)
+	case network == "tcp":
+		response, err = u.exchangeTCP(query)
+	default:
+		return u.exchangeUDP(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 2 || [2]byte(response) != [2]byte(query) {
+		return nil, fmt.Errorf("response from %s does not match the query", u.name)
+	}
+	return response, nil
+}
+
+func (u *dnsUpstream) exchangeUDP(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", u.addr, dnsUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// A stray datagram with another ID is skipped, not taken as the answer
+		if n >= 2 && [2]byte(buf) == [2]byte(query) {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (u *dnsUpstream) exchangeTCP(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", u.addr, dnsUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(conn, query)
+}
+
+// exchangeTLS sends query over a kept connection, or a new one if there is
+// none or the server has closed it since, and keeps the connection open after
+func (u *dnsUpstream) exchangeTLS(query []byte) ([]byte, error) {
+	if conn := u.takeIdle(); conn != nil {
+		if response, err := exchangeStream(conn, query); err == nil {
+			u.putIdle(conn)
+			return response, nil
+		}
+		conn.Close()
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: dnsUpstreamTimeout}, "tcp", u.addr, u.tls)
+	if err != nil {
+		return nil, err
+	}
+	response, err := exchangeStream(conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	u.putIdle(conn)
+	return response, nil
+}
+
+// takeIdle returns the most recently used kept connection, closing those
+// idle for too long, or nil
+func (u *dnsUpstream) takeIdle() net.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for len(u.idle) > 0 {
+		idle := u.idle[len(u.idle)-1]
+		u.idle = u.idle[:len(u.idle)-1]
+		if time.Since(idle.since) < dnsTLSIdleTimeout {
+			return idle.conn
+		}
+		idle.conn.Close()
+	}
+	return nil
+}
+
+// putIdle keeps conn open for the next query, or closes it if enough are kept
+func (u *dnsUpstream) putIdle(conn net.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) >= dnsTLSIdleConns {
+		conn.Close()
+		return
+	}
+	u.idle = append(u.idle, idleConn{conn: conn, since: time.Now()})
+}
+
+// close closes the connections kept open to the upstream
+func (u *dnsUpstream) close() {
+	u.mu.Lock()
+	idle := u.idle
+	u.idle = nil
+	u.mu.Unlock()
+	for _, i := range idle {
+		i.conn.Close()
+	}
+	if u.client != nil {
+		u.client.CloseIdleConnections()
+	}
+}
+
+// exchangeStream sends query as [2 byte length][message] over conn, as DNS
+// over TCP and TLS do, and reads the response
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+		return nil, err
+	}
+	return readDNSStream(conn)
+}
+
+func (u *dnsUpstream) exchangeHTTPS(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", u.name, resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != dnsMessageType {
+		return nil, fmt.Errorf("%s answered with %q instead of %s", u.name, contentType, dnsMessageType)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
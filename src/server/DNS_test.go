@@ -0,0 +1,388 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testAnswer answers query with count A records, 192.0.2.99 first
+func testAnswer(query []byte, count int) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	msg.Response, msg.RecursionAvailable = true, true
+	msg.Additionals = nil
+	for i := 0; i < count; i++ {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: dnsTTL},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, byte(99 + i)}},
+		})
+	}
+	response, _ := msg.Pack()
+	return response
+}
+
+// fakeUpstream answers every A query over UDP and TCP with 192.0.2.99
+func fakeUpstream(t *testing.T) string {
+	t.Helper()
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	tcp, err := net.ListenTCP("tcp4", net.TCPAddrFromAddrPort(udp.LocalAddr().(*net.UDPAddr).AddrPort()))
+	if err != nil {
+		t.Fatalf("ListenTCP: %v", err)
+	}
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+
+	reply := func(query []byte) []byte { return testAnswer(query, 1) }
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := udp.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteToUDPAddrPort(reply(buf[:n]), from)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			query, err := readDNSStream(conn)
+			if err == nil {
+				response := reply(query)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			}
+			conn.Close()
+		}
+	}()
+	return udp.LocalAddr().String()
+}
+
+// queryDNS asks server for name over network, with an EDNS size if
+// udpSize is set, and returns the response
+func queryDNS(t *testing.T, server, network, name string, qtype dnsmessage.Type, udpSize uint16) *dnsmessage.Message {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x4242, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	if udpSize > 0 {
+		var opt dnsmessage.ResourceHeader
+		opt.SetEDNS0(int(udpSize), dnsmessage.RCodeSuccess, false)
+		builder.StartAdditionals()
+		builder.OPTResource(opt, dnsmessage.OPTResource{})
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("building query: %v", err)
+	}
+
+	conn, err := net.DialTimeout(network, server, time.Second)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	var response []byte
+	if network == "tcp" {
+		conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...))
+		if response, err = readDNSStream(conn); err != nil {
+			t.Fatalf("reading %s response: %v", name, err)
+		}
+	} else {
+		conn.Write(query)
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("reading %s response: %v", name, err)
+		}
+		response = buf[:n]
+	}
+
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("unpacking %s response: %v", name, err)
+	}
+	if msg.ID != 0x4242 || !msg.Response {
+		t.Fatalf("bad response header %+v", msg.Header)
+	}
+	return msg
+}
+
+// lookupA asks server for name's A records over network
+func lookupA(t *testing.T, server, network, name string) (dnsmessage.RCode, []net.IP) {
+	t.Helper()
+	msg := queryDNS(t, server, network, name, dnsmessage.TypeA, 0)
+	return msg.RCode, aRecords(msg)
+}
+
+// aRecords returns the addresses in msg's A records
+func aRecords(msg *dnsmessage.Message) []net.IP {
+	var ips []net.IP
+	for _, answer := range msg.Answers {
+		if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+			ips = append(ips, net.IP(a.A[:]))
+		}
+	}
+	return ips
+}
+
+func TestDNSServer(t *testing.T) {
+	manager := newTestManager(t)
+	alice, _ := addTestSession(t, manager, 1, "token-alice")
+	manager.ClaimName(alice.Addr, dnsName("Alice"))
+	pending, _ := addTestSession(t, manager, 2, "token-bob")
+	manager.ClaimName(pending.Addr, "bob")
+	pending.Authenticated.Store(false)
+
+	cfg := &ServerConfig{TunIP: "10.8.0.1", TunSubnet: "10.8.0.0/24", DNSEnabled: true, DNSDomain: "Corp.VPN.", DNSUpstreams: []string{fakeUpstream(t)}}
+	if err := cfg.validateDNS(); err != nil {
+		t.Fatalf("validateDNS: %v", err)
+	}
+	d := NewDNSServer(cfg, manager)
+	if err := d.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer d.Close()
+	server := d.udp.LocalAddr().String()
+
+	for _, network := range []string{"udp", "tcp"} {
+		rcode, ips := lookupA(t, server, network, "ALICE.corp.vpn.")
+		if rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || !ips[0].Equal(alice.AssignedIP) {
+			t.Fatalf("%s: alice = %v %v, want %v", network, rcode, ips, alice.AssignedIP)
+		}
+		if rcode, ips := lookupA(t, server, network, network+".example.com."); rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 99)) {
+			t.Fatalf("%s: forwarded answer = %v %v", network, rcode, ips)
+		}
+	}
+	if msg := queryDNS(t, server, "udp", "alice.corp.vpn.", dnsmessage.TypeAAAA, 0); msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Fatalf("AAAA for alice = %v %v, want an empty answer", msg.RCode, msg.Answers)
+	}
+	// bob has not authenticated, so has no name yet
+	for _, name := range []string{"bob.corp.vpn.", "nobody.corp.vpn.", "a.alice.corp.vpn."} {
+		if rcode, _ := lookupA(t, server, "udp", name); rcode != dnsmessage.RCodeNameError {
+			t.Fatalf("%s = %v, want NXDOMAIN", name, rcode)
+		}
+	}
+
+	d.upstreams = []*dnsUpstream{newDNSUpstream("127.0.0.1:1", nil)}
+	if rcode, _ := lookupA(t, server, "tcp", "uncached.example.com."); rcode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("unreachable upstream = %v, want SERVFAIL", rcode)
+	}
+}
+
+func TestDNSNames(t *testing.T) {
+	for username, want := range map[string]string{
+		"alice":       "alice",
+		"Bob-2":       "bob-2",
+		"":            "",
+		"-x":          "",
+		"carol.smith": "",
+		"dave_smith":  "",
+	} {
+		if got := dnsName(username); got != want {
+			t.Errorf("dnsName(%q) = %q, want %q", username, got, want)
+		}
+	}
+
+	cfg := &ServerConfig{TunIP: "10.8.0.1", DNSEnabled: true, DNS: []string{"1.1.1.1"}}
+	if err := cfg.validateDNS(); err != nil || cfg.DNSDomain != "vpn" || cfg.dnsUpstreams[0] != "1.1.1.1:53" {
+		t.Fatalf("defaults: %v %q %v", err, cfg.DNSDomain, cfg.dnsUpstreams)
+	}
+	if domains := cfg.ClientSearchDomains(); len(domains) != 1 || domains[0] != "vpn" {
+		t.Fatalf("search domains = %v", domains)
+	}
+	if servers := cfg.ClientDNSServers(); len(servers) != 1 || !servers[0].Equal(net.IPv4(10, 8, 0, 1)) {
+		t.Fatalf("DNS servers = %v", servers)
+	}
+	if err := (&ServerConfig{DNSDomain: "bad_domain"}).validateDNS(); err == nil {
+		t.Fatalf("invalid dns_domain accepted")
+	}
+
+	cfg = &ServerConfig{Groups: []GroupConfig{
+		{Name: "ops", Usernames: []string{"Alice"}},
+		{Name: "dev", Usernames: []string{"alice"}},
+	}}
+	if err := cfg.validateDNS(); err == nil {
+		t.Fatalf("username of two groups accepted")
+	}
+	cfg.Groups = cfg.Groups[:1]
+	if err := cfg.validateDNS(); err != nil {
+		t.Fatalf("validateDNS: %v", err)
+	}
+	for _, tt := range []struct {
+		group, name string
+		want        bool
+	}{
+		{"ops", "alice", true},
+		{"ops", "bob", false},
+		{"", "alice", false},
+		{"", "bob", true},
+		{"ops", "", false}, // The group's clients must send a name
+		{"", "", true},
+	} {
+		if got := cfg.NameAllowed(tt.group, tt.name); got != tt.want {
+			t.Errorf("NameAllowed(%q, %q) = %v, want %v", tt.group, tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeEncryptedUpstreams starts a stand-in DNS-over-HTTPS server on
+// /dns-query and a DNS-over-TLS listener with the same certificate, both
+// answering with testAnswer: 60 records for names starting "big.", 1 for
+// others. It returns them with the TLS config that trusts them and counters
+// of the queries each got and of the DoT connections.
+func fakeEncryptedUpstreams(t *testing.T) (doh, dot string, tlsConfig *tls.Config, dohQueries, dotQueries, dotConns *atomic.Int32) {
+	t.Helper()
+	dohQueries, dotQueries, dotConns = &atomic.Int32{}, &atomic.Int32{}, &atomic.Int32{}
+	answer := func(query []byte) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err == nil && len(msg.Questions) == 1 && strings.HasPrefix(msg.Questions[0].Name.String(), "big.") {
+			return testAnswer(query, 60)
+		}
+		return testAnswer(query, 1)
+	}
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(w, "not a DoH query", http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		dohQueries.Add(1)
+		w.Header().Set("Content-Type", dnsMessageType)
+		w.Write(answer(query))
+	}))
+	t.Cleanup(ts.Close)
+
+	listener, err := tls.Listen("tcp4", "127.0.0.1:0", ts.TLS.Clone())
+	if err != nil {
+		t.Fatalf("tls.Listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	// Like a busy server, the DoT stand-in closes a connection after two queries
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			dotConns.Add(1)
+			go func() {
+				defer conn.Close()
+				for range 2 {
+					query, err := readDNSStream(conn)
+					if err != nil {
+						return
+					}
+					dotQueries.Add(1)
+					response := answer(query)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+
+	tlsConfig = ts.Client().Transport.(*http.Transport).TLSClientConfig
+	return ts.URL + "/dns-query", "tls://" + listener.Addr().String(), tlsConfig, dohQueries, dotQueries, dotConns
+}
+
+func TestDNSEncryptedUpstreams(t *testing.T) {
+	manager := newTestManager(t)
+	doh, dot, tlsConfig, dohQueries, dotQueries, dotConns := fakeEncryptedUpstreams(t)
+
+	cfg := &ServerConfig{TunIP: "10.8.0.1", TunSubnet: "10.8.0.0/24", DNSEnabled: true, DNSUpstreams: []string{doh, dot}}
+	if err := cfg.validateDNS(); err != nil {
+		t.Fatalf("validateDNS: %v", err)
+	}
+	d := NewDNSServer(cfg, manager)
+	// The system roots do not trust the stand-ins
+	d.upstreams = []*dnsUpstream{newDNSUpstream(cfg.dnsUpstreams[0], tlsConfig), newDNSUpstream(cfg.dnsUpstreams[1], tlsConfig)}
+	if err := d.Listen("127.0.0.1:0"); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer d.Close()
+	server := d.udp.LocalAddr().String()
+
+	msg := queryDNS(t, server, "udp", "www.example.com.", dnsmessage.TypeA, 0)
+	if ips := aRecords(msg); msg.RCode != dnsmessage.RCodeSuccess || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 99)) || dohQueries.Load() != 1 {
+		t.Fatalf("DoH answer = %v %v after %d queries", msg.RCode, ips, dohQueries.Load())
+	}
+
+	// Asked again, in other letters, the answer comes from the cache
+	msg = queryDNS(t, server, "udp", "WWW.Example.com.", dnsmessage.TypeA, 0)
+	if len(msg.Answers) != 1 || msg.Questions[0].Name.String() != "WWW.Example.com." || dohQueries.Load() != 1 {
+		t.Fatalf("cached answer = %+v after %d DoH queries", msg, dohQueries.Load())
+	}
+
+	// Too long for a client without EDNS: truncated over UDP, whole over TCP
+	if msg := queryDNS(t, server, "udp", "big.example.com.", dnsmessage.TypeA, 0); !msg.Truncated || len(msg.Answers) != 0 {
+		t.Fatalf("long answer over UDP = %+v, want it truncated", msg.Header)
+	}
+	if msg := queryDNS(t, server, "udp", "big.example.com.", dnsmessage.TypeA, 4096); msg.Truncated || len(msg.Answers) != 60 {
+		t.Fatalf("long answer over UDP with EDNS = %d records, truncated %v", len(msg.Answers), msg.Truncated)
+	}
+	if msg := queryDNS(t, server, "tcp", "big.example.com.", dnsmessage.TypeA, 0); msg.Truncated || len(msg.Answers) != 60 {
+		t.Fatalf("long answer over TCP = %d records, truncated %v", len(msg.Answers), msg.Truncated)
+	}
+
+	// A failing DoH server falls through to DoT
+	d.upstreams[0] = newDNSUpstream(strings.TrimSuffix(doh, "/dns-query")+"/missing", tlsConfig)
+	if rcode, ips := lookupA(t, server, "tcp", "dot.example.com."); rcode != dnsmessage.RCodeSuccess || len(ips) != 1 || dotQueries.Load() != 1 {
+		t.Fatalf("DoT answer = %v %v after %d queries", rcode, ips, dotQueries.Load())
+	}
+
+	// The next query reuses the connection; the one after finds it closed and dials again
+	for _, name := range []string{"dot2.example.com.", "dot3.example.com."} {
+		if rcode, ips := lookupA(t, server, "tcp", name); rcode != dnsmessage.RCodeSuccess || len(ips) != 1 {
+			t.Fatalf("DoT answer for %s = %v %v", name, rcode, ips)
+		}
+	}
+	if dotQueries.Load() != 3 || dotConns.Load() != 2 {
+		t.Fatalf("3 DoT queries took %d queries over %d connections, want 3 over 2", dotQueries.Load(), dotConns.Load())
+	}
+
+	// Without the stand-ins' roots, neither is trusted
+	d.upstreams = []*dnsUpstream{newDNSUpstream(doh, nil), newDNSUpstream(dot, nil)}
+	if rcode, _ := lookupA(t, server, "tcp", "untrusted.example.com."); rcode != dnsmessage.RCodeServerFailure {
+		t.Fatalf("untrusted upstreams = %v, want SERVFAIL", rcode)
+	}
+}
+
+func TestDNSUpstreamConfig(t *testing.T) {
+	for upstream, want := range map[string]string{
+		"9.9.9.9":                                "9.9.9.9:53",
+		"9.9.9.9:5353":                           "9.9.9.9:5353",
+		"tls://dns.quad9.net":                    "tls://dns.quad9.net:853",
+		"tls://9.9.9.9:8853":                     "tls://9.9.9.9:8853",
+		"https://dns.quad9.net/dns-query":        "https://dns.quad9.net/dns-query",
+		"https://cloudflare-dns.com/dns-query?x": "https://cloudflare-dns.com/dns-query?x",
+	} {
+		if got, err := normalizeDNSUpstream(upstream); err != nil || got != want {
+			t.Errorf("normalizeDNSUpstream(%q) = %q, %v, want %q", upstream, got, err, want)
+		}
+	}
+	for _, upstream := range []string{"quic://dns.example", "https:///dns-query", "tls://", ":53"} {
+		if _, err := normalizeDNSUpstream(upstream); err == nil {
+			t.Errorf("normalizeDNSUpstream(%q) accepted", upstream)
+		}
+	}
+}
@@ -6,9 +6,15 @@ import (
 	"github.com/pion/dtls/v2"
 )
 
+// Certificate and key shared by the DTLS and TLS listeners
+const (
+	serverCertFile = "/etc/vpn/server-cert.pem"
+	serverKeyFile  = "/etc/vpn/server-key.pem"
+)
+
 func LoadDtlsConfig(ServerCfg *ServerConfig) (*dtls.Config, error) {
 
-	cert, err := tls.LoadX509KeyPair("/etc/vpn/server-cert.pem", "/etc/vpn/server-key.pem")
+	cert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
 
 	if err != nil {
 		return nil, err
@@ -23,3 +29,17 @@ func LoadDtlsConfig(ServerCfg *ServerConfig) (*dtls.Config, error) {
 	return config, nil
 
 }
+
+// LoadTLSConfig returns the config for the TLS over TCP listener, using the
+// same certificate as DTLS
+func LoadTLSConfig(ServerCfg *ServerConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
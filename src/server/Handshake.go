@@ -0,0 +1,205 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// supportedCapabilities lists the capability bits this server implements
+// with the current config
+func supportedCapabilities() uint32 {
+	capabilities := protocol.CapBatching
+	if ServerCfg.Compression == CompressionZstd {
+		capabilities |= protocol.CapCompressZstd
+	}
+	if ServerCfg.PeerToPeer {
+		capabilities |= protocol.CapPeerToPeer
+	}
+	return capabilities
+}
+
+// sessionTokenSize is the length of the random token issued on a successful hello
+const sessionTokenSize = 16
+
+// newSessionToken generates a random token identifying the session
+func newSessionToken() ([]byte, error) {
+	token := make([]byte, sessionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, fmt.Errorf("failed to generate session token: %w", err)
+	}
+	return token, nil
+}
+
+// handleClientHello processes versioned authentication requests
+func handleClientHello(payload []byte, clientAddr net.Addr) {
+	fmt.Printf("Client hello from %s\n", clientAddr.String())
+
+	if !ClientManager.Exists(clientAddr) {
+		fmt.Printf("Session not found for %s\n", clientAddr.String())
+		sendAuthFailure(clientAddr, protocol.ReasonProtocolError, "no session for this connection")
+		return
+	}
+
+	hello, err := protocol.DecodeClientHello(payload)
+	if err != nil {
+		fmt.Printf("Invalid client hello from %s: %v\n", clientAddr.String(), err)
+		sendAuthFailure(clientAddr, protocol.ReasonProtocolError, "malformed client hello")
+		return
+	}
+
+	version, ok := protocol.NegotiateVersion(hello.Version)
+	if !ok {
+		fmt.Printf("Rejecting %s: protocol version %d not supported (server supports %d-%d)\n",
+			clientAddr.String(), hello.Version, protocol.MinProtocolVersion, protocol.ProtocolVersion)
+		sendVersionReject(clientAddr)
+		return
+	}
+
+	ip := sourceIP(clientAddr)
+	if reason, message, ok := authGuard.Check(ip, time.Now()); !ok {
+		fmt.Printf("Refusing authentication from %s: %s\n", clientAddr.String(), reason)
+		sendAuthFailure(clientAddr, reason, message)
+		return
+	}
+	if delay := authGuard.Delay(hello.Username); delay > 0 {
+		fmt.Printf("Delaying authentication from %s by %v: username %q failed too often\n", clientAddr.String(), delay, hello.Username)
+		time.Sleep(delay)
+	}
+
+	group, ok := ServerCfg.GroupForPassword(hello.Password)
+	name := dnsName(hello.Username)
+	if !ok {
+		fmt.Printf("Authentication failed for %s (username %q): incorrect password\n", clientAddr.String(), hello.Username)
+	} else if !ServerCfg.NameAllowed(group, name) {
+		fmt.Printf("Authentication failed for %s: username %q is not allowed with this password\n", clientAddr.String(), hello.Username)
+		ok = false
+	}
+	if !ok {
+		authGuard.Failed(ip, hello.Username, time.Now())
+		sendAuthFailure(clientAddr, protocol.ReasonBadCredentials, "")
+		return
+	}
+	authGuard.Succeeded(ip, hello.Username)
+
+	token, err := newSessionToken()
+	if err != nil {
+		fmt.Printf("Authentication failed for %s: %v\n", clientAddr.String(), err)
+		sendAuthFailure(clientAddr, protocol.ReasonUnspecified, "internal server error")
+		return
+	}
+
+	capabilities := hello.Capabilities & supportedCapabilities()
+
+	if len(hello.ResumeToken) > 0 {
+		resumeSession(clientAddr, hello.ResumeToken, group)
+	}
+	if !claimName(clientAddr, name) {
+		fmt.Printf("Refusing %s: username %q is in use by another client\n", clientAddr.String(), name)
+		sendAuthFailure(clientAddr, protocol.ReasonNameInUse, name)
+		return
+	}
+	ClientManager.SetHandshake(clientAddr, version, capabilities, token)
+	ClientManager.SetGroup(clientAddr, group)
+	if subnets := ServerCfg.SiteSubnets(group, hello.Subnets); len(subnets) > 0 {
+		subnets = ClientManager.SetSubnets(clientAddr, subnets)
+		fmt.Printf("Routing subnets %v to %s\n", subnets, clientAddr.String())
+	}
+	ClientManager.SetAuthenticated(clientAddr, true)
+
+	// The setters published new versions of the session; the address is the latest one's
+	session, exists := ClientManager.GetClient(clientAddr)
+	if !exists {
+		return
+	}
+	sendServerConfig(clientAddr, version, capabilities, session.AssignedIP, group, token)
+}
+
+// claimName gives the client at addr the DNS name unless another client has
+// it, here or on another cluster node. A client that resumed here keeps its
+// name while the node it left still lists it.
+func claimName(addr net.Addr, name string) bool {
+	if name == "" {
+		return ClientManager.ClaimName(addr, name)
+	}
+	session, exists := ClientManager.GetClient(addr)
+	if !exists {
+		return false
+	}
+	if cluster != nil {
+		if ip, held := cluster.LookupName(name); held && !ip.Equal(session.AssignedIP) {
+			return false
+		}
+	}
+	return ClientManager.ClaimName(addr, name)
+}
+
+// resumeSession gives the client at addr back the address of the session it
+// was issued token for, here or on another cluster node. When that fails the
+// client keeps the fresh address it got on connecting.
+func resumeSession(addr net.Addr, token []byte, group string) {
+	var ip net.IP
+	if old, ok := ClientManager.SessionByToken(token); ok && old.Group == group {
+		ip = old.AssignedIP
+	} else if cluster != nil {
+		if lease, ok := cluster.Lookup(token); ok && lease.Group == group {
+			ip = lease.IP
+		}
+	}
+	if ip == nil {
+		fmt.Printf("No session to resume for %s, assigning a new address\n", addr.String())
+		return
+	}
+
+	if err := ClientManager.Resume(addr, ip); err != nil {
+		fmt.Printf("Failed to resume session of %s at %s: %v\n", addr.String(), ip, err)
+		return
+	}
+	fmt.Printf("Resumed session of %s at %s\n", addr.String(), ip)
+}
+
+// sendServerConfig sends the versioned auth success message to the client
+func sendServerConfig(addr net.Addr, version byte, capabilities uint32, assignedIP net.IP, group string, token []byte) {
+	mode, routes := ServerCfg.RoutePolicy(group)
+
+	packet, err := protocol.EncodeServerConfig(&protocol.SessionConfig{
+		Version:       version,
+		Capabilities:  capabilities,
+		AssignedIP:    assignedIP,
+		PrefixLen:     ServerCfg.PrefixLen(),
+		MTU:           ServerCfg.MTU,
+		DNSServers:    ServerCfg.ClientDNSServers(),
+		SearchDomains: ServerCfg.ClientSearchDomains(),
+		SplitTunnel:   mode == TunnelModeSplit,
+		Routes:        RouteNets(routes),
+		Keepalive:     time.Duration(ServerCfg.KeepaliveInterval) * time.Second,
+		SessionToken:  token,
+	})
+	if err != nil {
+		fmt.Printf("Failed to build server config for %s: %v\n", addr.String(), err)
+		return
+	}
+
+	err = ClientManager.WriteToClient(addr, packet)
+	if err != nil {
+		fmt.Printf("Failed to send server config to %s: %v\n", addr.String(), err)
+	} else {
+		fmt.Printf("Server config sent to %s (protocol v%d, Assigned IP: %s)\n", addr.String(), version, assignedIP.String())
+	}
+}
+
+// sendVersionReject tells the client which protocol versions the server accepts
+func sendVersionReject(addr net.Addr) {
+	packet := protocol.EncodeVersionReject(protocol.MinProtocolVersion, protocol.ProtocolVersion)
+
+	err := ClientManager.WriteToClient(addr, packet)
+	if err != nil {
+		fmt.Printf("Failed to send version reject to %s: %v\n", addr.String(), err)
+	}
+}
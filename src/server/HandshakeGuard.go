@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// tokenBucket allows rate events per second on average, in bursts of up to rate
+type tokenBucket struct {
+	tokens float64 // Events left in the bucket
+	rate   float64 // Tokens added per second, also the bucket size
+	refill time.Time
+}
+
+func newTokenBucket(rate int, now time.Time) tokenBucket {
+	return tokenBucket{tokens: float64(rate), rate: float64(rate), refill: now}
+}
+
+// take removes a token from the bucket, reporting false if it is empty
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.refill).Seconds()*b.rate)
+	b.refill = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// handshakeLimiter limits how often one source IP may start a DTLS handshake,
+// so a single host cannot keep every handshake worker busy
+type handshakeLimiter struct {
+	rate int
+
+	mu      sync.Mutex
+	sources map[netip.Addr]*tokenBucket
+	pruned  time.Time
+}
+
+func newHandshakeLimiter(rate int) *handshakeLimiter {
+	return &handshakeLimiter{rate: rate, sources: make(map[netip.Addr]*tokenBucket), pruned: time.Now()}
+}
+
+// allow reports whether ip may start another handshake
+func (l *handshakeLimiter) allow(ip netip.Addr, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bucket untouched for a second is full again, so it can be forgotten
+	if now.Sub(l.pruned) > time.Minute {
+		for source, b := range l.sources {
+			if now.Sub(b.refill) > time.Second {
+				delete(l.sources, source)
+			}
+		}
+		l.pruned = now
+	}
+
+	b, ok := l.sources[ip]
+	if !ok {
+		bucket := newTokenBucket(l.rate, now)
+		b = &bucket
+		l.sources[ip] = b
+	}
+	return b.take(now)
+}
+
+// knockWindow is how far a knock's time may be from the server's clock
+const knockWindow = 30 * time.Second
+
+// knockFilter accepts only valid knocks it has not seen before, so the DTLS
+// port stays silent for anyone without the knock key
+type knockFilter struct {
+	key []byte
+
+	mu     sync.Mutex
+	seen   map[uint64]time.Time // Nonces of accepted knocks, until they expire
+	pruned time.Time
+}
+
+func newKnockFilter(key string) *knockFilter {
+	return &knockFilter{key: []byte(key), seen: make(map[uint64]time.Time), pruned: time.Now()}
+}
+
+// accept reports whether packet is a fresh knock
+func (f *knockFilter) accept(packet []byte) bool {
+	now := time.Now()
+	nonce, ok := protocol.VerifyKnock(f.key, packet, now, knockWindow)
+	if !ok {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now.Sub(f.pruned) > knockWindow {
+		for n, expires := range f.seen {
+			if now.After(expires) {
+				delete(f.seen, n)
+			}
+		}
+		f.pruned = now
+	}
+
+	// A replayed knock is rejected until its time falls outside the window
+	if _, replayed := f.seen[nonce]; replayed {
+		return false
+	}
+	f.seen[nonce] = now.Add(2 * knockWindow)
+	return true
+}
@@ -13,6 +13,7 @@ type IPPool struct {
 	minIP    int
 	maxIP    int
 	assigned map[int]bool
+	reserved func(ip int) bool // Addresses not to hand out even though free here, nil = none
 	mu       sync.Mutex
 }
 
@@ -31,7 +32,7 @@ func (p *IPPool) Allocate() (int, error) {
 	defer p.mu.Unlock()
 
 	for ip := p.minIP; ip <= p.maxIP; ip++ {
-		if !p.assigned[ip] {
+		if !p.assigned[ip] && (p.reserved == nil || !p.reserved(ip)) {
 			p.assigned[ip] = true
 			return ip, nil
 		}
@@ -40,6 +41,25 @@ func (p *IPPool) Allocate() (int, error) {
 	return 0, fmt.Errorf("no available IPs in pool (range: 10.8.0.%d-10.8.0.%d)", p.minIP, p.maxIP)
 }
 
+// SetReserved sets the check for addresses Allocate must skip
+func (p *IPPool) SetReserved(reserved func(ip int) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reserved = reserved
+}
+
+// Claim marks a specific IP as assigned, reporting false if it is outside the pool or taken
+func (p *IPPool) Claim(ip int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip < p.minIP || ip > p.maxIP || p.assigned[ip] {
+		return false
+	}
+	p.assigned[ip] = true
+	return true
+}
+
 // Release returns an IP back to the pool
 func (p *IPPool) Release(ip int) {
 	p.mu.Lock()
@@ -0,0 +1,96 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// ingressDrop is why a packet from a client was not written to the TUN
+type ingressDrop int
+
+const (
+	dropNone      ingressDrop = iota
+	dropTruncated             // Shorter than its header or total length says
+	dropMalformed             // Not IPv4, header and total lengths that make no sense, or bytes past the total length
+	dropChecksum              // Bad IPv4 header checksum
+	dropSpoofed               // Source is not the session's assigned address
+	dropMartian               // Destination can never be routed from a client
+	numIngressDrops
+)
+
+var ingressDropNames = [numIngressDrops]string{
+	dropNone:      "none",
+	dropTruncated: "truncated",
+	dropMalformed: "malformed",
+	dropChecksum:  "bad_checksum",
+	dropSpoofed:   "spoofed",
+	dropMartian:   "martian",
+}
+
+func (d ingressDrop) String() string {
+	return ingressDropNames[d]
+}
+
+// ingressDrops counts a session's dropped packets by reason
+type ingressDrops [numIngressDrops]atomic.Uint64
+
+// Counts returns the drop counters by reason
+func (d *ingressDrops) Counts() map[string]uint64 {
+	counts := make(map[string]uint64, numIngressDrops-1)
+	for reason := dropNone + 1; reason < numIngressDrops; reason++ {
+		counts[reason.String()] = d[reason].Load()
+	}
+	return counts
+}
+
+// checkIngress decides whether a packet from session may be written to the
+// TUN. Its source must be the session's address or in one of its subnets.
+func checkIngress(packet []byte, session *ClientSession) ingressDrop {
+	if len(packet) < 20 {
+		return dropTruncated
+	}
+	if packet[0]>>4 != 4 {
+		return dropMalformed
+	}
+	headerLen := int(packet[0]&0x0F) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerLen < 20 || totalLen < headerLen {
+		return dropMalformed
+	}
+	if len(packet) < headerLen || len(packet) < totalLen {
+		return dropTruncated
+	}
+	if len(packet) > totalLen {
+		// The packet is written whole, so trailing bytes would reach the TUN
+		return dropMalformed
+	}
+	// A valid header, checksum included, sums to 0xFFFF
+	if CalculateIPChecksum(packet[:headerLen]) != 0 {
+		return dropChecksum
+	}
+
+	src := [4]byte(packet[12:16])
+	if src != ipKey(session.AssignedIP) && !ClientManager.routesSource(src, session) {
+		return dropSpoofed
+	}
+	if isMartian(packet[16:20]) {
+		return dropMartian
+	}
+	return dropNone
+}
+
+// isMartian reports whether dst is an address no client traffic should go
+// to: "this network" (0/8), loopback (127/8), link-local (169.254/16),
+// multicast (224/4) and reserved or broadcast (240/4)
+func isMartian(dst []byte) bool {
+	switch {
+	case dst[0] == 0, dst[0] == 127, dst[0] >= 224:
+		return true
+	case dst[0] == 169 && dst[1] == 254:
+		return true
+	}
+	return false
+}
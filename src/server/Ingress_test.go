@@ -0,0 +1,70 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// ipv4Packet builds a UDP packet from src to dst with a valid header checksum
+func ipv4Packet(src, dst net.IP, payload int) []byte {
+	packet := make([]byte, 28+payload)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = 17
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:12], CalculateIPChecksum(packet[:20]))
+	return packet
+}
+
+func TestCheckIngress(t *testing.T) {
+	newTestManager(t)
+	conn := &discardConn{}
+	session, err := ClientManager.GetOrAddClient(conn.RemoteAddr(), conn)
+	if err != nil {
+		t.Fatalf("GetOrAddClient: %v", err)
+	}
+	ClientManager.SetSubnets(conn.RemoteAddr(), []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")})
+
+	assigned := session.AssignedIP
+	remote := net.IPv4(198, 51, 100, 7)
+	good := ipv4Packet(assigned, remote, 8)
+
+	tests := []struct {
+		name   string
+		packet func() []byte
+		want   ingressDrop
+	}{
+		{"valid", func() []byte { return good }, dropNone},
+		{"short", func() []byte { return good[:19] }, dropTruncated},
+		{"truncated", func() []byte { return good[:24] }, dropTruncated},
+		{"ipv6", func() []byte { p := clonePacket(good); p[0] = 0x65; return p }, dropMalformed},
+		{"short ihl", func() []byte { p := clonePacket(good); p[0] = 0x44; return p }, dropMalformed},
+		{"length below header", func() []byte { p := clonePacket(good); binary.BigEndian.PutUint16(p[2:4], 10); return p }, dropMalformed},
+		{"trailing bytes", func() []byte { return append(clonePacket(good), 0, 0, 0, 0) }, dropMalformed},
+		{"checksum", func() []byte { p := clonePacket(good); p[8]--; return p }, dropChecksum},
+		{"spoofed", func() []byte { return ipv4Packet(net.IPv4(10, 8, 0, 3), remote, 8) }, dropSpoofed},
+		{"from subnet", func() []byte { return ipv4Packet(net.IPv4(192, 168, 10, 5), remote, 8) }, dropNone},
+		{"outside subnet", func() []byte { return ipv4Packet(net.IPv4(192, 168, 11, 5), remote, 8) }, dropSpoofed},
+		{"loopback", func() []byte { return ipv4Packet(assigned, net.IPv4(127, 0, 0, 1), 8) }, dropMartian},
+		{"link-local", func() []byte { return ipv4Packet(assigned, net.IPv4(169, 254, 1, 1), 8) }, dropMartian},
+		{"multicast", func() []byte { return ipv4Packet(assigned, net.IPv4(224, 0, 0, 251), 8) }, dropMartian},
+		{"broadcast", func() []byte { return ipv4Packet(assigned, net.IPv4bcast, 8) }, dropMartian},
+		{"private", func() []byte { return ipv4Packet(assigned, net.IPv4(192, 168, 1, 1), 8) }, dropNone},
+	}
+	for _, tt := range tests {
+		if got := checkIngress(tt.packet(), session); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func clonePacket(p []byte) []byte {
+	return append([]byte(nil), p...)
+}
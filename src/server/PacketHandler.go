@@ -6,79 +6,83 @@ package server
 import (
 	"fmt"
 	"net"
-)
+	"time"
 
-// PacketType identifies the type of VPN packet
-type PacketType byte
-
-const (
-	PacketTypeAuthReq      PacketType = 0x01 // Authentication request
-	PacketTypeAuthRespPass PacketType = 0x02 // Authentication response - success
-	PacketTypeData         PacketType = 0x03 // VPN data packet
-	PacketTypePing         PacketType = 0x04 // Keep-alive ping
-	PacketTypePong         PacketType = 0x05 // Keep-alive pong
-	PacketTypeDisc         PacketType = 0x06 // Disconnect
-	PacketTypeAuthRespFail PacketType = 0x07 // Authentication response - failure
-	PacketTypeAskForIP     PacketType = 0x08 // Request for IP address
-	PacketTypeIPRes        PacketType = 0x09 // IP address response
+	"github.com/varun0310t/VPN/src/protocol"
 )
 
-// VPNPacket represents a VPN protocol packet
-type VPNPacket struct {
-	Type    PacketType
-	Payload []byte
-}
-
 // HandlePacket processes incoming packets from clients
 func HandlePacket(data []byte, clientAddr net.Addr) {
-	// Minimum packet size check
-	if len(data) < 1 {
-		fmt.Printf("Received invalid packet from %s: too small\n", clientAddr.String())
+	packetType, payload, err := protocol.Decode(data)
+	if err != nil {
+		fmt.Printf("Received invalid packet from %s: %v\n", clientAddr.String(), err)
 		return
 	}
 
-	packetType := PacketType(data[0])
-	payload := data[1:]
-
 	switch packetType {
-	case PacketTypeAuthReq:
+	case protocol.PacketTypeClientHello:
+		handleClientHello(payload, clientAddr)
+	case protocol.PacketTypeAuthReq:
 		handleAuthPacket(payload, clientAddr)
-	case PacketTypeData:
+	case protocol.PacketTypeData:
 		handleDataPacket(payload, clientAddr)
-	case PacketTypePing:
+	case protocol.PacketTypeDataBatch:
+		handleDataBatchPacket(payload, clientAddr)
+	case protocol.PacketTypeDataCompressed:
+		handleCompressedDataPacket(payload, clientAddr)
+	case protocol.PacketTypePing:
 		handlePingPacket(payload, clientAddr)
-	case PacketTypeDisc:
+	case protocol.PacketTypeDisc:
 		handleDisconnectPacket(payload, clientAddr)
-	case PacketTypeAskForIP:
+	case protocol.PacketTypeAskForIP:
 		handleAskForIPPacket(payload, clientAddr)
+	case protocol.PacketTypePeerRequest:
+		handlePeerRequestPacket(payload, clientAddr)
 	default:
-		fmt.Printf("Unknown packet type 0x%02x from %s\n", packetType, clientAddr.String())
+		fmt.Printf("Unknown packet type %s from %s\n", packetType, clientAddr.String())
 	}
 }
 
-// handleAuthPacket processes authentication requests
+// handleAuthPacket processes legacy (version 0) authentication requests
 func handleAuthPacket(payload []byte, clientAddr net.Addr) {
 	fmt.Printf("Auth request from %s\n", clientAddr.String())
 
 	session, exists := ClientManager.GetClient(clientAddr)
 	if !exists {
 		fmt.Printf("Session not found for %s\n", clientAddr.String())
-		sendAuthResponse(clientAddr, false, nil)
+		sendAuthFailure(clientAddr, protocol.ReasonProtocolError, "no session for this connection")
 		return
 	}
 
 	// Convert payload to string
-	receivedPassword := string(payload)
-	if receivedPassword != ServerCfg.Password {
+	receivedPassword := protocol.DecodeAuthRequest(payload)
+	ip := sourceIP(clientAddr)
+	if reason, message, ok := authGuard.Check(ip, time.Now()); !ok {
+		fmt.Printf("Refusing authentication from %s: %s\n", clientAddr.String(), reason)
+		sendAuthFailure(clientAddr, reason, message)
+		return
+	}
+
+	group, ok := ServerCfg.GroupForPassword(receivedPassword)
+	if !ok {
 		fmt.Printf("Authentication failed for %s: incorrect password\n", clientAddr.String())
-		sendAuthResponse(clientAddr, false, nil)
+	} else if !ServerCfg.NameAllowed(group, "") {
+		// Legacy requests carry no username, which the group requires
+		fmt.Printf("Authentication failed for %s: group %q needs a username\n", clientAddr.String(), group)
+		ok = false
+	}
+	if !ok {
+		authGuard.Failed(ip, "", time.Now())
+		sendAuthFailure(clientAddr, protocol.ReasonBadCredentials, "")
 		return
 	}
+	authGuard.Succeeded(ip, "")
 
 	// Mark session as authenticated
+	ClientManager.SetGroup(clientAddr, group)
 	ClientManager.SetAuthenticated(clientAddr, true)
 
-	sendAuthResponse(clientAddr, true, session.AssignedIP)
+	sendAuthSuccess(clientAddr, session.AssignedIP, group)
 }
 
 // handleDataPacket processes VPN data packets
@@ -90,41 +94,94 @@ func handleDataPacket(payload []byte, clientAddr net.Addr) {
 		return
 	}
 
-	if !session.Authenticated {
+	if !session.Authenticated.Load() {
 		fmt.Printf("Data packet from unauthenticated client %s - ignored\n", clientAddr.String())
 		return
 	}
 
-	// Update stats
-	ClientManager.UpdateLastSeen(clientAddr)
-	ClientManager.AddBytesRecv(clientAddr, uint64(len(payload)))
+	// Update stats without taking the manager lock
+	session.Touch()
+	session.BytesRecv.Add(uint64(len(payload)))
 
 	//fmt.Printf("Data packet from %s (Assigned IP: %s): %d bytes\n",
 	//	clientAddr.String(), session.AssignedIP.String(), len(payload))
 
 	// Forward packet to the TUN interface
-	err := tunManager.ForwardFromClient(payload, session.AssignedIP)
+	err := tunManager.ForwardFromClient(payload, session)
 	if err != nil {
 		fmt.Printf("Failed to forward packet from %s: %v\n", clientAddr.String(), err)
 	}
 }
 
+// handleDataBatchPacket unpacks a batch of VPN data packets and forwards each to TUN
+func handleDataBatchPacket(payload []byte, clientAddr net.Addr) {
+	session, exists := ClientManager.GetClient(clientAddr)
+	if !exists || !session.Authenticated.Load() {
+		fmt.Printf("Data batch from unauthenticated client %s - ignored\n", clientAddr.String())
+		return
+	}
+	if session.Capabilities&protocol.CapBatching == 0 {
+		fmt.Printf("Data batch from %s without negotiating batching - ignored\n", clientAddr.String())
+		return
+	}
+
+	session.Touch()
+	session.BytesRecv.Add(uint64(len(payload)))
+
+	err := tunManager.ForwardBatchFromClient(payload, session)
+	if err != nil {
+		fmt.Printf("Failed to forward data batch from %s: %v\n", clientAddr.String(), err)
+	}
+}
+
+// handleCompressedDataPacket expands a compressed VPN data packet and forwards it to TUN
+func handleCompressedDataPacket(payload []byte, clientAddr net.Addr) {
+	session, exists := ClientManager.GetClient(clientAddr)
+	if !exists || !session.Authenticated.Load() {
+		fmt.Printf("Compressed data from unauthenticated client %s - ignored\n", clientAddr.String())
+		return
+	}
+	if session.Capabilities&protocol.CapCompressZstd == 0 {
+		fmt.Printf("Compressed data from %s without negotiating compression - ignored\n", clientAddr.String())
+		return
+	}
+
+	session.Touch()
+	session.BytesRecv.Add(uint64(len(payload)))
+
+	session.decompressor.mu.Lock()
+	defer session.decompressor.mu.Unlock()
+	packet, err := session.decompressor.Decompress(payload)
+	if err != nil {
+		fmt.Printf("Bad compressed packet from %s: %v\n", clientAddr.String(), err)
+		return
+	}
+	if err := tunManager.ForwardFromClient(packet, session); err != nil {
+		fmt.Printf("Failed to forward packet from %s: %v\n", clientAddr.String(), err)
+	}
+}
+
 // handlePingPacket processes keep-alive pings
 func handlePingPacket(payload []byte, clientAddr net.Addr) {
 	// Check if client is authenticated
 	session, exists := ClientManager.GetClient(clientAddr)
-	if !exists || !session.Authenticated {
+	if !exists || !session.Authenticated.Load() {
 		fmt.Printf("Ping from unauthenticated client %s - ignored\n", clientAddr.String())
 		return
 	}
 
-	ClientManager.UpdateLastSeen(clientAddr)
+	session.Touch()
 	sendPongPacket(clientAddr)
 }
 
 // handleDisconnectPacket processes disconnect requests
 func handleDisconnectPacket(payload []byte, clientAddr net.Addr) {
-	fmt.Printf("Disconnect request from %s\n", clientAddr.String())
+	reason, message := protocol.DecodeDisconnect(payload)
+	if message != "" {
+		fmt.Printf("Disconnect request from %s: %s (%s)\n", clientAddr.String(), reason, message)
+	} else {
+		fmt.Printf("Disconnect request from %s: %s\n", clientAddr.String(), reason)
+	}
 	ClientManager.RemoveClient(clientAddr)
 }
 
@@ -132,7 +189,7 @@ func handleDisconnectPacket(payload []byte, clientAddr net.Addr) {
 func handleAskForIPPacket(payload []byte, clientAddr net.Addr) {
 	// Check if client is authenticated
 	session, exists := ClientManager.GetClient(clientAddr)
-	if !exists || !session.Authenticated {
+	if !exists || !session.Authenticated.Load() {
 		fmt.Printf("IP request from unauthenticated client %s - ignored\n", clientAddr.String())
 		return
 	}
@@ -142,48 +199,63 @@ func handleAskForIPPacket(payload []byte, clientAddr net.Addr) {
 	sendIPResponse(clientAddr, session.AssignedIP)
 }
 
-// sendAuthResponse sends authentication response to client
-func sendAuthResponse(addr net.Addr, success bool, assignedIP net.IP) {
-	var response []byte
-
-	if success {
-		// Convert IP to 4-byte format
-		ip4 := assignedIP.To4()
-		if ip4 == nil {
-			fmt.Printf("Invalid IP address format\n")
-			return
-		}
-
-		// Success response with assigned IP (5 bytes total)
-		response = make([]byte, 5)
-		response[0] = byte(PacketTypeAuthRespPass)
-		response[1] = ip4[0] // First octet (10)
-		response[2] = ip4[1] // Second octet (8)
-		response[3] = ip4[2] // Third octet (0)
-		response[4] = ip4[3] // Fourth octet
-	} else {
-		// Failure response
-		response = []byte{byte(PacketTypeAuthRespFail)}
+// handlePeerRequestPacket passes a request for a direct path to another client to the rendezvous
+func handlePeerRequestPacket(payload []byte, clientAddr net.Addr) {
+	session, exists := ClientManager.GetClient(clientAddr)
+	if !exists || !session.Authenticated.Load() || session.Capabilities&protocol.CapPeerToPeer == 0 || rendezvous == nil {
+		fmt.Printf("Peer request from %s without negotiating peer-to-peer - ignored\n", clientAddr.String())
+		return
+	}
+
+	req, err := protocol.DecodePeerRequest(payload)
+	if err != nil {
+		fmt.Printf("Invalid peer request from %s: %v\n", clientAddr.String(), err)
+		return
+	}
+	if err := rendezvous.Request(session, req, time.Now()); err != nil {
+		fmt.Printf("Peer request from %s for %s failed: %v\n", clientAddr.String(), req.PeerIP, err)
+	}
+}
+
+// sendAuthSuccess sends the legacy authentication success response to client
+func sendAuthSuccess(addr net.Addr, assignedIP net.IP, group string) {
+	mode, routes := ServerCfg.RoutePolicy(group)
+
+	// DNS settings and routing policy follow the assigned IP; older clients only read the IP
+	response, err := protocol.EncodeAuthSuccess(&protocol.AuthSuccess{
+		AssignedIP:    assignedIP,
+		DNSServers:    ServerCfg.ClientDNSServers(),
+		SearchDomains: ServerCfg.ClientSearchDomains(),
+		SplitTunnel:   mode == TunnelModeSplit,
+		Routes:        RouteNets(routes),
+	})
+	if err != nil {
+		fmt.Printf("Failed to build auth response for %s: %v\n", addr.String(), err)
+		return
 	}
 
 	// Use ClientManager to write to client
-	err := ClientManager.WriteToClient(addr, response)
+	err = ClientManager.WriteToClient(addr, response)
 	if err != nil {
 		fmt.Printf("Failed to send auth response to %s: %v\n", addr.String(), err)
 	} else {
-		if success {
-			fmt.Printf("Auth success sent to %s (Assigned IP: %s)\n", addr.String(), assignedIP.String())
-		} else {
-			fmt.Printf("Auth failure sent to %s\n", addr.String())
-		}
+		fmt.Printf("Auth success sent to %s (Assigned IP: %s)\n", addr.String(), assignedIP.String())
+	}
+}
+
+// sendAuthFailure tells the client why authentication was refused
+func sendAuthFailure(addr net.Addr, reason protocol.Reason, message string) {
+	err := ClientManager.WriteToClient(addr, protocol.EncodeAuthFail(reason, message))
+	if err != nil {
+		fmt.Printf("Failed to send auth failure to %s: %v\n", addr.String(), err)
+	} else {
+		fmt.Printf("Auth failure sent to %s: %s\n", addr.String(), reason)
 	}
 }
 
 // sendPongPacket sends pong response to client
 func sendPongPacket(addr net.Addr) {
-	packet := []byte{byte(PacketTypePong)}
-
-	err := ClientManager.WriteToClient(addr, packet)
+	err := ClientManager.WriteToClient(addr, protocol.EncodePong())
 	if err != nil {
 		fmt.Printf("Failed to send pong to %s: %v\n", addr.String(), err)
 	}
@@ -191,22 +263,13 @@ func sendPongPacket(addr net.Addr) {
 
 // sendIPResponse sends IP address response to client
 func sendIPResponse(addr net.Addr, assignedIP net.IP) {
-	// Convert to 4-byte format
-	ip4 := assignedIP.To4()
-	if ip4 == nil {
+	response, err := protocol.EncodeIPResponse(assignedIP)
+	if err != nil {
 		fmt.Printf("Invalid IP address format\n")
 		return
 	}
 
-	// Response: [PacketType][IP byte 1][IP byte 2][IP byte 3][IP byte 4]
-	response := make([]byte, 5)
-	response[0] = byte(PacketTypeIPRes)
-	response[1] = ip4[0]
-	response[2] = ip4[1]
-	response[3] = ip4[2]
-	response[4] = ip4[3]
-
-	err := ClientManager.WriteToClient(addr, response)
+	err = ClientManager.WriteToClient(addr, response)
 	if err != nil {
 		fmt.Printf("Failed to send IP response to %s: %v\n", addr.String(), err)
 	} else {
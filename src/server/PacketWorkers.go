@@ -0,0 +1,101 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"encoding/binary"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// workerQueueSize is how many packets can wait for each worker
+const workerQueueSize = 1024
+
+// packetWorkers sends TUN packets to clients in parallel. Packets are steered
+// by flow hash so every packet of a flow is handled by the same worker, in order.
+type packetWorkers struct {
+	queues []chan *protocol.Buffer
+	quit   chan struct{}
+}
+
+// newPacketWorkers starts n workers that call send for every dispatched packet
+func newPacketWorkers(n int, send func(buf *protocol.Buffer)) *packetWorkers {
+	if n < 1 {
+		n = 1
+	}
+
+	pw := &packetWorkers{
+		queues: make([]chan *protocol.Buffer, n),
+		quit:   make(chan struct{}),
+	}
+	for i := range pw.queues {
+		pw.queues[i] = make(chan *protocol.Buffer, workerQueueSize)
+		go pw.run(pw.queues[i], send)
+	}
+	return pw
+}
+
+func (pw *packetWorkers) run(queue chan *protocol.Buffer, send func(buf *protocol.Buffer)) {
+	for {
+		select {
+		case buf := <-queue:
+			send(buf)
+		case <-pw.quit:
+			return
+		}
+	}
+}
+
+// dispatch queues a framed packet on the worker that owns its flow.
+// The worker takes ownership of the buffer.
+func (pw *packetWorkers) dispatch(hash uint32, buf *protocol.Buffer) {
+	select {
+	case pw.queues[hash%uint32(len(pw.queues))] <- buf:
+	case <-pw.quit:
+		buf.Release()
+	}
+}
+
+// stop shuts the workers down; packets still queued are dropped
+func (pw *packetWorkers) stop() {
+	close(pw.quit)
+}
+
+// flowHash hashes the IPv4 addresses, protocol and TCP/UDP ports of a packet
+// (FNV-1a). Only the first fragment carries ports, so fragmented packets are
+// hashed on addresses and protocol alone to keep all fragments together.
+func flowHash(packet []byte) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	hash := uint32(offset32)
+	if len(packet) >= 40 && packet[0]>>4 == 6 {
+		// IPv6: next header, source and destination address
+		hash = (hash ^ uint32(packet[6])) * prime32
+		for _, b := range packet[8:40] {
+			hash = (hash ^ uint32(b)) * prime32
+		}
+		return hash
+	}
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return hash
+	}
+
+	// Protocol, source and destination address
+	hash = (hash ^ uint32(packet[9])) * prime32
+	for _, b := range packet[12:20] {
+		hash = (hash ^ uint32(b)) * prime32
+	}
+
+	fragmented := binary.BigEndian.Uint16(packet[6:8])&0x3FFF != 0
+	headerLen := int(packet[0]&0x0F) * 4
+	if !fragmented && (packet[9] == 6 || packet[9] == 17) && len(packet) >= headerLen+4 {
+		for _, b := range packet[headerLen : headerLen+4] {
+			hash = (hash ^ uint32(b)) * prime32
+		}
+	}
+	return hash
+}
@@ -0,0 +1,71 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// discardConn is a net.Conn that drops everything written to it
+type discardConn struct {
+	net.Conn
+	writes atomic.Int64
+}
+
+func (c *discardConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return len(b), nil
+}
+
+func (c *discardConn) Close() error { return nil }
+func (c *discardConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+}
+
+// BenchmarkTunToClient measures the server's TUN -> client path: pooled read
+// buffer, flow steering, session lookup and the per-session send queue.
+func BenchmarkTunToClient(b *testing.B) {
+	ServerCfg = &ServerConfig{IPPoolMin: 10, IPPoolMax: 20, MTU: 1400, SendQueueSize: 4096, SendQueuePolicy: DropPolicyTail}
+	ClientManager, _ = NewManager()
+
+	conn := &discardConn{}
+	if err := ClientManager.AddClient(conn.RemoteAddr(), conn); err != nil {
+		b.Fatalf("AddClient: %v", err)
+	}
+	ClientManager.SetAuthenticated(conn.RemoteAddr(), true)
+	session, _ := ClientManager.GetClient(conn.RemoteAddr())
+	defer ClientManager.RemoveClient(conn.RemoteAddr())
+
+	// A 1400 byte UDP packet addressed to the client
+	ipPacket := make([]byte, 1400)
+	ipPacket[0] = 0x45
+	ipPacket[9] = 17
+	copy(ipPacket[12:16], net.IPv4(8, 8, 8, 8).To4())
+	copy(ipPacket[16:20], session.AssignedIP.To4())
+
+	tm := &TunManager{pool: protocol.NewBufferPool(ServerCfg.MTU)}
+	workers := newPacketWorkers(1, tm.sendToClient)
+	defer workers.stop()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(ipPacket)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		buf := tm.pool.Get()
+		n := copy(buf.Payload(), ipPacket) // Stands in for the TUN read
+		buf.FrameData(n)
+		workers.dispatch(flowHash(buf.Payload()[:n]), buf)
+	}
+
+	// Let the writer drain so its work is part of the measurement
+	for int(conn.writes.Load())+int(session.queue.dropped.Load()) < b.N {
+		time.Sleep(time.Millisecond)
+	}
+}
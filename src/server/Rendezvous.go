@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// rendezvous introduces clients that want a direct path to each other; nil
+// unless peer_to_peer is set
+var rendezvous *Rendezvous
+
+// peerRequestTTL is how long a peer request waits for its probe and the
+// peer's request before it is dropped
+const peerRequestTTL = 30 * time.Second
+
+// peerKeySize is the length of the pre-shared key handed to both peers
+const peerKeySize = 32
+
+// Rendezvous pairs up peer requests. A client asks for a path to a peer over
+// its tunnel and sends the request's nonce to the rendezvous port from its
+// peer socket, which shows the server that socket's public endpoint. Once
+// both peers have asked for each other and both probes arrived, each gets the
+// other's endpoints and a fresh key for the link.
+type Rendezvous struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	requests map[peerPair]*peerRequest
+	byNonce  map[[protocol.PeerNonceSize]byte]*peerRequest
+}
+
+// peerPair is a request's direction, by tunnel address
+type peerPair struct {
+	from, to [4]byte
+}
+
+type peerRequest struct {
+	session  *ClientSession
+	pair     peerPair
+	nonce    [protocol.PeerNonceSize]byte
+	local    []netip.AddrPort // Endpoints the client reported
+	observed netip.AddrPort   // Endpoint the probe came from, once it has
+	created  time.Time
+}
+
+// NewRendezvous creates a rendezvous with no rendezvous port; see Listen
+func NewRendezvous() *Rendezvous {
+	return &Rendezvous{
+		requests: make(map[peerPair]*peerRequest),
+		byNonce:  make(map[[protocol.PeerNonceSize]byte]*peerRequest),
+	}
+}
+
+// Listen receives rendezvous probes on addr until Close
+func (r *Rendezvous) Listen(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve rendezvous address: %w", err)
+	}
+	r.conn, err = net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to start rendezvous listener: %w", err)
+	}
+
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := r.conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			// Anything else is ignored, like unknown nonces
+			if nonce, ok := protocol.DecodePeerProbe(buf[:n]); ok {
+				r.Observe(nonce, netip.AddrPortFrom(from.Addr().Unmap(), from.Port()))
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops receiving probes
+func (r *Rendezvous) Close() error {
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.Close()
+}
+
+// Request records that session wants a direct path to req.PeerIP and invites
+// the peer to ask for one back, unless it already has
+func (r *Rendezvous) Request(session *ClientSession, req *protocol.PeerRequest, now time.Time) error {
+	peer, ok := ClientManager.GetClientByIP(req.PeerIP)
+	if !ok || peer.same(session) || !peer.Authenticated.Load() || peer.Capabilities&protocol.CapPeerToPeer == 0 {
+		return fmt.Errorf("no peer-to-peer client at %v", req.PeerIP)
+	}
+
+	pair := peerPair{from: ipKey(session.AssignedIP), to: ipKey(req.PeerIP)}
+	pr := &peerRequest{
+		session: session,
+		pair:    pair,
+		nonce:   [protocol.PeerNonceSize]byte(req.Nonce),
+		local:   req.Endpoints,
+		created: now,
+	}
+
+	r.mu.Lock()
+	if old, ok := r.requests[pair]; ok {
+		delete(r.byNonce, old.nonce)
+	}
+	r.requests[pair] = pr
+	r.byNonce[pr.nonce] = pr
+	_, asked := r.requests[peerPair{from: pair.to, to: pair.from}]
+	r.mu.Unlock()
+
+	if !asked {
+		invite, err := protocol.EncodePeerInvite(session.AssignedIP)
+		if err != nil {
+			return err
+		}
+		return ClientManager.WriteToClient(peer.Addr, invite)
+	}
+	r.tryPair(pair)
+	return nil
+}
+
+// Observe records the public endpoint a probe with nonce came from
+func (r *Rendezvous) Observe(nonce []byte, from netip.AddrPort) {
+	r.mu.Lock()
+	pr, ok := r.byNonce[[protocol.PeerNonceSize]byte(nonce)]
+	if ok {
+		pr.observed = from
+	}
+	r.mu.Unlock()
+
+	if ok {
+		r.tryPair(pr.pair)
+	}
+}
+
+// tryPair introduces the two ends of pair once both are ready
+func (r *Rendezvous) tryPair(pair peerPair) {
+	reverse := peerPair{from: pair.to, to: pair.from}
+
+	r.mu.Lock()
+	a, aok := r.requests[pair]
+	b, bok := r.requests[reverse]
+	if !aok || !bok || !a.observed.IsValid() || !b.observed.IsValid() {
+		r.mu.Unlock()
+		return
+	}
+	for _, pr := range []*peerRequest{a, b} {
+		delete(r.requests, pr.pair)
+		delete(r.byNonce, pr.nonce)
+	}
+	r.mu.Unlock()
+
+	key := make([]byte, peerKeySize)
+	if _, err := rand.Read(key); err != nil {
+		fmt.Printf("Failed to generate peer link key: %v\n", err)
+		return
+	}
+	sendPeerInfo(a.session, b, key)
+	sendPeerInfo(b.session, a, key)
+	fmt.Printf("Introduced peers %s (%s) and %s (%s)\n",
+		a.session.AssignedIP, a.observed, b.session.AssignedIP, b.observed)
+}
+
+// sendPeerInfo tells session how to reach the client that made peer
+func sendPeerInfo(session *ClientSession, peer *peerRequest, key []byte) {
+	endpoints := append([]netip.AddrPort{peer.observed}, peer.local...)
+	packet, err := protocol.EncodePeerInfo(&protocol.PeerInfo{
+		PeerIP:    peer.session.AssignedIP,
+		Endpoints: endpoints,
+		Key:       key,
+	})
+	if err != nil {
+		fmt.Printf("Failed to build peer info for %s: %v\n", session.Addr, err)
+		return
+	}
+	if err := ClientManager.WriteToClient(session.Addr, packet); err != nil {
+		fmt.Printf("Failed to send peer info to %s: %v\n", session.Addr, err)
+	}
+}
+
+// Prune drops requests that were not paired within peerRequestTTL
+func (r *Rendezvous) Prune(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for pair, pr := range r.requests {
+		if now.Sub(pr.created) > peerRequestTTL {
+			delete(r.requests, pair)
+			delete(r.byNonce, pr.nonce)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// captureConn records what the server writes to a client
+type captureConn struct {
+	net.Conn
+	addr   net.Addr
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (c *captureConn) Close() error         { return nil }
+func (c *captureConn) RemoteAddr() net.Addr { return c.addr }
+
+// last returns the payload of the last message of type t written to the client
+func (c *captureConn) last(t protocol.PacketType) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.writes) - 1; i >= 0; i-- {
+		if packetType, payload, _ := protocol.Decode(c.writes[i]); packetType == t {
+			return payload
+		}
+	}
+	return nil
+}
+
+func newPeerClient(t *testing.T, ip byte) (*ClientSession, *captureConn) {
+	t.Helper()
+	conn := &captureConn{addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, ip), Port: 4000}}
+	session, err := ClientManager.GetOrAddClient(conn.addr, conn)
+	if err != nil {
+		t.Fatalf("GetOrAddClient: %v", err)
+	}
+	ClientManager.SetHandshake(conn.addr, protocol.ProtocolVersion, protocol.CapPeerToPeer, nil)
+	session.Authenticated.Store(true)
+	session, _ = ClientManager.GetClient(conn.addr)
+	return session, conn
+}
+
+// TestRendezvousPairsPeers checks that a request invites the peer and that
+// both get each other's observed endpoints and the same key once both probed
+func TestRendezvousPairsPeers(t *testing.T) {
+	newTestManager(t)
+	r := NewRendezvous()
+	now := time.Now()
+
+	a, aConn := newPeerClient(t, 1)
+	b, bConn := newPeerClient(t, 2)
+	aNonce, bNonce := bytes.Repeat([]byte{1}, protocol.PeerNonceSize), bytes.Repeat([]byte{2}, protocol.PeerNonceSize)
+	aPublic, bPublic := netip.MustParseAddrPort("203.0.113.1:40001"), netip.MustParseAddrPort("198.51.100.2:40002")
+	aLocal := netip.MustParseAddrPort("192.168.1.10:40001")
+
+	if err := r.Request(a, &protocol.PeerRequest{PeerIP: b.AssignedIP, Nonce: aNonce, Endpoints: []netip.AddrPort{aLocal}}, now); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	invite := bConn.last(protocol.PacketTypePeerInvite)
+	if ip, err := protocol.DecodePeerInvite(invite); err != nil || !ip.Equal(a.AssignedIP) {
+		t.Fatalf("b was invited to %v (%v), want %v", ip, err, a.AssignedIP)
+	}
+
+	r.Observe(aNonce, aPublic)
+	if err := r.Request(b, &protocol.PeerRequest{PeerIP: a.AssignedIP, Nonce: bNonce}, now); err != nil {
+		t.Fatalf("Request: %v", err)
+	}
+	if aConn.last(protocol.PacketTypePeerInfo) != nil {
+		t.Fatalf("peer info sent before b's probe arrived")
+	}
+	r.Observe(bNonce, bPublic)
+
+	aInfo, err := protocol.DecodePeerInfo(aConn.last(protocol.PacketTypePeerInfo))
+	if err != nil {
+		t.Fatalf("a's peer info: %v", err)
+	}
+	bInfo, err := protocol.DecodePeerInfo(bConn.last(protocol.PacketTypePeerInfo))
+	if err != nil {
+		t.Fatalf("b's peer info: %v", err)
+	}
+	if !aInfo.PeerIP.Equal(b.AssignedIP) || len(aInfo.Endpoints) != 1 || aInfo.Endpoints[0] != bPublic {
+		t.Errorf("a got %+v, want b at %v", aInfo, bPublic)
+	}
+	if !bInfo.PeerIP.Equal(a.AssignedIP) || len(bInfo.Endpoints) != 2 || bInfo.Endpoints[0] != aPublic || bInfo.Endpoints[1] != aLocal {
+		t.Errorf("b got %+v, want a at %v and %v", bInfo, aPublic, aLocal)
+	}
+	if !bytes.Equal(aInfo.Key, bInfo.Key) || len(aInfo.Key) != peerKeySize {
+		t.Errorf("peers got different keys")
+	}
+}
+
+// TestRendezvousRefusesUnknownPeer checks that only peer-to-peer clients are introduced
+func TestRendezvousRefusesUnknownPeer(t *testing.T) {
+	newTestManager(t)
+	r := NewRendezvous()
+
+	a, _ := newPeerClient(t, 1)
+	b, _ := newPeerClient(t, 2)
+	ClientManager.SetHandshake(b.Addr, protocol.ProtocolVersion, 0, nil)
+	nonce := bytes.Repeat([]byte{1}, protocol.PeerNonceSize)
+	for _, ip := range []net.IP{b.AssignedIP, a.AssignedIP, net.IPv4(10, 8, 0, 250)} {
+		if err := r.Request(a, &protocol.PeerRequest{PeerIP: ip, Nonce: nonce}, time.Now()); err == nil {
+			t.Errorf("request for %v accepted", ip)
+		}
+	}
+
+	r.Prune(time.Now().Add(2 * peerRequestTTL))
+	if len(r.requests) != 0 || len(r.byNonce) != 0 {
+		t.Errorf("requests left after prune")
+	}
+}
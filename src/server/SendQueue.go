@@ -0,0 +1,222 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// sendQueue is a session's bounded outbound queue, drained by its own writer
+// goroutine so a slow client only delays its own traffic.
+type sendQueue struct {
+	conn       net.Conn
+	packets    chan *protocol.Buffer
+	dropOldest bool
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	batching    atomic.Bool // Client negotiated CapBatching
+	recordLimit int         // Largest record a batch may grow to
+	batch       []byte      // Reused batch storage, only touched by the writer
+
+	compressing atomic.Bool         // Client negotiated CapCompressZstd
+	compressor  protocol.Compressor // Only used by the writer; counters are atomic
+	compressed  []byte              // Reused compressed record storage
+
+	sent       atomic.Uint64
+	dropped    atomic.Uint64
+	fullSince  atomic.Int64 // Unix nanoseconds the queue first overflowed, 0 if it drained since
+	writeError atomic.Bool
+}
+
+// newSendQueue starts a writer for conn with room for size packets. Batches
+// never exceed recordLimit, the size of the largest single data record.
+func newSendQueue(conn net.Conn, size int, policy string, recordLimit int) *sendQueue {
+	q := &sendQueue{
+		conn:        conn,
+		packets:     make(chan *protocol.Buffer, size),
+		dropOldest:  policy == DropPolicyOldest,
+		done:        make(chan struct{}),
+		recordLimit: recordLimit,
+	}
+	go q.writeLoop()
+	return q
+}
+
+// setCapabilities enables the optional features the session negotiated
+func (q *sendQueue) setCapabilities(capabilities uint32) {
+	q.batching.Store(capabilities&protocol.CapBatching != 0)
+	q.compressing.Store(capabilities&protocol.CapCompressZstd != 0)
+}
+
+// Enqueue queues a framed packet for the client, applying the drop policy when
+// full. It never blocks. The queue takes ownership of the buffer either way.
+func (q *sendQueue) Enqueue(buf *protocol.Buffer) bool {
+	select {
+	case <-q.done:
+		buf.Release()
+		return false
+	default:
+	}
+
+	select {
+	case q.packets <- buf:
+		return true
+	default:
+	}
+
+	q.fullSince.CompareAndSwap(0, time.Now().UnixNano())
+	if !q.dropOldest {
+		q.dropped.Add(1)
+		buf.Release()
+		return false
+	}
+
+	// Make room by discarding the oldest packet, then retry once
+	select {
+	case oldest := <-q.packets:
+		q.dropped.Add(1)
+		oldest.Release()
+	default:
+	}
+	select {
+	case q.packets <- buf:
+		return true
+	default:
+		q.dropped.Add(1)
+		buf.Release()
+		return false
+	}
+}
+
+func (q *sendQueue) writeLoop() {
+	for {
+		select {
+		case buf := <-q.packets:
+			if q.batching.Load() && len(q.packets) > 0 {
+				q.writeBatch(buf)
+			} else {
+				q.writePacket(buf)
+				buf.Release()
+			}
+
+			// Below half full counts as drained
+			if len(q.packets) < cap(q.packets)/2 {
+				q.fullSince.Store(0)
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// write sends one record carrying the given number of packets
+func (q *sendQueue) write(record []byte, packets int) {
+	if _, err := q.conn.Write(record); err != nil {
+		if !q.writeError.Swap(true) {
+			fmt.Printf(" Error sending to client %s: %v\n", q.conn.RemoteAddr(), err)
+		}
+		return
+	}
+	q.writeError.Store(false)
+	q.sent.Add(uint64(packets))
+}
+
+// compress returns the packet in buf as a compressed data record, or
+// ok=false if it should be sent as is
+func (q *sendQueue) compress(buf *protocol.Buffer) ([]byte, bool) {
+	if !q.compressing.Load() {
+		return nil, false
+	}
+	record, ok := q.compressor.Compress(protocol.StartCompressedData(q.compressed), buf.Packet())
+	if ok {
+		q.compressed = record
+	}
+	return record, ok
+}
+
+// writePacket sends one framed packet, compressed when that pays off
+func (q *sendQueue) writePacket(buf *protocol.Buffer) {
+	if record, ok := q.compress(buf); ok {
+		q.write(record, 1)
+		return
+	}
+	q.write(buf.Bytes(), 1)
+}
+
+// writeBatch packs first and every packet already waiting into as few
+// batch records as fit in recordLimit
+func (q *sendQueue) writeBatch(first *protocol.Buffer) {
+	batch := protocol.StartBatch(q.batch)
+	count := 0
+
+	limit := q.recordLimit
+	if q.compressing.Load() {
+		limit = min(limit, protocol.CompressedBatchLimit)
+	}
+
+	add := func(buf *protocol.Buffer) {
+		defer buf.Release()
+
+		record, compressed := q.compress(buf)
+		if !compressed {
+			record = buf.Bytes()
+		}
+		entry := record[protocol.HeaderSize:]
+
+		if !protocol.BatchFits(batch, len(entry), limit) {
+			if count > 0 {
+				q.write(batch, count)
+				batch, count = protocol.StartBatch(batch), 0
+			}
+			if !protocol.BatchFits(batch, len(entry), limit) {
+				// Too big to batch at all
+				q.write(record, 1)
+				return
+			}
+		}
+		if compressed {
+			batch = protocol.AppendBatchCompressed(batch, entry)
+		} else {
+			batch = protocol.AppendBatchPacket(batch, entry)
+		}
+		count++
+	}
+
+	add(first)
+	for {
+		select {
+		case buf := <-q.packets:
+			add(buf)
+		default:
+			if count > 0 {
+				q.write(batch, count)
+			}
+			q.batch = batch
+			return
+		}
+	}
+}
+
+// Depth returns the number of packets waiting to be sent
+func (q *sendQueue) Depth() int {
+	return len(q.packets)
+}
+
+// Backlogged reports whether the queue has stayed full for longer than timeout
+func (q *sendQueue) Backlogged(timeout time.Duration) bool {
+	since := q.fullSince.Load()
+	return since != 0 && time.Since(time.Unix(0, since)) > timeout
+}
+
+// Close stops the writer; queued packets are discarded
+func (q *sendQueue) Close() {
+	q.closeOnce.Do(func() { close(q.done) })
+}
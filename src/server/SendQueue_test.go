@@ -0,0 +1,136 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// recordConn is a net.Conn that keeps a copy of every record written to it
+type recordConn struct {
+	discardConn
+	mu      sync.Mutex
+	records [][]byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.records = append(c.records, append([]byte(nil), b...))
+	c.mu.Unlock()
+	return len(b), nil
+}
+
+// TestSendQueueCompressedBatch checks that a batch of compressible packets is
+// sent compressed and expands back to the original packets
+func TestSendQueueCompressedBatch(t *testing.T) {
+	conn := &recordConn{}
+	q := &sendQueue{conn: conn, packets: make(chan *protocol.Buffer, 8), recordLimit: 1400 + protocol.HeaderSize}
+	q.setCapabilities(protocol.CapBatching | protocol.CapCompressZstd)
+
+	pool := protocol.NewBufferPool(1400)
+	var want [][]byte
+	for i := 0; i < 5; i++ {
+		buf := pool.Get()
+		n := copy(buf.Payload(), bytes.Repeat([]byte{0x45, byte(i), 'l', 'o', 'g'}, 200))
+		want = append(want, append([]byte(nil), buf.Payload()[:n]...))
+		buf.FrameData(n)
+		q.packets <- buf
+	}
+
+	// Drain everything queued into batches
+	q.writeBatch(<-q.packets)
+
+	var got [][]byte
+	var d protocol.Decompressor
+	for _, record := range conn.records {
+		packetType, payload, _ := protocol.Decode(record)
+		if packetType != protocol.PacketTypeDataBatch {
+			t.Fatalf("record type %s, want DataBatch", packetType)
+		}
+		err := protocol.ForEachBatchPacket(payload, &d, func(p []byte) { got = append(got, append([]byte(nil), p...)) })
+		if err != nil {
+			t.Fatalf("ForEachBatchPacket: %v", err)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("packet %d differs after compression", i)
+		}
+	}
+	if len(conn.records) != 1 || q.compressor.Ratio() < 2 {
+		t.Fatalf("%d records, ratio %.2f; want one compressed batch", len(conn.records), q.compressor.Ratio())
+	}
+}
+
+// TestSendQueueDropPolicy fills a queue nothing drains and checks which
+// packets each policy keeps
+func TestSendQueueDropPolicy(t *testing.T) {
+	pool := protocol.NewBufferPool(1400)
+	for _, tc := range []struct {
+		policy   string
+		accepted int
+		kept     []byte
+	}{
+		{DropPolicyTail, 4, []byte{0, 1, 2, 3}},
+		{DropPolicyOldest, 6, []byte{2, 3, 4, 5}},
+	} {
+		q := &sendQueue{conn: &recordConn{}, packets: make(chan *protocol.Buffer, 4), dropOldest: tc.policy == DropPolicyOldest, done: make(chan struct{})}
+		accepted := 0
+		for i := 0; i < 6; i++ {
+			buf := pool.Get()
+			buf.Payload()[0] = byte(i)
+			buf.FrameData(1)
+			if q.Enqueue(buf) {
+				accepted++
+			}
+		}
+
+		var kept []byte
+		for q.Depth() > 0 {
+			buf := <-q.packets
+			kept = append(kept, buf.Packet()[0])
+			buf.Release()
+		}
+		if accepted != tc.accepted || !bytes.Equal(kept, tc.kept) || q.dropped.Load() != 2 {
+			t.Errorf("%s: accepted %d, kept %v, dropped %d; want %d, %v, 2", tc.policy, accepted, kept, q.dropped.Load(), tc.accepted, tc.kept)
+		}
+		if q.fullSince.Load() == 0 || q.Backlogged(time.Hour) {
+			t.Errorf("%s: fullSince = %d after overflowing just now", tc.policy, q.fullSince.Load())
+		}
+	}
+}
+
+// TestDisconnectBacklogged checks that only a client whose queue stayed full
+// past the timeout is disconnected, with ReasonBacklogged
+func TestDisconnectBacklogged(t *testing.T) {
+	m := newTestManager(t)
+	stuck, stuckConn := addTestSession(t, m, 1, "stuck")
+	_, fineConn := addTestSession(t, m, 2, "fine")
+	stuck.queue.fullSince.Store(time.Now().Add(-time.Minute).UnixNano())
+	stuck.queue.dropped.Store(7)
+
+	if drops := m.QueueDrops(); len(drops) != 1 || drops[stuck.AssignedIP.String()] != 7 {
+		t.Fatalf("QueueDrops = %v", drops)
+	}
+	if removed := m.DisconnectBacklogged(30 * time.Second); removed != 1 {
+		t.Fatalf("DisconnectBacklogged removed %d clients, want 1", removed)
+	}
+	if _, ok := m.GetClient(stuckConn.addr); ok {
+		t.Fatalf("backlogged client still connected")
+	}
+	if reason, _ := protocol.DecodeDisconnect(stuckConn.last(protocol.PacketTypeDisc)); reason != protocol.ReasonBacklogged {
+		t.Errorf("backlogged client got reason %s", reason)
+	}
+	if _, ok := m.GetClient(fineConn.addr); !ok || fineConn.last(protocol.PacketTypeDisc) != nil {
+		t.Errorf("client with a draining queue was disconnected")
+	}
+}
@@ -7,17 +7,25 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
+
+	"github.com/varun0310t/VPN/src/offload"
+	"github.com/varun0310t/VPN/src/protocol"
 )
 
 const (
-	TUNSETIFF = 0x400454ca
-	IFF_TUN   = 0x0001
-	IFF_NO_PI = 0x1000
+	TUNSETIFF       = 0x400454ca
+	IFF_TUN         = 0x0001
+	IFF_NO_PI       = 0x1000
+	IFF_MULTI_QUEUE = 0x0100
 )
 
 type ifreq struct {
@@ -28,43 +36,90 @@ type ifreq struct {
 
 // TunInterface handles TUN interface for packet routing
 type TunInterface struct {
-	fd     int
-	name   string
-	closed bool
+	fds     []int // One fd per queue
+	name    string
+	offload bool // Opened with IFF_VNET_HDR; every packet has a virtio-net header
+	closed  bool
 }
 
-// NewTunInterface creates a new TUN interface
-func NewTunInterface(name string) (*TunInterface, error) {
+// NewTunInterface creates a new TUN interface with the given number of queues.
+// More than one queue opens the device with IFF_MULTI_QUEUE so the kernel
+// spreads flows across the fds. With offloads the device is opened with
+// IFF_VNET_HDR and the kernel may hand over TCP packets larger than the MTU.
+func NewTunInterface(name string, queues int, withOffload bool) (*TunInterface, error) {
+	if queues < 1 {
+		queues = 1
+	}
+
+	flags := uint16(IFF_TUN | IFF_NO_PI)
+	if queues > 1 {
+		flags |= IFF_MULTI_QUEUE
+	}
+	if withOffload {
+		flags |= offload.IFF_VNET_HDR
+	}
+
+	tun := &TunInterface{name: name, offload: withOffload}
+	for i := 0; i < queues; i++ {
+		fd, err := openTunQueue(name, flags)
+		if err != nil {
+			tun.Close()
+			return nil, err
+		}
+		tun.fds = append(tun.fds, fd)
+
+		if withOffload {
+			if err := offload.EnableTUN(fd); err != nil {
+				tun.Close()
+				return nil, err
+			}
+		}
+	}
+
+	mode := ""
+	if withOffload {
+		mode = ", offloads on"
+	}
+	fmt.Printf("TUN interface %s created (%d queues%s)\n", name, len(tun.fds), mode)
+	return tun, nil
+}
+
+// openTunQueue opens /dev/net/tun and attaches it to the named device
+func openTunQueue(name string, flags uint16) (int, error) {
 	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR, 0)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open /dev/net/tun: %w (requires root)", err)
+		return -1, fmt.Errorf("failed to open /dev/net/tun: %w (requires root)", err)
 	}
 
 	var ifr ifreq
 	copy(ifr.name[:], name)
-	ifr.flags = IFF_TUN | IFF_NO_PI
+	ifr.flags = flags
 
 	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), uintptr(TUNSETIFF), uintptr(unsafe.Pointer(&ifr)))
 	if errno != 0 {
 		syscall.Close(fd)
-		return nil, fmt.Errorf("ioctl TUNSETIFF failed: %v", errno)
+		return -1, fmt.Errorf("ioctl TUNSETIFF failed: %v", errno)
 	}
+	return fd, nil
+}
 
-	fmt.Printf("TUN interface %s created (fd: %d)\n", name, fd)
-
-	return &TunInterface{
-		fd:     fd,
-		name:   name,
-		closed: false,
-	}, nil
+// Queues returns the number of open queues
+func (tun *TunInterface) Queues() int {
+	return len(tun.fds)
 }
 
 // Configure sets up the TUN interface with IP and routes
-func (tun *TunInterface) Configure(ipAddr string, subnet string) error {
+func (tun *TunInterface) Configure(ipAddr string, subnet string, mtu int) error {
 	fmt.Printf("Configuring TUN interface %s...\n", tun.name)
 
+	prefixLen := 24
+	if _, ipNet, err := net.ParseCIDR(subnet); err == nil {
+		prefixLen, _ = ipNet.Mask.Size()
+	}
+	cidr := fmt.Sprintf("%s/%d", ipAddr, prefixLen)
+
 	// Set MTU first
-	cmd := exec.Command("ip", "link", "set", "dev", tun.name, "mtu", "1400")
+	cmd := exec.Command("ip", "link", "set", "dev", tun.name, "mtu", strconv.Itoa(mtu))
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("failed to set MTU: %w, output: %s", err, string(output))
@@ -75,7 +130,7 @@ func (tun *TunInterface) Configure(ipAddr string, subnet string) error {
 	_ = cmd.Run()
 
 	// Set IP address
-	cmd = exec.Command("ip", "addr", "add", ipAddr+"/24", "dev", tun.name)
+	cmd = exec.Command("ip", "addr", "add", cidr, "dev", tun.name)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to set IP: %w", err)
 	}
@@ -90,7 +145,7 @@ func (tun *TunInterface) Configure(ipAddr string, subnet string) error {
 		return fmt.Errorf("failed to bring interface up: %w", err)
 	}
 
-	fmt.Printf(" TUN interface configured with IP %s/24\n", ipAddr)
+	fmt.Printf(" TUN interface configured with IP %s\n", cidr)
 	return nil
 }
 
@@ -125,7 +180,24 @@ func (tun *TunInterface) SetupNATAndForwarding(subnet string, outInterface strin
 	return nil
 }
 
-// WritePacket writes an IP packet to the TUN interface
+// AddRoute routes prefix into the TUN interface
+func (tun *TunInterface) AddRoute(prefix netip.Prefix) error {
+	output, err := exec.Command("ip", "route", "replace", prefix.String(), "dev", tun.name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w (output: %s)", err, string(output))
+	}
+	return nil
+}
+
+// RemoveRoute removes the route for prefix from the TUN interface
+func (tun *TunInterface) RemoveRoute(prefix netip.Prefix) {
+	if output, err := exec.Command("ip", "route", "del", prefix.String(), "dev", tun.name).CombinedOutput(); err != nil {
+		fmt.Printf(" Warning: failed to remove route %s: %v (output: %s)\n", prefix, err, string(output))
+	}
+}
+
+// WritePacket writes an IP packet to the TUN interface. Packets of the same
+// flow always use the same queue so the kernel sees them in order.
 func (tun *TunInterface) WritePacket(packet []byte) error {
 	if tun.closed {
 		return fmt.Errorf("TUN interface is closed")
@@ -135,7 +207,11 @@ func (tun *TunInterface) WritePacket(packet []byte) error {
 		return fmt.Errorf("packet too small: %d bytes", len(packet))
 	}
 
-	n, err := syscall.Write(tun.fd, packet)
+	fd := tun.fds[flowHash(packet)%uint32(len(tun.fds))]
+	if tun.offload {
+		return offload.WriteTUN(fd, offload.VirtioNetHdr{}, packet)
+	}
+	n, err := syscall.Write(fd, packet)
 	if err != nil {
 		return fmt.Errorf("failed to write to TUN: %w", err)
 	}
@@ -145,13 +221,28 @@ func (tun *TunInterface) WritePacket(packet []byte) error {
 	return nil
 }
 
-// ReadPacket reads an IP packet from the TUN interface
-func (tun *TunInterface) ReadPacket(buffer []byte) (int, error) {
+// WriteVnet writes a packet behind the given virtio-net header. Only valid
+// when the interface was opened with offloads.
+func (tun *TunInterface) WriteVnet(hdr offload.VirtioNetHdr, packet []byte) error {
+	if tun.closed {
+		return fmt.Errorf("TUN interface is closed")
+	}
+
+	if len(packet) < 20 {
+		return fmt.Errorf("packet too small: %d bytes", len(packet))
+	}
+
+	fd := tun.fds[flowHash(packet)%uint32(len(tun.fds))]
+	return offload.WriteTUN(fd, hdr, packet)
+}
+
+// ReadPacket reads an IP packet from the given queue of the TUN interface
+func (tun *TunInterface) ReadPacket(queue int, buffer []byte) (int, error) {
 	if tun.closed {
 		return 0, fmt.Errorf("TUN interface is closed")
 	}
 
-	n, err := syscall.Read(tun.fd, buffer)
+	n, err := syscall.Read(tun.fds[queue], buffer)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read from TUN: %w", err)
 	}
@@ -166,7 +257,13 @@ func (tun *TunInterface) Close() error {
 	}
 	tun.closed = true
 
-	return syscall.Close(tun.fd)
+	var firstErr error
+	for _, fd := range tun.fds {
+		if err := syscall.Close(fd); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // htons converts host byte order to network byte order
@@ -273,18 +370,23 @@ func CalculateTCPChecksum(packet []byte, srcIP, dstIP net.IP) uint16 {
 }
 
 type TunManager struct {
-	tun *TunInterface
+	tun        *TunInterface
+	workers    *packetWorkers
+	pool       *protocol.BufferPool // Buffers for packets read from TUN, sized to the MTU
+	coalescers sync.Pool            // *offload.Coalescer for batches written with offloads
+
+	packetsRead atomic.Int64 // Packets read from TUN since the last stats line
 }
 
 // NewTunManager creates a new TUN manager
 func NewTunManager(tunName string, serverIP string, subnet string, outInterface string) (*TunManager, error) {
-	tun, err := NewTunInterface(tunName)
+	tun, err := NewTunInterface(tunName, ServerCfg.QueueCount(), ServerCfg.TunOffload)
 	if err != nil {
 		return nil, err
 	}
 
 	// Configure TUN interface
-	err = tun.Configure(serverIP, subnet)
+	err = tun.Configure(serverIP, subnet, ServerCfg.MTU)
 	if err != nil {
 		tun.Close()
 		return nil, err
@@ -297,137 +399,209 @@ func NewTunManager(tunName string, serverIP string, subnet string, outInterface
 		return nil, err
 	}
 
-	return &TunManager{
-		tun: tun,
-	}, nil
+	tm := &TunManager{
+		tun:  tun,
+		pool: protocol.NewBufferPool(ServerCfg.MTU),
+	}
+	tm.coalescers.New = func() any {
+		return offload.NewCoalescer(tun.WriteVnet)
+	}
+	return tm, nil
 }
 
-// Start starts the TUN receiver loop
+// Start starts one receiver per TUN queue and the workers that send to clients
 func (tm *TunManager) Start() {
-	go tm.receiveLoop()
+	tm.workers = newPacketWorkers(tm.tun.Queues(), tm.sendToClient)
+	for queue := 0; queue < tm.tun.Queues(); queue++ {
+		go tm.receiveLoop(queue)
+	}
+	go tm.statsLoop()
 }
 
-// receiveLoop receives packets from TUN and routes to VPN clients
-func (tm *TunManager) receiveLoop() {
-	buffer := make([]byte, 65535)
+// statsLoop prints how many packets the server read from TUN every second
+func (tm *TunManager) statsLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	fmt.Println("Listening for packets from TUN interface...")
-	//counjter for how many packets server processd from tun interface
+	for range ticker.C {
+		if tm.tun.closed {
+			return
+		}
+		if n := tm.packetsRead.Swap(0); n > 0 {
+			fmt.Printf("Processed %d packets from TUN in the last second\n", n)
+		}
+	}
+}
+
+// receiveLoop receives packets from one TUN queue and hands them to the flow's worker
+func (tm *TunManager) receiveLoop(queue int) {
+	fmt.Printf("Listening for packets from TUN queue %d...\n", queue)
+	if tm.tun.offload {
+		tm.receiveOffloadLoop(queue)
+		return
+	}
 
-	packetRecCounter := 0
-	prevRecTime := time.Now().UnixMilli()
+	buf := tm.pool.Get()
 	for {
-		n, err := tm.tun.ReadPacket(buffer)
+		n, err := tm.tun.ReadPacket(queue, buf.Payload())
 		if err != nil {
+			if tm.tun.closed {
+				buf.Release()
+				return
+			}
 			continue
 		}
 
-		packet := buffer[:n]
+		packet := buf.Payload()[:n]
 
 		// Parse IP header
 		if len(packet) < 20 {
 			continue
 		}
 
-		destIP := net.IPv4(packet[16], packet[17], packet[18], packet[19])
-		//	srcIP := net.IPv4(packet[12], packet[13], packet[14], packet[15])
-
-		//	fmt.Printf("📥 TUN packet: %s -> %s (%d bytes)\n", srcIP.String(), destIP.String(), n)
-
-		// Prepend PacketTypeData header before sending to client
-		vpnPacket := make([]byte, 1+len(packet))
-		vpnPacket[0] = byte(0x03) // PacketTypeData
-		copy(vpnPacket[1:], packet)
-
-		tm.sendToClient(vpnPacket, destIP)
-		packetRecCounter++
-		// Calculate and print packets per second every second
-		currentRecTime := time.Now().UnixMilli()
-		if currentRecTime-prevRecTime >= 1000 {
-			//different emoji here so i can spot it easily in terminal logs
-			fmt.Printf("Processed %d packets from TUN in the last second\n", packetRecCounter)
-			packetRecCounter = 0
-			prevRecTime = currentRecTime
+		// Frame in place; the buffer now belongs to the worker and a new one is read into
+		buf.FrameData(n)
+		tm.workers.dispatch(flowHash(packet), buf)
+		tm.packetsRead.Add(1)
+		buf = tm.pool.Get()
+	}
+}
+
+// receiveOffloadLoop reads packets behind a virtio-net header, splits large
+// TCP packets into MTU-sized segments and hands each to the flow's worker
+func (tm *TunManager) receiveOffloadLoop(queue int) {
+	raw := make([]byte, offload.HdrLen+offload.MaxPacketSize)
+	scratch := make([]byte, offload.MaxPacketSize)
+
+	emit := func(segment []byte) {
+		buf := tm.pool.Get()
+		if len(segment) < 20 || len(segment) > len(buf.Payload()) {
+			buf.Release()
+			return
+		}
+		n := copy(buf.Payload(), segment)
+		buf.FrameData(n)
+		tm.workers.dispatch(flowHash(segment), buf)
+		tm.packetsRead.Add(1)
+	}
+
+	for {
+		n, err := tm.tun.ReadPacket(queue, raw)
+		if err != nil {
+			if tm.tun.closed {
+				return
+			}
+			continue
+		}
+
+		hdr, err := offload.DecodeHdr(raw[:n])
+		if err != nil {
+			continue
+		}
+		if err := offload.Segment(raw[offload.HdrLen:n], hdr, scratch, emit); err != nil {
+			fmt.Printf(" Dropped offloaded TUN packet: %v\n", err)
 		}
 	}
 }
 
-// sendToClient sends packet back to the connected client
-func (tm *TunManager) sendToClient(packet []byte, destIP net.IP) {
-	// Get the client session (we only have one client for now, simplify)
-	session, exist := ClientManager.GetClientByIP(destIP)
+// sendToClient queues a framed TUN packet for the client that owns its
+// destination address, or forwards it to the cluster node that has the client
+func (tm *TunManager) sendToClient(buf *protocol.Buffer) {
+	destIP := net.IP(buf.Payload()[16:20])
+
+	session, exist := ClientManager.GetClientForDestination(destIP)
 	if !exist {
+		if cluster != nil && cluster.Forward(buf) {
+			return
+		}
 		fmt.Printf(" No client found for IP %s\n", destIP.String())
+		buf.Release()
 		return
 	}
 
-	if session.Authenticated {
-		_, err := session.Conn.Write(packet)
-		if err != nil {
-			fmt.Printf(" Error sending to client: %v\n", err)
-		} else {
-			//		fmt.Printf(" Sent %d bytes to client %s\n", len(packet), session.Addr.String())
-		}
+	if !session.Authenticated.Load() {
+		buf.Release()
 		return
 	}
 
+	// Queued per session so a slow client can't stall the others
+	session.Send(buf)
 }
 
-// ForwardFromClient forwards packet from VPN client to TUN interface
-func (tm *TunManager) ForwardFromClient(packet []byte, assignedIP net.IP) error {
-	// Parse IP header
-	ipHeader := ParseIPHeader(packet)
-	if ipHeader == nil {
-		return fmt.Errorf("invalid IP packet")
-	}
-
-	// **SWAP SOURCE IP**: Replace client's source IP with their assigned VPN IP
-	// vpnIP := net.IPv4(10, 8, 0, byte(assignedIP))
-
-	// // Modify source IP in packet
-	// packet[12] = vpnIP[0]
-	// packet[13] = vpnIP[1]
-	// packet[14] = vpnIP[2]
-	// packet[15] = vpnIP[3]
-
-	// // Recalculate IP checksum
-	// packet[10] = 0 // Clear old checksum
-	// packet[11] = 0
-	// checksum := CalculateIPChecksum(packet[:20])
-	// packet[10] = byte(checksum >> 8)
-	// packet[11] = byte(checksum)
-
-	// // Recalculate TCP/UDP checksum if needed
-	// protocol := packet[9]
-	// if protocol == 6 || protocol == 17 { // TCP or UDP
-	// 	ipHeaderLen := int((packet[0] & 0x0F) * 4)
-	// 	// Clear transport layer checksum
-	// 	if protocol == 6 { // TCP
-	// 		packet[ipHeaderLen+16] = 0
-	// 		packet[ipHeaderLen+17] = 0
-	// 	} else { // UDP
-	// 		packet[ipHeaderLen+6] = 0
-	// 		packet[ipHeaderLen+7] = 0
-	// 	}
-
-	// 	tcpChecksum := CalculateTCPChecksum(packet, vpnIP, ipHeader.DstIP)
-	// 	if protocol == 6 {
-	// 		packet[ipHeaderLen+16] = byte(tcpChecksum >> 8)
-	// 		packet[ipHeaderLen+17] = byte(tcpChecksum)
-	// 	} else {
-	// 		packet[ipHeaderLen+6] = byte(tcpChecksum >> 8)
-	// 		packet[ipHeaderLen+7] = byte(tcpChecksum)
-	// 	}
-	// }
-
-	//fmt.Printf(" Forwarding from client: 10.8.0.%s -> %s\n",
-	//	assignedIP.String(), ipHeader.DstIP.String())
+// ForwardFromClient forwards packet from VPN client to TUN interface. Packets
+// that are malformed, spoofed or addressed to martians are dropped and counted
+// on the session instead.
+func (tm *TunManager) ForwardFromClient(packet []byte, session *ClientSession) error {
+	if reason := checkIngress(packet, session); reason != dropNone {
+		session.drops[reason].Add(1)
+		return nil
+	}
 
 	// Write to TUN - kernel handles NAT and routing
 	return tm.tun.WritePacket(packet)
 }
 
+// ForwardBatchFromClient forwards a batch of packets from a VPN client to the
+// TUN interface. With offloads, consecutive TCP segments are coalesced so the
+// kernel receives fewer, larger packets.
+func (tm *TunManager) ForwardBatchFromClient(payload []byte, session *ClientSession) error {
+	var d *protocol.Decompressor
+	if cd := session.batchDecompressor(); cd != nil {
+		cd.mu.Lock()
+		defer cd.mu.Unlock()
+		d = &cd.Decompressor
+	}
+	if !tm.tun.offload {
+		var firstErr error
+		err := protocol.ForEachBatchPacket(payload, d, func(packet []byte) {
+			if err := tm.ForwardFromClient(packet, session); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return firstErr
+	}
+
+	c := tm.coalescers.Get().(*offload.Coalescer)
+	defer tm.coalescers.Put(c)
+
+	var firstErr error
+	err := protocol.ForEachBatchPacket(payload, d, func(packet []byte) {
+		if reason := checkIngress(packet, session); reason != dropNone {
+			session.drops[reason].Add(1)
+			return
+		}
+		if err := c.Add(packet); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	})
+	if err := c.Flush(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// AddRoute sends traffic for a site-to-site subnet into the TUN, so it
+// reaches the gateway client that the subnet is behind
+func (tm *TunManager) AddRoute(prefix netip.Prefix) error {
+	return tm.tun.AddRoute(prefix)
+}
+
+// RemoveRoute stops routing a site-to-site subnet into the TUN
+func (tm *TunManager) RemoveRoute(prefix netip.Prefix) {
+	tm.tun.RemoveRoute(prefix)
+}
+
 // Close closes the TUN manager
 func (tm *TunManager) Close() error {
-	return tm.tun.Close()
+	err := tm.tun.Close()
+	if tm.workers != nil {
+		tm.workers.stop()
+	}
+	return err
 }
@@ -3,25 +3,108 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"runtime"
+	"slices"
+	"strings"
 )
 
+// Tunnel modes pushed to clients
+const (
+	TunnelModeFull  = "full"  // All client traffic goes through the VPN
+	TunnelModeSplit = "split" // Only the configured routes go through the VPN
+)
+
+// Send queue drop policies
+const (
+	DropPolicyTail   = "tail_drop"   // Drop the new packet when the queue is full
+	DropPolicyOldest = "drop_oldest" // Drop the oldest queued packet to make room
+)
+
+// Data packet compression modes
+const (
+	CompressionOff  = "off"
+	CompressionZstd = "zstd" // Offer zstd to clients that support it
+)
+
+// GroupConfig overrides the routing policy for clients that authenticate with the group's password
+type GroupConfig struct {
+	Name       string   `json:"name"`
+	Password   string   `json:"password"`
+	TunnelMode string   `json:"tunnel_mode"`
+	Routes     []string `json:"routes"`
+	Subnets    []string `json:"subnets"`   // Subnets behind the group's site-to-site gateway clients
+	Usernames  []string `json:"usernames"` // DNS names only the group's clients may take; when set, its clients must send one
+}
+
+// ClusterNodeConfig is another server of the cluster
+type ClusterNodeConfig struct {
+	ID      string `json:"id"`
+	Address string `json:"address"` // host:port of the node's cluster_port
+}
+
 type ServerConfig struct {
-	ListenAddress     string   `json:"listen_address"`
-	ListenPort        int      `json:"listen_port"`
-	TunIP             string   `json:"tun_ip"`
-	TunSubnet         string   `json:"tun_subnet"`
-	DNS               []string `json:"dns_servers"`
-	MaxClients        int      `json:"max_clients"`
-	LogLevel          string   `json:"log_level"`
-	TLSEnabled        bool     `json:"tls_enabled"`
-	CertFile          string   `json:"cert_file"`
-	KeyFile           string   `json:"key_file"`
-	IPPoolMin         int      `json:"ip_pool_min"`
-	IPPoolMax         int      `json:"ip_pool_max"`
-	TunDevice         string   `json:"tun_device"`
-	OutgoingInterface string   `json:"outgoing_interface"`
-	Password          string   `json:"password"`
+	ListenAddress     string              `json:"listen_address"`
+	ListenPort        int                 `json:"listen_port"`
+	TunIP             string              `json:"tun_ip"`
+	TunSubnet         string              `json:"tun_subnet"`
+	DNS               []string            `json:"dns_servers"`
+	SearchDomains     []string            `json:"search_domains"`
+	MaxClients        int                 `json:"max_clients"`
+	LogLevel          string              `json:"log_level"`
+	TLSEnabled        bool                `json:"tls_enabled"`
+	CertFile          string              `json:"cert_file"`
+	KeyFile           string              `json:"key_file"`
+	IPPoolMin         int                 `json:"ip_pool_min"`
+	IPPoolMax         int                 `json:"ip_pool_max"`
+	TunDevice         string              `json:"tun_device"`
+	OutgoingInterface string              `json:"outgoing_interface"`
+	Password          string              `json:"password"`
+	MTU               int                 `json:"mtu"`
+	KeepaliveInterval int                 `json:"keepalive_interval"` // Seconds between client pings
+	TunQueues         int                 `json:"tun_queues"`         // TUN queues and packet workers, 0 = GOMAXPROCS
+	TunOffload        bool                `json:"tun_offload"`        // Open TUN with IFF_VNET_HDR for GSO/GRO
+	SendQueueSize     int                 `json:"send_queue_size"`    // Packets buffered per client
+	SendQueuePolicy   string              `json:"send_queue_policy"`  // "tail_drop" or "drop_oldest"
+	BacklogTimeout    int                 `json:"backlog_timeout"`    // Seconds a send queue may stay full before the client is dropped
+	Compression       string              `json:"compression"`        // "off" or "zstd"
+	TCPEnabled        bool                `json:"tcp_enabled"`        // Also accept TLS over TCP for networks that block UDP
+	TCPPort           int                 `json:"tcp_port"`           // TCP port, 0 = listen_port
+	WebSocketEnabled  bool                `json:"websocket_enabled"`  // Also accept WebSocket over HTTPS for HTTP-only proxies
+	WebSocketPort     int                 `json:"websocket_port"`     // HTTPS port, 0 = 443
+	WebSocketPath     string              `json:"websocket_path"`     // URL path of the WebSocket endpoint, "" = /vpn
+	QUICEnabled       bool                `json:"quic_enabled"`       // Also accept QUIC, with data in unreliable datagrams
+	QUICPort          int                 `json:"quic_port"`          // UDP port for QUIC, 0 = listen_port + 1
+	PeerToPeer        bool                `json:"peer_to_peer"`       // Help clients set up direct links to each other
+	PeerPort          int                 `json:"peer_port"`          // UDP port for rendezvous probes, 0 = listen_port + 2
+	ClusterNodeID     string              `json:"cluster_node_id"`    // This server's ID in the cluster, "" = no cluster
+	ClusterPort       int                 `json:"cluster_port"`       // UDP port for links to the other nodes, 0 = listen_port + 3
+	ClusterKey        string              `json:"cluster_key"`        // Pre-shared key every node of the cluster uses
+	ClusterNodes      []ClusterNodeConfig `json:"cluster_nodes"`      // The other nodes
+	DNSEnabled        bool                `json:"dns_enabled"`        // Run a resolver on tun_ip and push it to clients instead of dns_servers
+	DNSDomain         string              `json:"dns_domain"`         // Clients are <username>.<dns_domain>, "" = vpn
+	DNSUpstreams      []string            `json:"dns_upstreams"`      // Resolvers other names go to: "host[:port]", "tls://host[:port]" or an https:// URL; empty = dns_servers
+	HandshakeWorkers  int                 `json:"handshake_workers"`  // DTLS handshakes in progress at once, 0 = 64
+	HandshakeTimeout  int                 `json:"handshake_timeout"`  // Seconds a TLS, DTLS or QUIC handshake may take, 0 = 10
+	HandshakeRate     int                 `json:"handshake_rate"`     // New DTLS handshakes per second from one source IP, 0 = 5
+	DTLSCookie        string              `json:"dtls_cookie"`        // When to require a HelloVerifyRequest cookie: "always" or "under_load"
+	KnockKey          string              `json:"knock_key"`          // Pre-shared key clients must knock with before DTLS, "" = no knock
+	AuthMaxFailures   int                 `json:"auth_max_failures"`  // Failed attempts per source IP before a lockout, and per username before attempts are delayed, 0 = 5
+	AuthLockout       int                 `json:"auth_lockout"`       // Seconds of the first lockout, doubled for each further one, 0 = 60
+	AuthLockoutMax    int                 `json:"auth_lockout_max"`   // Longest lockout in seconds, 0 = 3600
+	AuthRate          int                 `json:"auth_rate"`          // Authentication attempts per second across all clients, 0 = 20
+	AllowSources      []string            `json:"allow_sources"`      // CIDRs that may connect, empty = any
+	DenySources       []string            `json:"deny_sources"`       // CIDRs that may not connect, checked first
+	TunnelMode        string              `json:"tunnel_mode"`
+	Routes            []string            `json:"routes"`
+	Groups            []GroupConfig       `json:"groups"`
+
+	dnsUpstreams []string       // DNSUpstreams (or DNS) with their ports filled in
+	allowSources []netip.Prefix // Parsed AllowSources
+	denySources  []netip.Prefix // Parsed DenySources
 }
 
 func LoadServerConfig() (*ServerConfig, error) {
@@ -39,6 +122,7 @@ func LoadServerConfig() (*ServerConfig, error) {
 				TunIP:             "10.8.0.0",
 				TunSubnet:         "10.8.0.0/24",
 				DNS:               []string{"8.8.8.8", "8.8.4.4"},
+				SearchDomains:     []string{},
 				MaxClients:        10,
 				LogLevel:          "info",
 				TLSEnabled:        true,
@@ -49,6 +133,22 @@ func LoadServerConfig() (*ServerConfig, error) {
 				TunDevice:         "tun0",
 				OutgoingInterface: "eth0",
 				Password:          "VPN1234",
+				MTU:               1400,
+				KeepaliveInterval: 30,
+				SendQueueSize:     defaultSendQueueSize,
+				SendQueuePolicy:   DropPolicyTail,
+				BacklogTimeout:    defaultBacklogTimeout,
+				HandshakeWorkers:  defaultHandshakeWorkers,
+				HandshakeTimeout:  defaultHandshakeTimeout,
+				HandshakeRate:     defaultHandshakeRate,
+				DTLSCookie:        DTLSCookieAlways,
+				AuthMaxFailures:   defaultAuthMaxFailures,
+				AuthLockout:       defaultAuthLockout,
+				AuthLockoutMax:    defaultAuthLockoutMax,
+				AuthRate:          defaultAuthRate,
+				Compression:       CompressionOff,
+				TunnelMode:        TunnelModeFull,
+				Routes:            []string{},
 			}, nil
 		}
 		return nil, err
@@ -56,5 +156,616 @@ func LoadServerConfig() (*ServerConfig, error) {
 
 	var config ServerConfig
 	err = json.Unmarshal(data, &config)
-	return &config, err
+	if err != nil {
+		return nil, err
+	}
+
+	if err := config.validateRoutePolicies(); err != nil {
+		return nil, err
+	}
+
+	if config.MTU == 0 {
+		config.MTU = 1400
+	}
+	if config.MTU < 576 || config.MTU > 65535 {
+		return nil, fmt.Errorf("invalid mtu %d", config.MTU)
+	}
+	if config.KeepaliveInterval == 0 {
+		config.KeepaliveInterval = 30
+	}
+	if config.KeepaliveInterval < 0 || config.KeepaliveInterval > 65535 {
+		return nil, fmt.Errorf("invalid keepalive_interval %d", config.KeepaliveInterval)
+	}
+	if config.TunQueues < 0 || config.TunQueues > maxTunQueues {
+		return nil, fmt.Errorf("invalid tun_queues %d (expected 0-%d)", config.TunQueues, maxTunQueues)
+	}
+	if err := config.validateSendQueue(); err != nil {
+		return nil, err
+	}
+	if config.TCPPort == 0 {
+		config.TCPPort = config.ListenPort
+	}
+	if config.TCPPort < 0 || config.TCPPort > 65535 {
+		return nil, fmt.Errorf("invalid tcp_port %d", config.TCPPort)
+	}
+	if err := config.validateWebSocket(); err != nil {
+		return nil, err
+	}
+	if err := config.validateQUIC(); err != nil {
+		return nil, err
+	}
+	if err := config.validatePeer(); err != nil {
+		return nil, err
+	}
+	if err := config.validateCluster(); err != nil {
+		return nil, err
+	}
+	if err := config.validateDNS(); err != nil {
+		return nil, err
+	}
+	if err := config.validateHandshake(); err != nil {
+		return nil, err
+	}
+	if err := config.validateAuth(); err != nil {
+		return nil, err
+	}
+	if config.Compression == "" {
+		config.Compression = CompressionOff
+	}
+	if config.Compression != CompressionOff && config.Compression != CompressionZstd {
+		return nil, fmt.Errorf("invalid compression %q (expected %q or %q)", config.Compression, CompressionOff, CompressionZstd)
+	}
+	return &config, nil
+}
+
+// Send queue defaults
+const (
+	defaultSendQueueSize  = 1024
+	defaultBacklogTimeout = 10
+)
+
+// validateSendQueue applies defaults to the per-client send queue settings and checks them
+func (cfg *ServerConfig) validateSendQueue() error {
+	if cfg.SendQueueSize == 0 {
+		cfg.SendQueueSize = defaultSendQueueSize
+	}
+	if cfg.SendQueueSize < 0 {
+		return fmt.Errorf("invalid send_queue_size %d", cfg.SendQueueSize)
+	}
+	if cfg.SendQueuePolicy == "" {
+		cfg.SendQueuePolicy = DropPolicyTail
+	}
+	if cfg.SendQueuePolicy != DropPolicyTail && cfg.SendQueuePolicy != DropPolicyOldest {
+		return fmt.Errorf("invalid send_queue_policy %q (expected %q or %q)", cfg.SendQueuePolicy, DropPolicyTail, DropPolicyOldest)
+	}
+	if cfg.BacklogTimeout == 0 {
+		cfg.BacklogTimeout = defaultBacklogTimeout
+	}
+	if cfg.BacklogTimeout < 0 {
+		return fmt.Errorf("invalid backlog_timeout %d", cfg.BacklogTimeout)
+	}
+	return nil
+}
+
+// WebSocket defaults
+const (
+	defaultWebSocketPort = 443
+	defaultWebSocketPath = "/vpn"
+)
+
+// validateWebSocket applies defaults to the WebSocket listener settings and checks them
+func (cfg *ServerConfig) validateWebSocket() error {
+	if cfg.WebSocketPort == 0 {
+		cfg.WebSocketPort = defaultWebSocketPort
+	}
+	if cfg.WebSocketPort < 0 || cfg.WebSocketPort > 65535 {
+		return fmt.Errorf("invalid websocket_port %d", cfg.WebSocketPort)
+	}
+	if cfg.WebSocketPath == "" {
+		cfg.WebSocketPath = defaultWebSocketPath
+	}
+	if cfg.WebSocketPath[0] != '/' {
+		return fmt.Errorf("invalid websocket_path %q (must start with /)", cfg.WebSocketPath)
+	}
+	if cfg.WebSocketEnabled && cfg.TCPEnabled && cfg.WebSocketPort == cfg.TCPPort {
+		return fmt.Errorf("tcp_port and websocket_port are both %d", cfg.TCPPort)
+	}
+	return nil
+}
+
+// validateQUIC applies the default QUIC port and checks it; DTLS already owns
+// listen_port on UDP
+func (cfg *ServerConfig) validateQUIC() error {
+	if cfg.QUICPort == 0 {
+		cfg.QUICPort = cfg.ListenPort + 1
+	}
+	if cfg.QUICPort < 0 || cfg.QUICPort > 65535 {
+		return fmt.Errorf("invalid quic_port %d", cfg.QUICPort)
+	}
+	if cfg.QUICEnabled && cfg.QUICPort == cfg.ListenPort {
+		return fmt.Errorf("quic_port %d is the DTLS listen_port", cfg.QUICPort)
+	}
+	return nil
+}
+
+// validatePeer applies the default rendezvous port and checks it
+func (cfg *ServerConfig) validatePeer() error {
+	if cfg.PeerPort == 0 {
+		cfg.PeerPort = cfg.ListenPort + 2
+	}
+	if cfg.PeerPort < 0 || cfg.PeerPort > 65535 {
+		return fmt.Errorf("invalid peer_port %d", cfg.PeerPort)
+	}
+	if cfg.PeerToPeer && (cfg.PeerPort == cfg.ListenPort || cfg.QUICEnabled && cfg.PeerPort == cfg.QUICPort) {
+		return fmt.Errorf("peer_port %d is already used by DTLS or QUIC", cfg.PeerPort)
+	}
+	return nil
+}
+
+// defaultDNSDomain is the zone client names are answered in
+const defaultDNSDomain = "vpn"
+
+// validateDNS applies the default domain and checks the resolver settings
+func (cfg *ServerConfig) validateDNS() error {
+	if cfg.DNSDomain == "" {
+		cfg.DNSDomain = defaultDNSDomain
+	}
+	cfg.DNSDomain = strings.ToLower(strings.TrimSuffix(cfg.DNSDomain, "."))
+	for _, label := range strings.Split(cfg.DNSDomain, ".") {
+		if !validDNSLabel(label) {
+			return fmt.Errorf("invalid dns_domain %q", cfg.DNSDomain)
+		}
+	}
+	owners := make(map[string]string)
+	for i := range cfg.Groups {
+		group := &cfg.Groups[i]
+		for j, username := range group.Usernames {
+			username = strings.ToLower(username)
+			if !validDNSLabel(username) {
+				return fmt.Errorf("group %s: username %q is not a valid DNS label", group.Name, username)
+			}
+			if owner, taken := owners[username]; taken {
+				return fmt.Errorf("group %s: username %q already belongs to group %s", group.Name, username, owner)
+			}
+			owners[username] = group.Name
+			group.Usernames[j] = username
+		}
+	}
+	if !cfg.DNSEnabled {
+		return nil
+	}
+	if net.ParseIP(cfg.TunIP).To4() == nil {
+		return fmt.Errorf("dns_enabled needs an IPv4 tun_ip, got %q", cfg.TunIP)
+	}
+
+	upstreams := cfg.DNSUpstreams
+	if len(upstreams) == 0 {
+		upstreams = cfg.DNS
+	}
+	cfg.dnsUpstreams = make([]string, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		normalized, err := normalizeDNSUpstream(upstream)
+		if err != nil {
+			return err
+		}
+		if normalized == net.JoinHostPort(cfg.TunIP, "53") {
+			return fmt.Errorf("DNS upstream %q is the built-in resolver itself", upstream)
+		}
+		cfg.dnsUpstreams = append(cfg.dnsUpstreams, normalized)
+	}
+	return nil
+}
+
+// normalizeDNSUpstream checks a dns_upstreams entry and fills in the default
+// port: 53 for plain DNS, 853 for DNS over TLS. DNS-over-HTTPS URLs are kept.
+func normalizeDNSUpstream(upstream string) (string, error) {
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		u, err := url.Parse(upstream)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid DNS-over-HTTPS upstream %q", upstream)
+		}
+		return upstream, nil
+	case strings.HasPrefix(upstream, "tls://"):
+		host := strings.TrimPrefix(upstream, "tls://")
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "853")
+		}
+		if h, _, _ := net.SplitHostPort(host); h == "" {
+			return "", fmt.Errorf("invalid DNS-over-TLS upstream %q", upstream)
+		}
+		return "tls://" + host, nil
+	case strings.Contains(upstream, "://"):
+		return "", fmt.Errorf("unsupported DNS upstream %q (expected host, tls:// or https://)", upstream)
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	if h, _, _ := net.SplitHostPort(upstream); h == "" {
+		return "", fmt.Errorf("invalid DNS upstream %q", upstream)
+	}
+	return upstream, nil
+}
+
+// validDNSLabel reports whether label is a lowercase DNS label (RFC 1123)
+func validDNSLabel(label string) bool {
+	if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// minClusterKeyLen keeps the cluster key from being guessable
+const minClusterKeyLen = 16
+
+// validateCluster applies the default cluster port and checks the node list
+func (cfg *ServerConfig) validateCluster() error {
+	if cfg.ClusterPort == 0 {
+		cfg.ClusterPort = cfg.ListenPort + 3
+	}
+	if cfg.ClusterPort < 0 || cfg.ClusterPort > 65535 {
+		return fmt.Errorf("invalid cluster_port %d", cfg.ClusterPort)
+	}
+	if cfg.ClusterNodeID == "" {
+		return nil
+	}
+	if cfg.ClusterPort == cfg.ListenPort || cfg.QUICEnabled && cfg.ClusterPort == cfg.QUICPort || cfg.PeerToPeer && cfg.ClusterPort == cfg.PeerPort {
+		return fmt.Errorf("cluster_port %d is already used by DTLS, QUIC or the rendezvous", cfg.ClusterPort)
+	}
+	if len(cfg.ClusterKey) < minClusterKeyLen {
+		return fmt.Errorf("cluster_key must be at least %d characters", minClusterKeyLen)
+	}
+	if len(cfg.ClusterNodes) == 0 {
+		return fmt.Errorf("cluster_node_id is set but cluster_nodes is empty")
+	}
+	seen := map[string]bool{cfg.ClusterNodeID: true}
+	for _, node := range cfg.ClusterNodes {
+		if node.ID == "" || seen[node.ID] {
+			return fmt.Errorf("invalid or duplicate cluster node ID %q", node.ID)
+		}
+		seen[node.ID] = true
+		if _, _, err := net.SplitHostPort(node.Address); err != nil {
+			return fmt.Errorf("invalid address %q for cluster node %q: %w", node.Address, node.ID, err)
+		}
+	}
+	return nil
+}
+
+// ClusterNodeIDs returns the IDs of every node of the cluster, this one
+// included, sorted
+func (cfg *ServerConfig) ClusterNodeIDs() []string {
+	ids := []string{cfg.ClusterNodeID}
+	for _, node := range cfg.ClusterNodes {
+		ids = append(ids, node.ID)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Handshake defaults
+const (
+	defaultHandshakeWorkers = 64
+	defaultHandshakeTimeout = 10
+	defaultHandshakeRate    = 5
+)
+
+// DTLS cookie modes
+const (
+	DTLSCookieAlways    = "always"     // Every client must echo a HelloVerifyRequest cookie
+	DTLSCookieUnderLoad = "under_load" // Only while more than half the handshake workers are busy
+)
+
+// validateHandshake applies defaults to the handshake limits and checks them
+func (cfg *ServerConfig) validateHandshake() error {
+	if cfg.HandshakeWorkers == 0 {
+		cfg.HandshakeWorkers = defaultHandshakeWorkers
+	}
+	if cfg.HandshakeWorkers < 0 {
+		return fmt.Errorf("invalid handshake_workers %d", cfg.HandshakeWorkers)
+	}
+	if cfg.HandshakeTimeout == 0 {
+		cfg.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if cfg.HandshakeTimeout < 0 {
+		return fmt.Errorf("invalid handshake_timeout %d", cfg.HandshakeTimeout)
+	}
+	if cfg.HandshakeRate == 0 {
+		cfg.HandshakeRate = defaultHandshakeRate
+	}
+	if cfg.HandshakeRate < 0 {
+		return fmt.Errorf("invalid handshake_rate %d", cfg.HandshakeRate)
+	}
+	if cfg.DTLSCookie == "" {
+		cfg.DTLSCookie = DTLSCookieAlways
+	}
+	if cfg.DTLSCookie != DTLSCookieAlways && cfg.DTLSCookie != DTLSCookieUnderLoad {
+		return fmt.Errorf("invalid dtls_cookie %q (expected %q or %q)", cfg.DTLSCookie, DTLSCookieAlways, DTLSCookieUnderLoad)
+	}
+	return nil
+}
+
+// Brute-force protection defaults
+const (
+	defaultAuthMaxFailures = 5
+	defaultAuthLockout     = 60
+	defaultAuthLockoutMax  = 3600
+	defaultAuthRate        = 20
+)
+
+// validateAuth applies defaults to the brute-force protection settings and
+// parses the source lists
+func (cfg *ServerConfig) validateAuth() error {
+	if cfg.AuthMaxFailures == 0 {
+		cfg.AuthMaxFailures = defaultAuthMaxFailures
+	}
+	if cfg.AuthLockout == 0 {
+		cfg.AuthLockout = defaultAuthLockout
+	}
+	if cfg.AuthLockoutMax == 0 {
+		cfg.AuthLockoutMax = defaultAuthLockoutMax
+	}
+	if cfg.AuthRate == 0 {
+		cfg.AuthRate = defaultAuthRate
+	}
+	if cfg.AuthMaxFailures < 0 || cfg.AuthLockout < 0 || cfg.AuthRate < 0 || cfg.AuthLockoutMax < cfg.AuthLockout {
+		return fmt.Errorf("invalid auth limits: auth_max_failures %d, auth_lockout %d, auth_lockout_max %d, auth_rate %d",
+			cfg.AuthMaxFailures, cfg.AuthLockout, cfg.AuthLockoutMax, cfg.AuthRate)
+	}
+
+	var err error
+	if cfg.allowSources, err = parseSources("allow_sources", cfg.AllowSources); err != nil {
+		return err
+	}
+	if cfg.denySources, err = parseSources("deny_sources", cfg.DenySources); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseSources parses a list of CIDRs or single addresses
+func parseSources(name string, sources []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(sources))
+	for _, source := range sources {
+		prefix, err := netip.ParsePrefix(source)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(source)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid %s entry %q: %w", name, source, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// SourceAllowed reports whether a client at ip may connect: it must not be
+// in deny_sources and, when allow_sources is set, must be in it
+func (cfg *ServerConfig) SourceAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range cfg.denySources {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(cfg.allowSources) == 0 {
+		return true
+	}
+	for _, prefix := range cfg.allowSources {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxTunQueues is the kernel's limit on queues per TUN device
+const maxTunQueues = 256
+
+// QueueCount returns the number of TUN queues to open (GOMAXPROCS if unset)
+func (cfg *ServerConfig) QueueCount() int {
+	if cfg.TunQueues > 0 {
+		return cfg.TunQueues
+	}
+	return min(runtime.GOMAXPROCS(0), maxTunQueues)
+}
+
+// PrefixLen returns the prefix length of the tunnel subnet (24 if it can't be parsed)
+func (cfg *ServerConfig) PrefixLen() int {
+	_, ipNet, err := net.ParseCIDR(cfg.TunSubnet)
+	if err != nil {
+		return 24
+	}
+	ones, _ := ipNet.Mask.Size()
+	return ones
+}
+
+// validateRoutePolicies checks tunnel modes and route CIDRs for the server and every group
+func (cfg *ServerConfig) validateRoutePolicies() error {
+	if cfg.TunnelMode == "" {
+		cfg.TunnelMode = TunnelModeFull
+	}
+	if err := validateRoutePolicy("server", cfg.TunnelMode, cfg.Routes); err != nil {
+		return err
+	}
+
+	for i := range cfg.Groups {
+		group := &cfg.Groups[i]
+		if group.Name == "" || group.Password == "" {
+			return fmt.Errorf("group %d: name and password are required", i)
+		}
+		if group.TunnelMode == "" {
+			group.TunnelMode = cfg.TunnelMode
+		}
+		if group.Routes == nil {
+			group.Routes = cfg.Routes
+		}
+		if err := validateRoutePolicy("group "+group.Name, group.TunnelMode, group.Routes); err != nil {
+			return err
+		}
+		for _, subnet := range group.Subnets {
+			prefix, err := netip.ParsePrefix(subnet)
+			if err != nil || !prefix.Addr().Is4() {
+				return fmt.Errorf("group %s: invalid IPv4 subnet %q", group.Name, subnet)
+			}
+		}
+	}
+	return nil
+}
+
+func validateRoutePolicy(owner string, mode string, routes []string) error {
+	if mode != TunnelModeFull && mode != TunnelModeSplit {
+		return fmt.Errorf("%s: invalid tunnel_mode %q (expected %q or %q)", owner, mode, TunnelModeFull, TunnelModeSplit)
+	}
+
+	for _, route := range routes {
+		_, ipNet, err := net.ParseCIDR(route)
+		if err != nil || ipNet.IP.To4() == nil {
+			return fmt.Errorf("%s: invalid IPv4 route %q", owner, route)
+		}
+	}
+
+	if mode == TunnelModeSplit && len(routes) == 0 {
+		fmt.Printf(" Warning: %s uses split tunneling without any routes\n", owner)
+	}
+	return nil
+}
+
+// RoutePolicy returns the tunnel mode and routes for the given group ("" for the default policy)
+func (cfg *ServerConfig) RoutePolicy(group string) (string, []string) {
+	for _, g := range cfg.Groups {
+		if g.Name == group {
+			return g.TunnelMode, g.Routes
+		}
+	}
+	return cfg.TunnelMode, cfg.Routes
+}
+
+// SiteSubnets returns the subnets routed to a client of group: those it
+// advertised that lie within the group's subnets, or all of the group's
+// subnets if it advertised none
+func (cfg *ServerConfig) SiteSubnets(group string, advertised []net.IPNet) []netip.Prefix {
+	var allowed []netip.Prefix
+	for _, g := range cfg.Groups {
+		if g.Name != group || group == "" {
+			continue
+		}
+		for _, subnet := range g.Subnets {
+			if prefix, err := netip.ParsePrefix(subnet); err == nil {
+				allowed = append(allowed, prefix.Masked())
+			}
+		}
+	}
+	if len(advertised) == 0 {
+		return allowed
+	}
+
+	subnets := make([]netip.Prefix, 0, len(advertised))
+	for _, a := range advertised {
+		prefix, err := netip.ParsePrefix(a.String())
+		if err != nil {
+			continue
+		}
+		if !slices.ContainsFunc(allowed, func(p netip.Prefix) bool {
+			return p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr())
+		}) {
+			fmt.Printf("Ignoring subnet %s advertised by a client of group %q: not in its subnets\n", prefix, group)
+			continue
+		}
+		subnets = append(subnets, prefix)
+	}
+	return subnets
+}
+
+// DNSServerIPs returns the configured IPv4 DNS servers, skipping invalid entries
+func (cfg *ServerConfig) DNSServerIPs() []net.IP {
+	servers := make([]net.IP, 0, len(cfg.DNS))
+	for _, s := range cfg.DNS {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			fmt.Printf("Skipping invalid DNS server in config: %q\n", s)
+			continue
+		}
+		servers = append(servers, ip)
+	}
+	return servers
+}
+
+// ValidSearchDomains returns the configured search domains, skipping invalid entries
+func (cfg *ServerConfig) ValidSearchDomains() []string {
+	domains := make([]string, 0, len(cfg.SearchDomains))
+	for _, d := range cfg.SearchDomains {
+		if d == "" || len(d) > 255 {
+			fmt.Printf("Skipping invalid search domain in config: %q\n", d)
+			continue
+		}
+		domains = append(domains, d)
+	}
+	return domains
+}
+
+// ClientDNSServers returns the DNS servers pushed to clients: the built-in
+// resolver when it runs, the configured servers otherwise
+func (cfg *ServerConfig) ClientDNSServers() []net.IP {
+	if cfg.DNSEnabled {
+		return []net.IP{net.ParseIP(cfg.TunIP).To4()}
+	}
+	return cfg.DNSServerIPs()
+}
+
+// ClientSearchDomains returns the search domains pushed to clients, with
+// dns_domain first when the built-in resolver runs so bare usernames resolve
+func (cfg *ServerConfig) ClientSearchDomains() []string {
+	domains := cfg.ValidSearchDomains()
+	if cfg.DNSEnabled && !slices.Contains(domains, cfg.DNSDomain) {
+		domains = append([]string{cfg.DNSDomain}, domains...)
+	}
+	return domains
+}
+
+// RouteNets parses route CIDRs, skipping invalid entries
+func RouteNets(routes []string) []net.IPNet {
+	nets := make([]net.IPNet, 0, len(routes))
+	for _, route := range routes {
+		_, ipNet, err := net.ParseCIDR(route)
+		if err != nil || ipNet.IP.To4() == nil {
+			fmt.Printf("Skipping invalid route in config: %q\n", route)
+			continue
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets
+}
+
+// NameAllowed reports whether a client of group may take the DNS name ("" for
+// none). A name in a group's usernames is only that group's, and a group that
+// lists usernames allows no others and no client without one.
+func (cfg *ServerConfig) NameAllowed(group, name string) bool {
+	for _, g := range cfg.Groups {
+		if g.Name == group && len(g.Usernames) > 0 {
+			return slices.Contains(g.Usernames, name)
+		}
+		if g.Name != group && name != "" && slices.Contains(g.Usernames, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// GroupForPassword returns the group whose password matches; "" with ok=true means the default password
+func (cfg *ServerConfig) GroupForPassword(password string) (string, bool) {
+	if password == cfg.Password {
+		return "", true
+	}
+	for _, g := range cfg.Groups {
+		if g.Password == password {
+			return g.Name, true
+		}
+	}
+	return "", false
 }
@@ -4,147 +4,382 @@
 package server
 
 import (
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+var (
+	// ErrServerFull is returned when max_clients sessions are already connected
+	ErrServerFull = errors.New("server full")
+	// ErrPoolExhausted is returned when no address is left in the IP pool
+	ErrPoolExhausted = errors.New("IP pool exhausted")
 )
 
-// ClientSession identified by address and stores the DTLS connection
+// ReasonForError maps a session setup error to the reason reported to the client
+func ReasonForError(err error) protocol.Reason {
+	switch {
+	case errors.Is(err, ErrServerFull):
+		return protocol.ReasonServerFull
+	case errors.Is(err, ErrPoolExhausted):
+		return protocol.ReasonPoolExhausted
+	default:
+		return protocol.ReasonUnspecified
+	}
+}
+
+// ClientSession identified by address and stores the DTLS connection. A
+// published session is never modified: changes publish a copy, which shares
+// the live counters in sessionState, so lock-free readers see one version or
+// the other.
 type ClientSession struct {
-	Addr          net.Addr // Client address
-	Conn          net.Conn // DTLS connection
-	AssignedIP    net.IP   // Full IP address
-	LastSeen      time.Time
-	Authenticated bool
-	BytesSent     uint64
-	BytesRecv     uint64
-	ConnectedAt   time.Time
+	*sessionState
+	Addr         net.Addr       // Client address
+	Conn         net.Conn       // DTLS connection
+	AssignedIP   net.IP         // Full IP address
+	Group        string         // Group that selected the routing policy ("" for default)
+	Name         string         // DNS name from the hello's username, "" if none
+	Version      byte           // Negotiated protocol version (0 for legacy clients)
+	Capabilities uint32         // Negotiated capability bits
+	SessionToken []byte         // Token issued on a successful hello
+	Subnets      []netip.Prefix // Site-to-site subnets routed to the client
+	ConnectedAt  time.Time
+	queue        *sendQueue        // Outbound data packets, drained by the connection's writer
+	decompressor *connDecompressor // Compressed packets from the connection
+}
+
+// sessionState is what every version of a session shares; updated on every
+// packet, so atomic
+type sessionState struct {
+	Authenticated atomic.Bool
+	BytesSent     atomic.Uint64
+	BytesRecv     atomic.Uint64
+	lastSeen      atomic.Int64 // Unix nanoseconds of the last packet
+	drops         ingressDrops // Packets from the client that never reached the TUN
+}
+
+// connDecompressor expands compressed packets from one connection. After a
+// reconnect the old connection's reader may still be finishing a packet
+// while the new one starts, so it is locked.
+type connDecompressor struct {
+	mu sync.Mutex
+	protocol.Decompressor
+}
+
+// same reports whether s and other are versions of the same session
+func (s *ClientSession) same(other *ClientSession) bool {
+	return s != nil && other != nil && s.sessionState == other.sessionState
+}
+
+// batchDecompressor returns the decompressor for batches from the client, or
+// nil if the session did not negotiate compression
+func (s *ClientSession) batchDecompressor() *connDecompressor {
+	if s.Capabilities&protocol.CapCompressZstd == 0 {
+		return nil
+	}
+	return s.decompressor
+}
+
+func newClientSession(addr net.Addr, conn net.Conn, assignedIP net.IP) *ClientSession {
+	session := &ClientSession{
+		sessionState: &sessionState{},
+		Addr:         addr,
+		Conn:         conn,
+		AssignedIP:   assignedIP,
+		ConnectedAt:  time.Now(),
+		queue:        newSessionQueue(conn),
+		decompressor: &connDecompressor{},
+	}
+	session.Touch()
+	return session
+}
+
+// newSessionQueue creates a send queue using the server's queue settings
+func newSessionQueue(conn net.Conn) *sendQueue {
+	return newSendQueue(conn, ServerCfg.SendQueueSize, ServerCfg.SendQueuePolicy, ServerCfg.MTU+protocol.HeaderSize)
+}
+
+// Send queues a framed data packet for the client without blocking the caller
+// and takes ownership of the buffer. It returns false if the packet was dropped.
+func (s *ClientSession) Send(buf *protocol.Buffer) bool {
+	return s.queue.Enqueue(buf)
+}
+
+// Touch records that a packet was just received from the client
+func (s *ClientSession) Touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// LastSeen returns when the last packet was received from the client
+func (s *ClientSession) LastSeen() time.Time {
+	return time.Unix(0, s.lastSeen.Load())
+}
+
+// ipKey returns the map key for an IPv4 address without allocating
+func ipKey(ip net.IP) [4]byte {
+	var key [4]byte
+	copy(key[:], ip.To4())
+	return key
+}
+
+// addrKey returns the map key for a client address. UDP and TCP addresses
+// convert without allocating; other transports fall back to parsing the string form.
+func addrKey(addr net.Addr) netip.AddrPort {
+	var key netip.AddrPort
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		key = a.AddrPort()
+	case *net.TCPAddr:
+		key = a.AddrPort()
+	default:
+		key, _ = netip.ParseAddrPort(addr.String())
+	}
+	return netip.AddrPortFrom(key.Addr().Unmap(), key.Port())
+}
+
+// sessionTable is an immutable snapshot of the sessions. Readers load it
+// without locking; writers copy it, modify the copy and swap it in.
+type sessionTable struct {
+	byAddr map[netip.AddrPort]*ClientSession // Key: client address
+	byIP   map[[4]byte]*ClientSession        // Key: IPv4 address bytes
+
+	subnets    map[netip.Prefix]*ClientSession // Site-to-site subnets behind gateway clients
+	subnetBits []int                           // Distinct prefix lengths in subnets, longest first
+}
+
+// clone returns a copy of the table that can be modified
+func (t *sessionTable) clone() *sessionTable {
+	c := &sessionTable{
+		byAddr: make(map[netip.AddrPort]*ClientSession, len(t.byAddr)+1),
+		byIP:   make(map[[4]byte]*ClientSession, len(t.byIP)+1),
+	}
+	for k, v := range t.byAddr {
+		c.byAddr[k] = v
+	}
+	for k, v := range t.byIP {
+		c.byIP[k] = v
+	}
+	c.subnets = make(map[netip.Prefix]*ClientSession, len(t.subnets))
+	for k, v := range t.subnets {
+		c.subnets[k] = v
+	}
+	c.subnetBits = t.subnetBits
+	return c
+}
+
+// indexSubnets recomputes subnetBits after subnets changed
+func (t *sessionTable) indexSubnets() {
+	t.subnetBits = t.subnetBits[:0:0]
+	for prefix := range t.subnets {
+		if !slices.Contains(t.subnetBits, prefix.Bits()) {
+			t.subnetBits = append(t.subnetBits, prefix.Bits())
+		}
+	}
+	slices.SortFunc(t.subnetBits, func(a, b int) int { return b - a })
+}
+
+// lookupSubnet returns the session with the longest subnet containing ip
+func (t *sessionTable) lookupSubnet(ip [4]byte) (*ClientSession, bool) {
+	addr := netip.AddrFrom4(ip)
+	for _, bits := range t.subnetBits {
+		prefix, _ := addr.Prefix(bits)
+		if session, ok := t.subnets[prefix]; ok {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// replace publishes next, a copy of old, in old's place
+func (t *sessionTable) replace(old, next *ClientSession) {
+	t.byAddr[addrKey(next.Addr)] = next
+	delete(t.byIP, ipKey(old.AssignedIP))
+	t.byIP[ipKey(next.AssignedIP)] = next
+	for _, prefix := range next.Subnets {
+		if old.same(t.subnets[prefix]) {
+			t.subnets[prefix] = next
+		}
+	}
 }
 
 type Manager struct {
-	sessions    map[string]*ClientSession // Key: addr.String()
-	assignedIPs map[string]*ClientSession // Key: IP string (e.g., "10.8.0.2")
-	IPPool      *IPPool
-	mu          sync.RWMutex
+	table  atomic.Pointer[sessionTable]
+	IPPool *IPPool
+	mu     sync.Mutex // Serialises writers of table and the IP pool
 }
 
 func NewManager() (*Manager, error) {
-	return &Manager{
-		sessions:    make(map[string]*ClientSession),
-		assignedIPs: make(map[string]*ClientSession),
-		IPPool:      NewIPPool(ServerCfg.IPPoolMin, ServerCfg.IPPoolMax),
-	}, nil
+	m := &Manager{
+		IPPool: NewIPPool(ServerCfg.IPPoolMin, ServerCfg.IPPoolMax),
+	}
+	m.table.Store(&sessionTable{
+		byAddr:  make(map[netip.AddrPort]*ClientSession),
+		byIP:    make(map[[4]byte]*ClientSession),
+		subnets: make(map[netip.Prefix]*ClientSession),
+	})
+	return m, nil
 }
 
-// AddClient creates a new client session with DTLS connection
-func (m *Manager) AddClient(addr net.Addr, conn net.Conn) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	key := addr.String()
+// sessions returns the current session table; it must not be modified
+func (m *Manager) sessions() *sessionTable {
+	return m.table.Load()
+}
 
-	if existing, ok := m.sessions[key]; ok {
-		existing.LastSeen = time.Now()
-		existing.Conn = conn // Update connection
-		return nil
+// addLocked allocates an address and publishes a new session. Caller holds m.mu.
+func (m *Manager) addLocked(addr net.Addr, conn net.Conn) (*ClientSession, error) {
+	current := m.sessions()
+	if ServerCfg.MaxClients > 0 && len(current.byAddr) >= ServerCfg.MaxClients {
+		return nil, fmt.Errorf("%w: %d clients connected", ErrServerFull, len(current.byAddr))
 	}
 
 	// Allocate IP (returns last octet as int)
 	lastOctet, err := m.IPPool.Allocate()
 	if err != nil {
-		return fmt.Errorf("failed to allocate IP: %w", err)
+		return nil, fmt.Errorf("%w: %v", ErrPoolExhausted, err)
 	}
 
 	// Convert to net.IP
 	assignedIP := net.IPv4(10, 8, 0, byte(lastOctet))
 
-	session := &ClientSession{
-		Addr:        addr,
-		Conn:        conn,
-		AssignedIP:  assignedIP,
-		LastSeen:    time.Now(),
-		ConnectedAt: time.Now(),
-	}
+	session := newClientSession(addr, conn, assignedIP)
 
-	m.sessions[key] = session
-	m.assignedIPs[assignedIP.String()] = session
+	next := current.clone()
+	next.byAddr[addrKey(addr)] = session
+	next.byIP[ipKey(assignedIP)] = session
+	m.table.Store(next)
 
 	fmt.Printf("Client connected: %s -> Assigned IP: %s\n", addr.String(), assignedIP.String())
-	return nil
+	return session, nil
+}
+
+// removeLocked unpublishes sessions and releases their addresses. Caller holds m.mu.
+func (m *Manager) removeLocked(sessions ...*ClientSession) {
+	next := m.sessions().clone()
+	for _, session := range sessions {
+		// Release IP (extract last octet)
+		lastOctet := int(session.AssignedIP.To4()[3])
+		m.IPPool.Release(lastOctet)
+
+		delete(next.byIP, ipKey(session.AssignedIP))
+		delete(next.byAddr, addrKey(session.Addr))
+		removeSubnets(next, session)
+	}
+	next.indexSubnets()
+	m.table.Store(next)
+}
+
+// removeSubnets unpublishes session's subnets from t and removes their kernel routes
+func removeSubnets(t *sessionTable, session *ClientSession) {
+	for _, prefix := range session.Subnets {
+		if !session.same(t.subnets[prefix]) {
+			continue
+		}
+		delete(t.subnets, prefix)
+		if tunManager != nil {
+			tunManager.RemoveRoute(prefix)
+		}
+	}
+}
+
+// updateLocked publishes a copy of session changed by change and returns it.
+// Caller holds m.mu.
+func (m *Manager) updateLocked(session *ClientSession, change func(next *ClientSession)) *ClientSession {
+	next := *session
+	change(&next)
+	table := m.sessions().clone()
+	table.replace(session, &next)
+	m.table.Store(table)
+	return &next
+}
+
+// AddClient creates a new client session with DTLS connection
+func (m *Manager) AddClient(addr net.Addr, conn net.Conn) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if existing, ok := m.sessions().byAddr[addrKey(addr)]; ok {
+		// The client reconnected: publish the session with the new connection,
+		// then stop the old connection's writer and reader
+		existing.Touch()
+		m.updateLocked(existing, func(next *ClientSession) {
+			next.Conn = conn
+			next.queue = newSessionQueue(conn)
+			next.queue.setCapabilities(existing.Capabilities)
+			next.decompressor = &connDecompressor{}
+		})
+		existing.queue.Close()
+		if existing.Conn != nil && existing.Conn != conn {
+			existing.Conn.Close()
+		}
+		return nil
+	}
+
+	_, err := m.addLocked(addr, conn)
+	return err
 }
 
 // Get client by address
 func (m *Manager) GetClient(addr net.Addr) (*ClientSession, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	session, exists := m.sessions[addr.String()]
+	session, exists := m.sessions().byAddr[addrKey(addr)]
 	return session, exists
 }
 
 // GetClientByIP looks up client by their assigned IP
 func (m *Manager) GetClientByIP(ip net.IP) (*ClientSession, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	session, exists := m.assignedIPs[ip.String()]
+	session, exists := m.sessions().byIP[ipKey(ip)]
 	return session, exists
 }
 
+// GetClientForDestination returns the client a packet to ip is sent to: the
+// one assigned ip, or else the gateway with the longest subnet containing it
+func (m *Manager) GetClientForDestination(ip net.IP) (*ClientSession, bool) {
+	table := m.sessions()
+	key := ipKey(ip)
+	if session, exists := table.byIP[key]; exists {
+		return session, true
+	}
+	return table.lookupSubnet(key)
+}
+
+// routesSource reports whether ip lies in one of session's subnets
+func (m *Manager) routesSource(ip [4]byte, session *ClientSession) bool {
+	owner, ok := m.sessions().lookupSubnet(ip)
+	return ok && owner.same(session)
+}
+
 // GetOrAddClient adds client if not exists and returns the session
 func (m *Manager) GetOrAddClient(addr net.Addr, conn net.Conn) (*ClientSession, error) {
-	key := addr.String()
+	key := addrKey(addr)
 
-	// Try read lock first (fast path)
-	m.mu.RLock()
-	if session, exists := m.sessions[key]; exists {
-		session.LastSeen = time.Now()
-		m.mu.RUnlock()
+	// Lock-free fast path
+	if session, exists := m.sessions().byAddr[key]; exists {
+		session.Touch()
 		return session, nil
 	}
-	m.mu.RUnlock()
 
-	// Need to add - upgrade to write lock
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	// Double-check (another goroutine might have added it)
-	if session, exists := m.sessions[key]; exists {
-		session.LastSeen = time.Now()
+	if session, exists := m.sessions().byAddr[key]; exists {
+		session.Touch()
 		return session, nil
 	}
 
-	// Allocate IP (returns last octet as int)
-	lastOctet, err := m.IPPool.Allocate()
-	if err != nil {
-		return nil, fmt.Errorf("failed to allocate IP: %w", err)
-	}
-
-	// Convert to net.IP
-	assignedIP := net.IPv4(10, 8, 0, byte(lastOctet))
-
-	// Create new session
-	session := &ClientSession{
-		Addr:        addr,
-		Conn:        conn,
-		AssignedIP:  assignedIP,
-		LastSeen:    time.Now(),
-		ConnectedAt: time.Now(),
-	}
-	m.sessions[key] = session
-	m.assignedIPs[assignedIP.String()] = session
-
-	fmt.Printf("Client connected: %s -> Assigned IP: %s\n", addr.String(), assignedIP.String())
-	return session, nil
+	return m.addLocked(addr, conn)
 }
 
 // GetClientConnection retrieves the DTLS connection for a client by address
 func (m *Manager) GetClientConnection(addr net.Addr) (net.Conn, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	session, exists := m.sessions[addr.String()]
+	session, exists := m.GetClient(addr)
 	if !exists {
 		return nil, false
 	}
@@ -156,50 +391,99 @@ func (m *Manager) RemoveClient(addr net.Addr) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	key := addr.String()
-	if session, exists := m.sessions[key]; exists {
-		// Close the connection
-		if session.Conn != nil {
-			session.Conn.Close()
+	session, exists := m.sessions().byAddr[addrKey(addr)]
+	if !exists {
+		return
+	}
+
+	// Close the connection
+	session.queue.Close()
+	if session.Conn != nil {
+		session.Conn.Close()
+	}
+	m.removeLocked(session)
+
+	fmt.Printf("Client disconnected: %s (Assigned IP: %s)\n", addr.String(), session.AssignedIP.String())
+}
+
+// DisconnectClient tells the client why its session is ending and removes it
+func (m *Manager) DisconnectClient(addr net.Addr, reason protocol.Reason, message string) {
+	session, exists := m.GetClient(addr)
+	if !exists {
+		return
+	}
+
+	if session.Conn != nil {
+		if _, err := session.Conn.Write(protocol.EncodeDisconnect(reason, message)); err != nil {
+			fmt.Printf("Failed to send disconnect to %s: %v\n", addr.String(), err)
 		}
+	}
 
-		// Release IP (extract last octet)
-		lastOctet := int(session.AssignedIP.To4()[3])
-		m.IPPool.Release(lastOctet)
+	if message != "" {
+		fmt.Printf("Disconnecting %s (Assigned IP: %s): %s (%s)\n", addr.String(), session.AssignedIP.String(), reason, message)
+	} else {
+		fmt.Printf("Disconnecting %s (Assigned IP: %s): %s\n", addr.String(), session.AssignedIP.String(), reason)
+	}
+	m.RemoveClient(addr)
+}
+
+// KickClient removes a client on the operator's behalf
+func (m *Manager) KickClient(addr net.Addr, message string) {
+	m.DisconnectClient(addr, protocol.ReasonKicked, message)
+}
+
+// DisconnectAll ends every session with the given reason
+func (m *Manager) DisconnectAll(reason protocol.Reason, message string) {
+	for _, s := range m.sessions().byAddr {
+		m.DisconnectClient(s.Addr, reason, message)
+	}
+}
+
+// DisconnectBacklogged ends sessions whose send queue stayed full for longer than timeout
+func (m *Manager) DisconnectBacklogged(timeout time.Duration) int {
+	backlogged := make([]*ClientSession, 0)
+	for _, s := range m.sessions().byAddr {
+		if s.queue.Backlogged(timeout) {
+			backlogged = append(backlogged, s)
+		}
+	}
 
-		delete(m.assignedIPs, session.AssignedIP.String())
-		delete(m.sessions, key)
+	for _, s := range backlogged {
+		message := fmt.Sprintf("send queue full for over %s, %d packets dropped", timeout, s.queue.dropped.Load())
+		m.DisconnectClient(s.Addr, protocol.ReasonBacklogged, message)
+	}
+	return len(backlogged)
+}
 
-		fmt.Printf("Client disconnected: %s (Assigned IP: %s)\n", addr.String(), session.AssignedIP.String())
+// QueueDrops returns the packets each session's send queue dropped, by
+// tunnel address, for the sessions that dropped any
+func (m *Manager) QueueDrops() map[string]uint64 {
+	drops := make(map[string]uint64)
+	for _, s := range m.sessions().byAddr {
+		if n := s.queue.dropped.Load(); n > 0 {
+			drops[s.AssignedIP.String()] = n
+		}
 	}
+	return drops
 }
 
 // Update last seen timestamp
 func (m *Manager) UpdateLastSeen(addr net.Addr) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if session, exists := m.sessions[addr.String()]; exists {
-		session.LastSeen = time.Now()
+	if session, exists := m.GetClient(addr); exists {
+		session.Touch()
 	}
 }
 
 // Update byte counters
 func (m *Manager) AddBytesSent(addr net.Addr, bytes uint64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if session, exists := m.sessions[addr.String()]; exists {
-		session.BytesSent += bytes
+	if session, exists := m.GetClient(addr); exists {
+		session.BytesSent.Add(bytes)
 	}
 }
 
 func (m *Manager) AddBytesRecv(addr net.Addr, bytes uint64) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if session, exists := m.sessions[addr.String()]; exists {
-		session.BytesRecv += bytes
+	if session, exists := m.GetClient(addr); exists {
+		session.BytesRecv.Add(bytes)
 	}
 }
 
@@ -208,97 +492,220 @@ func (m *Manager) CleanupStale(timeout time.Duration) int {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	removed := 0
 	now := time.Now()
+	stale := make([]*ClientSession, 0)
 
-	for key, session := range m.sessions {
-		if now.Sub(session.LastSeen) > timeout {
-			// Close connection
+	for _, session := range m.sessions().byAddr {
+		if now.Sub(session.LastSeen()) > timeout {
+			fmt.Printf("Disconnecting %s (Assigned IP: %s): %s\n", session.Addr.String(), session.AssignedIP.String(), protocol.ReasonIdleTimeout)
+
+			// Tell the client before closing the connection
+			session.queue.Close()
 			if session.Conn != nil {
+				session.Conn.Write(protocol.EncodeDisconnect(protocol.ReasonIdleTimeout, ""))
 				session.Conn.Close()
 			}
-
-			// Release IP (extract last octet)
-			lastOctet := int(session.AssignedIP.To4()[3])
-			m.IPPool.Release(lastOctet)
-
-			delete(m.assignedIPs, session.AssignedIP.String())
-			delete(m.sessions, key)
-			removed++
+			stale = append(stale, session)
 		}
 	}
 
-	return removed
+	if len(stale) > 0 {
+		m.removeLocked(stale...)
+	}
+	return len(stale)
 }
 
-// Get all active sessions
+// Get all active sessions. The sessions are live; use the atomic fields to read counters.
 func (m *Manager) GetAllSessions() []*ClientSession {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	sessions := make([]*ClientSession, 0, len(m.sessions))
-	for _, s := range m.sessions {
-		sessionCopy := *s
-		sessions = append(sessions, &sessionCopy)
+	table := m.sessions()
+	sessions := make([]*ClientSession, 0, len(table.byAddr))
+	for _, s := range table.byAddr {
+		sessions = append(sessions, s)
 	}
 	return sessions
 }
 
 // Count active sessions
 func (m *Manager) Count() int {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	return len(m.sessions)
+	return len(m.sessions().byAddr)
 }
 
 // Check if client exists
 func (m *Manager) Exists(addr net.Addr) bool {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-	_, exists := m.sessions[addr.String()]
+	_, exists := m.GetClient(addr)
 	return exists
 }
 
 // Get session info for monitoring/stats
 func (m *Manager) GetSessionInfo(addr net.Addr) map[string]interface{} {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
-
-	session, exists := m.sessions[addr.String()]
+	session, exists := m.GetClient(addr)
 	if !exists {
 		return nil
 	}
 
 	return map[string]interface{}{
-		"address":      session.Addr.String(),
-		"assigned_ip":  session.AssignedIP.String(),
-		"connected_at": session.ConnectedAt,
-		"last_seen":    session.LastSeen,
-		"bytes_sent":   session.BytesSent,
-		"bytes_recv":   session.BytesRecv,
-		"duration":     time.Since(session.ConnectedAt).Seconds(),
+		"address":           session.Addr.String(),
+		"assigned_ip":       session.AssignedIP.String(),
+		"group":             session.Group,
+		"version":           session.Version,
+		"connected_at":      session.ConnectedAt,
+		"last_seen":         session.LastSeen(),
+		"bytes_sent":        session.BytesSent.Load(),
+		"bytes_recv":        session.BytesRecv.Load(),
+		"queue_depth":       session.queue.Depth(),
+		"queue_sent":        session.queue.sent.Load(),
+		"queue_drops":       session.queue.dropped.Load(),
+		"compress_tx_ratio": session.queue.compressor.Ratio(),
+		"compress_rx_ratio": session.decompressor.Ratio(),
+		"ingress_drops":     session.drops.Counts(),
+		"duration":          time.Since(session.ConnectedAt).Seconds(),
 	}
 }
 
 // SetAuthenticated marks a client session as authenticated
 func (m *Manager) SetAuthenticated(addr net.Addr, authenticated bool) {
+	if session, exists := m.GetClient(addr); exists {
+		session.Authenticated.Store(authenticated)
+		if authenticated {
+			fmt.Printf("Client %s authenticated successfully\n", addr.String())
+		}
+	}
+}
+
+// SetGroup records which group's routing policy applies to the client
+func (m *Manager) SetGroup(addr net.Addr, group string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if session, exists := m.sessions[addr.String()]; exists {
-		session.Authenticated = authenticated
-		if authenticated {
-			fmt.Printf("Client %s authenticated successfully\n", addr.String())
+	if session, exists := m.sessions().byAddr[addrKey(addr)]; exists {
+		m.updateLocked(session, func(next *ClientSession) { next.Group = group })
+	}
+}
+
+// ClaimName gives the client at addr the DNS name, reporting false if
+// another session here already has it
+func (m *Manager) ClaimName(addr net.Addr, name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions().byAddr[addrKey(addr)]
+	if !exists {
+		return false
+	}
+	for _, other := range m.sessions().byAddr {
+		if name != "" && other.Name == name && !other.same(session) {
+			return false
 		}
 	}
+	m.updateLocked(session, func(next *ClientSession) { next.Name = name })
+	return true
+}
+
+// ClientByName returns the authenticated session with the DNS name
+func (m *Manager) ClientByName(name string) (*ClientSession, bool) {
+	for _, session := range m.sessions().byAddr {
+		if session.Name == name && session.Authenticated.Load() {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// SetSubnets routes subnets to the client at addr, replacing any it had, and
+// returns those it got. A subnet already routed to another client stays with it.
+func (m *Manager) SetSubnets(addr net.Addr, subnets []netip.Prefix) []netip.Prefix {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions().byAddr[addrKey(addr)]
+	if !exists {
+		return nil
+	}
+
+	next := m.sessions().clone()
+	removeSubnets(next, session)
+	updated := *session
+	updated.Subnets = make([]netip.Prefix, 0, len(subnets))
+	for _, prefix := range subnets {
+		if owner, taken := next.subnets[prefix]; taken {
+			fmt.Printf("Subnet %s of %s is already routed to %s\n", prefix, addr.String(), owner.Addr.String())
+			continue
+		}
+		if tunManager != nil {
+			if err := tunManager.AddRoute(prefix); err != nil {
+				fmt.Printf("Failed to route subnet %s to %s: %v\n", prefix, addr.String(), err)
+				continue
+			}
+		}
+		next.subnets[prefix] = &updated
+		updated.Subnets = append(updated.Subnets, prefix)
+	}
+	next.replace(session, &updated)
+	next.indexSubnets()
+	m.table.Store(next)
+	return updated.Subnets
+}
+
+// SessionByToken returns the session that was issued token
+func (m *Manager) SessionByToken(token []byte) (*ClientSession, bool) {
+	for _, session := range m.sessions().byAddr {
+		if len(session.SessionToken) > 0 && subtle.ConstantTimeCompare(session.SessionToken, token) == 1 {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// Resume moves the session at addr to ip, the address the client held in an
+// earlier session, here or on another cluster node. An earlier session still
+// holding ip here is closed without a message, as it is the same client's.
+func (m *Manager) Resume(addr net.Addr, ip net.IP) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions().byAddr[addrKey(addr)]
+	if !exists {
+		return fmt.Errorf("client not found: %s", addr.String())
+	}
+	if session.AssignedIP.Equal(ip) {
+		return nil
+	}
+	if old, held := m.sessions().byIP[ipKey(ip)]; held {
+		old.queue.Close()
+		if old.Conn != nil {
+			old.Conn.Close()
+		}
+		m.removeLocked(old)
+	}
+
+	lastOctet := int(ip.To4()[3])
+	if !m.IPPool.Claim(lastOctet) {
+		return fmt.Errorf("%s is outside the pool or in use", ip)
+	}
+	m.IPPool.Release(int(session.AssignedIP.To4()[3]))
+
+	m.updateLocked(session, func(next *ClientSession) { next.AssignedIP = ip.To4() })
+	return nil
+}
+
+// SetHandshake records the negotiated protocol version, capabilities and session token
+func (m *Manager) SetHandshake(addr net.Addr, version byte, capabilities uint32, token []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session, exists := m.sessions().byAddr[addrKey(addr)]; exists {
+		session.queue.setCapabilities(capabilities)
+		m.updateLocked(session, func(next *ClientSession) {
+			next.Version = version
+			next.Capabilities = capabilities
+			next.SessionToken = token
+		})
+	}
 }
 
 // WriteToClient sends data to a specific client using their stored connection
 func (m *Manager) WriteToClient(addr net.Addr, data []byte) error {
-	m.mu.RLock()
-	session, exists := m.sessions[addr.String()]
-	m.mu.RUnlock()
-
+	session, exists := m.GetClient(addr)
 	if !exists {
 		return fmt.Errorf("client not found: %s", addr.String())
 	}
@@ -313,7 +720,7 @@ func (m *Manager) WriteToClient(addr net.Addr, data []byte) error {
 	}
 
 	// Update bytes sent
-	m.AddBytesSent(addr, uint64(len(data)))
+	session.BytesSent.Add(uint64(len(data)))
 
 	return nil
 }
@@ -0,0 +1,208 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"net/netip"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// newTestManager installs a small test config and a fresh ClientManager,
+// restoring both when the test ends
+func newTestManager(tb testing.TB) *Manager {
+	tb.Helper()
+	oldCfg, oldManager := ServerCfg, ClientManager
+	tb.Cleanup(func() { ServerCfg, ClientManager = oldCfg, oldManager })
+
+	ServerCfg = &ServerConfig{IPPoolMin: 2, IPPoolMax: 254, MTU: 1400, SendQueueSize: 16, SendQueuePolicy: DropPolicyTail}
+	ClientManager, _ = NewManager()
+	return ClientManager
+}
+
+// newBenchManager creates a manager with n authenticated sessions
+func newBenchManager(b *testing.B, n int) []*ClientSession {
+	b.Helper()
+	newTestManager(b)
+
+	sessions := make([]*ClientSession, 0, n)
+	for i := 0; i < n; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 4000 + i}
+		session, err := ClientManager.GetOrAddClient(addr, &discardConn{})
+		if err != nil {
+			b.Fatalf("GetOrAddClient: %v", err)
+		}
+		session.Authenticated.Store(true)
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// BenchmarkDataPathConcurrent runs the per-packet session work of
+// handleDataPacket and sendToClient from many goroutines at once. With the
+// lock-free table and atomic counters ns/op should drop as -cpu grows.
+func BenchmarkDataPathConcurrent(b *testing.B) {
+	sessions := newBenchManager(b, 200)
+	var next atomic.Uint32
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine plays a different client
+		session := sessions[int(next.Add(1))%len(sessions)]
+		addr := session.Addr
+		ip := session.AssignedIP
+
+		for pb.Next() {
+			// Client -> TUN
+			s, ok := ClientManager.GetClient(addr)
+			if !ok || !s.Authenticated.Load() {
+				b.Fatal("session lookup failed")
+			}
+			s.Touch()
+			s.BytesRecv.Add(1400)
+
+			// TUN -> client
+			if s, ok = ClientManager.GetClientByIP(ip); !ok || !s.Authenticated.Load() {
+				b.Fatal("lookup by IP failed")
+			}
+			s.BytesSent.Add(1400)
+		}
+	})
+}
+
+// TestSubnetLongestPrefixMatch checks that packets for site-to-site subnets
+// go to the gateway with the most specific subnet
+func TestSubnetLongestPrefixMatch(t *testing.T) {
+	newTestManager(t)
+
+	office := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4000}
+	lab := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 4000}
+	officeSession, _ := ClientManager.GetOrAddClient(office, &discardConn{})
+	labSession, _ := ClientManager.GetOrAddClient(lab, &discardConn{})
+
+	ClientManager.SetSubnets(office, []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")})
+	if got := ClientManager.SetSubnets(lab, []netip.Prefix{
+		netip.MustParsePrefix("172.16.5.0/24"),
+		netip.MustParsePrefix("172.16.0.0/12"), // Already the office's
+	}); len(got) != 1 {
+		t.Fatalf("lab got subnets %v, want only 172.16.5.0/24", got)
+	}
+
+	tests := []struct {
+		ip   net.IP
+		want *ClientSession
+	}{
+		{net.IPv4(172, 16, 5, 9), labSession},
+		{net.IPv4(172, 20, 1, 1), officeSession},
+		{officeSession.AssignedIP, officeSession},
+		{labSession.AssignedIP, labSession},
+	}
+	for _, tt := range tests {
+		if got, ok := ClientManager.GetClientForDestination(tt.ip); !ok || !got.same(tt.want) {
+			t.Errorf("%v went to the wrong client", tt.ip)
+		}
+	}
+	if _, ok := ClientManager.GetClientForDestination(net.IPv4(10, 1, 1, 1)); ok {
+		t.Errorf("address outside every subnet matched a client")
+	}
+
+	ClientManager.RemoveClient(lab)
+	if got, ok := ClientManager.GetClientForDestination(net.IPv4(172, 16, 5, 9)); !ok || !got.same(officeSession) {
+		t.Errorf("lab's subnet did not fall back to the office after it left")
+	}
+}
+
+// TestReconnectWhileSending reconnects a client from the same address while
+// packets flow both ways; run with -race
+func TestReconnectWhileSending(t *testing.T) {
+	newTestManager(t)
+	conn := &discardConn{}
+	addr := conn.RemoteAddr()
+	if err := ClientManager.AddClient(addr, conn); err != nil {
+		t.Fatalf("AddClient: %v", err)
+	}
+	ClientManager.SetHandshake(addr, protocol.ProtocolVersion, protocol.CapBatching|protocol.CapCompressZstd, []byte("token"))
+	ClientManager.SetAuthenticated(addr, true)
+	session, _ := ClientManager.GetClient(addr)
+
+	// Compresses well and is then dropped as malformed, before the TUN
+	var compressor protocol.Compressor
+	compressed, ok := compressor.Compress(protocol.StartCompressedData(nil), make([]byte, 1000))
+	if !ok {
+		t.Fatalf("test packet did not compress")
+	}
+
+	pool := protocol.NewBufferPool(ServerCfg.MTU)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	traffic := func(send func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					send()
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+	traffic(func() { // TUN -> client
+		if s, ok := ClientManager.GetClientByIP(session.AssignedIP); ok {
+			buf := pool.Get()
+			buf.FrameData(copy(buf.Payload(), make([]byte, 100)))
+			s.Send(buf)
+		}
+	})
+	traffic(func() { HandlePacket(protocol.EncodePing(), addr) })
+	traffic(func() { HandlePacket(compressed, addr) })
+
+	// Keep reconnecting until the readers got packets through as well
+	for i := 0; i < 200 || session.drops[dropMalformed].Load() < 200; i++ {
+		if err := ClientManager.AddClient(addr, &discardConn{}); err != nil {
+			t.Fatalf("reconnect %d: %v", i, err)
+		}
+		runtime.Gosched()
+	}
+	close(stop)
+	wg.Wait()
+
+	s, ok := ClientManager.GetClient(addr)
+	if !ok || !s.same(session) || !s.Authenticated.Load() || s.Capabilities != session.Capabilities {
+		t.Fatalf("session did not survive reconnecting")
+	}
+}
+
+// TestResumeKeepsPublishedSession checks that resuming publishes the session
+// at its old address instead of changing the one readers may hold
+func TestResumeKeepsPublishedSession(t *testing.T) {
+	newTestManager(t)
+	conn := &discardConn{}
+	session, _ := ClientManager.GetOrAddClient(conn.RemoteAddr(), conn)
+	assigned := session.AssignedIP
+	ip := net.IPv4(10, 8, 0, 100)
+
+	if err := ClientManager.Resume(session.Addr, ip); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if !session.AssignedIP.Equal(assigned) {
+		t.Errorf("published session changed to %s", session.AssignedIP)
+	}
+	if resumed, ok := ClientManager.GetClientByIP(ip); !ok || !resumed.same(session) || !resumed.AssignedIP.Equal(ip) {
+		t.Errorf("session not found at %s", ip)
+	}
+	if _, ok := ClientManager.GetClientByIP(assigned); ok {
+		t.Errorf("session still found at %s", assigned)
+	}
+}
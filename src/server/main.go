@@ -6,15 +6,17 @@ package server
 import (
 	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/pion/dtls/v2"
+	"github.com/varun0310t/VPN/src/protocol"
 )
 
 var (
 	ServerCfg     *ServerConfig
-	udpConn       *net.UDPConn
-	dtlsConn      net.Listener
+	dtlsConn      Listener   // DTLS over UDP, always on
+	listeners     []Listener // Every transport, DTLS first
 	ClientManager *Manager
 	tunManager    *TunManager
 )
@@ -26,29 +28,71 @@ func InitServer() error {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
-	// Start UDP listener
+	authGuard = NewAuthGuard(ServerCfg)
+
+	// Start DTLS listener
 	addr := fmt.Sprintf("%s:%d", ServerCfg.ListenAddress, ServerCfg.ListenPort)
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	dtlsConfig, err := LoadDtlsConfig(ServerCfg)
 	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %w", err)
+		return fmt.Errorf("failed to load DTLS config: %w", err)
 	}
+	handshakeTimeout := time.Duration(ServerCfg.HandshakeTimeout) * time.Second
+	dtlsConn, err = newDTLSListener(addr, dtlsConfig, newDTLSLimits(ServerCfg))
+	if err != nil {
+		return err
+	}
+	listeners = []Listener{dtlsConn}
 
-	// udpConn, err = net.ListenUDP("udp", udpAddr)
-	// if err != nil {
-	// 	return fmt.Errorf("failed to start UDP listener: %w", err)
-	// }
-
-	//wrap with dtls
+	if ServerCfg.TCPEnabled {
+		tlsConfig, err := LoadTLSConfig(ServerCfg)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS config: %w", err)
+		}
+		tcpAddr := fmt.Sprintf("%s:%d", ServerCfg.ListenAddress, ServerCfg.TCPPort)
+		listener, err := newTLSListener(tcpAddr, tlsConfig, handshakeTimeout)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		fmt.Printf("TLS over TCP fallback listening on %s\n", tcpAddr)
+	}
 
-	dtlsConfig, err := LoadDtlsConfig(ServerCfg)
-	if err != nil {
-		return fmt.Errorf("failed to load DTLS config: %w", err)
+	if ServerCfg.WebSocketEnabled {
+		tlsConfig, err := LoadTLSConfig(ServerCfg)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS config: %w", err)
+		}
+		wsAddr := fmt.Sprintf("%s:%d", ServerCfg.ListenAddress, ServerCfg.WebSocketPort)
+		listener, err := newWebSocketListener(wsAddr, ServerCfg.WebSocketPath, tlsConfig, handshakeTimeout)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		fmt.Printf("WebSocket transport listening on https://%s%s\n", wsAddr, ServerCfg.WebSocketPath)
 	}
 
-	dtlsConn, err = dtls.Listen("udp", udpAddr, dtlsConfig)
+	if ServerCfg.QUICEnabled {
+		tlsConfig, err := LoadTLSConfig(ServerCfg)
+		if err != nil {
+			return fmt.Errorf("failed to load TLS config: %w", err)
+		}
+		tlsConfig.NextProtos = []string{protocol.QUICALPN}
+		quicAddr := fmt.Sprintf("%s:%d", ServerCfg.ListenAddress, ServerCfg.QUICPort)
+		listener, err := newQUICListener(quicAddr, tlsConfig, handshakeTimeout)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+		fmt.Printf("QUIC transport listening on %s\n", quicAddr)
+	}
 
-	if err != nil {
-		return fmt.Errorf("failed to start DTLS listener: %w", err)
+	if ServerCfg.PeerToPeer {
+		rendezvous = NewRendezvous()
+		peerAddr := fmt.Sprintf("%s:%d", ServerCfg.ListenAddress, ServerCfg.PeerPort)
+		if err := rendezvous.Listen(peerAddr); err != nil {
+			return err
+		}
+		fmt.Printf("Peer-to-peer rendezvous listening on %s\n", peerAddr)
 	}
 
 	ClientManager, err = NewManager()
@@ -59,34 +103,48 @@ func InitServer() error {
 	if err != nil {
 		return fmt.Errorf("failed to create TUN manager: %w", err)
 	}
+	if ServerCfg.ClusterNodeID != "" {
+		cluster = NewCluster(ServerCfg, ClientManager)
+		ClientManager.IPPool.SetReserved(cluster.Reserved)
+		clusterAddr := fmt.Sprintf("%s:%d", ServerCfg.ListenAddress, ServerCfg.ClusterPort)
+		if err := cluster.Listen(clusterAddr); err != nil {
+			return err
+		}
+		fmt.Printf("Cluster node %s listening on %s\n", ServerCfg.ClusterNodeID, clusterAddr)
+	}
+	if ServerCfg.DNSEnabled {
+		dnsServer = NewDNSServer(ServerCfg, ClientManager)
+		dnsAddr := net.JoinHostPort(ServerCfg.TunIP, "53")
+		if err := dnsServer.Listen(dnsAddr); err != nil {
+			return err
+		}
+		fmt.Printf("DNS for *.%s listening on %s\n", ServerCfg.DNSDomain, dnsAddr)
+	}
 	fmt.Printf("VPN Server started on %s\n", addr)
 	fmt.Printf("Max clients: %d\n", ServerCfg.MaxClients)
 
 	return nil
 }
 
-// Run starts the main server loop (call this to start accepting connections)
+// Run starts the main server loop (call this to start accepting connections).
+// It returns once StopServer closes the listeners.
 func Run() error {
 	if dtlsConn == nil {
 		return fmt.Errorf("server not initialized, call InitServer() first")
 	}
 	tunManager.Start()
+	go cleanupLoop()
+	go backlogLoop()
 
-	// Accept DTLS connections in a loop
-	for {
-		// Accept a new encrypted connection
-		conn, err := dtlsConn.Accept()
-		if err != nil {
-			fmt.Printf("Error accepting DTLS connection: %v\n", err)
-			continue
-		}
-
-		// each client in a separate goroutine
-		go handleDTLSClient(conn)
+	for _, l := range listeners[1:] {
+		go serveListener(l)
 	}
+	serveListener(dtlsConn)
+	return nil
 }
 
-func handleDTLSClient(conn net.Conn) {
+// handleClient reads packets from one client connection, whatever its transport
+func handleClient(conn net.Conn) {
 	defer conn.Close()
 	//calculate how mnay packets does server proccessed per second
 
@@ -97,7 +155,14 @@ func handleDTLSClient(conn net.Conn) {
 	clientAddr := conn.RemoteAddr()
 	fmt.Printf("New encrypted connection from: %s\n", clientAddr)
 
-	ClientManager.AddClient(clientAddr.(*net.UDPAddr), conn)
+	err := ClientManager.AddClient(clientAddr, conn)
+	if err != nil {
+		// Nothing to authenticate against; tell the client why and drop the connection
+		reason := ReasonForError(err)
+		fmt.Printf("Rejecting %s: %v\n", clientAddr, err)
+		conn.Write(protocol.EncodeAuthFail(reason, err.Error()))
+		return
+	}
 
 	buffer := make([]byte, 65535)
 
@@ -109,11 +174,8 @@ func handleDTLSClient(conn net.Conn) {
 			return
 		}
 
-		// Copy data for handling
-		dataCopy := make([]byte, n)
-		copy(dataCopy, buffer[:n])
-
-		HandlePacket(dataCopy, clientAddr)
+		// Handlers finish with the packet before returning, so the read buffer is reused
+		HandlePacket(buffer[:n], clientAddr)
 		packetsCounter++
 
 		// Calculate and print packets per second every second
@@ -127,10 +189,98 @@ func handleDTLSClient(conn net.Conn) {
 	}
 }
 
+// cleanupLoop disconnects clients that missed several keep-alives
+func cleanupLoop() {
+	interval := time.Duration(ServerCfg.KeepaliveInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastStats, lastDrops string
+	for range ticker.C {
+		if removed := ClientManager.CleanupStale(3 * interval); removed > 0 {
+			fmt.Printf("Removed %d idle clients\n", removed)
+		}
+		if stats := securityStats(); stats != lastStats {
+			fmt.Printf("Security stats: %s\n", stats)
+			lastStats = stats
+		}
+		if drops := queueDrops(); drops != lastDrops {
+			fmt.Printf("Send queue drops: %s\n", drops)
+			lastDrops = drops
+		}
+		authGuard.Prune(time.Now())
+		if rendezvous != nil {
+			rendezvous.Prune(time.Now())
+		}
+		if cluster != nil {
+			cluster.Prune(time.Now())
+		}
+	}
+}
+
+// securityStats returns the brute-force protection and handshake failure
+// counters that are not zero, as sorted name=count pairs
+func securityStats() string {
+	var fields []string
+	for name, n := range AuthStats() {
+		if n > 0 {
+			fields = append(fields, fmt.Sprintf("%s=%d", name, n))
+		}
+	}
+	for reason, n := range HandshakeFailures() {
+		if n > 0 {
+			fields = append(fields, fmt.Sprintf("handshake_%s=%d", reason, n))
+		}
+	}
+	slices.Sort(fields)
+	return strings.Join(fields, " ")
+}
+
+// queueDrops returns the packets dropped by the send queues of connected
+// clients, as sorted tunnel-address=count pairs
+func queueDrops() string {
+	var fields []string
+	for ip, n := range ClientManager.QueueDrops() {
+		fields = append(fields, fmt.Sprintf("%s=%d", ip, n))
+	}
+	slices.Sort(fields)
+	return strings.Join(fields, " ")
+}
+
+// backlogLoop disconnects clients whose send queue stays full
+func backlogLoop() {
+	timeout := time.Duration(ServerCfg.BacklogTimeout) * time.Second
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if removed := ClientManager.DisconnectBacklogged(timeout); removed > 0 {
+			fmt.Printf("Removed %d backlogged clients\n", removed)
+		}
+	}
+}
+
 func StopServer() error {
-	if udpConn != nil {
-		fmt.Println("Shutting down VPN server...")
-		return udpConn.Close()
+	fmt.Println("Shutting down VPN server...")
+
+	// The other nodes keep the last leases we sent, so clients can resume there
+	if cluster != nil {
+		cluster.Close()
 	}
-	return nil
+	if ClientManager != nil {
+		ClientManager.DisconnectAll(protocol.ReasonServerShutdown, "")
+	}
+	if rendezvous != nil {
+		rendezvous.Close()
+	}
+	if dnsServer != nil {
+		dnsServer.Close()
+	}
+	var err error
+	for _, l := range listeners {
+		if closeErr := l.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
@@ -0,0 +1,454 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/dtls/v2"
+	dtlsprotocol "github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/pion/transport/v2/udp"
+	"github.com/quic-go/quic-go"
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// Listener accepts client connections for one transport. Each connection
+// carries one protocol message per Read and Write, so sessions and packet
+// handling never see which transport a client used. Accept returns an error
+// wrapping net.ErrClosed once the listener is closed.
+type Listener interface {
+	Accept() (net.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+// serveListener accepts clients from l until it is closed
+func serveListener(l Listener) {
+	var backoff acceptBackoff
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			backoff.wait(l.Addr().String(), err)
+			continue
+		}
+		backoff.reset()
+		if !authGuard.Admit(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+
+		// each client in a separate goroutine
+		go handleClient(conn)
+	}
+}
+
+// acceptBackoff spaces out retries after accept errors, from 5ms doubling up
+// to a second, so a failing listener does not spin
+type acceptBackoff struct {
+	delay time.Duration
+}
+
+func (b *acceptBackoff) wait(listener string, err error) {
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else {
+		b.delay = min(2*b.delay, time.Second)
+	}
+	fmt.Printf("Error accepting connection on %s: %v; retrying in %v\n", listener, err, b.delay)
+	time.Sleep(b.delay)
+}
+
+func (b *acceptBackoff) reset() {
+	b.delay = 0
+}
+
+// Handshake failure reasons counted by HandshakeFailures
+const (
+	HandshakeFailTimeout = "timeout" // The peer did not finish within handshake_timeout
+	HandshakeFailBusy    = "busy"    // Every handshake worker was in use
+	HandshakeFailAlert   = "alert"   // A fatal alert, e.g. bad certificate or no shared cipher suite
+	HandshakeFailRate    = "rate"    // The source started more than handshake_rate handshakes a second
+	HandshakeFailKnock   = "knock"   // A new peer's first datagram was not a valid knock
+	HandshakeFailOther   = "other"
+)
+
+// handshakeFailures counts failed handshakes; the map itself is never modified
+var handshakeFailures = map[string]*atomic.Uint64{
+	HandshakeFailTimeout: new(atomic.Uint64),
+	HandshakeFailBusy:    new(atomic.Uint64),
+	HandshakeFailAlert:   new(atomic.Uint64),
+	HandshakeFailRate:    new(atomic.Uint64),
+	HandshakeFailKnock:   new(atomic.Uint64),
+	HandshakeFailOther:   new(atomic.Uint64),
+}
+
+// HandshakeFailures returns how many handshakes have failed, by reason
+func HandshakeFailures() map[string]uint64 {
+	counts := make(map[string]uint64, len(handshakeFailures))
+	for reason, n := range handshakeFailures {
+		counts[reason] = n.Load()
+	}
+	return counts
+}
+
+// handshakeFailureReason classifies a handshake error
+func handshakeFailureReason(err error) string {
+	var netErr net.Error
+	var tlsAlert tls.AlertError
+	var dtlsAlert interface{ IsFatalOrCloseNotify() bool } // pion's alert errors
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return HandshakeFailTimeout
+	case errors.As(err, &tlsAlert), errors.As(err, &dtlsAlert):
+		return HandshakeFailAlert
+	default:
+		return HandshakeFailOther
+	}
+}
+
+// handshakeFailed counts and logs a failed handshake
+func handshakeFailed(transport string, addr net.Addr, err error) {
+	reason := handshakeFailureReason(err)
+	handshakeFailures[reason].Add(1)
+	fmt.Printf("%s handshake with %s failed (%s): %v\n", transport, addr, reason, err)
+}
+
+// isDTLSHandshake reports whether a datagram from an unknown peer starts a
+// DTLS handshake; anything else does not create a connection
+func isDTLSHandshake(packet []byte) bool {
+	pkts, err := recordlayer.UnpackDatagram(packet)
+	if err != nil || len(pkts) < 1 {
+		return false
+	}
+	h := &recordlayer.Header{}
+	if err := h.Unmarshal(pkts[0]); err != nil {
+		return false
+	}
+	return h.ContentType == dtlsprotocol.ContentTypeHandshake
+}
+
+// dtlsLimits are the DTLS listener's protections against handshake floods
+type dtlsLimits struct {
+	workers  int           // Handshakes in progress at once
+	timeout  time.Duration // Longest a handshake may take
+	rate     int           // New handshakes per second from one source IP
+	cookie   string        // DTLSCookieAlways or DTLSCookieUnderLoad
+	knockKey string        // If set, a new peer's first datagram must be a knock
+}
+
+// newDTLSLimits returns the DTLS limits set in cfg
+func newDTLSLimits(cfg *ServerConfig) dtlsLimits {
+	return dtlsLimits{
+		workers:  cfg.HandshakeWorkers,
+		timeout:  time.Duration(cfg.HandshakeTimeout) * time.Second,
+		rate:     cfg.HandshakeRate,
+		cookie:   cfg.DTLSCookie,
+		knockKey: cfg.KnockKey,
+	}
+}
+
+// newDTLSListener listens for DTLS clients on addr. Up to limits.workers
+// handshakes run at once, each limited to limits.timeout, so a slow or
+// malicious peer only holds up its own worker; new peers are turned away while
+// every worker is busy or when their source starts handshakes too often.
+// With a knock key, datagrams from new peers are ignored unless the first is
+// a valid knock, so scanners get no answer at all.
+func newDTLSListener(addr string, config *dtls.Config, limits dtlsLimits) (Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UDP address: %w", err)
+	}
+	lc := udp.ListenConfig{AcceptFilter: isDTLSHandshake}
+	if limits.knockKey != "" {
+		knocks := newKnockFilter(limits.knockKey)
+		lc.AcceptFilter = func(packet []byte) bool {
+			if knocks.accept(packet) {
+				return true
+			}
+			handshakeFailures[HandshakeFailKnock].Add(1)
+			return false
+		}
+	}
+	parent, err := lc.Listen("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start DTLS listener: %w", err)
+	}
+
+	// Without the cookie exchange a handshake takes one round trip less, but
+	// a spoofed ClientHello gets a full server flight back
+	noCookie := *config
+	noCookie.InsecureSkipVerifyHello = true
+
+	q := newConnQueue(parent.Addr(), parent.Close)
+	slots := make(chan struct{}, limits.workers)
+	limiter := newHandshakeLimiter(limits.rate)
+	go func() {
+		var backoff acceptBackoff
+		for {
+			conn, err := parent.Accept()
+			if err != nil {
+				if errors.Is(err, udp.ErrClosedListener) {
+					return
+				}
+				backoff.wait(addr, err)
+				continue
+			}
+			backoff.reset()
+			if !authGuard.Admit(conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
+			// Not logged, like a full worker pool: this is what a flood looks like
+			if !limiter.allow(sourceIP(conn.RemoteAddr()), time.Now()) {
+				handshakeFailures[HandshakeFailRate].Add(1)
+				conn.Close()
+				continue
+			}
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				handshakeFailures[HandshakeFailBusy].Add(1)
+				conn.Close()
+				continue
+			}
+
+			serverConfig := config
+			if limits.cookie == DTLSCookieUnderLoad && 2*len(slots) <= cap(slots) {
+				serverConfig = &noCookie
+			}
+
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), limits.timeout)
+				dtlsConn, err := dtlsHandshake(ctx, conn, serverConfig, limits.knockKey != "")
+				cancel()
+				<-slots
+				if err != nil {
+					handshakeFailed("DTLS", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				q.push(dtlsConn)
+			}()
+		}
+	}()
+	return q, nil
+}
+
+// dtlsHandshake runs the server side of a DTLS handshake on conn, first
+// discarding the knock that opened the connection if there is one
+func dtlsHandshake(ctx context.Context, conn net.Conn, config *dtls.Config, knocked bool) (net.Conn, error) {
+	if knocked {
+		deadline, _ := ctx.Deadline()
+		conn.SetReadDeadline(deadline)
+		if _, err := conn.Read(make([]byte, protocol.KnockSize)); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Time{})
+	}
+	return dtls.ServerWithContext(ctx, conn, config)
+}
+
+// connQueue is a Listener fed by a transport's own accept loop, for
+// transports that finish a handshake per connection before it is ready
+type connQueue struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	addr      net.Addr
+	close     func() error // Stops the transport's accept loop
+}
+
+func newConnQueue(addr net.Addr, close func() error) *connQueue {
+	return &connQueue{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+		addr:  addr,
+		close: close,
+	}
+}
+
+// push hands a ready connection to Accept, closing it if the queue is closed
+func (q *connQueue) push(conn net.Conn) {
+	select {
+	case q.conns <- conn:
+	case <-q.done:
+		conn.Close()
+	}
+}
+
+func (q *connQueue) Accept() (net.Conn, error) {
+	select {
+	case conn := <-q.conns:
+		return conn, nil
+	case <-q.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (q *connQueue) Close() error {
+	var err error
+	q.closeOnce.Do(func() {
+		close(q.done)
+		err = q.close()
+	})
+	return err
+}
+
+func (q *connQueue) Addr() net.Addr {
+	return q.addr
+}
+
+// newTLSListener listens for TLS over TCP clients on addr, one framed message
+// per packet; each client must finish the TLS handshake within timeout
+func newTLSListener(addr string, config *tls.Config, timeout time.Duration) (Listener, error) {
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start TLS listener: %w", err)
+	}
+
+	q := newConnQueue(listener.Addr(), listener.Close)
+	go func() {
+		var backoff acceptBackoff
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				backoff.wait(addr, err)
+				continue
+			}
+			backoff.reset()
+			if !authGuard.Admit(conn.RemoteAddr()) {
+				conn.Close()
+				continue
+			}
+
+			go func() {
+				tlsConn := conn.(*tls.Conn)
+				tlsConn.SetDeadline(time.Now().Add(timeout))
+				if err := tlsConn.Handshake(); err != nil {
+					handshakeFailed("TLS", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				tlsConn.SetDeadline(time.Time{})
+
+				q.push(protocol.NewStreamConn(tlsConn))
+			}()
+		}
+	}()
+	return q, nil
+}
+
+// newQUICListener listens for QUIC clients on addr; a connection is ready
+// once the client has opened its control stream, which must happen within
+// timeout. Sources refused by allow_sources/deny_sources are turned away on
+// their first packet, before any handshake work.
+func newQUICListener(addr string, config *tls.Config, timeout time.Duration) (Listener, error) {
+	quicConfig := protocol.QUICConfig()
+	quicConfig.HandshakeIdleTimeout = timeout
+	quicConfig.GetConfigForClient = func(info *quic.ClientInfo) (*quic.Config, error) {
+		if !authGuard.Admit(info.RemoteAddr) {
+			return nil, fmt.Errorf("source %s not allowed", info.RemoteAddr)
+		}
+		return quicConfig, nil
+	}
+	listener, err := quic.ListenAddr(addr, config, quicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start QUIC listener: %w", err)
+	}
+
+	q := newConnQueue(listener.Addr(), listener.Close)
+	go func() {
+		var backoff acceptBackoff
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				if errors.Is(err, quic.ErrServerClosed) {
+					return
+				}
+				backoff.wait(addr, err)
+				continue
+			}
+			backoff.reset()
+
+			go func() {
+				ctx, cancel := context.WithTimeout(conn.Context(), timeout)
+				stream, err := conn.AcceptStream(ctx)
+				cancel()
+				if err != nil {
+					handshakeFailed("QUIC", conn.RemoteAddr(), err)
+					conn.CloseWithError(0, "")
+					return
+				}
+
+				q.push(protocol.NewQUICConn(conn, stream))
+			}()
+		}
+	}()
+	return q, nil
+}
+
+// wsUpgrader accepts WebSocket clients; they are not browsers, so no Origin check applies
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  16 * 1024,
+	WriteBufferSize: 16 * 1024,
+}
+
+// newWebSocketListener serves HTTPS on addr and upgrades requests for path
+// to WebSockets, one binary message per packet. Request headers must arrive
+// within timeout.
+func newWebSocketListener(addr string, path string, config *tls.Config, timeout time.Duration) (Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start WebSocket listener: %w", err)
+	}
+
+	srv := &http.Server{
+		TLSConfig:         config,
+		ReadHeaderTimeout: timeout,
+		// WebSocket upgrades need HTTP/1.1, so HTTP/2 stays off
+		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
+	}
+	q := newConnQueue(listener.Addr(), srv.Close)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil && !authGuard.Admit(addr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		ws, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already answered with an HTTP error
+			fmt.Printf("WebSocket upgrade from %s failed: %v\n", r.RemoteAddr, err)
+			return
+		}
+		// The connection is hijacked, so it outlives this handler
+		q.push(protocol.NewWebSocketConn(ws))
+	})
+	srv.Handler = mux
+
+	go func() {
+		if err := srv.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Printf("WebSocket server stopped: %v\n", err)
+		}
+	}()
+	return q, nil
+}
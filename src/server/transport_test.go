@@ -0,0 +1,437 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"github.com/quic-go/quic-go"
+	"github.com/varun0310t/VPN/src/protocol"
+	"github.com/varun0310t/VPN/src/transport"
+)
+
+// newTestServer serves clients of an in-memory transport with a fresh manager
+func newTestServer(t *testing.T) *transport.Memory {
+	t.Helper()
+	ServerCfg = &ServerConfig{
+		TunSubnet:         "10.8.0.0/24",
+		IPPoolMin:         2,
+		IPPoolMax:         254,
+		Password:          "secret",
+		MTU:               1400,
+		KeepaliveInterval: 30,
+		SendQueueSize:     16,
+		SendQueuePolicy:   DropPolicyTail,
+		Compression:       CompressionOff,
+		TunnelMode:        TunnelModeFull,
+		AuthMaxFailures:   3,
+		AuthLockout:       60,
+		AuthLockoutMax:    3600,
+		AuthRate:          100,
+	}
+	ClientManager, _ = NewManager()
+	authGuard = NewAuthGuard(ServerCfg)
+
+	mem := transport.NewMemory()
+	go serveListener(mem)
+	t.Cleanup(func() { mem.Close() })
+	return mem
+}
+
+// readMessage reads one message from conn and checks its type
+func readMessage(t *testing.T, conn net.Conn, want protocol.PacketType) []byte {
+	t.Helper()
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	packetType, payload, err := protocol.Decode(buf[:n])
+	if err != nil || packetType != want {
+		t.Fatalf("got %v (%v), want %v", packetType, err, want)
+	}
+	return payload
+}
+
+// TestHandshakeOverMemoryTransport runs the client handshake against the
+// real session and packet handling, with no sockets involved
+func TestHandshakeOverMemoryTransport(t *testing.T) {
+	mem := newTestServer(t)
+
+	assigned := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		conn, err := mem.Dial()
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+
+		conn.Write(protocol.EncodeClientHello(&protocol.ClientHello{Version: protocol.ProtocolVersion, Password: "secret"}))
+		cfg, err := protocol.DecodeServerConfig(readMessage(t, conn, protocol.PacketTypeServerConfig))
+		if err != nil {
+			t.Fatalf("DecodeServerConfig: %v", err)
+		}
+		if cfg.MTU != 1400 || assigned[cfg.AssignedIP.String()] {
+			t.Fatalf("client %d: MTU %d, IP %s (already assigned: %v)", i, cfg.MTU, cfg.AssignedIP, assigned)
+		}
+		assigned[cfg.AssignedIP.String()] = true
+
+		conn.Write(protocol.EncodePing())
+		readMessage(t, conn, protocol.PacketTypePong)
+	}
+
+	if n := ClientManager.Count(); n != 2 {
+		t.Fatalf("%d sessions, want 2", n)
+	}
+}
+
+// TestHandshakeBadPassword checks that a wrong password is refused
+func TestHandshakeBadPassword(t *testing.T) {
+	mem := newTestServer(t)
+
+	conn, err := mem.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write(protocol.EncodeClientHello(&protocol.ClientHello{Version: protocol.ProtocolVersion, Password: "wrong"}))
+	readMessage(t, conn, protocol.PacketTypeAuthRespFail)
+}
+
+// TestHandshakeResume checks that a client reconnecting with its session
+// token gets its address back and the old session is dropped
+func TestHandshakeResume(t *testing.T) {
+	mem := newTestServer(t)
+
+	first, err := mem.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer first.Close()
+	first.Write(protocol.EncodeClientHello(&protocol.ClientHello{Version: protocol.ProtocolVersion, Password: "secret"}))
+	old, err := protocol.DecodeServerConfig(readMessage(t, first, protocol.PacketTypeServerConfig))
+	if err != nil {
+		t.Fatalf("DecodeServerConfig: %v", err)
+	}
+
+	second, err := mem.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer second.Close()
+	second.Write(protocol.EncodeClientHello(&protocol.ClientHello{Version: protocol.ProtocolVersion, Password: "secret", ResumeToken: old.SessionToken}))
+	resumed, err := protocol.DecodeServerConfig(readMessage(t, second, protocol.PacketTypeServerConfig))
+	if err != nil {
+		t.Fatalf("DecodeServerConfig: %v", err)
+	}
+	if !resumed.AssignedIP.Equal(old.AssignedIP) || bytes.Equal(resumed.SessionToken, old.SessionToken) {
+		t.Fatalf("resumed at %s with token %x, want %s and a new token", resumed.AssignedIP, resumed.SessionToken, old.AssignedIP)
+	}
+	if n := ClientManager.Count(); n != 1 {
+		t.Fatalf("%d sessions, want only the resumed one", n)
+	}
+}
+
+// TestHandshakeNames checks that usernames listed for a group need its
+// password and that a name is only given to one client at a time
+func TestHandshakeNames(t *testing.T) {
+	mem := newTestServer(t)
+	ServerCfg.Groups = []GroupConfig{{Name: "ops", Password: "ops-secret", Usernames: []string{"alice"}}}
+
+	hello := func(password, username string) (protocol.PacketType, protocol.Reason) {
+		conn, err := mem.Dial()
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write(protocol.EncodeClientHello(&protocol.ClientHello{Version: protocol.ProtocolVersion, Username: username, Password: password}))
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		packetType, payload, _ := protocol.Decode(buf[:n])
+		reason, _ := protocol.DecodeAuthFail(payload)
+		return packetType, reason
+	}
+
+	tests := []struct {
+		password, username string
+		want               protocol.Reason // ReasonUnspecified = accepted
+	}{
+		{"secret", "alice", protocol.ReasonBadCredentials},   // The ops group's name
+		{"ops-secret", "bob", protocol.ReasonBadCredentials}, // Not one of the group's names
+		{"ops-secret", "Alice", protocol.ReasonUnspecified},
+		{"ops-secret", "alice", protocol.ReasonNameInUse}, // Taken by the client before
+		{"secret", "carol", protocol.ReasonUnspecified},
+		{"secret", "carol", protocol.ReasonNameInUse},
+		{"secret", "", protocol.ReasonUnspecified}, // No name
+		{"secret", "", protocol.ReasonUnspecified},
+		{"ops-secret", "", protocol.ReasonBadCredentials}, // The group needs a name
+	}
+	for i, tt := range tests {
+		packetType, reason := hello(tt.password, tt.username)
+		if tt.want == protocol.ReasonUnspecified && packetType != protocol.PacketTypeServerConfig {
+			t.Errorf("%d: %q with %q refused: %s", i, tt.username, tt.password, reason)
+		} else if tt.want != protocol.ReasonUnspecified && (packetType != protocol.PacketTypeAuthRespFail || reason != tt.want) {
+			t.Errorf("%d: %q with %q got %v %s, want %s", i, tt.username, tt.password, packetType, reason, tt.want)
+		}
+	}
+	if session, ok := ClientManager.ClientByName("alice"); !ok || session.Group != "ops" {
+		t.Errorf("alice is not the ops client")
+	}
+
+	// Legacy requests carry no username, so the group's password is refused there too
+	conn, err := mem.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(protocol.EncodeAuthRequest("ops-secret"))
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	packetType, payload, _ := protocol.Decode(buf[:n])
+	if reason, _ := protocol.DecodeAuthFail(payload); packetType != protocol.PacketTypeAuthRespFail || reason != protocol.ReasonBadCredentials {
+		t.Errorf("legacy request with the ops password got %v %s", packetType, reason)
+	}
+}
+
+// TestHandshakeLockout checks that after too many wrong passwords even the
+// right one is refused
+func TestHandshakeLockout(t *testing.T) {
+	mem := newTestServer(t)
+
+	conn, err := mem.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < ServerCfg.AuthMaxFailures; i++ {
+		conn.Write(protocol.EncodeClientHello(&protocol.ClientHello{Version: protocol.ProtocolVersion, Username: "bob", Password: "wrong"}))
+		reason, _ := protocol.DecodeAuthFail(readMessage(t, conn, protocol.PacketTypeAuthRespFail))
+		if reason != protocol.ReasonBadCredentials {
+			t.Fatalf("attempt %d: reason %s, want bad credentials", i, reason)
+		}
+	}
+
+	conn.Write(protocol.EncodeClientHello(&protocol.ClientHello{Version: protocol.ProtocolVersion, Username: "bob", Password: "secret"}))
+	reason, _ := protocol.DecodeAuthFail(readMessage(t, conn, protocol.PacketTypeAuthRespFail))
+	if reason != protocol.ReasonLockedOut {
+		t.Fatalf("reason %s, want locked out", reason)
+	}
+	if stats := AuthStats(); stats["auth_lockouts"] != 1 || stats["auth_locked_out"] != 1 {
+		t.Fatalf("stats %v, want one source lockout", stats)
+	}
+}
+
+// clientHelloFlight returns the first datagram a DTLS client sends
+func clientHelloFlight(t *testing.T) []byte {
+	t.Helper()
+	client, capture := net.Pipe()
+	defer capture.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dtls.ClientWithContext(ctx, client, &dtls.Config{InsecureSkipVerify: true})
+
+	buf := make([]byte, 2048)
+	n, err := capture.Read(buf)
+	if err != nil {
+		t.Fatalf("capturing ClientHello: %v", err)
+	}
+	return buf[:n]
+}
+
+// TestDTLSHandshakeStallDoesNotBlock checks that a peer that never finishes
+// its handshake neither delays other clients nor holds a worker past the timeout
+func TestDTLSHandshakeStallDoesNotBlock(t *testing.T) {
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	config := &dtls.Config{Certificates: []tls.Certificate{cert}, ExtendedMasterSecret: dtls.RequireExtendedMasterSecret}
+	const timeout = 300 * time.Millisecond
+	authGuard = NewAuthGuard(&ServerConfig{})
+	l, err := newDTLSListener("127.0.0.1:0", config, dtlsLimits{workers: 4, timeout: timeout, rate: 10, cookie: DTLSCookieAlways})
+	if err != nil {
+		t.Fatalf("newDTLSListener: %v", err)
+	}
+	defer l.Close()
+	timeouts := handshakeFailures[HandshakeFailTimeout].Load()
+
+	// The staller sends a ClientHello and goes quiet
+	staller, err := net.Dial("udp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer staller.Close()
+	staller.Write(clientHelloFlight(t))
+
+	go func() {
+		udpAddr, _ := net.ResolveUDPAddr("udp", l.Addr().String())
+		udpConn, err := net.DialUDP("udp", nil, udpAddr)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if conn, err := dtls.ClientWithContext(ctx, udpConn, &dtls.Config{InsecureSkipVerify: true}); err == nil {
+			defer conn.Close()
+			time.Sleep(2 * timeout)
+		}
+	}()
+
+	// The honest client is ready well before the staller times out
+	start := time.Now()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	defer conn.Close()
+	if waited := time.Since(start); waited >= timeout {
+		t.Fatalf("honest client waited %v behind the staller", waited)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for handshakeFailures[HandshakeFailTimeout].Load() == timeouts {
+		if time.Now().After(deadline) {
+			t.Fatalf("stalled handshake never timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialDTLSTest runs a DTLS client handshake with the listener at addr,
+// sending a knock first when knockKey is set
+func dialDTLSTest(addr string, knockKey string, timeout time.Duration) (net.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if knockKey != "" {
+		knock, err := protocol.NewKnock([]byte(knockKey), time.Now())
+		if err != nil {
+			return nil, err
+		}
+		udpConn.Write(knock)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := dtls.ClientWithContext(ctx, udpConn, &dtls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// TestDTLSKnock checks that a listener with a knock key ignores handshakes
+// without a valid knock and completes them after one
+func TestDTLSKnock(t *testing.T) {
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	config := &dtls.Config{Certificates: []tls.Certificate{cert}, ExtendedMasterSecret: dtls.RequireExtendedMasterSecret}
+	authGuard = NewAuthGuard(&ServerConfig{})
+	limits := dtlsLimits{workers: 4, timeout: time.Second, rate: 10, cookie: DTLSCookieUnderLoad, knockKey: "open sesame"}
+	l, err := newDTLSListener("127.0.0.1:0", config, limits)
+	if err != nil {
+		t.Fatalf("newDTLSListener: %v", err)
+	}
+	defer l.Close()
+	knocks := handshakeFailures[HandshakeFailKnock].Load()
+
+	if conn, err := dialDTLSTest(l.Addr().String(), "", 300*time.Millisecond); err == nil {
+		conn.Close()
+		t.Fatalf("handshake without a knock succeeded")
+	}
+	if conn, err := dialDTLSTest(l.Addr().String(), "wrong key", 300*time.Millisecond); err == nil {
+		conn.Close()
+		t.Fatalf("handshake with a wrong knock succeeded")
+	}
+	if handshakeFailures[HandshakeFailKnock].Load() == knocks {
+		t.Fatalf("ignored datagrams were not counted")
+	}
+
+	go func() {
+		if conn, err := dialDTLSTest(l.Addr().String(), limits.knockKey, 5*time.Second); err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	conn.Close()
+}
+
+// TestQUICRefusesDeniedSource checks that deny_sources turns QUIC clients
+// away before the handshake
+func TestQUICRefusesDeniedSource(t *testing.T) {
+	cfg := &ServerConfig{DenySources: []string{"127.0.0.1"}}
+	if err := cfg.validateAuth(); err != nil {
+		t.Fatalf("validateAuth: %v", err)
+	}
+	authGuard = NewAuthGuard(cfg)
+
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatalf("GenerateSelfSigned: %v", err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{protocol.QUICALPN}}
+	l, err := newQUICListener("127.0.0.1:0", serverTLS, time.Second)
+	if err != nil {
+		t.Fatalf("newQUICListener: %v", err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clientTLS := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{protocol.QUICALPN}}
+	if conn, err := quic.DialAddr(ctx, l.Addr().String(), clientTLS, protocol.QUICConfig()); err == nil {
+		conn.CloseWithError(0, "")
+		t.Fatalf("denied source completed the QUIC handshake")
+	}
+	if AuthStats()["sources_denied"] == 0 {
+		t.Fatalf("refusal not counted")
+	}
+}
+
+// TestHandshakeLimiter checks the per-source handshake rate
+func TestHandshakeLimiter(t *testing.T) {
+	limiter := newHandshakeLimiter(2)
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	now := time.Now()
+	if !limiter.allow(a, now) || !limiter.allow(a, now) {
+		t.Fatalf("handshakes within the rate refused")
+	}
+	if limiter.allow(a, now) {
+		t.Fatalf("handshake over the rate allowed")
+	}
+	if !limiter.allow(b, now) {
+		t.Fatalf("one source's rate limited another")
+	}
+	if !limiter.allow(a, now.Add(time.Second)) {
+		t.Fatalf("bucket did not refill")
+	}
+}
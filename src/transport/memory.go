@@ -0,0 +1,86 @@
+// Package transport holds transport implementations shared by the server and
+// the clients. Memory connects a client to a server inside one process, so
+// sessions and packet handling can be tested end to end without sockets.
+// PeerSocket carries direct links between clients.
+package transport
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// memoryHost is the address every in-memory connection appears to come from
+var memoryHost = netip.MustParseAddr("127.0.0.1")
+
+// MemoryAddr is the address of one end of an in-memory connection. It prints
+// as ip:port so code that keys sessions by address treats it like UDP.
+type MemoryAddr netip.AddrPort
+
+func (a MemoryAddr) Network() string { return "memory" }
+func (a MemoryAddr) String() string  { return netip.AddrPort(a).String() }
+
+// Memory is an in-memory transport. Dial returns one end of a synchronous pipe
+// and Accept the other, so it works as the server's Listener and the client's
+// Transport at once. Each Write arrives as one Read on the peer when the
+// reader's buffer is large enough; writes block until the peer reads.
+type Memory struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	nextPort  atomic.Uint32
+}
+
+// NewMemory creates an in-memory transport
+func NewMemory() *Memory {
+	return &Memory{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// Dial connects a new client; it blocks until the server accepts
+func (m *Memory) Dial() (net.Conn, error) {
+	clientAddr := MemoryAddr(netip.AddrPortFrom(memoryHost, uint16(1024+m.nextPort.Add(1))))
+	client, server := net.Pipe()
+
+	select {
+	case m.conns <- &memoryConn{Conn: server, local: m.Addr(), remote: clientAddr}:
+		return &memoryConn{Conn: client, local: clientAddr, remote: m.Addr()}, nil
+	case <-m.done:
+		client.Close()
+		server.Close()
+		return nil, net.ErrClosed
+	}
+}
+
+// Accept waits for the next client to dial
+func (m *Memory) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops Accept and Dial; connections already made stay open
+func (m *Memory) Close() error {
+	m.closeOnce.Do(func() { close(m.done) })
+	return nil
+}
+
+// Addr returns the address clients appear to dial
+func (m *Memory) Addr() net.Addr {
+	return MemoryAddr(netip.AddrPortFrom(memoryHost, 1))
+}
+
+// memoryConn is a pipe end with the addresses of an in-memory connection
+type memoryConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr { return c.remote }
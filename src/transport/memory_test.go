@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestMemoryMessages(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	go func() {
+		conn, err := m.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 2048)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n]) // Echo
+		}
+	}()
+
+	conn, err := m.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	// Every write comes back as exactly one read
+	buf := make([]byte, 2048)
+	for _, msg := range [][]byte{{0x04}, bytes.Repeat([]byte{0x45}, 1400), {0x03, 1, 2, 3}} {
+		conn.Write(msg)
+		n, err := conn.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("echo of %d bytes: got %d bytes, %v", len(msg), n, err)
+		}
+	}
+}
+
+func TestMemoryAddresses(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := m.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	a, err := m.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	b, err := m.Dial()
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	serverA, serverB := <-accepted, <-accepted
+
+	if a.LocalAddr() == b.LocalAddr() {
+		t.Fatalf("two clients share the address %s", a.LocalAddr())
+	}
+	if serverA.RemoteAddr() != a.LocalAddr() || serverB.RemoteAddr() != b.LocalAddr() {
+		t.Fatalf("server sees %s and %s, clients are %s and %s",
+			serverA.RemoteAddr(), serverB.RemoteAddr(), a.LocalAddr(), b.LocalAddr())
+	}
+	if _, err := netip.ParseAddrPort(a.LocalAddr().String()); err != nil {
+		t.Fatalf("address %q does not parse: %v", a.LocalAddr(), err)
+	}
+}
+
+func TestMemoryClose(t *testing.T) {
+	m := NewMemory()
+	m.Close()
+	if _, err := m.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept after Close: err = %v", err)
+	}
+	if _, err := m.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Dial after Close: err = %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/transport/v2/deadline"
+)
+
+// punchMagic starts every hole punching datagram: [magic][8 byte link ID][flag]
+var punchMagic = []byte("MYCH")
+
+const (
+	punchSize      = 4 + 8 + 1
+	punchSearching = 0 // The sender has not heard from the peer yet
+	punchLocked    = 1 // The sender has picked the endpoint it heard from
+
+	punchInterval = 100 * time.Millisecond
+	peerQueueSize = 256 // Datagrams buffered per link before dropping
+)
+
+// peerIdentityHint names the pre-shared key of a direct link
+var peerIdentityHint = []byte("mycelium-peer")
+
+// PeerSocket is the UDP socket a client uses for direct links to other
+// clients. Connect punches a hole through both NATs to a peer and runs DTLS
+// with a pre-shared key over it; datagrams are demultiplexed by the peer's
+// endpoint, so one socket (and one NAT mapping) serves every link.
+type PeerSocket struct {
+	conn *net.UDPConn
+	done chan struct{}
+
+	mu      sync.Mutex
+	pending map[[8]byte]chan netip.AddrPort // Punching links by link ID
+	links   map[netip.AddrPort]*peerConn    // Links past punching, by peer endpoint
+}
+
+// ListenPeer opens a peer socket on addr, e.g. ":0"
+func ListenPeer(addr string) (*PeerSocket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open peer socket: %w", err)
+	}
+
+	s := &PeerSocket{
+		conn:    conn,
+		done:    make(chan struct{}),
+		pending: make(map[[8]byte]chan netip.AddrPort),
+		links:   make(map[netip.AddrPort]*peerConn),
+	}
+	go s.readLoop()
+	return s, nil
+}
+
+// LocalAddr returns the socket's local address
+func (s *PeerSocket) LocalAddr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// WriteTo sends a raw datagram from the socket, e.g. a rendezvous probe that
+// lets the server see the socket's public endpoint
+func (s *PeerSocket) WriteTo(b []byte, addr netip.AddrPort) error {
+	_, err := s.conn.WriteToUDPAddrPort(b, addr)
+	return err
+}
+
+// Close closes the socket and every link on it
+func (s *PeerSocket) Close() error {
+	err := s.conn.Close()
+	<-s.done
+	return err
+}
+
+// linkID derives the ID both ends put in their punches from the link key
+func linkID(key []byte) [8]byte {
+	sum := sha256.Sum256(append([]byte("mycelium peer link "), key...))
+	return [8]byte(sum[:8])
+}
+
+func (s *PeerSocket) sendPunch(id [8]byte, flag byte, to netip.AddrPort) {
+	punch := make([]byte, 0, punchSize)
+	punch = append(append(append(punch, punchMagic...), id[:]...), flag)
+	s.conn.WriteToUDPAddrPort(punch, to)
+}
+
+// Connect opens a direct link to the peer holding the same key. Both ends
+// punch every candidate endpoint until one hears from the other, which may be
+// from an endpoint neither knew about when a NAT picks a new port. Then the
+// end with server set runs the DTLS server side.
+func (s *PeerSocket) Connect(ctx context.Context, candidates []netip.AddrPort, key []byte, server bool) (net.Conn, error) {
+	id := linkID(key)
+	found := make(chan netip.AddrPort, 1)
+	s.mu.Lock()
+	if _, busy := s.pending[id]; busy {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("already connecting this link")
+	}
+	s.pending[id] = found
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, id)
+		s.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(punchInterval)
+	defer ticker.Stop()
+	var remote netip.AddrPort
+	for remote == (netip.AddrPort{}) {
+		for _, candidate := range candidates {
+			s.sendPunch(id, punchSearching, candidate)
+		}
+		select {
+		case remote = <-found:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("no reply from peer: %w", ctx.Err())
+		case <-s.done:
+			return nil, net.ErrClosed
+		}
+	}
+	// Tell the peer which endpoint we heard from, in case our punches were lost
+	s.sendPunch(id, punchLocked, remote)
+
+	pc, err := s.register(remote, id)
+	if err != nil {
+		return nil, err
+	}
+	config := &dtls.Config{
+		PSK:                  func([]byte) ([]byte, error) { return key, nil },
+		PSKIdentityHint:      peerIdentityHint,
+		CipherSuites:         []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256},
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+	var conn net.Conn
+	if server {
+		conn, err = dtls.ServerWithContext(ctx, pc, config)
+	} else {
+		conn, err = dtls.ClientWithContext(ctx, pc, config)
+	}
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("peer handshake with %s failed: %w", remote, err)
+	}
+	return conn, nil
+}
+
+// register creates the link to remote once punching found it
+func (s *PeerSocket) register(remote netip.AddrPort, id [8]byte) (*peerConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.links[remote]; exists {
+		return nil, fmt.Errorf("already linked to %s", remote)
+	}
+	pc := &peerConn{
+		s:            s,
+		remote:       remote,
+		id:           id,
+		in:           make(chan []byte, peerQueueSize),
+		closed:       make(chan struct{}),
+		readDeadline: deadline.New(),
+	}
+	s.links[remote] = pc
+	return pc, nil
+}
+
+// readLoop answers punches and hands every other datagram to its link
+func (s *PeerSocket) readLoop() {
+	defer close(s.done)
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				s.closeLinks()
+				return
+			}
+			continue
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		datagram := buf[:n]
+
+		if n == punchSize && bytes.HasPrefix(datagram, punchMagic) {
+			s.handlePunch([8]byte(datagram[4:12]), datagram[12], from)
+			continue
+		}
+
+		s.mu.Lock()
+		pc := s.links[from]
+		s.mu.Unlock()
+		if pc != nil {
+			pc.deliver(append([]byte(nil), datagram...))
+		}
+	}
+}
+
+// handlePunch completes punching for a pending link and answers a peer that
+// is still searching for an established one
+func (s *PeerSocket) handlePunch(id [8]byte, flag byte, from netip.AddrPort) {
+	s.mu.Lock()
+	found, pending := s.pending[id]
+	linked := false
+	for _, pc := range s.links {
+		if pc.id == id && pc.remote == from {
+			linked = true
+		}
+	}
+	s.mu.Unlock()
+
+	if pending {
+		select {
+		case found <- from:
+		default:
+		}
+	}
+	if linked && flag == punchSearching {
+		s.sendPunch(id, punchLocked, from)
+	}
+}
+
+func (s *PeerSocket) closeLinks() {
+	s.mu.Lock()
+	links := make([]*peerConn, 0, len(s.links))
+	for _, pc := range s.links {
+		links = append(links, pc)
+	}
+	s.mu.Unlock()
+	for _, pc := range links {
+		pc.Close()
+	}
+}
+
+// peerConn is one link's view of the shared socket, carrying DTLS records
+type peerConn struct {
+	s      *PeerSocket
+	remote netip.AddrPort
+	id     [8]byte
+	in     chan []byte
+
+	closeOnce    sync.Once
+	closed       chan struct{}
+	readDeadline *deadline.Deadline
+}
+
+// peerTimeout is returned by a read that hit its deadline
+type peerTimeout struct{}
+
+func (peerTimeout) Error() string   { return "peer link read timeout" }
+func (peerTimeout) Timeout() bool   { return true }
+func (peerTimeout) Temporary() bool { return true }
+
+func (c *peerConn) deliver(datagram []byte) {
+	select {
+	case c.in <- datagram:
+	default:
+	}
+}
+
+func (c *peerConn) Read(b []byte) (int, error) {
+	select {
+	case datagram := <-c.in:
+		return copy(b, datagram), nil
+	case <-c.readDeadline.Done():
+		return 0, peerTimeout{}
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *peerConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.s.conn.WriteToUDPAddrPort(b, c.remote)
+}
+
+// Close removes the link from the socket, which stays open for other links
+func (c *peerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.s.mu.Lock()
+		if c.s.links[c.remote] == c {
+			delete(c.s.links, c.remote)
+		}
+		c.s.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *peerConn) LocalAddr() net.Addr  { return c.s.conn.LocalAddr() }
+func (c *peerConn) RemoteAddr() net.Addr { return net.UDPAddrFromAddrPort(c.remote) }
+
+func (c *peerConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *peerConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.Set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op: writes to a UDP socket do not block
+func (c *peerConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
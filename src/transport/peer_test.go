@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func listenPeerTest(t *testing.T) (*PeerSocket, netip.AddrPort) {
+	t.Helper()
+	s, err := ListenPeer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPeer: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, s.LocalAddr().AddrPort()
+}
+
+// TestPeerConnect checks that two sockets punch to each other, skipping a
+// dead candidate, and exchange messages over the DTLS link
+func TestPeerConnect(t *testing.T) {
+	a, aAddr := listenPeerTest(t)
+	b, bAddr := listenPeerTest(t)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	dead := netip.MustParseAddrPort("127.0.0.1:9")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	fromB := make(chan result, 1)
+	go func() {
+		conn, err := b.Connect(ctx, []netip.AddrPort{aAddr}, key, false)
+		fromB <- result{conn, err}
+	}()
+	aConn, err := a.Connect(ctx, []netip.AddrPort{dead, bAddr}, key, true)
+	if err != nil {
+		t.Fatalf("a.Connect: %v", err)
+	}
+	defer aConn.Close()
+	r := <-fromB
+	if r.err != nil {
+		t.Fatalf("b.Connect: %v", r.err)
+	}
+	defer r.conn.Close()
+
+	buf := make([]byte, 2048)
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte{0x42}, 1200)} {
+		if _, err := aConn.Write(msg); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		r.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := r.conn.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("Read = %d bytes (%v), want %d", n, err, len(msg))
+		}
+	}
+}
+
+// TestPeerConnectWrongKey checks that peers with different keys never link
+func TestPeerConnectWrongKey(t *testing.T) {
+	a, aAddr := listenPeerTest(t)
+	b, bAddr := listenPeerTest(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	go b.Connect(ctx, []netip.AddrPort{aAddr}, []byte("key one"), false)
+	if conn, err := a.Connect(ctx, []netip.AddrPort{bAddr}, []byte("key two"), true); err == nil {
+		conn.Close()
+		t.Fatalf("peers with different keys linked")
+	}
+}
@@ -4,12 +4,49 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"time"
 )
 
 type ClientConfig struct {
-	PASSWORD   string `json:"PASSWORD"`
-	SERVERIP   string `json:"SERVERIP,omitempty"`
-	SERVERPORT int    `json:"SERVERPORT,omitempty"`
+	PASSWORD     string `json:"PASSWORD"`
+	USERNAME     string `json:"USERNAME,omitempty"` // Optional; the client's DNS name on servers that run a resolver
+	SERVERIP     string `json:"SERVERIP,omitempty"`
+	SERVERPORT   int    `json:"SERVERPORT,omitempty"`
+	TRANSPORT    string `json:"TRANSPORT,omitempty"`    // "dtls" (default), "tls", "websocket" or "quic"
+	TCPFALLBACK  bool   `json:"TCPFALLBACK,omitempty"`  // Use TLS over TCP when DTLS over UDP fails
+	TCPPORT      int    `json:"TCPPORT,omitempty"`      // Server TCP port, 0 = the UDP port
+	UDPTIMEOUT   int    `json:"UDPTIMEOUT,omitempty"`   // Seconds to wait for the DTLS handshake, 0 = 5
+	WEBSOCKETURL string `json:"WEBSOCKETURL,omitempty"` // wss:// URL of the server, "" = wss://<server>/vpn
+	HTTPPROXY    string `json:"HTTPPROXY,omitempty"`    // HTTP proxy for WebSocket, "" = system proxy settings
+	QUICPORT     int    `json:"QUICPORT,omitempty"`     // Server QUIC port, 0 = the UDP port + 1
+	KNOCKKEY     string `json:"KNOCKKEY,omitempty"`     // Pre-shared knock key, when the server sets knock_key
+}
+
+// tcpPort returns the server's TLS over TCP port
+func (cfg *ClientConfig) tcpPort(serverPort int) int {
+	if cfg.TCPPORT != 0 {
+		return cfg.TCPPORT
+	}
+	return serverPort
+}
+
+// quicPort returns the server's QUIC port
+func (cfg *ClientConfig) quicPort(serverPort int) int {
+	if cfg.QUICPORT != 0 {
+		return cfg.QUICPORT
+	}
+	return serverPort + 1
+}
+
+// defaultUDPTimeout is how long the DTLS handshake may take before giving up on UDP
+const defaultUDPTimeout = 5 * time.Second
+
+// udpTimeout returns the DTLS handshake timeout
+func (cfg *ClientConfig) udpTimeout() time.Duration {
+	if cfg.UDPTIMEOUT > 0 {
+		return time.Duration(cfg.UDPTIMEOUT) * time.Second
+	}
+	return defaultUDPTimeout
 }
 
 func loadClientConfig() (*ClientConfig, error) {
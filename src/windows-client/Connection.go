@@ -8,77 +8,51 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"os/exec"
 	"time"
 
-	"github.com/pion/dtls/v2"
+	"github.com/varun0310t/VPN/src/protocol"
 	"golang.org/x/sys/windows"
 )
 
-// PacketType identifies the type of VPN packet
-type PacketType byte
-
-const (
-	PacketTypeAuthReq      PacketType = 0x01 // Authentication request
-	PacketTypeAuthRespPass PacketType = 0x02 // Authentication response - success
-	PacketTypeData         PacketType = 0x03 // VPN data packet
-	PacketTypePing         PacketType = 0x04 // Keep-alive ping
-	PacketTypePong         PacketType = 0x05 // Keep-alive pong
-	PacketTypeDisc         PacketType = 0x06 // Disconnect
-	PacketTypeAuthRespFail PacketType = 0x07 // Authentication response - failure
-	PacketTypeAskForIP     PacketType = 0x08 // Request for IP address
-	PacketTypeIPRes        PacketType = 0x09 // IP address response
-)
-
 type VPNClient struct {
-	serverAddr    *net.UDPAddr
-	ServerIP      string
+	serverAddr    net.Addr
+	ServerIP      string // Peer of the tunnel connection (the proxy, if one is used), kept off the VPN routes
 	conn          net.Conn
 	tunManager    *TunManager
 	assignedIP    string
 	authenticated bool
 	running       bool
 	SecretKey     string
+	session       *protocol.SessionConfig // Session parameters pushed by the server
 }
 
-func NewVPNClient(serverIP string, serverPort int, SecretKEY string) (*VPNClient, error) {
-
-	// Resolve server address
-	serverAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", serverIP, serverPort))
-	if err != nil {
-		return nil, fmt.Errorf("failed to resolve server address: %w", err)
-	}
-	// Load server certificate for verification
+// loadServerCertPool loads the server certificate to verify against, next to
+// the client config, or returns nil to skip verification when it is missing
+func loadServerCertPool() *x509.CertPool {
 	certPool := x509.NewCertPool()
-
-	// Configure DTLS
-	config := &dtls.Config{
-		InsecureSkipVerify:   true,
-		RootCAs:              certPool,
-		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
-	}
-
-	// Create UDP connection
-	udpConn, err := net.DialUDP("udp", nil, serverAddr)
+	serverCert, err := os.ReadFile("./src/config/server-cert.pem")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
+		fmt.Printf(" Warning: Could not load server cert, using insecure mode: %v\n", err)
+		return nil
 	}
+	certPool.AppendCertsFromPEM(serverCert)
+	return certPool
+}
 
-	udpConn.SetReadBuffer(4 * 1024 * 1024)
-	udpConn.SetWriteBuffer(4 * 1024 * 1024)
-
-	fmt.Println(" Establishing encrypted DTLS connection...")
-	dtlsConn, err := dtls.Client(udpConn, config)
+// NewVPNClient connects to the server over transport
+func NewVPNClient(transport Transport, SecretKEY string) (*VPNClient, error) {
+	conn, err := transport.Dial()
 	if err != nil {
-		udpConn.Close()
-		return nil, fmt.Errorf("failed to establish DTLS connection: %w", err)
+		return nil, err
 	}
 
 	fmt.Println(" Encrypted connection established!")
 	return &VPNClient{
-		serverAddr: serverAddr,
-		ServerIP:   serverIP,
-		conn:       dtlsConn,
+		serverAddr: conn.RemoteAddr(),
+		ServerIP:   hostOf(conn.RemoteAddr()),
+		conn:       conn,
 		SecretKey:  SecretKEY,
 	}, nil
 }
@@ -133,8 +107,7 @@ func (client *VPNClient) Disconnect() {
 	client.running = false
 	// Send disconnect packet
 	if client.conn != nil {
-		packet := []byte{byte(PacketTypeDisc)}
-		client.conn.Write(packet)
+		client.conn.Write(protocol.EncodeDisconnect(protocol.ReasonClientShutdown, ""))
 	}
 
 	// Remove server route
@@ -158,13 +131,12 @@ func (client *VPNClient) Disconnect() {
 
 }
 func (client *VPNClient) keepAlive() {
-	ticker := time.NewTicker(30 * time.Second)
+	ticker := time.NewTicker(client.session.Keepalive)
 	defer ticker.Stop()
 
 	for client.running {
 		<-ticker.C
-		packet := []byte{byte(PacketTypePing)}
-		_, err := client.conn.Write(packet)
+		_, err := client.conn.Write(protocol.EncodePing())
 		if err != nil {
 			fmt.Printf(" Warning: Keep-alive failed: %v\n", err)
 		}
@@ -174,13 +146,18 @@ func (client *VPNClient) sendAuthRequest() error {
 	if client.conn == nil {
 		return fmt.Errorf("connection is not established")
 	}
-	payload := []byte(ClientCfg.PASSWORD)
+	password := ClientCfg.PASSWORD
 	if client.SecretKey == "" {
 		fmt.Printf("secret key is empty using Config file ")
 	} else {
-		payload = []byte(client.SecretKey)
+		password = client.SecretKey
 	}
-	packet := append([]byte{byte(PacketTypeAuthReq)}, payload...)
+	packet := protocol.EncodeClientHello(&protocol.ClientHello{
+		Version:      protocol.ProtocolVersion,
+		Capabilities: protocol.CapNone,
+		Username:     ClientCfg.USERNAME,
+		Password:     password,
+	})
 	_, err := client.conn.Write(packet)
 	if err != nil {
 		return fmt.Errorf("failed to send authentication request: %w", err)
@@ -200,35 +177,48 @@ func (client *VPNClient) waitForAuthResponse() error {
 
 	client.conn.SetReadDeadline(time.Time{}) // Clear deadline
 
-	if n < 1 {
+	packetType, payload, err := protocol.Decode(buffer[:n])
+	if err != nil {
 		return fmt.Errorf("invalid auth response")
 	}
 
-	packetType := PacketType(buffer[0])
-	if packetType == PacketTypeAuthRespPass {
-		// Extract assigned IP from response (last octet)
-		if n >= 5 {
-			lastOctet := int(buffer[4])
-			client.assignedIP = fmt.Sprintf("10.8.0.%d", lastOctet)
-			client.authenticated = true
-			return nil
+	switch packetType {
+	case protocol.PacketTypeServerConfig:
+		session, err := protocol.DecodeServerConfig(payload)
+		if err != nil {
+			return fmt.Errorf("invalid server config: %w", err)
+		}
+		if !protocol.SupportsVersion(session.Version) {
+			return fmt.Errorf("server selected unsupported protocol version %d", session.Version)
+		}
+		client.session = session
+		client.assignedIP = session.AssignedIP.String()
+		client.authenticated = true
+		return nil
+	case protocol.PacketTypeVersionReject:
+		minVersion, maxVersion, err := protocol.DecodeVersionReject(payload)
+		if err != nil {
+			return fmt.Errorf("protocol version %d rejected by server", protocol.ProtocolVersion)
 		}
-		return fmt.Errorf("invalid auth response format")
-	} else if packetType == PacketTypeAuthRespFail {
-		return fmt.Errorf("authentication rejected by server")
+		return fmt.Errorf("server supports protocol versions %d-%d, client supports %d-%d",
+			minVersion, maxVersion, protocol.MinProtocolVersion, protocol.ProtocolVersion)
+	case protocol.PacketTypeAuthRespFail:
+		reason, message := protocol.DecodeAuthFail(payload)
+		return &protocol.ReasonError{Reason: reason, Message: message}
 	}
 
-	return fmt.Errorf("unexpected response type: 0x%02x", packetType)
+	return fmt.Errorf("unexpected response type: %s", packetType)
 }
 
 func (client *VPNClient) forwardFromTUN() {
-	buffer := make([]byte, 65535)
+	// Packets are read after HeaderSize bytes of headroom and framed in place
+	buffer := make([]byte, protocol.HeaderSize+65535)
 	PacketSendCounter := 0
 	PrevTime := time.Now().UnixMilli()
 
 	for client.running {
 
-		n, err := client.tunManager.ReadPacket(buffer)
+		n, err := client.tunManager.ReadPacket(buffer[protocol.HeaderSize:])
 		if err != nil {
 			if client.running {
 				//fmt.Printf("error reading from TUN: %v\n", err)
@@ -238,8 +228,7 @@ func (client *VPNClient) forwardFromTUN() {
 			windows.WaitForSingleObject(waitHandle, windows.INFINITE)
 			continue
 		}
-		packet := buffer[:n]
-		err = client.sendDataPacket(packet)
+		err = client.sendDataPacket(buffer, n)
 		if err != nil {
 			fmt.Printf("error sending data packet: %v\n", err)
 			continue
@@ -270,7 +259,20 @@ func (client *VPNClient) receiveFromServer() {
 			}
 			continue
 		}
-		packet := buffer[1:n]
+		packetType, packet, err := protocol.Decode(buffer[:n])
+		if err != nil {
+			continue
+		}
+		if packetType == protocol.PacketTypeDisc {
+			reason, message := protocol.DecodeDisconnect(packet)
+			fmt.Printf(" Server closed the session: %s\n", reason)
+			serverDisconnected(&protocol.ReasonError{Reason: reason, Message: message})
+			return
+		}
+		if packetType != protocol.PacketTypeData {
+			// Pongs and other control messages carry no tunnel data
+			continue
+		}
 		// Write packet to TUN interface
 		err = client.tunManager.WritePacket(packet)
 		if err != nil {
@@ -288,11 +290,9 @@ func (client *VPNClient) receiveFromServer() {
 
 }
 
-func (vc *VPNClient) sendDataPacket(packet []byte) error {
-	dataPacket := make([]byte, len(packet)+1)
-	dataPacket[0] = byte(PacketTypeData)
-	copy(dataPacket[1:], packet)
-	_, err := vc.conn.Write(dataPacket)
+// sendDataPacket frames the n byte packet stored after the headroom of buffer and sends it
+func (vc *VPNClient) sendDataPacket(buffer []byte, n int) error {
+	_, err := vc.conn.Write(protocol.FrameData(buffer, n))
 	return err
 }
 
@@ -0,0 +1,219 @@
+//go:build windows
+// +build windows
+
+package windowsclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/dtls/v2"
+	"github.com/quic-go/quic-go"
+	"github.com/varun0310t/VPN/src/protocol"
+)
+
+// Transports the client can reach the server over
+const (
+	TransportDTLS      = "dtls"      // DTLS over UDP
+	TransportTLS       = "tls"       // TLS over TCP
+	TransportWebSocket = "websocket" // WebSocket over HTTPS, directly or through an HTTP proxy
+	TransportQUIC      = "quic"      // QUIC, with data in unreliable datagrams
+)
+
+// dialTimeout bounds connecting over TCP, including any proxy and the TLS handshake
+const dialTimeout = 10 * time.Second
+
+// Transport opens the connection the tunnel runs over. Each Read and Write on
+// the connection moves one protocol message, whatever the transport underneath,
+// so the client logic never depends on it.
+type Transport interface {
+	Dial() (net.Conn, error)
+}
+
+// TransportFunc adapts a dial function to a Transport
+type TransportFunc func() (net.Conn, error)
+
+// Dial calls f
+func (f TransportFunc) Dial() (net.Conn, error) {
+	return f()
+}
+
+// newTransport returns the configured transport to the server
+func newTransport(serverIP string, serverPort int, certPool *x509.CertPool) (Transport, error) {
+	switch ClientCfg.TRANSPORT {
+	case "", TransportDTLS:
+		serverAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(serverIP, strconv.Itoa(serverPort)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve server address: %w", err)
+		}
+		return TransportFunc(func() (net.Conn, error) {
+			conn, err := dialDTLS(serverAddr, certPool, ClientCfg.KNOCKKEY, ClientCfg.udpTimeout())
+			if err == nil || !ClientCfg.TCPFALLBACK {
+				return conn, err
+			}
+			fmt.Printf(" %v, falling back to TLS over TCP...\n", err)
+			return dialTLS(serverIP, ClientCfg.tcpPort(serverPort), certPool)
+		}), nil
+	case TransportTLS:
+		return TransportFunc(func() (net.Conn, error) {
+			return dialTLS(serverIP, ClientCfg.tcpPort(serverPort), certPool)
+		}), nil
+	case TransportWebSocket:
+		wsURL := ClientCfg.WEBSOCKETURL
+		if wsURL == "" {
+			wsURL = fmt.Sprintf("wss://%s/vpn", serverIP)
+		}
+		return TransportFunc(func() (net.Conn, error) {
+			return dialWebSocket(wsURL, ClientCfg.HTTPPROXY, certPool)
+		}), nil
+	case TransportQUIC:
+		return TransportFunc(func() (net.Conn, error) {
+			return dialQUIC(serverIP, ClientCfg.quicPort(serverPort), certPool)
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q (expected %q, %q, %q or %q)",
+			ClientCfg.TRANSPORT, TransportDTLS, TransportTLS, TransportWebSocket, TransportQUIC)
+	}
+}
+
+// dialDTLS opens the DTLS over UDP connection to the server, giving up if the
+// handshake does not finish within timeout. With a knock key, a knock datagram
+// goes first so a server that requires one answers the handshake.
+func dialDTLS(serverAddr *net.UDPAddr, certPool *x509.CertPool, knockKey string, timeout time.Duration) (net.Conn, error) {
+	config := &dtls.Config{
+		InsecureSkipVerify:   certPool == nil,
+		RootCAs:              certPool,
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+
+	// Create UDP connection
+	udpConn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UDP connection: %w", err)
+	}
+
+	udpConn.SetReadBuffer(4 * 1024 * 1024)
+	udpConn.SetWriteBuffer(4 * 1024 * 1024)
+
+	if knockKey != "" {
+		knock, err := protocol.NewKnock([]byte(knockKey), time.Now())
+		if err == nil {
+			_, err = udpConn.Write(knock)
+		}
+		if err != nil {
+			udpConn.Close()
+			return nil, fmt.Errorf("failed to send knock: %w", err)
+		}
+	}
+
+	fmt.Println(" Establishing encrypted DTLS connection...")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	dtlsConn, err := dtls.ClientWithContext(ctx, udpConn, config)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("failed to establish DTLS connection: %w", err)
+	}
+	return dtlsConn, nil
+}
+
+// dialTLS opens a TLS over TCP connection to the server and frames messages
+// on it, for networks that drop UDP
+func dialTLS(serverIP string, port int, certPool *x509.CertPool) (net.Conn, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: certPool == nil,
+		RootCAs:            certPool,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	addr := net.JoinHostPort(serverIP, strconv.Itoa(port))
+	fmt.Printf(" Establishing encrypted TLS connection to %s...\n", addr)
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	tlsConn, err := tls.DialWithDialer(dialer, "tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish TLS connection: %w", err)
+	}
+	return protocol.NewStreamConn(tlsConn), nil
+}
+
+// dialWebSocket opens a WebSocket to the server's HTTPS endpoint, through an
+// HTTP CONNECT proxy when proxy (or the system proxy) is set, and frames one
+// message per binary WebSocket message
+func dialWebSocket(wsURL string, proxy string, certPool *x509.CertPool) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: dialTimeout,
+		ReadBufferSize:   16 * 1024,
+		WriteBufferSize:  16 * 1024,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: certPool == nil,
+			RootCAs:            certPool,
+			MinVersion:         tls.VersionTLS12,
+		},
+	}
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP proxy %q: %w", proxy, err)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+		fmt.Printf(" Connecting to %s through proxy %s...\n", wsURL, proxyURL.Host)
+	} else {
+		fmt.Printf(" Connecting to %s...\n", wsURL)
+	}
+
+	ws, resp, err := dialer.Dial(wsURL, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to open WebSocket: %w (HTTP %s)", err, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to open WebSocket: %w", err)
+	}
+	return protocol.NewWebSocketConn(ws), nil
+}
+
+// dialQUIC opens a QUIC connection to the server and the control stream
+// that carries everything but data packets
+func dialQUIC(serverIP string, port int, certPool *x509.CertPool) (net.Conn, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: certPool == nil,
+		RootCAs:            certPool,
+		NextProtos:         []string{protocol.QUICALPN},
+	}
+
+	addr := net.JoinHostPort(serverIP, strconv.Itoa(port))
+	fmt.Printf(" Establishing encrypted QUIC connection to %s...\n", addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, addr, config, protocol.QUICConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish QUIC connection: %w", err)
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("failed to open QUIC control stream: %w", err)
+	}
+	return protocol.NewQUICConn(conn, stream), nil
+}
+
+// hostOf returns the IP address of addr without the port
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -9,6 +9,8 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+
+	"github.com/varun0310t/VPN/src/protocol"
 )
 
 var (
@@ -36,7 +38,12 @@ func InitClient(serverAddr string, serverPort int, password string) error {
 		password = ClientCfg.PASSWORD
 	}
 
-	vpnClient, err = NewVPNClient(serverAddr, serverPort, password)
+	transport, err := newTransport(serverAddr, serverPort, loadServerCertPool())
+	if err != nil {
+		return err
+	}
+
+	vpnClient, err = NewVPNClient(transport, password)
 	if err != nil {
 		return fmt.Errorf("failed to create VPN client: %w", err)
 	}
@@ -70,6 +77,17 @@ func Connect() error {
 	return nil
 }
 
+// serverDisconnected tears the tunnel down after the server ended the session
+// and exits with the reason's exit code so callers can tell why
+func serverDisconnected(reason *protocol.ReasonError) {
+	fmt.Printf("Disconnected by server: %v\n", reason)
+	Disconnect()
+	if code, ok := reason.Reason.ExitCode(); ok {
+		os.Exit(code)
+	}
+	os.Exit(1)
+}
+
 func Disconnect() {
 	if vpnClient == nil {
 		return